@@ -0,0 +1,360 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/brimstone/watchdock/channel"
+	"github.com/brimstone/watchdock/metrics"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+func logit(v ...interface{}) {
+	log.Println("API:", v)
+}
+
+// Processing is what the API needs from the processing module.
+type Processing interface {
+	Inspect(name string) (*dockerclient.Container, error)
+	Reconcile()
+	ImageStatus() map[string]string
+}
+
+// API is a storage module that keeps everything in memory and lets people
+// look at and change it over HTTP. Changes go out through the broker like
+// any other storage module's, so the real storage modules persist them.
+type API struct {
+	listener   net.Listener
+	processing Processing
+	specs      map[string]*channel.Spec
+	states     map[string]*channel.State
+	lock       sync.Mutex
+	// changes made over HTTP, on their way to the broker
+	events chan channel.Event
+	// closed once Sync has returned and nobody takes them any more
+	done chan struct{}
+}
+
+// Actual is the part of docker's view of a container worth showing.
+type Actual struct {
+	ID        string
+	Image     string
+	Running   bool
+	Status    string
+	StartedAt time.Time
+}
+
+// ActualOf is the part of have worth showing.
+func ActualOf(have *dockerclient.Container) *Actual {
+	actual := &Actual{
+		ID:        have.ID,
+		Image:     have.Image,
+		Running:   have.State.Running,
+		Status:    have.State.String(),
+		StartedAt: have.State.StartedAt,
+	}
+	if have.Config != nil {
+		actual.Image = have.Config.Image
+	}
+	return actual
+}
+
+// Container is one entry of GET /containers.
+type Container struct {
+	Name    string
+	Desired *channel.Spec  `json:",omitempty"`
+	Status  *channel.State `json:",omitempty"`
+	Actual  *Actual        `json:",omitempty"`
+	Error   string         `json:",omitempty"`
+}
+
+func (api *API) Init(listen string, processing Processing) error {
+	var err error
+	api.processing = processing
+	api.specs = make(map[string]*channel.Spec)
+	api.states = make(map[string]*channel.State)
+	api.events = make(chan channel.Event)
+	api.done = make(chan struct{})
+	network, address := endpoint(listen)
+	if network == "unix" {
+		// a socket a watchdock left behind when it didn't stop cleanly is
+		// in the way, one that's still answering isn't ours to take, and
+		// anything that isn't a socket isn't ours to remove
+		if conn, err := net.Dial(network, address); err == nil {
+			conn.Close()
+		} else if info, err := os.Lstat(address); err == nil {
+			if info.Mode()&os.ModeSocket == 0 {
+				return fmt.Errorf("%s is in the way and isn't a socket", address)
+			}
+			os.Remove(address)
+		}
+	}
+	api.listener, err = net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// endpoint splits listen into a network and an address: unix:///path is a
+// unix socket, anything else is host:port.
+func endpoint(listen string) (string, string) {
+	if strings.HasPrefix(listen, "unix://") {
+		return "unix", strings.TrimPrefix(listen, "unix://")
+	}
+	return "tcp", listen
+}
+
+// apply keeps our copy of everything up to date.
+func (api *API) apply(event channel.Event) {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	switch event.Kind {
+	case channel.Upsert:
+		api.specs[event.Name] = event.Spec
+	case channel.Delete:
+		delete(api.specs, event.Name)
+		delete(api.states, event.Name)
+	case channel.Status:
+		api.states[event.Name] = event.Status
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(v)
+	if err != nil {
+		logit("Error writing response:", err.Error())
+	}
+}
+
+func (api *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	switch {
+	case path == "containers":
+		api.listContainers(w, r)
+	case strings.HasPrefix(path, "containers/"):
+		api.container(w, r, strings.TrimPrefix(path, "containers/"))
+	case path == "reconcile":
+		if r.Method != "POST" {
+			http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		api.processing.Reconcile()
+		w.WriteHeader(http.StatusAccepted)
+	case path == "images":
+		if r.Method != "GET" {
+			http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, api.processing.ImageStatus())
+	case path == "metrics":
+		metrics.Handler().ServeHTTP(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// ContainersOf is what spec runs as: a container named after it, or one for
+// each of its replicas.
+func ContainersOf(spec *channel.Spec) []*Container {
+	if spec.Replicas == nil {
+		return []*Container{{Name: spec.Name, Desired: spec}}
+	}
+	var containers []*Container
+	for i := 1; i <= spec.Replicas.Count; i++ {
+		replica, err := spec.Replica(i)
+		if err != nil {
+			return []*Container{{Name: spec.Name, Desired: spec, Error: err.Error()}}
+		}
+		containers = append(containers, &Container{Name: replica.Name, Desired: replica})
+	}
+	return containers
+}
+
+// listContainers shows every container we know about, what it should look
+// like and what docker says it looks like.
+func (api *API) listContainers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	api.lock.Lock()
+	containers := make(map[string]*Container)
+	for _, spec := range api.specs {
+		for _, c := range ContainersOf(spec) {
+			containers[c.Name] = c
+		}
+	}
+	for name, state := range api.states {
+		if _, ok := containers[name]; !ok {
+			containers[name] = &Container{Name: name}
+		}
+		containers[name].Status = state
+	}
+	api.lock.Unlock()
+
+	var names []string
+	for name := range containers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := []*Container{}
+	for _, name := range names {
+		c := containers[name]
+		if c.Error != "" {
+			list = append(list, c)
+			continue
+		}
+		have, err := api.processing.Inspect(name)
+		if err != nil {
+			c.Error = err.Error()
+		} else {
+			c.Actual = ActualOf(have)
+		}
+		list = append(list, c)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (api *API) container(w http.ResponseWriter, r *http.Request, name string) {
+	name = channel.CleanName(name)
+	if name == "" || strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	api.lock.Lock()
+	spec, ok := api.specs[name]
+	api.lock.Unlock()
+
+	switch r.Method {
+	case "GET":
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		raw, err := spec.Encode()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(raw)
+	case "PUT":
+		raw, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		spec := new(channel.Spec)
+		err = json.Unmarshal(raw, spec)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// the name can come from the URL alone
+		if spec.Name == "" {
+			spec.Name = name
+		}
+		err = spec.Validate()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if spec.Name != name {
+			http.Error(w, "spec Name "+spec.Name+" doesn't match "+name, http.StatusBadRequest)
+			return
+		}
+		logit("Got a new spec for", name)
+		if !api.send(channel.NewUpsert(spec)) {
+			http.Error(w, "watchdock is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	case "DELETE":
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		logit("Deleting", name)
+		if !api.send(channel.NewDelete(name)) {
+			http.Error(w, "watchdock is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(w, "Only GET, PUT and DELETE are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// send hands a change made over HTTP to Sync and records it, and reports
+// false if Sync has stopped taking them. The broker won't echo it back to
+// us, so it has to be applied here.
+func (api *API) send(event channel.Event) bool {
+	select {
+	case api.events <- event:
+		api.apply(event)
+		return true
+	case <-api.done:
+		return false
+	}
+}
+
+func (api *API) Sync(ctx context.Context, readChannel <-chan channel.Event, writeChannel chan<- channel.Event) {
+	logit("Listening on", api.listener.Addr().String())
+	server := &http.Server{Handler: api}
+	go func() {
+		err := server.Serve(api.listener)
+		if err != nil && err != http.ErrServerClosed {
+			logit("Stopped serving:", err.Error())
+		}
+	}()
+	// requests being answered get a few seconds to finish
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+	// before the server shuts down, so it isn't left waiting on requests
+	// that can't get their change through
+	defer close(api.done)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-readChannel:
+			if !ok {
+				return
+			}
+			api.apply(event)
+		case event := <-api.events:
+			select {
+			case writeChannel <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func New(listen string, processing Processing) (*API, error) {
+	api := new(API)
+	err := api.Init(listen, processing)
+	if err != nil {
+		return nil, err
+	}
+	return api, nil
+}
@@ -0,0 +1,300 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/brimstone/watchdock/channel"
+	"github.com/brimstone/watchdock/metrics"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeProcessing struct {
+	reconciled chan bool
+}
+
+func (f *fakeProcessing) Inspect(name string) (*dockerclient.Container, error) {
+	if name != "web" && name != "app-1" {
+		return nil, errors.New("no such container")
+	}
+	return &dockerclient.Container{
+		ID:     "abc",
+		Config: &dockerclient.Config{Image: "nginx"},
+		State:  dockerclient.State{Running: true},
+	}, nil
+}
+
+func (f *fakeProcessing) Reconcile() {
+	f.reconciled <- true
+}
+
+func (f *fakeProcessing) ImageStatus() map[string]string {
+	return map[string]string{"nginx": "idle"}
+}
+
+func do(t *testing.T, method string, url string, body string) (int, string) {
+	request, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	raw, _ := ioutil.ReadAll(response.Body)
+	return response.StatusCode, string(raw)
+}
+
+func expect(t *testing.T, events <-chan channel.Event, kind channel.Kind, name string) {
+	select {
+	case event := <-events:
+		if event.Kind != kind || event.Name != name {
+			t.Errorf("Expected %s %s, got %s %s", kind, name, event.Kind, event.Name)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for", kind, name)
+	}
+}
+
+func TestAPI(t *testing.T) {
+	processing := &fakeProcessing{reconciled: make(chan bool, 1)}
+	api, err := New("127.0.0.1:0", processing)
+	if err != nil {
+		t.Fatal("Couldn't listen:", err)
+	}
+	read := make(chan channel.Event)
+	write := make(chan channel.Event, 10)
+	go api.Sync(context.Background(), read, write)
+	url := "http://" + api.listener.Addr().String()
+
+	// something a storage module already knows about
+	read <- channel.NewUpsert(&channel.Spec{Version: 1, Name: "db", Config: &dockerclient.Config{Image: "postgres"}})
+	read <- channel.NewUpsert(&channel.Spec{Version: 1, Name: "app", Config: &dockerclient.Config{Image: "nginx"}, Replicas: &channel.Replicas{Count: 2}})
+
+	status, _ := do(t, "PUT", url+"/containers/web", `{"Config": {"Image": "nginx"}}`)
+	if status != http.StatusAccepted {
+		t.Fatalf("PUT returned %d", status)
+	}
+	expect(t, write, channel.Upsert, "web")
+
+	status, body := do(t, "PUT", url+"/containers/web", `{"Name": "other", "Config": {"Image": "nginx"}}`)
+	if status != http.StatusBadRequest {
+		t.Errorf("PUT with the wrong name returned %d %s", status, body)
+	}
+	status, body = do(t, "PUT", url+"/containers/web", `{"Config": {}}`)
+	if status != http.StatusBadRequest || !strings.Contains(body, "has no Config.Image") {
+		t.Errorf("PUT without an image returned %d %s", status, body)
+	}
+
+	status, body = do(t, "GET", url+"/containers/web", "")
+	if status != http.StatusOK || !strings.Contains(body, `"Image": "nginx"`) {
+		t.Errorf("GET returned %d %s", status, body)
+	}
+
+	status, body = do(t, "GET", url+"/containers", "")
+	if status != http.StatusOK {
+		t.Fatalf("GET /containers returned %d", status)
+	}
+	var list []Container
+	err = json.Unmarshal([]byte(body), &list)
+	if err != nil {
+		t.Fatal("Couldn't decode", body, err)
+	}
+	var names []string
+	for _, c := range list {
+		names = append(names, c.Name)
+	}
+	if strings.Join(names, " ") != "app-1 app-2 db web" {
+		t.Fatalf("Unexpected containers %s", body)
+	}
+	// replicas are listed as the containers they run as
+	if list[0].Actual == nil || list[0].Desired.Config.Labels[channel.ReplicaOfLabel] != "app" || list[1].Actual != nil {
+		t.Errorf("app-1 should be running and app-2 not: %s", body)
+	}
+	if list[2].Error == "" || list[2].Actual != nil {
+		t.Errorf("db shouldn't be running: %s", body)
+	}
+	if list[3].Actual == nil || !list[3].Actual.Running || list[3].Desired.Config.Image != "nginx" {
+		t.Errorf("web should be running nginx: %s", body)
+	}
+
+	status, _ = do(t, "DELETE", url+"/containers/db", "")
+	if status != http.StatusAccepted {
+		t.Errorf("DELETE returned %d", status)
+	}
+	expect(t, write, channel.Delete, "db")
+	status, _ = do(t, "GET", url+"/containers/db", "")
+	if status != http.StatusNotFound {
+		t.Errorf("GET after DELETE returned %d", status)
+	}
+	status, _ = do(t, "DELETE", url+"/containers/db", "")
+	if status != http.StatusNotFound {
+		t.Errorf("Second DELETE returned %d", status)
+	}
+
+	status, _ = do(t, "POST", url+"/reconcile", "")
+	if status != http.StatusAccepted {
+		t.Errorf("POST /reconcile returned %d", status)
+	}
+	select {
+	case <-processing.reconciled:
+	case <-time.After(time.Second):
+		t.Error("Reconcile wasn't called")
+	}
+
+	status, body = do(t, "GET", url+"/images", "")
+	if status != http.StatusOK || !strings.Contains(body, `"nginx": "idle"`) {
+		t.Errorf("GET /images returned %d %s", status, body)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	api, err := New("127.0.0.1:0", &fakeProcessing{})
+	if err != nil {
+		t.Fatal("Couldn't listen:", err)
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		api.Sync(ctx, make(chan channel.Event), make(chan channel.Event))
+	}()
+	url := "http://" + api.listener.Addr().String()
+	// nobody takes the first change from Sync, so the second is still in
+	// flight when it stops
+	put := func() int {
+		request, _ := http.NewRequest("PUT", url+"/containers/web", strings.NewReader(`{"Config": {"Image": "nginx"}}`))
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return 0
+		}
+		response.Body.Close()
+		return response.StatusCode
+	}
+	if status := put(); status != http.StatusAccepted {
+		t.Fatalf("PUT returned %d", status)
+	}
+	answered := make(chan int)
+	go func() {
+		answered <- put()
+	}()
+	time.Sleep(100 * time.Millisecond)
+	stop()
+	select {
+	case status := <-answered:
+		if status != http.StatusServiceUnavailable {
+			t.Errorf("PUT during shutdown returned %d", status)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("PUT during shutdown never returned")
+	}
+	<-stopped
+}
+
+func TestMetrics(t *testing.T) {
+	api, err := New("127.0.0.1:0", &fakeProcessing{})
+	if err != nil {
+		t.Fatal("Couldn't listen:", err)
+	}
+	go api.Sync(context.Background(), make(chan channel.Event), make(chan channel.Event))
+	metrics.ReconcileRuns.Inc()
+
+	status, body := do(t, "GET", "http://"+api.listener.Addr().String()+"/metrics", "")
+	if status != http.StatusOK || !strings.Contains(body, "watchdock_reconcile_runs_total") {
+		t.Errorf("GET /metrics returned %d %s", status, body)
+	}
+}
+
+func TestClient(t *testing.T) {
+	socket := "unix://" + t.TempDir() + "/watchdock.sock"
+	processing := &fakeProcessing{reconciled: make(chan bool, 1)}
+	api, err := New(socket, processing)
+	if err != nil {
+		t.Fatal("Couldn't listen:", err)
+	}
+	read := make(chan channel.Event)
+	write := make(chan channel.Event, 10)
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go api.Sync(ctx, read, write)
+
+	client, err := NewClient(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Apply(&channel.Spec{Version: 1, Name: "web", Config: &dockerclient.Config{Image: "nginx"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, write, channel.Upsert, "web")
+	err = client.Apply(&channel.Spec{Version: 1, Name: "bad", Config: &dockerclient.Config{}})
+	if err == nil || err.Error() != "bad: spec bad has no Config" {
+		t.Errorf("Expected the API's error, got %v", err)
+	}
+
+	spec, err := client.Get("web")
+	if err != nil || spec.Config.Image != "nginx" {
+		t.Errorf("Expected web's spec, got %v %v", spec, err)
+	}
+	list, err := client.List()
+	if err != nil || len(list) != 1 || list[0].Actual == nil || !list[0].Actual.Running {
+		t.Errorf("Expected web running, got %v %v", list, err)
+	}
+
+	if err = client.Remove("web"); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, write, channel.Delete, "web")
+	if err = client.Remove("web"); err == nil || err.Error() != "web: not found" {
+		t.Errorf("Expected web not found, got %v", err)
+	}
+
+	if err = client.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	<-processing.reconciled
+
+	// a socket that's still answering isn't taken over
+	if _, err = New(socket, processing); err == nil {
+		t.Error("Expected the socket to be in use")
+	}
+}
+
+func TestStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+	processing := &fakeProcessing{reconciled: make(chan bool, 1)}
+
+	// left behind by a watchdock that didn't stop cleanly
+	stale := filepath.Join(dir, "stale.sock")
+	listener, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	api, err := New("unix://"+stale, processing)
+	if err != nil {
+		t.Fatal("Expected the stale socket taken over:", err)
+	}
+	api.listener.Close()
+
+	// a typo in api.listen mustn't cost anyone a file
+	notes := filepath.Join(dir, "notes.txt")
+	ioutil.WriteFile(notes, []byte("keep me"), 0644)
+	_, err = New("unix://"+notes, processing)
+	if err == nil || err.Error() != notes+" is in the way and isn't a socket" {
+		t.Errorf("Expected an error about %s, got %v", notes, err)
+	}
+	if _, err = os.Stat(notes); err != nil {
+		t.Error("Expected notes.txt left alone:", err)
+	}
+}
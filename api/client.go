@@ -0,0 +1,126 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/brimstone/watchdock/channel"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Client talks to the API of a running watchdock.
+type Client struct {
+	base string
+	http *http.Client
+}
+
+func (client *Client) Init(listen string) error {
+	network, address := endpoint(listen)
+	transport := &http.Transport{}
+	client.base = "http://" + address
+	if network == "unix" {
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, address)
+		}
+		// the host doesn't matter, the socket is all there is
+		client.base = "http://watchdock"
+	}
+	client.http = &http.Client{Transport: transport, Timeout: 30 * time.Second}
+	return nil
+}
+
+// do sends a request and decodes the answer into v, unless v is nil. Errors
+// are what the API said went wrong.
+func (client *Client) do(method string, path string, body io.Reader, v interface{}) error {
+	request, err := http.NewRequest(method, client.base+path, body)
+	if err != nil {
+		return err
+	}
+	response, err := client.http.Do(request)
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	if err != nil {
+		return fmt.Errorf("can't reach watchdock: %s", err.Error())
+	}
+	defer response.Body.Close()
+	raw, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("not found")
+	}
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("%s", strings.TrimSpace(string(raw)))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(raw, v)
+}
+
+func containerPath(name string) string {
+	return "/containers/" + url.PathEscape(channel.CleanName(name))
+}
+
+// List is every container the daemon knows about.
+func (client *Client) List() ([]*Container, error) {
+	var list []*Container
+	err := client.do("GET", "/containers", nil, &list)
+	return list, err
+}
+
+// Get is the spec called name.
+func (client *Client) Get(name string) (*channel.Spec, error) {
+	spec := new(channel.Spec)
+	err := client.do("GET", containerPath(name), nil, spec)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err.Error())
+	}
+	return spec, nil
+}
+
+// Apply creates or replaces spec.
+func (client *Client) Apply(spec *channel.Spec) error {
+	raw, err := spec.Encode()
+	if err != nil {
+		return err
+	}
+	err = client.do("PUT", containerPath(spec.Name), bytes.NewReader(raw), nil)
+	if err != nil {
+		return fmt.Errorf("%s: %s", spec.Name, err.Error())
+	}
+	return nil
+}
+
+// Remove deletes the spec called name, which removes its containers.
+func (client *Client) Remove(name string) error {
+	err := client.do("DELETE", containerPath(name), nil, nil)
+	if err != nil {
+		return fmt.Errorf("%s: %s", name, err.Error())
+	}
+	return nil
+}
+
+// Reconcile has the daemon check on everything now.
+func (client *Client) Reconcile() error {
+	return client.do("POST", "/reconcile", nil, nil)
+}
+
+func NewClient(listen string) (*Client, error) {
+	client := new(Client)
+	err := client.Init(listen)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
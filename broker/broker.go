@@ -0,0 +1,234 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"github.com/brimstone/watchdock/channel"
+	"github.com/brimstone/watchdock/metrics"
+	"log"
+	"sync"
+)
+
+func logit(v ...interface{}) {
+	log.Println("Broker:", v)
+}
+
+type storage struct {
+	name   string
+	module channel.Module
+	input  chan channel.Event
+}
+
+type message struct {
+	source int
+	event  channel.Event
+}
+
+// Broker sits between any number of storage modules and the processing
+// module. It looks like a single storage module to the processing module.
+type Broker struct {
+	storage []*storage
+	// what each container last looked like, to stop echoes bouncing around
+	seen map[string]string
+}
+
+// Lister is a storage module that can read everything it has without
+// running.
+type Lister interface {
+	Specs() ([]*channel.Spec, error)
+}
+
+// Writer is a storage module that can write a change without running.
+// Check says why Write would refuse a change, without making it.
+type Writer interface {
+	Check(event channel.Event) error
+	Write(event channel.Event) error
+}
+
+func (broker *Broker) Init() error {
+	broker.seen = make(map[string]string)
+	return nil
+}
+
+func (broker *Broker) AddStorage(name string, module channel.Module) {
+	broker.storage = append(broker.storage, &storage{
+		name:   name,
+		module: module,
+		input:  make(chan channel.Event),
+	})
+}
+
+func (broker *Broker) Len() int {
+	return len(broker.storage)
+}
+
+// Specs is every spec the storage modules that can list theirs have. The
+// first one to have a spec by some name wins, like at startup.
+func (broker *Broker) Specs() ([]*channel.Spec, error) {
+	seen := make(map[string]bool)
+	var all []*channel.Spec
+	for _, s := range broker.storage {
+		lister, ok := s.module.(Lister)
+		if !ok {
+			continue
+		}
+		specs, err := lister.Specs()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", s.name, err.Error())
+		}
+		for _, spec := range specs {
+			if !seen[spec.Name] {
+				seen[spec.Name] = true
+				all = append(all, spec)
+			}
+		}
+	}
+	return all, nil
+}
+
+// Write saves event in every storage module that can take it while nothing
+// runs. They're all asked first, so one refusing leaves the rest untouched
+// rather than out of step.
+func (broker *Broker) Write(event channel.Event) error {
+	var writers []*storage
+	for _, s := range broker.storage {
+		writer, ok := s.module.(Writer)
+		if !ok {
+			continue
+		}
+		err := writer.Check(event)
+		if err != nil {
+			return fmt.Errorf("%s: %s", s.name, err.Error())
+		}
+		writers = append(writers, s)
+	}
+	if len(writers) == 0 {
+		return fmt.Errorf("no storage module can write %s", event.Name)
+	}
+	for _, s := range writers {
+		err := s.module.(Writer).Write(event)
+		if err != nil {
+			return fmt.Errorf("%s: %s", s.name, err.Error())
+		}
+	}
+	return nil
+}
+
+func fingerprint(event channel.Event) string {
+	switch event.Kind {
+	case channel.Upsert:
+		raw, err := event.Spec.Encode()
+		if err != nil {
+			return ""
+		}
+		return string(raw)
+	case channel.Delete:
+		return "delete"
+	}
+	return ""
+}
+
+// changed records event and reports whether it differs from what we last
+// saw for the same container.
+func (broker *Broker) changed(event channel.Event) bool {
+	switch event.Kind {
+	case channel.Resync:
+		// everything is about to be sent again, so let it all through
+		broker.seen = make(map[string]string)
+		return true
+	case channel.Status:
+		return true
+	}
+	current := fingerprint(event)
+	if broker.seen[event.Name] == current {
+		return false
+	}
+	broker.seen[event.Name] = current
+	return true
+}
+
+// Sync runs every storage module until ctx is cancelled or readChannel is
+// closed. Then everything still on its way to a storage module is delivered,
+// and Sync waits for them all to finish writing it.
+func (broker *Broker) Sync(ctx context.Context, readChannel <-chan channel.Event, writeChannel chan<- channel.Event) {
+	fromStorage := make(chan message)
+	toProcessing := make(chan channel.Event)
+	go channel.Queue(toProcessing, writeChannel)
+
+	var running sync.WaitGroup
+	for i, s := range broker.storage {
+		output := make(chan channel.Event)
+		buffered := make(chan channel.Event)
+		go channel.Queue(output, buffered)
+		go func(source int, events <-chan channel.Event) {
+			for event := range events {
+				fromStorage <- message{source: source, event: event}
+			}
+		}(i, buffered)
+
+		input := make(chan channel.Event)
+		go channel.Queue(s.input, input)
+		logit("Starting storage module", s.name)
+		running.Add(1)
+		go func(s *storage) {
+			defer running.Done()
+			// storage modules stop once their input runs dry, not before,
+			// so nothing meant for them is lost
+			s.module.Sync(context.Background(), input, output)
+			logit("Storage module", s.name, "stopped")
+		}(s)
+	}
+
+	flush := func() {
+		logit("Flushing storage modules")
+		for _, s := range broker.storage {
+			close(s.input)
+		}
+		running.Wait()
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			flush()
+			return
+
+		// docker changed something, every storage module needs to know
+		case event, ok := <-readChannel:
+			if !ok {
+				logit("Nothing more from processing")
+				flush()
+				return
+			}
+			if !broker.changed(event) {
+				continue
+			}
+			for _, s := range broker.storage {
+				s.input <- event
+			}
+
+		// a storage module changed something, tell docker and everyone else
+		case msg := <-fromStorage:
+			metrics.StorageEvents.WithLabelValues(broker.storage[msg.source].name, msg.event.Kind.String()).Inc()
+			if !broker.changed(msg.event) {
+				logit("Ignoring echo from", broker.storage[msg.source].name, "about", msg.event.Name)
+				continue
+			}
+			toProcessing <- msg.event
+			for i, s := range broker.storage {
+				if i == msg.source {
+					continue
+				}
+				s.input <- msg.event
+			}
+		}
+	}
+}
+
+func New() (*Broker, error) {
+	broker := new(Broker)
+	err := broker.Init()
+	if err != nil {
+		return nil, err
+	}
+	return broker, nil
+}
@@ -0,0 +1,268 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"github.com/brimstone/watchdock/channel"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"testing"
+	"time"
+)
+
+// fakeStorage hands everything it is told to the test, and sends whatever
+// the test gives it back to the broker.
+type fakeStorage struct {
+	received chan channel.Event
+	send     chan channel.Event
+	// how long each event takes to write
+	slow time.Duration
+}
+
+func newFakeStorage() *fakeStorage {
+	return &fakeStorage{
+		received: make(chan channel.Event, 10),
+		send:     make(chan channel.Event),
+	}
+}
+
+func (f *fakeStorage) Sync(ctx context.Context, readChannel <-chan channel.Event, writeChannel chan<- channel.Event) {
+	for {
+		select {
+		case event, ok := <-readChannel:
+			if !ok {
+				close(f.received)
+				return
+			}
+			time.Sleep(f.slow)
+			f.received <- event
+		case event := <-f.send:
+			writeChannel <- event
+		}
+	}
+}
+
+// fakeLister is storage that can list what it has and write without
+// running.
+type fakeLister struct {
+	*fakeStorage
+	specs   []*channel.Spec
+	written []channel.Event
+	err     error
+	// what Check says about every change
+	refuse error
+}
+
+func (f *fakeLister) Specs() ([]*channel.Spec, error) {
+	return f.specs, f.err
+}
+
+func (f *fakeLister) Check(event channel.Event) error {
+	return f.refuse
+}
+
+func (f *fakeLister) Write(event channel.Event) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.written = append(f.written, event)
+	return nil
+}
+
+func expect(t *testing.T, events <-chan channel.Event, name string) {
+	select {
+	case event := <-events:
+		if event.Name != name {
+			t.Errorf("Expected %s, got %s", name, event.Name)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for", name)
+	}
+}
+
+func upsert(name string, image string) channel.Event {
+	return channel.NewUpsert(&channel.Spec{
+		Version: 1,
+		Name:    name,
+		Config:  &dockerclient.Config{Image: image},
+	})
+}
+
+func expectNothing(t *testing.T, events <-chan channel.Event) {
+	select {
+	case event := <-events:
+		t.Errorf("Didn't expect anything, got %s %s", event.Kind, event.Name)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestSync(t *testing.T) {
+	a := newFakeStorage()
+	b := newFakeStorage()
+	broker, _ := New()
+	broker.AddStorage("a", a)
+	broker.AddStorage("b", b)
+
+	fromDocker := make(chan channel.Event)
+	toDocker := make(chan channel.Event, 10)
+	go broker.Sync(context.Background(), fromDocker, toDocker)
+
+	t.Log("Docker reports a container, both storage modules should hear")
+	fromDocker <- upsert("web", "nginx")
+	expect(t, a.received, "web")
+	expect(t, b.received, "web")
+
+	t.Log("Storage module a echoes it back, nobody should hear")
+	a.send <- upsert("web", "nginx")
+	expectNothing(t, toDocker)
+	expectNothing(t, b.received)
+
+	t.Log("Storage module a changes it, docker and b should hear")
+	a.send <- upsert("web", "nginx:1.7")
+	expect(t, toDocker, "web")
+	expect(t, b.received, "web")
+	expectNothing(t, a.received)
+
+	t.Log("Storage module b deletes it, docker and a should hear once")
+	b.send <- channel.NewDelete("web")
+	expect(t, toDocker, "web")
+	expect(t, a.received, "web")
+	a.send <- channel.NewDelete("web")
+	expectNothing(t, toDocker)
+}
+
+func TestResync(t *testing.T) {
+	a := newFakeStorage()
+	broker, _ := New()
+	broker.AddStorage("a", a)
+
+	fromDocker := make(chan channel.Event)
+	toDocker := make(chan channel.Event, 10)
+	go broker.Sync(context.Background(), fromDocker, toDocker)
+
+	a.send <- upsert("web", "nginx")
+	expect(t, toDocker, "web")
+
+	t.Log("Docker asks for everything again, the same spec should get through")
+	fromDocker <- channel.NewResync()
+	expect(t, a.received, "")
+	a.send <- upsert("web", "nginx")
+	expect(t, toDocker, "web")
+}
+
+func TestShutdown(t *testing.T) {
+	a := newFakeStorage()
+	a.slow = 20 * time.Millisecond
+	broker, _ := New()
+	broker.AddStorage("a", a)
+
+	ctx, stop := context.WithCancel(context.Background())
+	fromDocker := make(chan channel.Event)
+	stopped := make(chan struct{})
+	go func() {
+		broker.Sync(ctx, fromDocker, make(chan channel.Event, 10))
+		close(stopped)
+	}()
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		fromDocker <- upsert(name, "nginx")
+	}
+
+	t.Log("Everything docker said is written before Sync returns")
+	stop()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the broker to stop")
+	}
+	var names string
+	for event := range a.received {
+		names += event.Name
+	}
+	if names != "abcde" {
+		t.Errorf("Expected a to get abcde, got %q", names)
+	}
+}
+
+func TestReadClosed(t *testing.T) {
+	a := newFakeStorage()
+	broker, _ := New()
+	broker.AddStorage("a", a)
+
+	fromDocker := make(chan channel.Event)
+	stopped := make(chan struct{})
+	go func() {
+		broker.Sync(context.Background(), fromDocker, make(chan channel.Event, 10))
+		close(stopped)
+	}()
+	fromDocker <- upsert("web", "nginx")
+
+	t.Log("Processing closing its output stops the broker like ctx does")
+	close(fromDocker)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the broker to stop")
+	}
+	var names []string
+	for event := range a.received {
+		names = append(names, event.Name)
+	}
+	if len(names) != 1 || names[0] != "web" {
+		t.Errorf("Expected a to get just web, got %q", names)
+	}
+}
+
+func TestSpecs(t *testing.T) {
+	broker, _ := New()
+	a := &fakeLister{fakeStorage: newFakeStorage(), specs: []*channel.Spec{upsert("web", "nginx").Spec}}
+	b := &fakeLister{fakeStorage: newFakeStorage(), specs: []*channel.Spec{upsert("web", "httpd").Spec, upsert("db", "postgres").Spec}}
+	broker.AddStorage("a", a)
+	broker.AddStorage("b", b)
+	// storage that can't list is left out
+	broker.AddStorage("c", newFakeStorage())
+
+	specs, err := broker.Specs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(specs) != 2 || specs[0].Config.Image != "nginx" || specs[1].Name != "db" {
+		t.Errorf("Expected web from a and db from b, got %v", specs)
+	}
+
+	b.err = errors.New("unreachable")
+	_, err = broker.Specs()
+	if err == nil || err.Error() != "b: unreachable" {
+		t.Errorf("Expected b's error, got %v", err)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	broker, _ := New()
+	broker.AddStorage("c", newFakeStorage())
+	if err := broker.Write(upsert("web", "nginx")); err == nil {
+		t.Error("Expected an error without storage that can write")
+	}
+	a := &fakeLister{fakeStorage: newFakeStorage()}
+	b := &fakeLister{fakeStorage: newFakeStorage()}
+	broker.AddStorage("a", a)
+	broker.AddStorage("b", b)
+
+	if err := broker.Write(upsert("web", "nginx")); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.written) != 1 || len(b.written) != 1 {
+		t.Errorf("Expected web written to a and b, got %d and %d", len(a.written), len(b.written))
+	}
+	// b refusing keeps a from being written too
+	b.refuse = errors.New("not touching web")
+	if err := broker.Write(channel.NewDelete("web")); err == nil || err.Error() != "b: not touching web" {
+		t.Errorf("Expected b to refuse, got %v", err)
+	}
+	if len(a.written) != 1 {
+		t.Errorf("Expected a left alone once b refused, got %d writes", len(a.written))
+	}
+	b.refuse = nil
+	b.err = errors.New("read only")
+	if err := broker.Write(channel.NewDelete("web")); err == nil || err.Error() != "b: read only" {
+		t.Errorf("Expected b's error, got %v", err)
+	}
+}
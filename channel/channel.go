@@ -0,0 +1,628 @@
+package channel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/brimstone/watchdock/reference"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// SpecVersion is the newest spec format we know how to read. Specs without
+// a version are raw `docker inspect` dumps and are treated as version 1.
+// Version 2 added NetworkingConfig, version 3 DependsOn, version 4
+// RegistryAuth, version 5 Update, version 6 Rollout, version 7 DependsOn
+// conditions, version 8 Health, version 9 Host and HostLabels, version 10
+// Placement, version 11 Replicas.
+const SpecVersion = 11
+
+type Kind int
+
+const (
+	// Upsert creates or updates a container from its Spec
+	Upsert Kind = iota
+	// Delete forgets about the container called Name
+	Delete
+	// Status reports what docker is actually doing with Name
+	Status
+	// Resync asks the receiver to send everything it knows again
+	Resync
+)
+
+func (kind Kind) String() string {
+	switch kind {
+	case Upsert:
+		return "upsert"
+	case Delete:
+		return "delete"
+	case Status:
+		return "status"
+	case Resync:
+		return "resync"
+	}
+	return fmt.Sprintf("kind(%d)", int(kind))
+}
+
+// Spec is the desired state of a single container. Everything docker
+// accepts at create time can be set: mounts, ulimits, resources, log driver
+// and capabilities live in HostConfig, labels and healthcheck in Config and
+// networks with their aliases in NetworkingConfig.
+type Spec struct {
+	Version          int
+	Name             string
+	Config           *dockerclient.Config
+	HostConfig       *dockerclient.HostConfig
+	NetworkingConfig *dockerclient.NetworkingConfig `json:",omitempty"`
+	// DependsOn names the containers that have to be up first
+	DependsOn []Dependency `json:",omitempty"`
+	// RegistryAuth names the registry login to pull Config.Image with
+	RegistryAuth string `json:",omitempty"`
+	// Update says when to move to a newer image, always by default, or
+	// digest-pinned for images given by digest
+	Update *UpdatePolicy `json:",omitempty"`
+	// Rollout is how the container is replaced when its image is updated
+	Rollout *Rollout `json:",omitempty"`
+	// Health is a probe watchdock runs itself. Failing it FailureThreshold
+	// times in a row gets the container restarted, less and less often if
+	// it keeps happening.
+	Health *Probe `json:",omitempty"`
+	// Host is the docker host to run on, by the name watchdock's config
+	// gives it. HostLabels instead runs it on every host that has all of
+	// these labels. Without either it runs on the first host.
+	Host       string            `json:",omitempty"`
+	HostLabels map[string]string `json:",omitempty"`
+	// Placement is which watchdock nodes run it in cluster mode
+	Placement *Placement `json:",omitempty"`
+	// Replicas runs several containers from the spec instead of one
+	// called Name
+	Replicas *Replicas `json:",omitempty"`
+}
+
+// Replicas is how many containers to run from one spec, each called Name-1,
+// Name-2 and so on. Env values can tell them apart with {{.Replica}}, the
+// replica's number, and {{.Name}}, its container name.
+type Replicas struct {
+	// Count is how many, 0 runs none at all
+	Count int
+	// PortOffset is added to every published host port once for every
+	// replica before this one, so with 1 Name-1 gets 8080 and Name-2 8081
+	PortOffset int `json:",omitempty"`
+}
+
+// The labels every replica carries, so it's known for what it is.
+const (
+	ReplicaOfLabel = "watchdock.replica-of"
+	ReplicaLabel   = "watchdock.replica"
+)
+
+// Placement is how the cluster leader picks nodes for a spec. Every node
+// has the label node set to its own name, on top of the ones it's given.
+type Placement struct {
+	// Nodes is how many nodes run it, 1 when empty
+	Nodes int `json:",omitempty"`
+	// Constraints are labels a node has to have all of
+	Constraints map[string]string `json:",omitempty"`
+	// Spread is a label to spread it evenly across the values of, like
+	// zone
+	Spread string `json:",omitempty"`
+}
+
+// The conditions a dependency can be waited on for.
+const (
+	// DependsRunning is the default, the dependency only has to be running
+	DependsRunning = "running"
+	// DependsHealthy waits for the dependency's docker healthcheck to pass
+	DependsHealthy = "healthy"
+)
+
+// Dependency is a container that has to be up before the one depending on
+// it is started. In JSON it's just the name, unless it has a Condition.
+type Dependency struct {
+	Name string
+	// Condition is running, the default, or healthy
+	Condition string `json:",omitempty"`
+}
+
+// plainDependency is Dependency without its JSON methods.
+type plainDependency Dependency
+
+func (dependency Dependency) MarshalJSON() ([]byte, error) {
+	if dependency.Condition == "" || dependency.Condition == DependsRunning {
+		return json.Marshal(dependency.Name)
+	}
+	return json.Marshal(plainDependency(dependency))
+}
+
+func (dependency *Dependency) UnmarshalJSON(raw []byte) error {
+	var name string
+	if json.Unmarshal(raw, &name) == nil {
+		*dependency = Dependency{Name: name}
+		return nil
+	}
+	return json.Unmarshal(raw, (*plainDependency)(dependency))
+}
+
+// The update policies a spec can ask for.
+const (
+	// UpdateNever leaves the image alone once it's been pulled
+	UpdateNever = "never"
+	// UpdateAlways pulls the tag again and moves to whatever it points at
+	UpdateAlways = "always"
+	// UpdateSemver moves to the newest tag within Constraint
+	UpdateSemver = "semver"
+	// UpdateDigestPinned runs exactly the digest in Config.Image
+	UpdateDigestPinned = "digest-pinned"
+)
+
+// UpdatePolicy is when to look for a newer image and what counts as one.
+type UpdatePolicy struct {
+	Policy string
+	// Constraint is the version range semver stays within, like ~1.4
+	Constraint string `json:",omitempty"`
+	// Interval is how often to look, like 5m. Empty means on every
+	// reconcile.
+	Interval string `json:",omitempty"`
+}
+
+// The ways a container can be replaced with one on a newer image.
+const (
+	// StartFirst gets the new container healthy under another name before
+	// the old one is stopped. It needs ports that don't clash.
+	StartFirst = "start-first"
+	// StopFirst stops the old container before starting the new one
+	StopFirst = "stop-first"
+)
+
+// Rollout is how a container is replaced with one on a newer image. The old
+// container is kept until the new one has proven itself, and comes back if
+// it doesn't.
+type Rollout struct {
+	// Strategy is start-first, the default, or stop-first. start-first
+	// falls back to stop-first for containers publishing fixed host ports.
+	Strategy string `json:",omitempty"`
+	// Probe is how to tell the new container is healthy, Health when
+	// empty. Without either its docker healthcheck is used, and without
+	// that being up is enough.
+	Probe *Probe `json:",omitempty"`
+	// Timeout is how long the new container gets to become healthy, 1m
+	// when empty
+	Timeout string `json:",omitempty"`
+	// Window is how long it has to keep running before the old one is
+	// removed, 30s when empty. Failing within it rolls back.
+	Window string `json:",omitempty"`
+}
+
+// Probe checks on the container itself. With Exec the command has to exit
+// 0 inside the container. Otherwise a Port with a Path has to answer an
+// HTTP GET with a 2xx or 3xx, and one without just accept a connection.
+type Probe struct {
+	Port int      `json:",omitempty"`
+	Path string   `json:",omitempty"`
+	Exec []string `json:",omitempty"`
+	// Interval is how often Health runs, 10s when empty
+	Interval string `json:",omitempty"`
+	// Timeout is how long one try gets, 5s when empty
+	Timeout string `json:",omitempty"`
+	// FailureThreshold is how many tries in a row have to fail before the
+	// container counts as unhealthy, 3 when empty
+	FailureThreshold int `json:",omitempty"`
+}
+
+// State is the actual state of a container as seen by docker.
+type State struct {
+	ID      string
+	Running bool
+	Message string
+	// Digest is the image an update moved to, PreviousDigest the one it
+	// moved away from
+	Digest         string `json:",omitempty"`
+	PreviousDigest string `json:",omitempty"`
+	// Health is healthy or unhealthy for containers with a Health probe
+	Health string `json:",omitempty"`
+	// Restarts is how many times in a row watchdock had to restart it,
+	// CrashLoop whether that's so many it's only tried now and then
+	Restarts  int  `json:",omitempty"`
+	CrashLoop bool `json:",omitempty"`
+	// Host is the docker host this is about, when there's more than one
+	Host string `json:",omitempty"`
+	// Node is the watchdock node this is from, in cluster mode
+	Node string `json:",omitempty"`
+}
+
+type Event struct {
+	Kind   Kind
+	Name   string
+	Spec   *Spec
+	Status *State
+}
+
+// Module is anything that sends and receives events, storage and
+// processing alike. Sync runs until ctx is cancelled or its read channel is
+// closed, and finishes whatever it's in the middle of before it returns.
+type Module interface {
+	Sync(ctx context.Context, readChannel <-chan Event, writeChannel chan<- Event)
+}
+
+// Queue buffers everything from in so whoever writes to it never waits on
+// whoever reads from out. Once in is closed whatever's left is handed over
+// and out is closed too.
+func Queue(in <-chan Event, out chan<- Event) {
+	defer close(out)
+	var pending []Event
+	for {
+		if len(pending) == 0 {
+			event, ok := <-in
+			if !ok {
+				return
+			}
+			pending = append(pending, event)
+		}
+		select {
+		case event, ok := <-in:
+			if !ok {
+				for _, event := range pending {
+					out <- event
+				}
+				return
+			}
+			pending = append(pending, event)
+		case out <- pending[0]:
+			pending = pending[1:]
+		}
+	}
+}
+
+// CleanName turns a docker container name like "/web" into "web".
+func CleanName(name string) string {
+	return strings.TrimPrefix(name, "/")
+}
+
+// Validate makes sure a spec is complete enough to run a container from.
+func (spec *Spec) Validate() error {
+	if spec.Version == 0 {
+		spec.Version = 1
+	}
+	if spec.Version > SpecVersion {
+		return fmt.Errorf("spec version %d is newer than %d", spec.Version, SpecVersion)
+	}
+	spec.Name = CleanName(spec.Name)
+	if spec.Name == "" {
+		return errors.New("spec has no Name")
+	}
+	if strings.Contains(spec.Name, "/") {
+		return fmt.Errorf("spec Name %q can't contain /", spec.Name)
+	}
+	if spec.Config == nil {
+		return fmt.Errorf("spec %s has no Config", spec.Name)
+	}
+	if spec.Config.Image == "" {
+		return fmt.Errorf("spec %s has no Config.Image", spec.Name)
+	}
+	image, err := reference.Parse(spec.Config.Image)
+	if err != nil {
+		return fmt.Errorf("spec %s: %s", spec.Name, err.Error())
+	}
+	if spec.Update != nil {
+		err = spec.Update.validate(image)
+		if err != nil {
+			return fmt.Errorf("spec %s: %s", spec.Name, err.Error())
+		}
+	}
+	if spec.Rollout != nil {
+		err = spec.Rollout.validate()
+		if err != nil {
+			return fmt.Errorf("spec %s: %s", spec.Name, err.Error())
+		}
+	}
+	if spec.Health != nil {
+		err = spec.Health.validate("Health")
+		if err != nil {
+			return fmt.Errorf("spec %s: %s", spec.Name, err.Error())
+		}
+	}
+	if spec.Host != "" && len(spec.HostLabels) > 0 {
+		return fmt.Errorf("spec %s can't have both Host and HostLabels", spec.Name)
+	}
+	if spec.Placement != nil && spec.Placement.Nodes < 0 {
+		return fmt.Errorf("spec %s: bad Placement.Nodes %d", spec.Name, spec.Placement.Nodes)
+	}
+	if spec.Replicas != nil {
+		err = spec.validateReplicas()
+		if err != nil {
+			return fmt.Errorf("spec %s: %s", spec.Name, err.Error())
+		}
+	}
+	if spec.HostConfig == nil {
+		spec.HostConfig = new(dockerclient.HostConfig)
+	}
+	for i := range spec.DependsOn {
+		dependency := &spec.DependsOn[i]
+		dependency.Name = CleanName(dependency.Name)
+		if dependency.Name == spec.Name {
+			return fmt.Errorf("spec %s can't depend on itself", spec.Name)
+		}
+		switch dependency.Condition {
+		case "", DependsRunning, DependsHealthy:
+		default:
+			return fmt.Errorf("spec %s has an unknown condition %q on %s", spec.Name, dependency.Condition, dependency.Name)
+		}
+	}
+	if spec.NetworkingConfig != nil {
+		for network, endpoint := range spec.NetworkingConfig.EndpointsConfig {
+			if endpoint == nil {
+				spec.NetworkingConfig.EndpointsConfig[network] = new(dockerclient.EndpointConfig)
+			}
+		}
+	}
+	return nil
+}
+
+func (spec *Spec) validateReplicas() error {
+	replicas := spec.Replicas
+	if replicas.Count < 0 {
+		return fmt.Errorf("bad Replicas.Count %d", replicas.Count)
+	}
+	if replicas.PortOffset < 0 {
+		return fmt.Errorf("bad Replicas.PortOffset %d", replicas.PortOffset)
+	}
+	if replicas.Count > 1 && replicas.PortOffset == 0 && len(hostPorts(spec.HostConfig)) > 0 {
+		return errors.New("replicas would all publish the same host ports, they need a Replicas.PortOffset")
+	}
+	// the last one has its ports moved the furthest
+	last := replicas.Count
+	if last < 1 {
+		last = 1
+	}
+	_, err := spec.Replica(last)
+	return err
+}
+
+// hostPorts is every host port hostConfig publishes, by where it's kept.
+func hostPorts(hostConfig *dockerclient.HostConfig) map[*dockerclient.PortBinding]int {
+	ports := make(map[*dockerclient.PortBinding]int)
+	if hostConfig == nil {
+		return ports
+	}
+	for _, bindings := range hostConfig.PortBindings {
+		for i := range bindings {
+			// empty or 0 is whatever docker picks, which can't clash
+			if port, err := strconv.Atoi(bindings[i].HostPort); err == nil && port > 0 {
+				ports[&bindings[i]] = port
+			}
+		}
+	}
+	return ports
+}
+
+// ReplicaName is what replica i of the spec called name is called.
+func ReplicaName(name string, i int) string {
+	return fmt.Sprintf("%s-%d", name, i)
+}
+
+// Replica is the spec replica i runs from, counting from 1: named after
+// it, with its Env filled in, its host ports moved along and labels saying
+// which replica of what it is.
+func (spec *Spec) Replica(i int) (*Spec, error) {
+	replica := *spec
+	replica.Name = ReplicaName(spec.Name, i)
+	replica.Replicas = nil
+	config := *spec.Config
+	config.Env = nil
+	data := struct {
+		Replica int
+		Name    string
+	}{i, replica.Name}
+	for _, env := range spec.Config.Env {
+		if strings.Contains(env, "{{") {
+			parsed, err := template.New("Env").Option("missingkey=error").Parse(env)
+			if err != nil {
+				return nil, err
+			}
+			var filled strings.Builder
+			err = parsed.Execute(&filled, data)
+			if err != nil {
+				return nil, err
+			}
+			env = filled.String()
+		}
+		config.Env = append(config.Env, env)
+	}
+	config.Labels = make(map[string]string)
+	for key, value := range spec.Config.Labels {
+		config.Labels[key] = value
+	}
+	config.Labels[ReplicaOfLabel] = spec.Name
+	config.Labels[ReplicaLabel] = strconv.Itoa(i)
+	replica.Config = &config
+	if spec.HostConfig != nil && spec.Replicas != nil && spec.Replicas.PortOffset > 0 {
+		hostConfig := *spec.HostConfig
+		hostConfig.PortBindings = make(map[dockerclient.Port][]dockerclient.PortBinding)
+		for port, bindings := range spec.HostConfig.PortBindings {
+			hostConfig.PortBindings[port] = append([]dockerclient.PortBinding(nil), bindings...)
+		}
+		for binding, port := range hostPorts(&hostConfig) {
+			port += (i - 1) * spec.Replicas.PortOffset
+			if port > 65535 {
+				return nil, fmt.Errorf("replica %d would publish port %d", i, port)
+			}
+			binding.HostPort = strconv.Itoa(port)
+		}
+		replica.HostConfig = &hostConfig
+	}
+	return &replica, nil
+}
+
+func (update *UpdatePolicy) validate(image *reference.Reference) error {
+	switch update.Policy {
+	case UpdateNever, UpdateAlways:
+	case UpdateSemver:
+		if image.Pinned() {
+			return fmt.Errorf("image %s is pinned to a digest, semver can't update it", image)
+		}
+		if _, err := reference.ParseConstraint(update.Constraint); err != nil {
+			return err
+		}
+	case UpdateDigestPinned:
+		if !image.Pinned() {
+			return fmt.Errorf("image %s has no digest to pin to", image)
+		}
+	default:
+		return fmt.Errorf("unknown update policy %q", update.Policy)
+	}
+	if update.Constraint != "" && update.Policy != UpdateSemver {
+		return fmt.Errorf("update policy %s takes no Constraint", update.Policy)
+	}
+	if update.Interval != "" {
+		interval, err := time.ParseDuration(update.Interval)
+		if err != nil || interval <= 0 {
+			return fmt.Errorf("bad update Interval %q", update.Interval)
+		}
+	}
+	return nil
+}
+
+func (rollout *Rollout) validate() error {
+	switch rollout.Strategy {
+	case "", StartFirst, StopFirst:
+	default:
+		return fmt.Errorf("unknown rollout Strategy %q", rollout.Strategy)
+	}
+	if rollout.Probe != nil {
+		err := rollout.Probe.validate("rollout Probe")
+		if err != nil {
+			return err
+		}
+	}
+	for name, value := range map[string]string{"Timeout": rollout.Timeout, "Window": rollout.Window} {
+		if value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration <= 0 {
+			return fmt.Errorf("bad rollout %s %q", name, value)
+		}
+	}
+	return nil
+}
+
+// validate checks a probe, called what in errors.
+func (probe *Probe) validate(what string) error {
+	if len(probe.Exec) > 0 {
+		if probe.Port != 0 || probe.Path != "" {
+			return fmt.Errorf("%s can't have both Exec and Port", what)
+		}
+	} else if probe.Port <= 0 || probe.Port > 65535 {
+		return fmt.Errorf("bad %s.Port %d", what, probe.Port)
+	}
+	for name, value := range map[string]string{"Interval": probe.Interval, "Timeout": probe.Timeout} {
+		if value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration <= 0 {
+			return fmt.Errorf("bad %s.%s %q", what, name, value)
+		}
+	}
+	if probe.FailureThreshold < 0 {
+		return fmt.Errorf("bad %s.FailureThreshold %d", what, probe.FailureThreshold)
+	}
+	return nil
+}
+
+// PolicyFor is the update policy image actually gets: update when there is
+// one, otherwise the default for the image.
+func PolicyFor(image string, update *UpdatePolicy) UpdatePolicy {
+	if update != nil {
+		return *update
+	}
+	if ref, err := reference.Parse(image); err == nil && ref.Pinned() {
+		return UpdatePolicy{Policy: UpdateDigestPinned}
+	}
+	return UpdatePolicy{Policy: UpdateAlways}
+}
+
+// Decode parses and validates a spec.
+func Decode(raw []byte) (*Spec, error) {
+	spec := new(Spec)
+	err := json.Unmarshal(raw, spec)
+	if err != nil {
+		return nil, err
+	}
+	err = spec.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// Encode writes a spec out the way a person would: indented, with keys in a
+// stable order and without anything that's empty, so it diffs cleanly.
+func (spec *Spec) Encode() ([]byte, error) {
+	raw, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	var generic map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	err = decoder.Decode(&generic)
+	if err != nil {
+		return nil, err
+	}
+	prune(generic)
+	// maps always marshal with their keys sorted
+	raw, err = json.MarshalIndent(generic, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(raw, '\n'), nil
+}
+
+// prune drops nulls, empty maps and lists of nothing but zeros like
+// HostConfig.ConsoleSize, which is everything omitempty doesn't already
+// catch. Empty lists stay: an Entrypoint or Cmd of [] clears the image's.
+func prune(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case map[string]interface{}:
+		for key, value := range v {
+			if prune(value) {
+				delete(v, key)
+			}
+		}
+		return len(v) == 0
+	case []interface{}:
+		zeros := len(v) > 0
+		for _, value := range v {
+			prune(value)
+			if value != json.Number("0") {
+				zeros = false
+			}
+		}
+		return zeros
+	}
+	return false
+}
+
+func NewUpsert(spec *Spec) Event {
+	return Event{Kind: Upsert, Name: spec.Name, Spec: spec}
+}
+
+func NewDelete(name string) Event {
+	return Event{Kind: Delete, Name: CleanName(name)}
+}
+
+func NewStatus(name string, state *State) Event {
+	return Event{Kind: Status, Name: CleanName(name), Status: state}
+}
+
+func NewResync() Event {
+	return Event{Kind: Resync}
+}
@@ -0,0 +1,148 @@
+package channel
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	var tests = []struct {
+		raw  string
+		name string
+		err  string
+	}{
+		{`{"Name": "/web", "Config": {"Image": "nginx"}}`, "web", ""},
+		{`{"Version": 1, "Name": "web", "Config": {"Image": "nginx"}, "HostConfig": {}}`, "web", ""},
+		{`{"Name": "web"}`, "", "spec web has no Config"},
+		{`{"Name": "web", "Config": {}}`, "", "spec web has no Config.Image"},
+		{`{"Config": {"Image": "nginx"}}`, "", "spec has no Name"},
+		{`{"Name": "a/b", "Config": {"Image": "nginx"}}`, "", `spec Name "a/b" can't contain /`},
+		{`{"Version": 2, "Name": "web", "Config": {"Image": "nginx"}, "NetworkingConfig": {"EndpointsConfig": {"backend": null}}}`, "web", ""},
+		{`{"Name": "web", "Config": {"Image": "nginx"}, "DependsOn": ["/web"]}`, "", "spec web can't depend on itself"},
+		{`{"Version": 99, "Name": "web", "Config": {"Image": "nginx"}}`, "", "spec version 99 is newer than 11"},
+		{`{"Name": "web", "Config": {"Image": "nginx"}, "DependsOn": ["db", {"Name": "cache", "Condition": "healthy"}]}`, "web", ""},
+		{`{"Name": "web", "Config": {"Image": "nginx"}, "DependsOn": [{"Name": "db", "Condition": "happy"}]}`, "", "spec web has an unknown condition \"happy\" on db"},
+		{`{"Name": "web", "Config": {"Image": "nginx"}, "Rollout": {"Strategy": "stop-first", "Probe": {"Port": 80, "Path": "/"}, "Window": "1m"}}`, "web", ""},
+		{`{"Name": "web", "Config": {"Image": "nginx"}, "Rollout": {"Strategy": "yolo"}}`, "", "spec web: unknown rollout Strategy \"yolo\""},
+		{`{"Name": "web", "Config": {"Image": "nginx"}, "Rollout": {"Probe": {"Path": "/"}}}`, "", "spec web: bad rollout Probe.Port 0"},
+		{`{"Name": "web", "Config": {"Image": "nginx"}, "Rollout": {"Timeout": "-1s"}}`, "", "spec web: bad rollout Timeout \"-1s\""},
+		{`{"Name": "web", "Config": {"Image": "nginx"}, "Health": {"Exec": ["pg_isready"], "Interval": "5s", "FailureThreshold": 2}}`, "web", ""},
+		{`{"Name": "web", "Config": {"Image": "nginx"}, "Health": {"Port": 80, "Path": "/", "Timeout": "1s"}}`, "web", ""},
+		{`{"Name": "web", "Config": {"Image": "nginx"}, "Health": {"Exec": ["true"], "Port": 80}}`, "", "spec web: Health can't have both Exec and Port"},
+		{`{"Name": "web", "Config": {"Image": "nginx"}, "Health": {"Port": 80, "Interval": "0s"}}`, "", "spec web: bad Health.Interval \"0s\""},
+		{`{"Name": "web", "Config": {"Image": "nginx"}, "Health": {}}`, "", "spec web: bad Health.Port 0"},
+		{`{"Name": "web", "Config": {"Image": "nginx"}, "Update": {"Policy": "semver", "Constraint": "~1.4", "Interval": "5m"}}`, "web", ""},
+		{`{"Name": "web", "Config": {"Image": "nginx"}, "Update": {"Policy": "sometimes"}}`, "", "spec web: unknown update policy \"sometimes\""},
+		{`{"Name": "web", "Config": {"Image": "nginx"}, "Update": {"Policy": "semver", "Constraint": "~a"}}`, "", "spec web: constraint \"~a\": a isn't a version"},
+		{`{"Name": "web", "Config": {"Image": "nginx"}, "Update": {"Policy": "digest-pinned"}}`, "", "spec web: image docker.io/library/nginx:latest has no digest to pin to"},
+		{`{"Name": "web", "Config": {"Image": "nginx"}, "Update": {"Policy": "always", "Interval": "soon"}}`, "", "spec web: bad update Interval \"soon\""},
+		{`{"Name": "web", "Config": {"Image": "Nginx"}}`, "", "spec web: image Nginx has a bad repository name library/Nginx"},
+		{`{"Name": "web", "Config": {"Image": "nginx"}, "HostLabels": {"region": "eu"}}`, "web", ""},
+		{`{"Name": "web", "Config": {"Image": "nginx"}, "Host": "edge1", "HostLabels": {"region": "eu"}}`, "", "spec web can't have both Host and HostLabels"},
+		{`{"Name": "web", "Config": {"Image": "nginx"}, "Placement": {"Nodes": 2, "Constraints": {"disk": "ssd"}, "Spread": "zone"}}`, "web", ""},
+		{`{"Name": "web", "Config": {"Image": "nginx"}, "Placement": {"Nodes": -1}}`, "", "spec web: bad Placement.Nodes -1"},
+		{`{"Name": "web", "Config": {"Image": "nginx", "Env": ["ID={{.Replica}}"]}, "Replicas": {"Count": 0}}`, "web", ""},
+		{`{"Name": "web", "Config": {"Image": "nginx"}, "Replicas": {"Count": -1}}`, "", "spec web: bad Replicas.Count -1"},
+		{`{"Name": "web", "Config": {"Image": "nginx"}, "HostConfig": {"PortBindings": {"80/tcp": [{"HostPort": "8080"}]}}, "Replicas": {"Count": 2}}`, "", "spec web: replicas would all publish the same host ports, they need a Replicas.PortOffset"},
+		{`{"Name": "web", "Config": {"Image": "nginx"}, "HostConfig": {"PortBindings": {"80/tcp": [{"HostPort": ""}]}}, "Replicas": {"Count": 2}}`, "web", ""},
+		{`{"Name": "web", "Config": {"Image": "nginx"}, "HostConfig": {"PortBindings": {"80/tcp": [{"HostPort": "65535"}]}}, "Replicas": {"Count": 2, "PortOffset": 1}}`, "", "spec web: replica 2 would publish port 65536"},
+		{`{"Name": "web", "Config": {"Image": "nginx", "Env": ["ID={{.Number}}"]}, "Replicas": {"Count": 2}}`, "", "spec web: template: Env:1:5: executing \"Env\" at <.Number>: can't evaluate field Number in type struct { Replica int; Name string }"},
+		{`{"Name": 5}`, "", "json: cannot unmarshal number into Go struct field Spec.Name of type string"},
+	}
+	for _, c := range tests {
+		spec, err := Decode([]byte(c.raw))
+		if c.err != "" {
+			if err == nil || err.Error() != c.err {
+				t.Errorf("Decode(%s) error == %v, want %q", c.raw, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Decode(%s) error == %v", c.raw, err)
+			continue
+		}
+		if spec.Name != c.name {
+			t.Errorf("Decode(%s).Name == %q, want %q", c.raw, spec.Name, c.name)
+		}
+		if spec.HostConfig == nil {
+			t.Errorf("Decode(%s).HostConfig == nil", c.raw)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	spec, err := Decode([]byte(`{"Name": "/web", "Config": {"Image": "nginx", "Cmd": null, "Entrypoint": [], "Env": [], "Labels": {"b": "2", "a": "1"}}, "HostConfig": {"Binds": [], "ConsoleSize": [0, 0]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := spec.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{
+  "Config": {
+    "Entrypoint": [],
+    "Image": "nginx",
+    "Labels": {
+      "a": "1",
+      "b": "2"
+    }
+  },
+  "Name": "web",
+  "Version": 1
+}
+`
+	if string(raw) != want {
+		t.Errorf("Encode() == %s, want %s", raw, want)
+	}
+}
+
+func TestDependencyJSON(t *testing.T) {
+	spec, err := Decode([]byte(`{"Name": "web", "Config": {"Image": "nginx"}, "DependsOn": ["/db", {"Name": "cache", "Condition": "healthy"}, {"Name": "queue", "Condition": "running"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := json.Marshal(spec.DependsOn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `["db",{"Name":"cache","Condition":"healthy"},"queue"]`
+	if string(raw) != want {
+		t.Errorf("DependsOn == %s, want %s", raw, want)
+	}
+}
+
+func TestReplica(t *testing.T) {
+	spec, err := Decode([]byte(`{
+		"Name": "web",
+		"Config": {"Image": "nginx", "Env": ["ID={{.Replica}}", "HOSTNAME={{.Name}}.local", "PORT=80"], "Labels": {"app": "web"}},
+		"HostConfig": {"PortBindings": {"80/tcp": [{"HostPort": "8080"}, {"HostPort": ""}]}},
+		"Replicas": {"Count": 3, "PortOffset": 10}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica, err := spec.Replica(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replica.Name != "web-3" || replica.Replicas != nil {
+		t.Errorf("Replica(3) is %s with %+v", replica.Name, replica.Replicas)
+	}
+	env, _ := json.Marshal(replica.Config.Env)
+	if string(env) != `["ID=3","HOSTNAME=web-3.local","PORT=80"]` {
+		t.Errorf("Env == %s", env)
+	}
+	labels, _ := json.Marshal(replica.Config.Labels)
+	if string(labels) != `{"app":"web","watchdock.replica":"3","watchdock.replica-of":"web"}` {
+		t.Errorf("Labels == %s", labels)
+	}
+	ports, _ := json.Marshal(replica.HostConfig.PortBindings)
+	if string(ports) != `{"80/tcp":[{"HostPort":"8100"},{}]}` {
+		t.Errorf("PortBindings == %s", ports)
+	}
+	// the spec itself is left alone
+	if spec.Config.Env[0] != "ID={{.Replica}}" || spec.HostConfig.PortBindings["80/tcp"][0].HostPort != "8080" || len(spec.Config.Labels) != 1 {
+		t.Errorf("Replica changed the spec: %+v %+v", spec.Config, spec.HostConfig.PortBindings)
+	}
+}
@@ -0,0 +1,180 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeConsul is just enough of consul's KV and session HTTP APIs for a
+// lock.
+type fakeConsul struct {
+	sync.Mutex
+	kv       map[string][]byte
+	holder   map[string]string
+	sessions map[string]bool
+	next     int
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{
+		kv:       make(map[string][]byte),
+		holder:   make(map[string]string),
+		sessions: make(map[string]bool),
+	}
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	path := r.URL.Path
+	switch {
+	case path == "/v1/session/create":
+		f.next++
+		id := "session" + string(rune('0'+f.next))
+		f.sessions[id] = true
+		json.NewEncoder(w).Encode(map[string]string{"ID": id})
+	case strings.HasPrefix(path, "/v1/session/renew/"):
+		id := strings.TrimPrefix(path, "/v1/session/renew/")
+		if !f.sessions[id] {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode([]map[string]string{{"ID": id}})
+	case strings.HasPrefix(path, "/v1/session/destroy/"):
+		id := strings.TrimPrefix(path, "/v1/session/destroy/")
+		delete(f.sessions, id)
+		for key, holder := range f.holder {
+			if holder == id {
+				delete(f.holder, key)
+			}
+		}
+		w.Write([]byte("true"))
+	case strings.HasPrefix(path, "/v1/kv/") && r.Method == "PUT":
+		key := strings.TrimPrefix(path, "/v1/kv/")
+		body, _ := ioutil.ReadAll(r.Body)
+		if session := r.URL.Query().Get("acquire"); session != "" {
+			if holder, ok := f.holder[key]; ok && holder != session {
+				w.Write([]byte("false"))
+				return
+			}
+			f.holder[key] = session
+		}
+		f.kv[key] = body
+		w.Write([]byte("true"))
+	case strings.HasPrefix(path, "/v1/kv/"):
+		key := strings.TrimPrefix(path, "/v1/kv/")
+		var pairs []map[string]interface{}
+		for k, v := range f.kv {
+			if k == key || (r.URL.Query().Has("recurse") && strings.HasPrefix(k, key)) {
+				pairs = append(pairs, map[string]interface{}{"Key": k, "Value": v})
+			}
+		}
+		// consul lists keys in order
+		sort.Slice(pairs, func(i, j int) bool {
+			return pairs[i]["Key"].(string) < pairs[j]["Key"].(string)
+		})
+		if len(pairs) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(pairs)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// testBackend puts two nodes of the same cluster through their paces.
+func testBackend(t *testing.T, a Backend, b Backend) {
+	if leads, err := a.Lead("a"); err != nil || !leads {
+		t.Fatalf("a should lead, got %v %v", leads, err)
+	}
+	if leads, err := b.Lead("b"); err != nil || leads {
+		t.Errorf("b shouldn't lead while a does, got %v %v", leads, err)
+	}
+	if leads, err := a.Lead("a"); err != nil || !leads {
+		t.Errorf("a should keep leading, got %v %v", leads, err)
+	}
+	if err := a.Resign("a"); err != nil {
+		t.Fatal(err)
+	}
+	if leads, err := b.Lead("b"); err != nil || !leads {
+		t.Errorf("b should lead once a resigned, got %v %v", leads, err)
+	}
+
+	seen := time.Now().Round(time.Second)
+	a.Register(Node{Name: "a", Labels: map[string]string{"zone": "1"}, Seen: seen})
+	b.Register(Node{Name: "b", Seen: seen})
+	nodes, err := a.Nodes()
+	if err != nil || len(nodes) != 2 || nodes[0].Labels["zone"] != "1" || !nodes[1].Seen.Equal(seen) {
+		t.Errorf("Nodes() == %+v, %v", nodes, err)
+	}
+
+	assignments, err := a.Assignments()
+	if err != nil || len(assignments) != 0 {
+		t.Errorf("Expected no assignments yet, got %v %v", assignments, err)
+	}
+	want := map[string][]string{"web": {"a", "b"}}
+	b.Assign(want)
+	assignments, err = a.Assignments()
+	if err != nil || !reflect.DeepEqual(assignments, want) {
+		t.Errorf("Assignments() == %v, %v", assignments, err)
+	}
+}
+
+func TestDir(t *testing.T) {
+	path := t.TempDir()
+	a, _ := NewDir(path, time.Minute)
+	b, _ := NewDir(path, time.Minute)
+	testBackend(t, a, b)
+
+	// c stopped renewing a while ago
+	path = t.TempDir()
+	c, _ := NewDir(path, -time.Second)
+	c.Lead("c")
+	a, _ = NewDir(path, time.Minute)
+	if leads, err := a.Lead("a"); err != nil || !leads {
+		t.Errorf("a should take over an expired lease, got %v %v", leads, err)
+	}
+
+	// only one of several nodes racing for an expired lease gets it
+	for round := 0; round < 20; round++ {
+		path = t.TempDir()
+		c, _ = NewDir(path, -time.Second)
+		c.Lead("c")
+		var wg sync.WaitGroup
+		var leaders int32
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+				node, _ := NewDir(path, time.Minute)
+				if leads, _ := node.Lead(name); leads {
+					atomic.AddInt32(&leaders, 1)
+				}
+			}(fmt.Sprintf("n%d", i))
+		}
+		wg.Wait()
+		if leaders != 1 {
+			t.Fatalf("Expected exactly one leader, got %d", leaders)
+		}
+	}
+}
+
+func TestConsul(t *testing.T) {
+	server := httptest.NewServer(newFakeConsul())
+	defer server.Close()
+	address := strings.TrimPrefix(server.URL, "http://")
+	a, _ := NewConsul(address, 30*time.Second)
+	b, _ := NewConsul(address+"/watchdock-cluster", 30*time.Second)
+	testBackend(t, a, b)
+}
@@ -0,0 +1,406 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"github.com/brimstone/watchdock/channel"
+	"github.com/brimstone/watchdock/docker"
+	"log"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+func logit(v ...interface{}) {
+	log.Println("Cluster:", v)
+}
+
+// Node is one watchdock in the cluster.
+type Node struct {
+	Name   string
+	Labels map[string]string `json:",omitempty"`
+	// Seen is when it last checked in
+	Seen time.Time
+}
+
+// Backend is where the nodes of a cluster find each other, one of them
+// leads, and the leader writes down which nodes run what.
+type Backend interface {
+	// Register records node, Seen and all
+	Register(node Node) error
+	// Nodes is every node that ever registered
+	Nodes() ([]Node, error)
+	// Lead makes name the leader, or keeps it leader, unless someone else
+	// already is. It reports whether name leads.
+	Lead(name string) (bool, error)
+	// Resign lets someone else lead right away
+	Resign(name string) error
+	// Assignments is the nodes each spec is placed on, first node first
+	Assignments() (map[string][]string, error)
+	Assign(assignments map[string][]string) error
+}
+
+// Cluster sits between the storage modules and this node's processing
+// module. Every node sees every spec, the leader places them on nodes, and
+// only the ones placed on this node get through to its processing module.
+type Cluster struct {
+	node       Node
+	backend    Backend
+	processing channel.Module
+	// how often we check in, and how long a node can go without before
+	// what it runs is placed elsewhere
+	heartbeat time.Duration
+	grace     time.Duration
+	// every spec storage sent, which the leader places, guarded by lock
+	specs map[string]*channel.Spec
+	lock  sync.Mutex
+	// only used by checkIn
+	leading      bool
+	leadingSince time.Time
+	// only used by Sync: the latest assignments, which of them are ours,
+	// and what processing said before there were any
+	assigned map[string][]string
+	mine     map[string]bool
+	ready    bool
+	pending  []channel.Event
+}
+
+func (cluster *Cluster) Init(node Node, backend Backend, processing channel.Module) error {
+	cluster.node = node
+	cluster.backend = backend
+	cluster.processing = processing
+	cluster.heartbeat = 5 * time.Second
+	cluster.grace = 30 * time.Second
+	cluster.specs = make(map[string]*channel.Spec)
+	cluster.assigned = make(map[string][]string)
+	cluster.mine = make(map[string]bool)
+	return nil
+}
+
+// SetTimings changes how often we check in and how long a node that
+// doesn't gets before it's rescheduled.
+func (cluster *Cluster) SetTimings(heartbeat time.Duration, grace time.Duration) {
+	cluster.heartbeat = heartbeat
+	cluster.grace = grace
+}
+
+// Sync runs the processing module and checks in with the cluster until ctx
+// is cancelled or readChannel is closed, then waits for the processing
+// module to finish up.
+func (cluster *Cluster) Sync(ctx context.Context, readChannel <-chan channel.Event, writeChannel chan<- channel.Event) {
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	toProcessing := make(chan channel.Event)
+	input := make(chan channel.Event)
+	go channel.Queue(toProcessing, input)
+	output := make(chan channel.Event)
+	fromProcessing := make(chan channel.Event)
+	go channel.Queue(output, fromProcessing)
+	go func() {
+		defer close(output)
+		cluster.processing.Sync(ctx, input, output)
+	}()
+	assignments := make(chan map[string][]string)
+	checkedOut := make(chan struct{})
+	go func() {
+		defer close(checkedOut)
+		cluster.checkIn(ctx, assignments)
+	}()
+
+	logit("Joined as", cluster.node.Name)
+	for {
+		select {
+		case event, ok := <-fromProcessing:
+			if !ok {
+				// processing has stopped and everything it said is passed on
+				close(toProcessing)
+				<-checkedOut
+				return
+			}
+			if !cluster.ready {
+				// until we know what's ours there's no telling what to do
+				cluster.pending = append(cluster.pending, event)
+				continue
+			}
+			cluster.fromProcessing(event, toProcessing, writeChannel)
+		case event, ok := <-readChannel:
+			if !ok {
+				readChannel = nil
+				stop()
+				continue
+			}
+			cluster.fromStorage(event, toProcessing)
+		case assigned := <-assignments:
+			cluster.apply(assigned, toProcessing)
+			if !cluster.ready {
+				cluster.ready = true
+				for _, event := range cluster.pending {
+					cluster.fromProcessing(event, toProcessing, writeChannel)
+				}
+				cluster.pending = nil
+			}
+		}
+	}
+}
+
+// checkIn registers us every heartbeat, places everything if we lead and
+// hands the assignments to Sync. On the way out it lets someone else lead.
+func (cluster *Cluster) checkIn(ctx context.Context, assignments chan<- map[string][]string) {
+	for {
+		assigned, err := cluster.round()
+		if err != nil {
+			logit("Error checking in:", err.Error())
+		} else {
+			select {
+			case assignments <- assigned:
+			case <-ctx.Done():
+			}
+		}
+		select {
+		case <-time.After(cluster.heartbeat):
+		case <-ctx.Done():
+			if cluster.leading {
+				err = cluster.backend.Resign(cluster.node.Name)
+				if err != nil {
+					logit("Error stepping down:", err.Error())
+				}
+			}
+			return
+		}
+	}
+}
+
+// round checks in once and returns the assignments, which it makes first
+// if we lead.
+func (cluster *Cluster) round() (map[string][]string, error) {
+	node := cluster.node
+	node.Seen = time.Now()
+	err := cluster.backend.Register(node)
+	if err != nil {
+		return nil, err
+	}
+	leading, err := cluster.backend.Lead(node.Name)
+	if err != nil {
+		return nil, err
+	}
+	if leading != cluster.leading {
+		if leading {
+			logit("Leading the cluster")
+			cluster.leadingSince = time.Now()
+		} else {
+			logit("No longer leading the cluster")
+		}
+		cluster.leading = leading
+	}
+	current, err := cluster.backend.Assignments()
+	if err != nil || !leading {
+		return current, err
+	}
+
+	nodes, err := cluster.backend.Nodes()
+	if err != nil {
+		return nil, err
+	}
+	var alive []Node
+	for _, n := range nodes {
+		if time.Since(n.Seen) < cluster.grace {
+			alive = append(alive, n)
+		} else if placedOn(current, n.Name) {
+			logit("Node", n.Name, "hasn't checked in since", n.Seen.Format(time.RFC3339)+", placing its containers elsewhere")
+		}
+	}
+	cluster.lock.Lock()
+	specs := make(map[string]*channel.Spec, len(cluster.specs))
+	for name, spec := range cluster.specs {
+		specs[name] = spec
+	}
+	cluster.lock.Unlock()
+	next := schedule(specs, alive, current)
+	for name, nodes := range current {
+		// a new leader may not have heard about everything yet, so it
+		// doesn't drop what it doesn't know about straight away
+		if _, ok := specs[name]; !ok && time.Since(cluster.leadingSince) < cluster.grace {
+			next[name] = nodes
+		}
+	}
+	for name := range specs {
+		if len(next[name]) < placementOf(specs[name]).Nodes && len(next[name]) != len(current[name]) {
+			logit("Only", len(next[name]), "of", placementOf(specs[name]).Nodes, "nodes can run", name)
+		}
+	}
+	if !reflect.DeepEqual(next, current) {
+		err = cluster.backend.Assign(next)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return next, nil
+}
+
+func placedOn(assignments map[string][]string, node string) bool {
+	for _, nodes := range assignments {
+		for _, n := range nodes {
+			if n == node {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pinned is whether spec can only run on node, so it's left alone even
+// before the leader has placed it there.
+func pinned(spec *channel.Spec, node string) bool {
+	return spec != nil && spec.Placement != nil && spec.Placement.Constraints["node"] == node
+}
+
+// apply starts and stops whatever assigned moved onto or off this node.
+func (cluster *Cluster) apply(assigned map[string][]string, toProcessing chan<- channel.Event) {
+	mine := make(map[string]bool)
+	for name, nodes := range assigned {
+		for _, n := range nodes {
+			if n == cluster.node.Name {
+				mine[name] = true
+			}
+		}
+	}
+	var names []string
+	for name := range cluster.mine {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !mine[name] {
+			logit("No longer running", name)
+			toProcessing <- channel.NewDelete(name)
+		}
+	}
+	cluster.lock.Lock()
+	defer cluster.lock.Unlock()
+	names = nil
+	for name := range mine {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		spec, ok := cluster.specs[name]
+		if !cluster.mine[name] && ok {
+			logit("Now running", name)
+			toProcessing <- channel.NewUpsert(spec)
+		}
+	}
+	cluster.assigned = assigned
+	cluster.mine = mine
+}
+
+// fromStorage keeps track of every spec and passes on what's ours.
+func (cluster *Cluster) fromStorage(event channel.Event, toProcessing chan<- channel.Event) {
+	switch event.Kind {
+	case channel.Upsert:
+		cluster.lock.Lock()
+		cluster.specs[event.Name] = event.Spec
+		cluster.lock.Unlock()
+		if cluster.mine[event.Name] {
+			toProcessing <- event
+		}
+	case channel.Delete:
+		cluster.lock.Lock()
+		delete(cluster.specs, event.Name)
+		cluster.lock.Unlock()
+		if cluster.mine[event.Name] {
+			toProcessing <- event
+		}
+	default:
+		toProcessing <- event
+	}
+}
+
+// fromProcessing passes on what docker says about what's ours. Containers
+// that aren't ours are removed, and ones nobody knows about are placed
+// here for good.
+func (cluster *Cluster) fromProcessing(event channel.Event, toProcessing chan<- channel.Event, writeChannel chan<- channel.Event) {
+	name := event.Name
+	cluster.lock.Lock()
+	spec, known := cluster.specs[name]
+	cluster.lock.Unlock()
+	nodes, assigned := cluster.assigned[name]
+	known = known || assigned
+	mine := cluster.mine[name]
+	switch event.Kind {
+	case channel.Upsert:
+		found := *event.Spec
+		switch {
+		case !known:
+			found.Placement = &channel.Placement{Constraints: map[string]string{"node": cluster.node.Name}}
+			cluster.lock.Lock()
+			cluster.specs[name] = &found
+			cluster.lock.Unlock()
+			writeChannel <- channel.NewUpsert(&found)
+		case !mine:
+			if pinned(spec, cluster.node.Name) {
+				// the leader just hasn't placed it here yet
+				return
+			}
+			logit("Removing", name, "which runs elsewhere")
+			toProcessing <- channel.NewDelete(name)
+		case nodes[0] == cluster.node.Name && spec != nil:
+			// only the first node speaks for the spec
+			found.Placement = spec.Placement
+			writeChannel <- channel.NewUpsert(&found)
+		}
+	case channel.Delete:
+		switch {
+		case !mine:
+			// we took it off, or never knew it
+		case len(nodes) > 1 && spec != nil:
+			logit("Container", name, "was removed but still belongs here, putting it back")
+			toProcessing <- channel.NewUpsert(spec)
+		default:
+			writeChannel <- event
+		}
+	case channel.Status:
+		if known && !mine {
+			return
+		}
+		state := *event.Status
+		state.Node = cluster.node.Name
+		writeChannel <- channel.NewStatus(name, &state)
+	default:
+		writeChannel <- event
+	}
+}
+
+// Plan is what this node's processing module would do about the specs
+// placed on it, going by the assignments the leader last wrote down. It
+// doesn't join the cluster, so specs nobody placed yet aren't planned for.
+func (cluster *Cluster) Plan(specs []*channel.Spec, deleted []string) ([]docker.Action, error) {
+	planner, ok := cluster.processing.(docker.Planner)
+	if !ok {
+		return nil, fmt.Errorf("processing can't plan")
+	}
+	assigned, err := cluster.backend.Assignments()
+	if err != nil {
+		return nil, err
+	}
+	var mine []*channel.Spec
+	for _, spec := range specs {
+		placed := pinned(spec, cluster.node.Name)
+		for _, n := range assigned[spec.Name] {
+			placed = placed || n == cluster.node.Name
+		}
+		if placed {
+			mine = append(mine, spec)
+		}
+	}
+	return planner.Plan(mine, deleted)
+}
+
+func New(node Node, backend Backend, processing channel.Module) (*Cluster, error) {
+	cluster := new(Cluster)
+	err := cluster.Init(node, backend, processing)
+	if err != nil {
+		return nil, err
+	}
+	return cluster, nil
+}
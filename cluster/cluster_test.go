@@ -0,0 +1,272 @@
+package cluster
+
+import (
+	"context"
+	"github.com/brimstone/watchdock/channel"
+	"github.com/brimstone/watchdock/docker"
+	"github.com/brimstone/watchdock/docker/dockertest"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeProcessing hands everything it is told to the test, and sends
+// whatever the test gives it back.
+type fakeProcessing struct {
+	received chan channel.Event
+	send     chan channel.Event
+}
+
+func newFakeProcessing() *fakeProcessing {
+	return &fakeProcessing{
+		received: make(chan channel.Event, 10),
+		send:     make(chan channel.Event),
+	}
+}
+
+func (f *fakeProcessing) Sync(ctx context.Context, readChannel <-chan channel.Event, writeChannel chan<- channel.Event) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-readChannel:
+			f.received <- event
+		case event := <-f.send:
+			writeChannel <- event
+		}
+	}
+}
+
+// Plan creates whatever it's given.
+func (f *fakeProcessing) Plan(specs []*channel.Spec, deleted []string) ([]docker.Action, error) {
+	var actions []docker.Action
+	for _, spec := range specs {
+		actions = append(actions, docker.Action{Action: docker.ActionCreate, Container: spec.Name})
+	}
+	return actions, nil
+}
+
+func expect(t *testing.T, events <-chan channel.Event, kind channel.Kind, name string) channel.Event {
+	select {
+	case event := <-events:
+		if event.Kind != kind || event.Name != name {
+			t.Errorf("Expected %s %s, got %s %s", kind, name, event.Kind, event.Name)
+		}
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timeout waiting for", kind, name)
+	}
+	return channel.Event{}
+}
+
+func expectNothing(t *testing.T, events <-chan channel.Event) {
+	select {
+	case event := <-events:
+		t.Errorf("Didn't expect anything, got %s %s", event.Kind, event.Name)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func spec(name string, placement *channel.Placement) *channel.Spec {
+	return &channel.Spec{
+		Version:   channel.SpecVersion,
+		Name:      name,
+		Config:    &dockerclient.Config{Image: "nginx"},
+		Placement: placement,
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	nodes := []Node{
+		{Name: "a", Labels: map[string]string{"zone": "1", "disk": "ssd"}},
+		{Name: "b", Labels: map[string]string{"zone": "1"}},
+		{Name: "c", Labels: map[string]string{"zone": "2", "disk": "ssd"}},
+	}
+	specs := map[string]*channel.Spec{
+		"db":     spec("db", &channel.Placement{Constraints: map[string]string{"disk": "ssd"}}),
+		"web":    spec("web", &channel.Placement{Nodes: 2, Spread: "zone"}),
+		"cache":  spec("cache", nil),
+		"pinned": spec("pinned", &channel.Placement{Constraints: map[string]string{"node": "b"}}),
+		"huge":   spec("huge", &channel.Placement{Nodes: 5}),
+		"gpu":    spec("gpu", &channel.Placement{Constraints: map[string]string{"gpu": "yes"}}),
+	}
+	// web already runs on b, and db on a node that's gone
+	current := map[string][]string{"web": {"b"}, "db": {"d"}}
+	got := schedule(specs, nodes, current)
+	want := map[string][]string{
+		"cache":  {"a"},
+		"db":     {"c"},
+		"huge":   {"a", "b", "c"},
+		"pinned": {"b"},
+		"web":    {"b", "c"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("schedule == %v, want %v", got, want)
+	}
+}
+
+func TestCluster(t *testing.T) {
+	dir := t.TempDir()
+	start := func(name string) (*fakeProcessing, chan channel.Event, chan channel.Event, context.CancelFunc) {
+		backend, err := NewDir(dir, 300*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		processing := newFakeProcessing()
+		cluster, _ := New(Node{Name: name}, backend, processing)
+		cluster.SetTimings(20*time.Millisecond, 300*time.Millisecond)
+		read := make(chan channel.Event)
+		write := make(chan channel.Event, 10)
+		ctx, cancel := context.WithCancel(context.Background())
+		go cluster.Sync(ctx, read, write)
+		return processing, read, write, cancel
+	}
+	a, readA, writeA, stopA := start("a")
+	defer stopA()
+	// a leads by the time b joins
+	time.Sleep(100 * time.Millisecond)
+	b, readB, writeB, stopB := start("b")
+	defer stopB()
+
+	// every node hears about every spec, only one of them runs it
+	web := spec("web", nil)
+	readA <- channel.NewUpsert(web)
+	readB <- channel.NewUpsert(web)
+	expect(t, a.received, channel.Upsert, "web")
+	expectNothing(t, b.received)
+
+	// only the node running it speaks for it
+	b.send <- channel.NewStatus("web", &channel.State{Running: true})
+	expectNothing(t, writeB)
+	a.send <- channel.NewStatus("web", &channel.State{Running: true})
+	status := expect(t, writeA, channel.Status, "web")
+	if status.Status.Node != "a" {
+		t.Errorf("Node == %q", status.Status.Node)
+	}
+
+	// and it's removed anywhere else it turns up
+	b.send <- channel.NewUpsert(spec("web", nil))
+	expect(t, b.received, channel.Delete, "web")
+
+	// a container nobody knows about stays where it is
+	b.send <- channel.NewUpsert(spec("db", nil))
+	found := expect(t, writeB, channel.Upsert, "db")
+	if found.Spec.Placement == nil || found.Spec.Placement.Constraints["node"] != "b" {
+		t.Errorf("db should be placed on b, got %+v", found.Spec.Placement)
+	}
+
+	// and isn't removed before the leader has heard of it
+	b.send <- channel.NewUpsert(spec("db", nil))
+	expectNothing(t, b.received)
+
+	// a goes away, b takes over and places db where it is, then after the
+	// grace period web moves to b too
+	stopA()
+	expect(t, b.received, channel.Upsert, "db")
+	expect(t, b.received, channel.Upsert, "web")
+}
+
+// TestMove moves a spec from one node to another against real docker
+// processing, and checks it stays gone from the first.
+func TestMove(t *testing.T) {
+	dir := t.TempDir()
+	start := func(name string) (*dockertest.Docker, *docker.Processing, chan channel.Event) {
+		fake := dockertest.New()
+		// docker's event stream keeps the server busy, so it's left up
+		server := httptest.NewServer(fake)
+		processing, err := docker.New(docker.Endpoint{Host: server.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = processing.Connect()
+		if err != nil {
+			t.Fatal(err)
+		}
+		backend, _ := NewDir(dir, 300*time.Millisecond)
+		cluster, _ := New(Node{Name: name}, backend, processing)
+		cluster.SetTimings(20*time.Millisecond, 300*time.Millisecond)
+		read := make(chan channel.Event)
+		write := make(chan channel.Event)
+		ctx, cancel := context.WithCancel(context.Background())
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			cluster.Sync(ctx, read, write)
+		}()
+		// the directory is only cleaned up once nobody writes to it
+		t.Cleanup(func() {
+			cancel()
+			<-stopped
+		})
+		go func() {
+			for range write {
+			}
+		}()
+		return fake, processing, read
+	}
+	running := func(fake *dockertest.Docker) bool {
+		c, ok := fake.ByName("web")
+		return ok && c.State.Running
+	}
+	eventually := func(what string, check func() bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !check() {
+			if time.Now().After(deadline) {
+				t.Fatal("Timeout waiting until", what)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	fakeA, processingA, readA := start("a")
+	time.Sleep(100 * time.Millisecond)
+	fakeB, _, readB := start("b")
+
+	// every node decodes its own copy of a spec
+	on := func(node string) *channel.Spec {
+		return spec("web", &channel.Placement{Constraints: map[string]string{"node": node}})
+	}
+	readA <- channel.NewUpsert(on("a"))
+	readB <- channel.NewUpsert(on("a"))
+	eventually("web runs on a", func() bool { return running(fakeA) })
+
+	readA <- channel.NewUpsert(on("b"))
+	readB <- channel.NewUpsert(on("b"))
+	eventually("web runs on b", func() bool { return running(fakeB) })
+	eventually("web is gone from a", func() bool {
+		_, ok := fakeA.ByName("web")
+		return !ok
+	})
+
+	// a checking on everything doesn't bring it back
+	processingA.Reconcile()
+	time.Sleep(300 * time.Millisecond)
+	if _, ok := fakeA.ByName("web"); ok {
+		t.Error("web came back on a after a reconcile, it runs on both nodes")
+	}
+}
+
+func TestPlan(t *testing.T) {
+	backend, err := NewDir(t.TempDir(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.Assign(map[string][]string{"web": {"a", "b"}, "db": {"b"}})
+	cluster, err := New(Node{Name: "a"}, backend, newFakeProcessing())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinnedHere := spec("pinned", &channel.Placement{Constraints: map[string]string{"node": "a"}})
+	actions, err := cluster.Plan([]*channel.Spec{spec("db", nil), pinnedHere, spec("new", nil), spec("web", nil)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var planned []string
+	for _, action := range actions {
+		planned = append(planned, action.Container)
+	}
+	if !reflect.DeepEqual(planned, []string{"pinned", "web"}) {
+		t.Errorf("Expected to plan for pinned and web, got %v", planned)
+	}
+}
@@ -0,0 +1,152 @@
+package cluster
+
+import (
+	"encoding/json"
+	"github.com/armon/consul-api"
+	"strings"
+	"time"
+)
+
+// Consul keeps the cluster under a consul KV prefix. Leadership is a lock on
+// the leader key held by a session, which consul lets go of if we stop
+// renewing it.
+type Consul struct {
+	kv      *consulapi.KV
+	session *consulapi.Session
+	prefix  string
+	ttl     time.Duration
+	// our session, empty until we need one
+	id string
+}
+
+// Init accepts "host:port" or "host:port/some/prefix", the prefix defaults
+// to "watchdock-cluster". It can't be the storage module's prefix.
+func (consul *Consul) Init(connect string, ttl time.Duration) error {
+	consulConfig := consulapi.DefaultConfig()
+	if strings.HasPrefix(connect, "https://") {
+		consulConfig.Scheme = "https"
+	}
+	connect = strings.TrimPrefix(connect, "http://")
+	connect = strings.TrimPrefix(connect, "https://")
+	consul.prefix = "watchdock-cluster"
+	if i := strings.Index(connect, "/"); i >= 0 {
+		if prefix := strings.Trim(connect[i:], "/"); prefix != "" {
+			consul.prefix = prefix
+		}
+		connect = connect[:i]
+	}
+	if connect != "" {
+		consulConfig.Address = connect
+	}
+	client, err := consulapi.NewClient(consulConfig)
+	if err != nil {
+		return err
+	}
+	consul.kv = client.KV()
+	consul.session = client.Session()
+	consul.ttl = ttl
+	return nil
+}
+
+func (consul *Consul) key(parts ...string) string {
+	return consul.prefix + "/" + strings.Join(parts, "/")
+}
+
+func (consul *Consul) put(key string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = consul.kv.Put(&consulapi.KVPair{Key: key, Value: raw}, nil)
+	return err
+}
+
+func (consul *Consul) Register(node Node) error {
+	return consul.put(consul.key("nodes", node.Name), node)
+}
+
+func (consul *Consul) Nodes() ([]Node, error) {
+	pairs, _, err := consul.kv.List(consul.key("nodes")+"/", nil)
+	if err != nil {
+		return nil, err
+	}
+	var nodes []Node
+	for _, pair := range pairs {
+		var node Node
+		err = json.Unmarshal(pair.Value, &node)
+		if err != nil {
+			logit("Skipping node", pair.Key, err.Error())
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// renew keeps our session alive, making a new one if it's gone.
+func (consul *Consul) renew() error {
+	if consul.id != "" {
+		entry, _, err := consul.session.Renew(consul.id, nil)
+		if err != nil {
+			return err
+		}
+		if entry != nil {
+			return nil
+		}
+		logit("Session", consul.id, "expired")
+	}
+	id, _, err := consul.session.Create(&consulapi.SessionEntry{
+		Name:     "watchdock",
+		TTL:      consul.ttl.String(),
+		Behavior: consulapi.SessionBehaviorRelease,
+	}, nil)
+	if err != nil {
+		consul.id = ""
+		return err
+	}
+	consul.id = id
+	return nil
+}
+
+func (consul *Consul) Lead(name string) (bool, error) {
+	err := consul.renew()
+	if err != nil {
+		return false, err
+	}
+	// acquiring a lock the session already holds just works
+	ok, _, err := consul.kv.Acquire(&consulapi.KVPair{Key: consul.key("leader"), Value: []byte(name), Session: consul.id}, nil)
+	return ok, err
+}
+
+func (consul *Consul) Resign(name string) error {
+	if consul.id == "" {
+		return nil
+	}
+	// which lets go of the lock with it
+	_, err := consul.session.Destroy(consul.id, nil)
+	consul.id = ""
+	return err
+}
+
+func (consul *Consul) Assignments() (map[string][]string, error) {
+	assignments := make(map[string][]string)
+	pair, _, err := consul.kv.Get(consul.key("assignments"), nil)
+	if err != nil || pair == nil {
+		return assignments, err
+	}
+	err = json.Unmarshal(pair.Value, &assignments)
+	return assignments, err
+}
+
+func (consul *Consul) Assign(assignments map[string][]string) error {
+	return consul.put(consul.key("assignments"), assignments)
+}
+
+func NewConsul(connect string, ttl time.Duration) (*Consul, error) {
+	consul := new(Consul)
+	err := consul.Init(connect, ttl)
+	if err != nil {
+		return nil, err
+	}
+	return consul, nil
+}
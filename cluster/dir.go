@@ -0,0 +1,176 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Dir keeps the cluster in a directory every node shares, over NFS or the
+// like. Leadership is a lease in leader.json, which relies on the nodes'
+// clocks roughly agreeing.
+type Dir struct {
+	path string
+	ttl  time.Duration
+}
+
+// lease is who leads until when.
+type lease struct {
+	Name  string
+	Until time.Time
+}
+
+func (dir *Dir) Init(path string, ttl time.Duration) error {
+	dir.path = path
+	dir.ttl = ttl
+	return os.MkdirAll(filepath.Join(path, "nodes"), 0755)
+}
+
+// write replaces filename with v all at once, so nobody reads half of it.
+func (dir *Dir) write(filename string, v interface{}) error {
+	raw, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.%d.tmp", filename, os.Getpid())
+	err = ioutil.WriteFile(tmp, raw, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+func (dir *Dir) read(filename string, v interface{}) error {
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+func (dir *Dir) Register(node Node) error {
+	return dir.write(filepath.Join(dir.path, "nodes", node.Name+".json"), node)
+}
+
+func (dir *Dir) Nodes() ([]Node, error) {
+	files, err := ioutil.ReadDir(filepath.Join(dir.path, "nodes"))
+	if err != nil {
+		return nil, err
+	}
+	var nodes []Node
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		var node Node
+		err = dir.read(filepath.Join(dir.path, "nodes", file.Name()), &node)
+		if err != nil {
+			logit("Skipping node", file.Name(), err.Error())
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+func (dir *Dir) Lead(name string) (bool, error) {
+	filename := filepath.Join(dir.path, "leader.json")
+	var current lease
+	err := dir.read(filename, &current)
+	if os.IsNotExist(err) {
+		// nobody leads, whoever links theirs in first does
+		return dir.create(filename, lease{Name: name, Until: time.Now().Add(dir.ttl)})
+	}
+	if err != nil {
+		return false, err
+	}
+	if time.Now().Before(current.Until) {
+		if current.Name != name {
+			return false, nil
+		}
+		return true, dir.write(filename, lease{Name: name, Until: time.Now().Add(dir.ttl)})
+	}
+	// the lease has run out, even if it was ours. Whoever links in their
+	// claim on this particular lease first takes it over, nobody else who
+	// saw it run out can
+	claim := fmt.Sprintf("%s.%d.takeover", filename, current.Until.UnixNano())
+	won, err := dir.create(claim, lease{Name: name})
+	if !won {
+		return false, err
+	}
+	dir.clean(filename, current.Until)
+	return true, dir.write(filename, lease{Name: name, Until: time.Now().Add(dir.ttl)})
+}
+
+// clean removes the claims on leases that ran out before until.
+func (dir *Dir) clean(filename string, until time.Time) {
+	claims, _ := filepath.Glob(filename + ".*.takeover")
+	for _, claim := range claims {
+		var nanos int64
+		_, err := fmt.Sscanf(strings.TrimPrefix(claim, filename+"."), "%d.takeover", &nanos)
+		if err == nil && nanos < until.UnixNano() {
+			os.Remove(claim)
+		}
+	}
+}
+
+// create writes v to filename unless it's there already, all at once.
+func (dir *Dir) create(filename string, v interface{}) (bool, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return false, err
+	}
+	// nodes share the directory, so the pid alone isn't unique
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(raw)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, err
+	}
+	err = os.Link(tmp.Name(), filename)
+	if os.IsExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (dir *Dir) Resign(name string) error {
+	filename := filepath.Join(dir.path, "leader.json")
+	var current lease
+	if dir.read(filename, &current) != nil || current.Name != name {
+		return nil
+	}
+	return os.Remove(filename)
+}
+
+func (dir *Dir) Assignments() (map[string][]string, error) {
+	assignments := make(map[string][]string)
+	err := dir.read(filepath.Join(dir.path, "assignments.json"), &assignments)
+	if os.IsNotExist(err) {
+		return assignments, nil
+	}
+	return assignments, err
+}
+
+func (dir *Dir) Assign(assignments map[string][]string) error {
+	return dir.write(filepath.Join(dir.path, "assignments.json"), assignments)
+}
+
+func NewDir(path string, ttl time.Duration) (*Dir, error) {
+	dir := new(Dir)
+	err := dir.Init(path, ttl)
+	if err != nil {
+		return nil, err
+	}
+	return dir, nil
+}
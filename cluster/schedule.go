@@ -0,0 +1,114 @@
+package cluster
+
+import (
+	"github.com/brimstone/watchdock/channel"
+	"sort"
+)
+
+// fits is whether node has every label constraints asks for. A node's name
+// is its node label.
+func fits(node Node, constraints map[string]string) bool {
+	for key, value := range constraints {
+		have, ok := node.Labels[key]
+		if key == "node" {
+			have, ok = node.Name, true
+		}
+		if !ok || have != value {
+			return false
+		}
+	}
+	return true
+}
+
+func placementOf(spec *channel.Spec) channel.Placement {
+	placement := channel.Placement{Nodes: 1}
+	if spec.Placement != nil {
+		placement = *spec.Placement
+		if placement.Nodes == 0 {
+			placement.Nodes = 1
+		}
+	}
+	return placement
+}
+
+// schedule places every spec on as many of nodes as it asks for. Whatever
+// already runs on a node that's still there and still fits stays put, so
+// only what has to move does. The rest goes to the least loaded nodes that
+// fit, spread over the values of the Spread label first.
+func schedule(specs map[string]*channel.Spec, nodes []Node, current map[string][]string) map[string][]string {
+	byName := make(map[string]Node)
+	for _, node := range nodes {
+		byName[node.Name] = node
+	}
+	var names []string
+	for name := range specs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	next := make(map[string][]string)
+	load := make(map[string]int)
+	for _, name := range names {
+		placement := placementOf(specs[name])
+		for _, nodeName := range current[name] {
+			node, alive := byName[nodeName]
+			if alive && fits(node, placement.Constraints) && len(next[name]) < placement.Nodes {
+				next[name] = append(next[name], nodeName)
+				load[nodeName]++
+			}
+		}
+	}
+	for _, name := range names {
+		placement := placementOf(specs[name])
+		for len(next[name]) < placement.Nodes {
+			best, ok := pick(nodes, next[name], placement, load)
+			if !ok {
+				break
+			}
+			next[name] = append(next[name], best.Name)
+			load[best.Name]++
+		}
+	}
+	return next
+}
+
+// pick is the best node for one more of placement, that isn't one of
+// chosen already.
+func pick(nodes []Node, chosen []string, placement channel.Placement, load map[string]int) (Node, bool) {
+	taken := make(map[string]bool)
+	spread := make(map[string]int)
+	for _, name := range chosen {
+		taken[name] = true
+	}
+	for _, node := range nodes {
+		if taken[node.Name] && placement.Spread != "" {
+			spread[node.Labels[placement.Spread]]++
+		}
+	}
+	var best Node
+	found := false
+	for _, node := range nodes {
+		if taken[node.Name] || !fits(node, placement.Constraints) {
+			continue
+		}
+		if !found || better(node, best, placement.Spread, spread, load) {
+			best = node
+			found = true
+		}
+	}
+	return best, found
+}
+
+// better is whether a beats b: fewer of the spec on its Spread value, then
+// less loaded, then first by name.
+func better(a Node, b Node, label string, spread map[string]int, load map[string]int) bool {
+	if label != "" {
+		if sa, sb := spread[a.Labels[label]], spread[b.Labels[label]]; sa != sb {
+			return sa < sb
+		}
+	}
+	if load[a.Name] != load[b.Name] {
+		return load[a.Name] < load[b.Name]
+	}
+	return a.Name < b.Name
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/brimstone/watchdock/api"
+	"github.com/brimstone/watchdock/broker"
+	"github.com/brimstone/watchdock/channel"
+	"github.com/brimstone/watchdock/config"
+	"github.com/brimstone/watchdock/dir"
+	"github.com/brimstone/watchdock/docker"
+	"github.com/brimstone/watchdock/plan"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+/* Commands other than running the daemon. They talk to the daemon's API when
+api.listen says where it is, and otherwise read and write the storage
+modules directly, which a running daemon picks up like any other change.
+Export, validate and plan never need the daemon.
+*/
+
+// stdout is where commands print what they have to say.
+var stdout io.Writer = os.Stdout
+
+// command is one thing watchdock can be told to do instead of running.
+type command struct {
+	usage string
+	help  string
+	// storage is whether it needs storage configured, and daemon whether
+	// it asks a running watchdock instead when api.listen is set
+	storage bool
+	daemon  bool
+	run     func(cfg *config.Config, args []string, asJSON bool) error
+}
+
+var commands = map[string]command{
+	"ls":        {"ls [--json]", "List every container, what it should run and what it does", true, true, list},
+	"status":    {"status [--json] <name>", "Show everything known about one container", true, true, status},
+	"apply":     {"apply -f <file>", "Create or replace the specs in a .json, .yaml or .yml file", true, true, apply},
+	"rm":        {"rm <name>...", "Delete specs, which removes their containers", true, true, remove},
+	"export":    {"export <container>", "Print the spec for an existing container", false, false, export},
+	"validate":  {"validate <dir or file>", "Check spec files without loading them", false, false, validate},
+	"reconcile": {"reconcile", "Have the daemon check on everything now", false, true, reconcile},
+	"plan":      {"plan [--json]", "Print what a reconcile would do, without doing it", true, false, planOnce},
+}
+
+// check is what's wrong with cfg for running c, given what loading it said.
+// Storage only has to be there when there's no daemon to ask.
+func (c command) check(cfg *config.Config, err error) error {
+	if err == config.ErrNoStorage && (!c.storage || c.daemon && cfg.API.Listen != "") {
+		return nil
+	}
+	return err
+}
+
+// usage lists the flags and the commands.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags] [command]\n\nWithout a command watchdock runs until it's stopped.\n\nCommands:\n", os.Args[0])
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\t%s\n", commands[name].usage, commands[name].help)
+	}
+	w.Flush()
+	fmt.Fprintln(out, "\nFlags:")
+	flag.PrintDefaults()
+}
+
+// daemon is the API of the running watchdock, if there's one to talk to.
+func daemon(cfg *config.Config) (*api.Client, error) {
+	if cfg.API.Listen == "" {
+		return nil, nil
+	}
+	return api.NewClient(cfg.API.Listen)
+}
+
+// jsonFlag parses args for a command that can print JSON, which it does
+// when told to either before or after its name.
+func jsonFlag(name string, args []string, asJSON bool) ([]string, bool) {
+	commandFlags := flag.NewFlagSet(name, flag.ExitOnError)
+	commandJSON := commandFlags.Bool("json", asJSON, "Print JSON")
+	commandFlags.Parse(args)
+	return commandFlags.Args(), *commandJSON
+}
+
+func printJSON(v interface{}) error {
+	raw, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, string(raw))
+	return nil
+}
+
+// containers is what the daemon knows about every container, or what
+// storage and docker say when there's no daemon to ask.
+func containers(cfg *config.Config) ([]*api.Container, error) {
+	client, err := daemon(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if client != nil {
+		return client.List()
+	}
+	storageModule, err := readStorage(cfg)
+	if err != nil {
+		return nil, err
+	}
+	specs, err := storageModule.Specs()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].Name < specs[j].Name })
+	// docker being down doesn't keep us from listing specs
+	processingModule, dockerErr := newProcessing(cfg)
+	if dockerErr != nil {
+		fmt.Fprintln(os.Stderr, dockerErr.Error())
+	}
+	list := []*api.Container{}
+	for _, spec := range specs {
+		for _, c := range api.ContainersOf(spec) {
+			if dockerErr == nil && c.Error == "" {
+				have, err := processingModule.Inspect(c.Name)
+				if err != nil {
+					c.Error = err.Error()
+				} else {
+					c.Actual = api.ActualOf(have)
+				}
+			}
+			list = append(list, c)
+		}
+	}
+	return list, nil
+}
+
+func list(cfg *config.Config, args []string, asJSON bool) error {
+	_, asJSON = jsonFlag("ls", args, asJSON)
+	all, err := containers(cfg)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		return printJSON(all)
+	}
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tIMAGE\tDOCKER\tMESSAGE")
+	for _, c := range all {
+		image, state, message := "", "", ""
+		if c.Desired != nil && c.Desired.Config != nil {
+			image = c.Desired.Config.Image
+		}
+		if c.Actual != nil {
+			state = c.Actual.Status
+		} else {
+			state = c.Error
+		}
+		if c.Status != nil {
+			message = c.Status.Message
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", c.Name, image, state, message)
+	}
+	return w.Flush()
+}
+
+func status(cfg *config.Config, args []string, asJSON bool) error {
+	args, asJSON = jsonFlag("status", args, asJSON)
+	if len(args) != 1 {
+		return fmt.Errorf("status needs the name of one container")
+	}
+	name := channel.CleanName(args[0])
+	all, err := containers(cfg)
+	if err != nil {
+		return err
+	}
+	var found *api.Container
+	var replicas []string
+	for _, c := range all {
+		if c.Name == name {
+			found = c
+		}
+		if c.Desired != nil && c.Desired.Config != nil && c.Desired.Config.Labels[channel.ReplicaOfLabel] == name {
+			replicas = append(replicas, c.Name)
+		}
+	}
+	if found == nil && len(replicas) > 0 {
+		return fmt.Errorf("%s runs as %s, ask about one of those", name, strings.Join(replicas, ", "))
+	}
+	if found == nil {
+		return fmt.Errorf("%s: not found", name)
+	}
+	if asJSON {
+		return printJSON(found)
+	}
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Name:\t%s\n", found.Name)
+	if found.Desired != nil && found.Desired.Config != nil {
+		fmt.Fprintf(w, "Image:\t%s\n", found.Desired.Config.Image)
+	}
+	if actual := found.Actual; actual != nil {
+		fmt.Fprintf(w, "Running:\t%s\n", actual.Image)
+		fmt.Fprintf(w, "Docker:\t%s\n", actual.Status)
+		fmt.Fprintf(w, "ID:\t%.12s\n", actual.ID)
+	}
+	if found.Error != "" {
+		fmt.Fprintf(w, "Docker:\t%s\n", found.Error)
+	}
+	if state := found.Status; state != nil {
+		for _, field := range [][2]string{
+			{"Message", state.Message},
+			{"Health", state.Health},
+			{"Digest", state.Digest},
+			{"Host", state.Host},
+			{"Node", state.Node},
+		} {
+			if field[1] != "" {
+				fmt.Fprintf(w, "%s:\t%s\n", field[0], field[1])
+			}
+		}
+		if state.Restarts > 0 {
+			fmt.Fprintf(w, "Restarts:\t%d\n", state.Restarts)
+		}
+		if state.CrashLoop {
+			fmt.Fprintf(w, "Crash looping:\tyes\n")
+		}
+	}
+	return w.Flush()
+}
+
+// target is where apply and rm send changes: the daemon, or without one
+// every storage module that can write by itself.
+type target struct {
+	client  *api.Client
+	storage *broker.Broker
+}
+
+func newTarget(cfg *config.Config) (*target, error) {
+	client, err := daemon(cfg)
+	if err != nil || client != nil {
+		return &target{client: client}, err
+	}
+	storageModule, err := newStorage(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &target{storage: storageModule}, nil
+}
+
+func (target *target) write(event channel.Event) error {
+	if target.client != nil {
+		if event.Kind == channel.Delete {
+			return target.client.Remove(event.Name)
+		}
+		return target.client.Apply(event.Spec)
+	}
+	if event.Kind == channel.Delete {
+		specs, err := target.storage.Specs()
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, spec := range specs {
+			found = found || spec.Name == event.Name
+		}
+		if !found {
+			return fmt.Errorf("%s: not found", event.Name)
+		}
+	}
+	return target.storage.Write(event)
+}
+
+func apply(cfg *config.Config, args []string, asJSON bool) error {
+	applyFlags := flag.NewFlagSet("apply", flag.ExitOnError)
+	filename := applyFlags.String("f", "", "A .json, .yaml or .yml file of specs")
+	applyFlags.Parse(args)
+	if *filename == "" {
+		return fmt.Errorf("apply needs a file, given with -f")
+	}
+	specs, err := dir.ReadFile(*filename, cfg.Docker.Selector)
+	if err != nil {
+		return fmt.Errorf("%s: %s", *filename, err.Error())
+	}
+	target, err := newTarget(cfg)
+	if err != nil {
+		return err
+	}
+	for _, spec := range specs {
+		err = target.write(channel.NewUpsert(spec))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, "Applied", spec.Name)
+	}
+	return nil
+}
+
+func remove(cfg *config.Config, args []string, asJSON bool) error {
+	if len(args) == 0 {
+		return fmt.Errorf("rm needs the name of a container")
+	}
+	target, err := newTarget(cfg)
+	if err != nil {
+		return err
+	}
+	for _, name := range args {
+		name = channel.CleanName(name)
+		err = target.write(channel.NewDelete(name))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, "Removed", name)
+	}
+	return nil
+}
+
+func export(cfg *config.Config, args []string, asJSON bool) error {
+	if len(args) != 1 {
+		return fmt.Errorf("export needs the name of one container")
+	}
+	processingModule, err := newProcessing(cfg)
+	if err != nil {
+		return err
+	}
+	spec, err := processingModule.Export(args[0])
+	if err != nil {
+		return fmt.Errorf("%s: %s", args[0], err.Error())
+	}
+	raw, err := spec.Encode()
+	if err != nil {
+		return err
+	}
+	_, err = stdout.Write(raw)
+	return err
+}
+
+func validate(cfg *config.Config, args []string, asJSON bool) error {
+	if len(args) != 1 {
+		return fmt.Errorf("validate needs a directory or a file")
+	}
+	filenames := []string{args[0]}
+	info, err := os.Stat(args[0])
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		files, err := ioutil.ReadDir(args[0])
+		if err != nil {
+			return err
+		}
+		filenames = nil
+		for _, file := range files {
+			switch filepath.Ext(file.Name()) {
+			case ".json", ".yaml", ".yml":
+				filenames = append(filenames, filepath.Join(args[0], file.Name()))
+			}
+		}
+	}
+
+	// the first file to have a container wins, like in the dir module
+	owner := make(map[string]string)
+	bad := 0
+	for _, filename := range filenames {
+		// only the names matter here
+		specs, err := dir.ReadFile(filename, "")
+		if err != nil {
+			bad++
+			fmt.Fprintf(stdout, "%s: %s\n", filename, err.Error())
+			continue
+		}
+		var names []string
+		var problems []string
+		for _, spec := range specs {
+			if first, ok := owner[spec.Name]; ok {
+				problems = append(problems, fmt.Sprintf("%s is already in %s", spec.Name, first))
+				continue
+			}
+			owner[spec.Name] = filename
+			names = append(names, spec.Name)
+		}
+		if len(problems) > 0 {
+			bad++
+			fmt.Fprintf(stdout, "%s: %s\n", filename, strings.Join(problems, ", "))
+			continue
+		}
+		fmt.Fprintf(stdout, "%s: ok, %s\n", filename, strings.Join(names, ", "))
+	}
+	if bad > 0 {
+		return fmt.Errorf("%d of %d files have problems", bad, len(filenames))
+	}
+	return nil
+}
+
+func reconcile(cfg *config.Config, args []string, asJSON bool) error {
+	client, err := daemon(cfg)
+	if err != nil {
+		return err
+	}
+	if client == nil {
+		return fmt.Errorf("reconcile needs a running watchdock, set api.listen to reach it")
+	}
+	err = client.Reconcile()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, "Reconciling")
+	return nil
+}
+
+// planOnce prints what a reconcile would do about what storage has right
+// now.
+func planOnce(cfg *config.Config, args []string, asJSON bool) error {
+	_, asJSON = jsonFlag("plan", args, asJSON)
+	storageModule, err := readStorage(cfg)
+	if err != nil {
+		return err
+	}
+	specs, err := storageModule.Specs()
+	if err != nil {
+		return fmt.Errorf("Error reading storage: %s", err.Error())
+	}
+	processingModule, err := newProcessing(cfg)
+	if err != nil {
+		return err
+	}
+	var planner docker.Planner = processingModule
+	if cfg.Cluster != nil {
+		planner, err = newCluster(cfg, processingModule)
+		if err != nil {
+			return fmt.Errorf("Error loading cluster: %s", err.Error())
+		}
+	}
+	actions, err := planner.Plan(specs, nil)
+	if err != nil {
+		return fmt.Errorf("Error planning: %s", err.Error())
+	}
+	return plan.Print(stdout, actions, asJSON)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/brimstone/watchdock/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// runCommand runs the command called name and returns what it printed.
+func runCommand(cfg *config.Config, name string, args ...string) (string, error) {
+	var out bytes.Buffer
+	stdout = &out
+	defer func() { stdout = os.Stdout }()
+	err := commands[name].run(cfg, args, false)
+	return out.String(), err
+}
+
+func write(t *testing.T, filename string, contents string) string {
+	err := ioutil.WriteFile(filename, []byte(contents), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestValidate(t *testing.T) {
+	specs := t.TempDir()
+	a := write(t, filepath.Join(specs, "a.yaml"), "Name: web\nConfig:\n  Image: nginx\n")
+	bad := write(t, filepath.Join(specs, "bad.json"), `{"Name": "broken"}`)
+	stack := write(t, filepath.Join(specs, "stack.yml"), "services:\n  web:\n    image: nginx\n  db:\n    image: postgres\n")
+	write(t, filepath.Join(specs, "notes.txt"), "not a spec")
+
+	var tests = []struct {
+		args []string
+		out  string
+		err  string
+	}{
+		{[]string{a}, a + ": ok, web\n", ""},
+		{[]string{stack}, stack + ": ok, db, web\n", ""},
+		// web is in both, the first file has it
+		{[]string{specs}, a + ": ok, web\n" +
+			bad + ": spec broken has no Config\n" +
+			stack + ": web is already in " + a + "\n",
+			"2 of 3 files have problems"},
+		{[]string{filepath.Join(specs, "missing.yaml")}, "", "stat " + filepath.Join(specs, "missing.yaml") + ": no such file or directory"},
+		{nil, "", "validate needs a directory or a file"},
+	}
+	for i, c := range tests {
+		out, err := runCommand(nil, "validate", c.args...)
+		if out != c.out {
+			t.Errorf("%d: printed\n%s\nwant\n%s", i, out, c.out)
+		}
+		if (err == nil) != (c.err == "") || (err != nil && err.Error() != c.err) {
+			t.Errorf("%d: err == %v, want %q", i, err, c.err)
+		}
+	}
+}
+
+// TestApplyRemove applies and removes specs with only the dir module
+// configured and no daemon to talk to.
+func TestApplyRemove(t *testing.T) {
+	storage := t.TempDir()
+	cfg := &config.Config{Storage: config.Storage{Dir: &config.Dir{Path: storage}}}
+	owned := write(t, filepath.Join(storage, "app.yaml"), "Name: app\nConfig:\n  Image: nginx\n")
+	files := t.TempDir()
+	web := write(t, filepath.Join(files, "web.yaml"), "Name: web\nConfig:\n  Image: nginx\n")
+	app := write(t, filepath.Join(files, "app.json"), `{"Name": "app", "Config": {"Image": "httpd"}}`)
+
+	var tests = []struct {
+		command string
+		args    []string
+		out     string
+		err     string
+	}{
+		{"apply", []string{"-f", web}, "Applied web\n", ""},
+		// app belongs to a file someone wrote
+		{"apply", []string{"-f", app}, "", "dir: not touching app, it's managed in " + owned},
+		{"apply", nil, "", "apply needs a file, given with -f"},
+		{"apply", []string{"-f", filepath.Join(files, "missing.yaml")}, "", filepath.Join(files, "missing.yaml") + ": open " + filepath.Join(files, "missing.yaml") + ": no such file or directory"},
+		{"rm", []string{"web"}, "Removed web\n", ""},
+		{"rm", []string{"web"}, "", "web: not found"},
+		{"rm", []string{"/nothing"}, "", "nothing: not found"},
+		{"rm", []string{"app"}, "", "dir: not touching app, it's managed in " + owned},
+		{"rm", nil, "", "rm needs the name of a container"},
+	}
+	for i, c := range tests {
+		out, err := runCommand(cfg, c.command, c.args...)
+		if out != c.out {
+			t.Errorf("%d: %s printed %q, want %q", i, c.command, out, c.out)
+		}
+		if (err == nil) != (c.err == "") || (err != nil && err.Error() != c.err) {
+			t.Errorf("%d: %s err == %v, want %q", i, c.command, err, c.err)
+		}
+		if i == 0 {
+			if _, err := os.Stat(filepath.Join(storage, "web.json")); err != nil {
+				t.Error("Expected web.json written:", err)
+			}
+		}
+	}
+	if _, err := os.Stat(filepath.Join(storage, "web.json")); !os.IsNotExist(err) {
+		t.Error("Expected web.json removed")
+	}
+	if raw, _ := ioutil.ReadFile(owned); string(raw) != "Name: app\nConfig:\n  Image: nginx\n" {
+		t.Errorf("app.yaml shouldn't have changed, got %s", raw)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	offline := &config.Config{}
+	online := &config.Config{API: config.API{Listen: "unix:///run/watchdock.sock"}}
+	var tests = []struct {
+		command string
+		cfg     *config.Config
+		err     error
+		ok      bool
+	}{
+		{"ls", offline, config.ErrNoStorage, false},
+		{"ls", online, config.ErrNoStorage, true},
+		{"apply", online, config.ErrNoStorage, true},
+		{"rm", offline, config.ErrNoStorage, false},
+		// plan reads storage itself, whatever the daemon says
+		{"plan", online, config.ErrNoStorage, false},
+		{"validate", offline, config.ErrNoStorage, true},
+		{"ls", online, errors.New("docker.host: missing"), false},
+		{"ls", offline, nil, true},
+	}
+	for _, c := range tests {
+		err := commands[c.command].check(c.cfg, c.err)
+		if (err == nil) != c.ok {
+			t.Errorf("%s with api.listen %q and %v: check() == %v", c.command, c.cfg.API.Listen, c.err, err)
+		}
+	}
+}
+
+// TestReadOnly lists without a spec directory, which mustn't make one.
+func TestReadOnly(t *testing.T) {
+	storage := filepath.Join(t.TempDir(), "specs")
+	cfg := &config.Config{Storage: config.Storage{Dir: &config.Dir{Path: storage}}}
+	for _, name := range []string{"ls", "plan"} {
+		if _, err := runCommand(cfg, name); err == nil {
+			t.Errorf("Expected %s to fail without %s", name, storage)
+		}
+		if _, err := os.Stat(storage); !os.IsNotExist(err) {
+			t.Fatalf("%s shouldn't have created %s", name, storage)
+		}
+	}
+}
@@ -0,0 +1,527 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is everything about how watchdock itself runs. It's read from a
+// YAML (or JSON) file like
+//
+//	docker:
+//	  host: unix:///var/run/docker.sock
+//	  tls:
+//	    cert_path: /etc/watchdock/certs
+//	    verify: true
+//	  selector: WATCHDOCK
+//	  reconcile_interval: 10s
+//	  cleanup:
+//	    untagged_images: true
+//	  hosts:
+//	    - name: edge1
+//	      host: tcp://edge1:2376
+//	      tls:
+//	        cert_path: /etc/watchdock/edge1
+//	        verify: true
+//	      labels:
+//	        region: eu
+//	storage:
+//	  dir:
+//	    path: /containers
+//	    debounce: 1s
+//	  consul:
+//	    address: localhost:8500/watchdock
+//	api:
+//	  listen: 127.0.0.1:8080
+//	metrics:
+//	  listen: 0.0.0.0:9090
+//	registry_logins: /etc/watchdock/logins.yaml
+//	cluster:
+//	  node: edge1
+//	  labels:
+//	    zone: a
+//	  consul: localhost:8500/watchdock-cluster
+//	  heartbeat: 5s
+//	  grace: 30s
+//	log:
+//	  file: /var/log/watchdock.log
+//	  timestamps: true
+//
+// on top of DOCKER_HOST, DOCKER_CERT_PATH and DOCKER_TLS_VERIFY, the way the
+// docker CLI reads them, and then overridden by the environment variables in
+// Overrides.
+type Config struct {
+	Docker         Docker
+	Storage        Storage
+	API            API `yaml:"api"`
+	Metrics        Metrics
+	RegistryLogins string `yaml:"registry_logins"`
+	// Cluster turns on cluster mode
+	Cluster *Cluster
+	Log     Log
+}
+
+type Docker struct {
+	// Host is a unix://, tcp://, http:// or https:// docker endpoint
+	Host string
+	TLS  TLS `yaml:"tls"`
+	// Selector is the environment variable a container needs to have to
+	// be managed, as NAME or NAME=value
+	Selector string
+	// ReconcileInterval is how often everything is checked on
+	ReconcileInterval string `yaml:"reconcile_interval"`
+	Cleanup           Cleanup
+	// Hosts is every docker host to manage, when there's more than the one
+	// in Host and TLS, which are ignored then
+	Hosts []Host
+}
+
+type Host struct {
+	// Name is what specs call the host by
+	Name string
+	Host string
+	TLS  TLS `yaml:"tls"`
+	// Labels are what specs' HostLabels pick hosts by
+	Labels map[string]string
+}
+
+type TLS struct {
+	// CertPath holds ca.pem, cert.pem and key.pem, the way the docker CLI
+	// expects them
+	CertPath string `yaml:"cert_path"`
+	// Verify checks the daemon's certificate against ca.pem
+	Verify bool
+}
+
+type Cleanup struct {
+	// UntaggedImages removes images left without a tag, on by default
+	UntaggedImages *bool `yaml:"untagged_images"`
+}
+
+type Storage struct {
+	Dir    *Dir
+	Consul *Consul
+}
+
+type Dir struct {
+	Path string
+	// Debounce is how long changes to a file are ignored for after it's
+	// read or written
+	Debounce string
+}
+
+type Consul struct {
+	// Address is host:port[/prefix]
+	Address string
+}
+
+type API struct {
+	// Listen is host:port, or unix:///path for a unix socket
+	Listen string
+}
+
+type Metrics struct {
+	// Listen is host:port to serve /metrics on for prometheus, whether the
+	// API is served or not
+	Listen string
+}
+
+type Cluster struct {
+	// Node is this watchdock's name in the cluster, the hostname when empty
+	Node   string
+	Labels map[string]string
+	// Dir or Consul is where the nodes meet: a directory they all share,
+	// or host:port[/prefix]. Neither can be where specs are stored.
+	Dir    string
+	Consul string
+	// Heartbeat is how often every node checks in, 5s when empty. Grace is
+	// how long one can go without before what it runs is placed elsewhere,
+	// 30s when empty.
+	Heartbeat string
+	Grace     string
+}
+
+type Log struct {
+	// File is where logs go, standard error when empty
+	File string
+	// Timestamps starts every line with the date and time, on by default
+	Timestamps *bool
+}
+
+// Defaults is the configuration without a file or any overrides.
+func Defaults() *Config {
+	return &Config{
+		Docker: Docker{
+			Host:              "unix:///var/run/docker.sock",
+			Selector:          "WATCHDOCK",
+			ReconcileInterval: "10s",
+		},
+	}
+}
+
+// Load reads filename over the defaults and whatever DOCKER_HOST,
+// DOCKER_CERT_PATH and DOCKER_TLS_VERIFY say, then applies the environment.
+// Without a filename it's just the defaults and the environment. The
+// result still has to be validated.
+func Load(filename string) (*Config, error) {
+	config := Defaults()
+	config.dockerEnvironment(os.LookupEnv)
+	if filename != "" {
+		raw, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		err = yaml.UnmarshalStrict(raw, config)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", filename, err.Error())
+		}
+	}
+	err := config.override(os.LookupEnv)
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// dockerEnvironment points docker wherever the docker CLI would go.
+func (config *Config) dockerEnvironment(lookup func(string) (string, bool)) {
+	if host, _ := lookup("DOCKER_HOST"); host != "" {
+		config.Docker.Host = host
+	}
+	// the CLI ignores the TLS settings for a socket too
+	if strings.HasPrefix(config.Docker.Host, "unix://") {
+		return
+	}
+	certPath, _ := lookup("DOCKER_CERT_PATH")
+	if verify, _ := lookup("DOCKER_TLS_VERIFY"); verify != "" {
+		config.Docker.TLS.Verify = true
+		if certPath == "" {
+			home, _ := lookup("HOME")
+			certPath = filepath.Join(home, ".docker")
+		}
+	}
+	config.Docker.TLS.CertPath = certPath
+}
+
+// Overrides lists the environment variables that win over the file.
+var Overrides = []string{
+	"WATCHDOCK_DOCKER_HOST",
+	"WATCHDOCK_DOCKER_CERT_PATH",
+	"WATCHDOCK_DOCKER_TLS_VERIFY",
+	"WATCHDOCK_SELECTOR",
+	"WATCHDOCK_RECONCILE_INTERVAL",
+	"WATCHDOCK_CLEANUP_UNTAGGED_IMAGES",
+	"WATCHDOCK_DIR",
+	"WATCHDOCK_DIR_DEBOUNCE",
+	"WATCHDOCK_CONSUL",
+	"WATCHDOCK_LISTEN",
+	"WATCHDOCK_METRICS_LISTEN",
+	"WATCHDOCK_REGISTRY_LOGINS",
+	"WATCHDOCK_CLUSTER_NODE",
+	"WATCHDOCK_CLUSTER_DIR",
+	"WATCHDOCK_CLUSTER_CONSUL",
+	"WATCHDOCK_LOG_FILE",
+	"WATCHDOCK_LOG_TIMESTAMPS",
+}
+
+// override applies every variable lookup finds.
+func (config *Config) override(lookup func(string) (string, bool)) error {
+	for _, name := range Overrides {
+		value, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		err := config.set(name, value)
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err.Error())
+		}
+	}
+	return nil
+}
+
+func (config *Config) set(name string, value string) error {
+	switch name {
+	case "WATCHDOCK_DOCKER_HOST":
+		config.Docker.Host = value
+	case "WATCHDOCK_DOCKER_CERT_PATH":
+		config.Docker.TLS.CertPath = value
+	case "WATCHDOCK_DOCKER_TLS_VERIFY":
+		return setBool(&config.Docker.TLS.Verify, value)
+	case "WATCHDOCK_SELECTOR":
+		config.Docker.Selector = value
+	case "WATCHDOCK_RECONCILE_INTERVAL":
+		config.Docker.ReconcileInterval = value
+	case "WATCHDOCK_CLEANUP_UNTAGGED_IMAGES":
+		config.Docker.Cleanup.UntaggedImages = new(bool)
+		return setBool(config.Docker.Cleanup.UntaggedImages, value)
+	case "WATCHDOCK_DIR":
+		config.dir().Path = value
+	case "WATCHDOCK_DIR_DEBOUNCE":
+		config.dir().Debounce = value
+	case "WATCHDOCK_CONSUL":
+		if config.Storage.Consul == nil {
+			config.Storage.Consul = new(Consul)
+		}
+		config.Storage.Consul.Address = value
+	case "WATCHDOCK_LISTEN":
+		config.API.Listen = value
+	case "WATCHDOCK_METRICS_LISTEN":
+		config.Metrics.Listen = value
+	case "WATCHDOCK_REGISTRY_LOGINS":
+		config.RegistryLogins = value
+	case "WATCHDOCK_CLUSTER_NODE":
+		config.cluster().Node = value
+	case "WATCHDOCK_CLUSTER_DIR":
+		config.cluster().Dir = value
+	case "WATCHDOCK_CLUSTER_CONSUL":
+		config.cluster().Consul = value
+	case "WATCHDOCK_LOG_FILE":
+		config.Log.File = value
+	case "WATCHDOCK_LOG_TIMESTAMPS":
+		config.Log.Timestamps = new(bool)
+		return setBool(config.Log.Timestamps, value)
+	}
+	return nil
+}
+
+func setBool(b *bool, value string) error {
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("%q isn't true or false", value)
+	}
+	*b = parsed
+	return nil
+}
+
+// dir is the dir storage module's settings, made if there are none yet.
+func (config *Config) dir() *Dir {
+	if config.Storage.Dir == nil {
+		config.Storage.Dir = new(Dir)
+	}
+	return config.Storage.Dir
+}
+
+func (config *Config) cluster() *Cluster {
+	if config.Cluster == nil {
+		config.Cluster = new(Cluster)
+	}
+	return config.Cluster
+}
+
+// SetDir and the setters after it are for command line flags, which win
+// over everything else.
+func (config *Config) SetDir(path string) {
+	config.dir().Path = path
+}
+
+func (config *Config) SetConsul(address string) {
+	config.Storage.Consul = &Consul{Address: address}
+}
+
+// ErrNoStorage is the only thing wrong with a config that would be fine for
+// something that doesn't need storage.
+var ErrNoStorage = errors.New("no storage module configured, storage.dir or storage.consul is needed")
+
+// Validate makes sure everything is there and makes sense, and says
+// exactly where it doesn't. Missing storage is checked last.
+func (config *Config) Validate() error {
+	docker := config.Docker
+	if len(docker.Hosts) == 0 {
+		if err := checkEndpoint("docker", docker.Host, docker.TLS); err != nil {
+			return err
+		}
+	}
+	names := make(map[string]bool)
+	for i, host := range docker.Hosts {
+		if host.Name == "" {
+			return fmt.Errorf("docker.hosts[%d].name is empty", i)
+		}
+		if names[host.Name] {
+			return fmt.Errorf("docker.hosts has %s more than once", host.Name)
+		}
+		names[host.Name] = true
+		if err := checkEndpoint("docker.hosts["+host.Name+"]", host.Host, host.TLS); err != nil {
+			return err
+		}
+	}
+	if name := strings.SplitN(docker.Selector, "=", 2)[0]; name == "" || strings.ContainsAny(name, " \t") {
+		return fmt.Errorf("docker.selector %q isn't an environment variable name", docker.Selector)
+	}
+	if err := checkDuration("docker.reconcile_interval", docker.ReconcileInterval); err != nil {
+		return err
+	}
+	if dir := config.Storage.Dir; dir != nil {
+		if dir.Path == "" {
+			return fmt.Errorf("storage.dir.path is empty")
+		}
+		if dir.Debounce != "" {
+			if err := checkDuration("storage.dir.debounce", dir.Debounce); err != nil {
+				return err
+			}
+		}
+	}
+	if consul := config.Storage.Consul; consul != nil && consul.Address == "" {
+		return fmt.Errorf("storage.consul.address is empty")
+	}
+	if socket := strings.TrimPrefix(config.API.Listen, "unix://"); socket != config.API.Listen {
+		if socket == "" {
+			return fmt.Errorf("api.listen: unix:// needs a path")
+		}
+	} else if config.API.Listen != "" {
+		if _, _, err := net.SplitHostPort(config.API.Listen); err != nil {
+			return fmt.Errorf("api.listen: %s", err.Error())
+		}
+	}
+	if config.Metrics.Listen != "" {
+		if _, _, err := net.SplitHostPort(config.Metrics.Listen); err != nil {
+			return fmt.Errorf("metrics.listen: %s", err.Error())
+		}
+	}
+	if config.RegistryLogins != "" {
+		if _, err := os.Stat(config.RegistryLogins); err != nil {
+			return fmt.Errorf("registry_logins: %s", err.Error())
+		}
+	}
+	if config.Cluster != nil {
+		if err := config.validateCluster(); err != nil {
+			return err
+		}
+	}
+	if config.Storage.Dir == nil && config.Storage.Consul == nil {
+		return ErrNoStorage
+	}
+	return nil
+}
+
+func (config *Config) validateCluster() error {
+	cluster := config.Cluster
+	if (cluster.Dir == "") == (cluster.Consul == "") {
+		return fmt.Errorf("cluster needs one of cluster.dir or cluster.consul")
+	}
+	if dir := config.Storage.Dir; dir != nil && cluster.Dir != "" && filepath.Clean(dir.Path) == filepath.Clean(cluster.Dir) {
+		return fmt.Errorf("cluster.dir can't be storage.dir.path too")
+	}
+	if consul := config.Storage.Consul; consul != nil && cluster.Consul != "" && consul.Address == cluster.Consul {
+		return fmt.Errorf("cluster.consul can't be storage.consul.address too")
+	}
+	for name, value := range map[string]string{"cluster.heartbeat": cluster.Heartbeat, "cluster.grace": cluster.Grace} {
+		if value == "" {
+			continue
+		}
+		if err := checkDuration(name, value); err != nil {
+			return err
+		}
+	}
+	if config.ClusterGrace() < 2*config.ClusterHeartbeat() {
+		return fmt.Errorf("cluster.grace %s has to be at least twice cluster.heartbeat %s", config.ClusterGrace(), config.ClusterHeartbeat())
+	}
+	// consul won't take a session TTL under that
+	if cluster.Consul != "" && config.ClusterGrace() < 10*time.Second {
+		return fmt.Errorf("cluster.grace %s has to be at least 10s with consul", config.ClusterGrace())
+	}
+	if _, err := config.ClusterNode(); err != nil {
+		return fmt.Errorf("cluster.node is empty and there's no hostname: %s", err.Error())
+	}
+	return nil
+}
+
+// checkEndpoint makes sure host and tls are something docker can be
+// reached with, what is where they are in the file.
+func checkEndpoint(what string, host string, tls TLS) error {
+	if host == "" {
+		return fmt.Errorf("%s.host is empty", what)
+	}
+	switch {
+	case strings.HasPrefix(host, "unix://"),
+		strings.HasPrefix(host, "tcp://"),
+		strings.HasPrefix(host, "http://"),
+		strings.HasPrefix(host, "https://"):
+	default:
+		return fmt.Errorf("%s.host %q has to start with unix://, tcp://, http:// or https://", what, host)
+	}
+	if tls.CertPath != "" {
+		for _, file := range []string{"ca.pem", "cert.pem", "key.pem"} {
+			if _, err := os.Stat(filepath.Join(tls.CertPath, file)); err != nil {
+				return fmt.Errorf("%s.tls.cert_path: %s", what, err.Error())
+			}
+		}
+		if strings.HasPrefix(host, "unix://") {
+			return fmt.Errorf("%s.tls.cert_path is set, but %s.host %s isn't over the network", what, what, host)
+		}
+	} else if tls.Verify {
+		return fmt.Errorf("%s.tls.verify needs %s.tls.cert_path", what, what)
+	}
+	return nil
+}
+
+func checkDuration(name string, value string) error {
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return fmt.Errorf("%s %q isn't a duration like 10s or 5m", name, value)
+	}
+	return nil
+}
+
+// ReconcileInterval and the rest are the settings with defaults filled
+// in, for a validated config.
+func (config *Config) ReconcileInterval() time.Duration {
+	interval, _ := time.ParseDuration(config.Docker.ReconcileInterval)
+	return interval
+}
+
+// DockerHosts is every host to manage, just the one in docker.host when
+// docker.hosts is empty. It's called local then.
+func (config *Config) DockerHosts() []Host {
+	if len(config.Docker.Hosts) > 0 {
+		return config.Docker.Hosts
+	}
+	return []Host{{Name: "local", Host: config.Docker.Host, TLS: config.Docker.TLS}}
+}
+
+// ClusterNode is what this node is called, its hostname unless
+// cluster.node says otherwise.
+func (config *Config) ClusterNode() (string, error) {
+	if config.Cluster.Node != "" {
+		return config.Cluster.Node, nil
+	}
+	return os.Hostname()
+}
+
+func (config *Config) ClusterHeartbeat() time.Duration {
+	return durationOr(config.Cluster.Heartbeat, 5*time.Second)
+}
+
+func (config *Config) ClusterGrace() time.Duration {
+	return durationOr(config.Cluster.Grace, 30*time.Second)
+}
+
+func durationOr(value string, fallback time.Duration) time.Duration {
+	if duration, err := time.ParseDuration(value); err == nil {
+		return duration
+	}
+	return fallback
+}
+
+func (config *Config) DirDebounce() time.Duration {
+	if config.Storage.Dir == nil || config.Storage.Dir.Debounce == "" {
+		return time.Second
+	}
+	debounce, _ := time.ParseDuration(config.Storage.Dir.Debounce)
+	return debounce
+}
+
+func (config *Config) CleanUntaggedImages() bool {
+	return config.Docker.Cleanup.UntaggedImages == nil || *config.Docker.Cleanup.UntaggedImages
+}
+
+func (config *Config) LogTimestamps() bool {
+	return config.Log.Timestamps == nil || *config.Log.Timestamps
+}
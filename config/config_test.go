@@ -0,0 +1,163 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "watchdock.yaml")
+	ioutil.WriteFile(filename, []byte(`
+docker:
+  host: tcp://docker.example.com:2376
+  reconcile_interval: 30s
+  cleanup:
+    untagged_images: false
+storage:
+  dir:
+    path: /containers
+api:
+  listen: 127.0.0.1:8080
+`), 0644)
+	t.Setenv("WATCHDOCK_RECONCILE_INTERVAL", "1m")
+	t.Setenv("WATCHDOCK_DIR_DEBOUNCE", "2s")
+	t.Setenv("WATCHDOCK_LOG_TIMESTAMPS", "false")
+
+	config, err := Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = config.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Docker.Host != "tcp://docker.example.com:2376" || config.Docker.Selector != "WATCHDOCK" {
+		t.Errorf("Docker == %+v", config.Docker)
+	}
+	if config.ReconcileInterval() != time.Minute {
+		t.Errorf("the environment should win, got %s", config.ReconcileInterval())
+	}
+	if config.Storage.Dir.Path != "/containers" || config.DirDebounce() != 2*time.Second {
+		t.Errorf("Storage.Dir == %+v", config.Storage.Dir)
+	}
+	if config.CleanUntaggedImages() || config.LogTimestamps() {
+		t.Error("cleanup and timestamps should both be off")
+	}
+	if config.API.Listen != "127.0.0.1:8080" {
+		t.Errorf("API == %+v", config.API)
+	}
+
+	// anything the file doesn't know about is a mistake
+	ioutil.WriteFile(filename, []byte("docker:\n  reconcile: 5s\n"), 0644)
+	_, err = Load(filename)
+	if err == nil {
+		t.Error("Expected an unknown key to fail")
+	}
+	t.Setenv("WATCHDOCK_LOG_TIMESTAMPS", "sometimes")
+	_, err = Load("")
+	if err == nil || err.Error() != `WATCHDOCK_LOG_TIMESTAMPS: "sometimes" isn't true or false` {
+		t.Errorf("Load error == %v", err)
+	}
+}
+
+func TestDockerEnvironment(t *testing.T) {
+	var tests = []struct {
+		env      map[string]string
+		host     string
+		certPath string
+		verify   bool
+	}{
+		{map[string]string{}, "unix:///var/run/docker.sock", "", false},
+		{map[string]string{"DOCKER_HOST": "tcp://docker:2375"}, "tcp://docker:2375", "", false},
+		{map[string]string{"DOCKER_HOST": "tcp://docker:2376", "DOCKER_CERT_PATH": "/certs"}, "tcp://docker:2376", "/certs", false},
+		{map[string]string{"DOCKER_HOST": "tcp://docker:2376", "DOCKER_TLS_VERIFY": "1", "HOME": "/home/ops"}, "tcp://docker:2376", "/home/ops/.docker", true},
+		{map[string]string{"DOCKER_HOST": "tcp://docker:2376", "DOCKER_TLS_VERIFY": "1", "DOCKER_CERT_PATH": "/certs"}, "tcp://docker:2376", "/certs", true},
+		// a socket doesn't do TLS
+		{map[string]string{"DOCKER_CERT_PATH": "/certs", "DOCKER_TLS_VERIFY": "1"}, "unix:///var/run/docker.sock", "", false},
+	}
+	for _, c := range tests {
+		config := Defaults()
+		config.dockerEnvironment(func(name string) (string, bool) {
+			value, ok := c.env[name]
+			return value, ok
+		})
+		if config.Docker.Host != c.host || config.Docker.TLS.CertPath != c.certPath || config.Docker.TLS.Verify != c.verify {
+			t.Errorf("%v gave %+v", c.env, config.Docker)
+		}
+	}
+
+	// the file wins over DOCKER_HOST
+	t.Setenv("DOCKER_HOST", "tcp://docker:2375")
+	filename := filepath.Join(t.TempDir(), "watchdock.yaml")
+	ioutil.WriteFile(filename, []byte("docker:\n  host: tcp://other:2375\n"), 0644)
+	config, err := Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Docker.Host != "tcp://other:2375" {
+		t.Errorf("docker.host == %s", config.Docker.Host)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	certs := t.TempDir()
+	for _, file := range []string{"ca.pem", "cert.pem", "key.pem"} {
+		ioutil.WriteFile(filepath.Join(certs, file), nil, 0600)
+	}
+	var tests = []struct {
+		change func(*Config)
+		err    string
+	}{
+		{func(c *Config) {}, ""},
+		{func(c *Config) { c.Docker.Host = "docker.sock" }, `docker.host "docker.sock" has to start with unix://, tcp://, http:// or https://`},
+		{func(c *Config) { c.Docker.ReconcileInterval = "often" }, `docker.reconcile_interval "often" isn't a duration like 10s or 5m`},
+		{func(c *Config) { c.Docker.Selector = "=1" }, `docker.selector "=1" isn't an environment variable name`},
+		{func(c *Config) { c.Docker.TLS.Verify = true }, "docker.tls.verify needs docker.tls.cert_path"},
+		{func(c *Config) { c.Docker.Host = "tcp://docker:2376"; c.Docker.TLS.CertPath = certs }, ""},
+		{func(c *Config) { c.Docker.TLS.CertPath = certs }, "docker.tls.cert_path is set, but docker.host unix:///var/run/docker.sock isn't over the network"},
+		{func(c *Config) { c.Docker.Host = "tcp://docker:2376"; c.Docker.TLS.CertPath = "/nowhere" }, "docker.tls.cert_path: stat /nowhere/ca.pem: no such file or directory"},
+		{func(c *Config) {
+			c.Docker.Host = "nowhere"
+			c.Docker.Hosts = []Host{{Name: "a", Host: "tcp://a:2375"}, {Name: "b", Host: "unix:///b.sock", Labels: map[string]string{"disk": "ssd"}}}
+		}, ""},
+		{func(c *Config) { c.Docker.Hosts = []Host{{Host: "tcp://a:2375"}} }, "docker.hosts[0].name is empty"},
+		{func(c *Config) {
+			c.Docker.Hosts = []Host{{Name: "a", Host: "tcp://a:2375"}, {Name: "a", Host: "tcp://b:2375"}}
+		}, "docker.hosts has a more than once"},
+		{func(c *Config) { c.Docker.Hosts = []Host{{Name: "a", Host: "a:2375"}} }, `docker.hosts[a].host "a:2375" has to start with unix://, tcp://, http:// or https://`},
+		{func(c *Config) { c.Docker.Hosts = []Host{{Name: "a", Host: "tcp://a:2375", TLS: TLS{Verify: true}}} }, "docker.hosts[a].tls.verify needs docker.hosts[a].tls.cert_path"},
+		{func(c *Config) { c.Storage.Dir = nil }, "no storage module configured, storage.dir or storage.consul is needed"},
+		{func(c *Config) { c.Storage.Dir.Debounce = "-1s" }, `storage.dir.debounce "-1s" isn't a duration like 10s or 5m`},
+		{func(c *Config) { c.Storage.Consul = &Consul{} }, "storage.consul.address is empty"},
+		{func(c *Config) { c.API.Listen = "8080" }, "api.listen: address 8080: missing port in address"},
+		{func(c *Config) { c.API.Listen = "unix:///run/watchdock.sock" }, ""},
+		{func(c *Config) { c.API.Listen = "unix://" }, "api.listen: unix:// needs a path"},
+		{func(c *Config) { c.Metrics.Listen = ":9090" }, ""},
+		{func(c *Config) { c.Metrics.Listen = "9090" }, "metrics.listen: address 9090: missing port in address"},
+		{func(c *Config) { c.RegistryLogins = "/nowhere.yaml" }, "registry_logins: stat /nowhere.yaml: no such file or directory"},
+		{func(c *Config) { c.Cluster = &Cluster{Node: "a", Dir: "/cluster", Heartbeat: "1s", Grace: "2s"} }, ""},
+		{func(c *Config) { c.Cluster = &Cluster{Node: "a"} }, "cluster needs one of cluster.dir or cluster.consul"},
+		{func(c *Config) { c.Cluster = &Cluster{Node: "a", Dir: "/containers/"} }, "cluster.dir can't be storage.dir.path too"},
+		{func(c *Config) { c.Cluster = &Cluster{Node: "a", Dir: "/cluster", Grace: "5"} }, `cluster.grace "5" isn't a duration like 10s or 5m`},
+		{func(c *Config) { c.Cluster = &Cluster{Node: "a", Dir: "/cluster", Grace: "8s"} }, "cluster.grace 8s has to be at least twice cluster.heartbeat 5s"},
+		{func(c *Config) { c.Cluster = &Cluster{Node: "a", Consul: "consul:8500", Grace: "5s", Heartbeat: "1s"} }, "cluster.grace 5s has to be at least 10s with consul"},
+	}
+	for i, c := range tests {
+		config := Defaults()
+		config.SetDir("/containers")
+		c.change(config)
+		err := config.Validate()
+		if c.err == "" {
+			if err != nil {
+				t.Errorf("%d: Validate() == %v", i, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != c.err {
+			t.Errorf("%d: Validate() == %v, want %q", i, err, c.err)
+		}
+	}
+}
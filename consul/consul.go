@@ -1,15 +1,13 @@
 package consul
 
 import (
-	//"encoding/json"
-	//"github.com/davecgh/go-spew/spew"
-	//"io/ioutil"
-	"log"
-	//"os"
-	//"path"
-	//"strings"
-	//"time"
+	"bytes"
+	"context"
 	"github.com/armon/consul-api"
+	"github.com/brimstone/watchdock/channel"
+	"log"
+	"strings"
+	"time"
 )
 
 func logit(v ...interface{}) {
@@ -19,18 +17,258 @@ func logit(v ...interface{}) {
 type Consul struct {
 	catalog *consulapi.Catalog
 	client  *consulapi.Client
+	kv      *consulapi.KV
+	prefix  string
+	values  map[string][]byte
+	// the consul index right after each of our own writes
+	written map[string]uint64
+}
+
+// listing is everything under our prefix as of index.
+type listing struct {
+	pairs consulapi.KVPairs
+	index uint64
 }
 
+// Init accepts either "host:port" or "host:port/some/prefix". Container
+// definitions are stored as one key per container under the prefix, which
+// defaults to "watchdock".
 func (consul *Consul) Init(connect string) error {
 	var err error
 	err = nil
 	consulConfig := consulapi.DefaultConfig()
-	consulConfig.Address = connect
+	if strings.HasPrefix(connect, "https://") {
+		consulConfig.Scheme = "https"
+	}
+	connect = strings.TrimPrefix(connect, "http://")
+	connect = strings.TrimPrefix(connect, "https://")
+	consul.prefix = "watchdock"
+	if i := strings.Index(connect, "/"); i >= 0 {
+		if prefix := strings.Trim(connect[i:], "/"); prefix != "" {
+			consul.prefix = prefix
+		}
+		connect = connect[:i]
+	}
+	if connect != "" {
+		consulConfig.Address = connect
+	}
 	consul.client, err = consulapi.NewClient(consulConfig)
+	if err != nil {
+		return err
+	}
+	consul.catalog = consul.client.Catalog()
+	consul.kv = consul.client.KV()
+	consul.values = make(map[string][]byte)
+	consul.written = make(map[string]uint64)
+	return nil
+}
+
+func (consul *Consul) key(name string) string {
+	return consul.prefix + "/" + strings.TrimPrefix(name, "/")
+}
+
+// watch runs blocking queries against the prefix and hands every new
+// listing to the Sync loop until ctx is cancelled. The first query returns
+// immediately, which doubles as the initial scan.
+func (consul *Consul) watch(ctx context.Context, listings chan<- listing) {
+	var index uint64
+	for ctx.Err() == nil {
+		pairs, meta, err := consul.kv.List(consul.prefix+"/", &consulapi.QueryOptions{WaitIndex: index})
+		if err != nil {
+			logit("Error listing", consul.prefix, err.Error())
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		// the index going backwards means consul was reset, start over
+		if meta.LastIndex < index {
+			index = 0
+			continue
+		}
+		index = meta.LastIndex
+		select {
+		case listings <- listing{pairs: pairs, index: index}:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// stale reports whether a listing was taken before our own last write to
+// key, in which case it can't be trusted about that key.
+func (consul *Consul) stale(key string, index uint64) bool {
+	written, ok := consul.written[key]
+	if !ok {
+		return false
+	}
+	if index < written {
+		return true
+	}
+	delete(consul.written, key)
+	return false
+}
+
+// remember records the consul index after writing key ourselves.
+func (consul *Consul) remember(key string) {
+	_, meta, err := consul.kv.Get(key, nil)
+	if err != nil {
+		logit("Error reading back", key, err.Error())
+		return
+	}
+	consul.written[key] = meta.LastIndex
+}
+
+// update compares a listing from consul against what we last saw and sends
+// anything new or missing on to the processing module.
+func (consul *Consul) update(list listing, events chan<- channel.Event) {
+	seen := make(map[string]bool)
+	for _, pair := range list.pairs {
+		// skip "directories" and anything nested further down
+		name := strings.TrimPrefix(pair.Key, consul.prefix+"/")
+		if name == "" || strings.Contains(name, "/") {
+			continue
+		}
+		seen[pair.Key] = true
+		if consul.stale(pair.Key, list.index) {
+			continue
+		}
+		// this is either unchanged or our own write echoing back
+		if value, ok := consul.values[pair.Key]; ok && bytes.Equal(value, pair.Value) {
+			continue
+		}
+		consul.values[pair.Key] = pair.Value
+		spec, err := channel.Decode(pair.Value)
+		if err != nil {
+			logit("Found invalid spec in", pair.Key, err.Error())
+			continue
+		}
+		if spec.Name != name {
+			logit("Key", pair.Key, "holds a spec for", spec.Name)
+			continue
+		}
+		logit("Detected change in", pair.Key)
+		events <- channel.NewUpsert(spec)
+	}
+	for key := range consul.values {
+		if seen[key] || consul.stale(key, list.index) {
+			continue
+		}
+		logit("Key", key, "was removed")
+		delete(consul.values, key)
+		events <- channel.NewDelete(strings.TrimPrefix(key, consul.prefix+"/"))
+	}
+}
+
+// Specs reads every spec under the prefix once.
+func (consul *Consul) Specs() ([]*channel.Spec, error) {
+	pairs, _, err := consul.kv.List(consul.prefix+"/", nil)
+	if err != nil {
+		return nil, err
+	}
+	var specs []*channel.Spec
+	for _, pair := range pairs {
+		name := strings.TrimPrefix(pair.Key, consul.prefix+"/")
+		if name == "" || strings.Contains(name, "/") {
+			continue
+		}
+		spec, err := channel.Decode(pair.Value)
+		if err != nil {
+			logit("Found invalid spec in", pair.Key, err.Error())
+			continue
+		}
+		if spec.Name != name {
+			logit("Key", pair.Key, "holds a spec for", spec.Name)
+			continue
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+func (consul *Consul) Sync(ctx context.Context, readChannel <-chan channel.Event, writeChannel chan<- channel.Event) {
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	kvChannel := make(chan listing)
+	go consul.watch(ctx, kvChannel)
+
+	for {
+		select {
+		case <-ctx.Done():
+			logit("Stopping")
+			return
+
+		// when consul tells us something changed
+		case list := <-kvChannel:
+			consul.update(list, writeChannel)
+
+		// when we get a new container, write it to consul
+		case event, ok := <-readChannel:
+			if !ok {
+				logit("Nothing more to write, stopping")
+				return
+			}
+			switch event.Kind {
+			case channel.Resync:
+				// forget everything and send it all again
+				consul.values = make(map[string][]byte)
+				pairs, meta, err := consul.kv.List(consul.prefix+"/", nil)
+				if err != nil {
+					logit("Error listing", consul.prefix, err.Error())
+					continue
+				}
+				consul.update(listing{pairs: pairs, index: meta.LastIndex}, writeChannel)
+				continue
+			case channel.Status:
+				continue
+			}
+			err := consul.write(event)
+			if err != nil {
+				logit("Couldn't write", event.Name+":", err.Error())
+			}
+		}
+	}
+}
+
+func (consul *Consul) write(event channel.Event) error {
+	key := consul.key(event.Name)
+	if event.Kind == channel.Delete {
+		logit("Should delete", key)
+		delete(consul.values, key)
+		_, err := consul.kv.Delete(key, nil)
+		if err != nil {
+			return err
+		}
+		consul.remember(key)
+		return nil
+	}
+	rawJson, err := event.Spec.Encode()
+	if err != nil {
+		return err
+	}
+	logit("Writing to", key)
+	// remember our own write so we don't trigger on it later
+	consul.values[key] = rawJson
+	_, err = consul.kv.Put(&consulapi.KVPair{Key: key, Value: rawJson}, nil)
+	if err != nil {
+		return err
+	}
+	consul.remember(key)
+	return nil
+}
+
+// Check makes sure consul can be reached before anything is written
+// anywhere. Consul takes any spec, so there's nothing else to refuse.
+func (consul *Consul) Check(event channel.Event) error {
+	_, _, err := consul.kv.Get(consul.key(event.Name), nil)
 	return err
 }
 
-func (consul *Consul) Sync(readChannel <-chan map[string]interface{}, writeChannel chan<- map[string]interface{}) {
+// Write puts one change in consul straight away, for when Sync isn't
+// running to do it.
+func (consul *Consul) Write(event channel.Event) error {
+	switch event.Kind {
+	case channel.Upsert, channel.Delete:
+		return consul.write(event)
+	}
+	return nil
 }
 
 func New(connect string) (*Consul, error) {
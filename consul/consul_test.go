@@ -0,0 +1,224 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/brimstone/watchdock/channel"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConsul is just enough of the consul KV HTTP API to exercise Sync,
+// including blocking queries on the index parameter.
+type fakeConsul struct {
+	sync.Mutex
+	index   uint64
+	kv      map[string][]byte
+	changed chan struct{}
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{
+		index:   1,
+		kv:      make(map[string][]byte),
+		changed: make(chan struct{}),
+	}
+}
+
+func (f *fakeConsul) set(key string, value []byte) {
+	f.Lock()
+	defer f.Unlock()
+	if value == nil {
+		delete(f.kv, key)
+	} else {
+		f.kv[key] = value
+	}
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeConsul) get(key string) ([]byte, bool) {
+	f.Lock()
+	defer f.Unlock()
+	value, ok := f.kv[key]
+	return value, ok
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	switch r.Method {
+	case "PUT":
+		body, _ := ioutil.ReadAll(r.Body)
+		f.set(key, body)
+		w.Write([]byte("true"))
+	case "DELETE":
+		f.set(key, nil)
+		w.Write([]byte("true"))
+	case "GET":
+		wait, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+		f.Lock()
+		if wait != 0 && wait == f.index {
+			changed := f.changed
+			f.Unlock()
+			select {
+			case <-changed:
+			case <-time.After(time.Second):
+			}
+			f.Lock()
+		}
+		type pair struct {
+			Key         string
+			Value       []byte
+			ModifyIndex uint64
+		}
+		pairs := []pair{}
+		for k, v := range f.kv {
+			if strings.HasPrefix(k, key) {
+				pairs = append(pairs, pair{Key: k, Value: v, ModifyIndex: f.index})
+			}
+		}
+		index := f.index
+		f.Unlock()
+		sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+		if len(pairs) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(pairs)
+	}
+}
+
+func expect(t *testing.T, events <-chan channel.Event) channel.Event {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timeout waiting for an event from consul")
+	}
+	return channel.Event{}
+}
+
+func TestSync(t *testing.T) {
+	fake := newFakeConsul()
+	fake.set("test/web", []byte(`{"Name":"/web","Config":{"Image":"nginx"}}`))
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	consul, err := New(server.URL + "/test")
+	if err != nil {
+		t.Fatal("Couldn't connect to fake consul:", err)
+	}
+
+	readChannel := make(chan channel.Event)
+	writeChannel := make(chan channel.Event)
+	go consul.Sync(context.Background(), readChannel, writeChannel)
+
+	t.Log("Waiting for the initial scan")
+	event := expect(t, writeChannel)
+	if event.Kind != channel.Upsert || event.Name != "web" {
+		t.Errorf("Expected web from the initial scan, got %s %s", event.Kind, event.Name)
+	}
+
+	t.Log("Changing a key behind our back")
+	fake.set("test/db", []byte(`{"Name":"/db","Config":{"Image":"postgres"}}`))
+	t.Log("Writing something that isn't a spec")
+	fake.set("test/broken", []byte(`{"Name":"/broken"}`))
+	event = expect(t, writeChannel)
+	if event.Name != "db" {
+		t.Errorf("Expected db after a change, got %s", event.Name)
+	}
+
+	t.Log("Persisting a container from docker")
+	readChannel <- channel.NewUpsert(&channel.Spec{
+		Version: 1,
+		Name:    "cache",
+		Config:  &dockerclient.Config{Image: "redis"},
+	})
+	// the following delete is only handled after the write above
+	readChannel <- channel.NewDelete("db")
+	if _, ok := fake.get("test/cache"); !ok {
+		t.Error("Expected test/cache to be written")
+	}
+
+	t.Log("Removing a key behind our back")
+	fake.set("test/web", nil)
+	for {
+		event = expect(t, writeChannel)
+		if event.Name == "cache" || event.Name == "broken" {
+			t.Errorf("Didn't expect to hear about %s", event.Name)
+		}
+		if event.Kind == channel.Delete {
+			break
+		}
+	}
+	if event.Name != "web" {
+		t.Errorf("Expected a delete for web, got %s", event.Name)
+	}
+	if _, ok := fake.get("test/db"); ok {
+		t.Error("Expected test/db to be deleted")
+	}
+}
+
+func TestSpecs(t *testing.T) {
+	fake := newFakeConsul()
+	fake.set("test/web", []byte(`{"Name":"/web","Config":{"Image":"nginx"}}`))
+	fake.set("test/broken", []byte(`{"Name":"/broken"}`))
+	fake.set("test/other", []byte(`{"Name":"/db","Config":{"Image":"postgres"}}`))
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	consul, err := New(server.URL + "/test")
+	if err != nil {
+		t.Fatal("Couldn't connect to fake consul:", err)
+	}
+	specs, err := consul.Specs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(specs) != 1 || specs[0].Name != "web" {
+		t.Errorf("Expected just web, got %v", specs)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	fake := newFakeConsul()
+	fake.set("test/old", []byte(`{"Name":"/old","Config":{"Image":"nginx"}}`))
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	consul, err := New(server.URL + "/test")
+	if err != nil {
+		t.Fatal("Couldn't connect to fake consul:", err)
+	}
+	spec, _ := channel.Decode([]byte(`{"Name":"/web","Config":{"Image":"nginx"}}`))
+	if err = consul.Check(channel.NewUpsert(spec)); err != nil {
+		t.Fatal(err)
+	}
+	if err = consul.Write(channel.NewUpsert(spec)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.get("test/web"); !ok {
+		t.Error("Expected web written to consul")
+	}
+	if err = consul.Write(channel.NewDelete("old")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.get("test/old"); ok {
+		t.Error("Expected old deleted from consul")
+	}
+
+	server.Close()
+	if err = consul.Check(channel.NewUpsert(spec)); err == nil {
+		t.Error("Expected Check to fail once consul is gone")
+	}
+}
@@ -0,0 +1,478 @@
+package dir
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/brimstone/watchdock/channel"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"gopkg.in/yaml.v2"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// composeService is the subset of a docker-compose v3 service we understand.
+// Fields that can be either a list or a map in compose are left as
+// interface{} and sorted out during translation.
+type composeService struct {
+	Image         string
+	ContainerName string `yaml:"container_name"`
+	Command       interface{}
+	Entrypoint    interface{}
+	Environment   interface{}
+	Ports         []interface{}
+	Expose        []interface{}
+	Volumes       []string
+	Restart       string
+	Labels        interface{}
+	DependsOn     interface{} `yaml:"depends_on"`
+	Networks      interface{}
+	NetworkMode   string `yaml:"network_mode"`
+	Hostname      string
+	User          string
+	WorkingDir    string `yaml:"working_dir"`
+	Privileged    bool
+	CapAdd        []string `yaml:"cap_add"`
+	CapDrop       []string `yaml:"cap_drop"`
+	Deploy        struct {
+		Replicas *int
+	}
+}
+
+type composeFile struct {
+	Version  string
+	Services map[string]composeService
+}
+
+// defaultSelector is the docker module's, for when nobody says otherwise.
+const defaultSelector = "WATCHDOCK"
+
+// decodeYAML reads either a docker-compose file, recognised by its top level
+// services key, or a single spec written in YAML instead of JSON. Relative
+// paths in a compose file are from dir, the one it's in, and every service
+// gets selector in its environment.
+func decodeYAML(raw []byte, dir string, selector string) ([]*channel.Spec, error) {
+	var generic map[interface{}]interface{}
+	err := yaml.Unmarshal(raw, &generic)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := generic["services"]; ok {
+		return decodeCompose(raw, dir, selector)
+	}
+	// go through JSON so the keys mean exactly what they do in a .json file
+	rawJson, err := json.Marshal(yamlToJSON(generic))
+	if err != nil {
+		return nil, err
+	}
+	spec, err := channel.Decode(rawJson)
+	if err != nil {
+		return nil, err
+	}
+	return []*channel.Spec{spec}, nil
+}
+
+// yamlToJSON turns the map[interface{}]interface{} yaml gives us into
+// something encoding/json can marshal.
+func yamlToJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{})
+		for key, value := range v {
+			result[fmt.Sprint(key)] = yamlToJSON(value)
+		}
+		return result
+	case []interface{}:
+		for i, value := range v {
+			v[i] = yamlToJSON(value)
+		}
+	}
+	return v
+}
+
+func decodeCompose(raw []byte, dir string, selector string) ([]*channel.Spec, error) {
+	var compose composeFile
+	err := yaml.Unmarshal(raw, &compose)
+	if err != nil {
+		return nil, err
+	}
+	if compose.Version != "" && !strings.HasPrefix(compose.Version, "3") {
+		return nil, fmt.Errorf("compose version %s isn't supported, only 3.x", compose.Version)
+	}
+	if len(compose.Services) == 0 {
+		return nil, errors.New("compose file has no services")
+	}
+	var names []string
+	for name := range compose.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// depends_on names services, but specs go by container name
+	containers := make(map[string]string)
+	for _, name := range names {
+		containers[name] = name
+		if compose.Services[name].ContainerName != "" {
+			containers[name] = compose.Services[name].ContainerName
+		}
+	}
+	var specs []*channel.Spec
+	for _, name := range names {
+		spec, err := compose.Services[name].spec(name, containers, dir, selector)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %s", name, err.Error())
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+func (service composeService) spec(name string, containers map[string]string, dir string, selector string) (*channel.Spec, error) {
+	var err error
+	if service.ContainerName != "" {
+		name = service.ContainerName
+	}
+	config := &dockerclient.Config{
+		Image:      service.Image,
+		Hostname:   service.Hostname,
+		User:       service.User,
+		WorkingDir: service.WorkingDir,
+	}
+	hostConfig := &dockerclient.HostConfig{
+		NetworkMode: service.NetworkMode,
+		Privileged:  service.Privileged,
+		CapAdd:      service.CapAdd,
+		CapDrop:     service.CapDrop,
+	}
+	if config.Cmd, err = stringOrList(service.Command); err != nil {
+		return nil, fmt.Errorf("command %s", err.Error())
+	}
+	if config.Entrypoint, err = stringOrList(service.Entrypoint); err != nil {
+		return nil, fmt.Errorf("entrypoint %s", err.Error())
+	}
+	environment, err := listOrMap(service.Environment, "=")
+	if err != nil {
+		return nil, fmt.Errorf("environment %s", err.Error())
+	}
+	config.Env = withSelector(environment, selector)
+	labels, err := listOrMap(service.Labels, "=")
+	if err != nil {
+		return nil, fmt.Errorf("labels %s", err.Error())
+	}
+	for _, label := range labels {
+		pair := strings.SplitN(label, "=", 2)
+		if config.Labels == nil {
+			config.Labels = make(map[string]string)
+		}
+		config.Labels[pair[0]] = ""
+		if len(pair) == 2 {
+			config.Labels[pair[0]] = pair[1]
+		}
+	}
+	for _, port := range service.Expose {
+		if config.ExposedPorts == nil {
+			config.ExposedPorts = make(map[dockerclient.Port]struct{})
+		}
+		config.ExposedPorts[containerPort(fmt.Sprint(port))] = struct{}{}
+	}
+	for _, port := range service.Ports {
+		err = addPort(config, hostConfig, fmt.Sprint(port))
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, volume := range service.Volumes {
+		parts := strings.Split(volume, ":")
+		if len(parts) == 1 {
+			if config.Volumes == nil {
+				config.Volumes = make(map[string]struct{})
+			}
+			config.Volumes[volume] = struct{}{}
+			continue
+		}
+		// docker only takes absolute paths, anything else is a named volume
+		if parts[0] == "." || parts[0] == ".." || strings.HasPrefix(parts[0], "./") || strings.HasPrefix(parts[0], "../") {
+			parts[0] = filepath.Join(dir, parts[0])
+			volume = strings.Join(parts, ":")
+		}
+		hostConfig.Binds = append(hostConfig.Binds, volume)
+	}
+	if hostConfig.RestartPolicy, err = restartPolicy(service.Restart); err != nil {
+		return nil, err
+	}
+	dependsOn, err := composeDependsOn(service.DependsOn, containers)
+	if err != nil {
+		return nil, fmt.Errorf("depends_on %s", err.Error())
+	}
+	spec := &channel.Spec{
+		Version:    channel.SpecVersion,
+		Name:       name,
+		Config:     config,
+		HostConfig: hostConfig,
+		DependsOn:  dependsOn,
+	}
+	networks, err := composeNetworks(service.Networks)
+	if err != nil {
+		return nil, err
+	}
+	if len(networks) > 0 {
+		spec.NetworkingConfig = &dockerclient.NetworkingConfig{EndpointsConfig: networks}
+	}
+	if service.Deploy.Replicas != nil {
+		spec.Replicas = &channel.Replicas{Count: *service.Deploy.Replicas}
+	}
+	err = spec.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// stringOrList handles compose's `command: a b c` and `command: [a, b, c]`.
+func stringOrList(v interface{}) ([]string, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return splitWords(v)
+	case []interface{}:
+		var result []string
+		for _, item := range v {
+			result = append(result, fmt.Sprint(item))
+		}
+		return result, nil
+	}
+	return nil, fmt.Errorf("must be a string or a list, not %T", v)
+}
+
+// splitWords splits a command line on spaces the way a shell would, minus
+// everything but quotes and backslashes.
+func splitWords(line string) ([]string, error) {
+	var words []string
+	var word []rune
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			word = append(word, r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word = append(word, r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				words = append(words, string(word))
+				word = word[:0]
+				inWord = false
+			}
+		default:
+			word = append(word, r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("has an unterminated quote or escape in %s", line)
+	}
+	if inWord {
+		words = append(words, string(word))
+	}
+	return words, nil
+}
+
+// listOrMap handles compose's `[A=1, B=2]` and `{A: 1, B: 2}` forms. Maps
+// come back as key + separator + value, sorted by key, and a key without a
+// value comes back alone. With an empty separator only the keys are kept.
+func listOrMap(v interface{}, separator string) ([]string, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		var result []string
+		for _, item := range v {
+			result = append(result, fmt.Sprint(item))
+		}
+		return result, nil
+	case map[interface{}]interface{}:
+		var result []string
+		for key, value := range v {
+			if separator == "" {
+				result = append(result, fmt.Sprint(key))
+			} else if value == nil {
+				// compose takes these from the environment it runs in
+				result = append(result, fmt.Sprint(key))
+			} else {
+				result = append(result, fmt.Sprint(key)+separator+fmt.Sprint(value))
+			}
+		}
+		sort.Strings(result)
+		return result, nil
+	}
+	return nil, fmt.Errorf("must be a list or a map, not %T", v)
+}
+
+// withSelector adds selector to env, as NAME=1 when it's just a name, unless
+// the service already sets that variable itself.
+func withSelector(env []string, selector string) []string {
+	if selector == "" {
+		return env
+	}
+	name := strings.SplitN(selector, "=", 2)[0]
+	for _, variable := range env {
+		if strings.SplitN(variable, "=", 2)[0] == name {
+			return env
+		}
+	}
+	if !strings.Contains(selector, "=") {
+		selector += "=1"
+	}
+	return append(env, selector)
+}
+
+// composeDependsOn understands both the list of services and the map of
+// services to their condition.
+func composeDependsOn(v interface{}, containers map[string]string) ([]channel.Dependency, error) {
+	conditions := make(map[string]string)
+	if services, ok := v.(map[interface{}]interface{}); ok {
+		for service, value := range services {
+			options, _ := value.(map[interface{}]interface{})
+			switch options["condition"] {
+			case nil, "service_started":
+				conditions[fmt.Sprint(service)] = ""
+			case "service_healthy":
+				conditions[fmt.Sprint(service)] = channel.DependsHealthy
+			default:
+				return nil, fmt.Errorf("condition %v of %v isn't supported", options["condition"], service)
+			}
+		}
+	}
+	services, err := listOrMap(v, "")
+	if err != nil {
+		return nil, err
+	}
+	var dependencies []channel.Dependency
+	for _, service := range services {
+		name, ok := containers[service]
+		if !ok {
+			return nil, fmt.Errorf("%s isn't a service", service)
+		}
+		dependencies = append(dependencies, channel.Dependency{Name: name, Condition: conditions[service]})
+	}
+	return dependencies, nil
+}
+
+func containerPort(port string) dockerclient.Port {
+	if !strings.Contains(port, "/") {
+		port += "/tcp"
+	}
+	return dockerclient.Port(port)
+}
+
+// addPort understands "80", "8080:80", "127.0.0.1:8080:80" and any of those
+// followed by /udp.
+func addPort(config *dockerclient.Config, hostConfig *dockerclient.HostConfig, mapping string) error {
+	protocol := ""
+	if i := strings.Index(mapping, "/"); i >= 0 {
+		protocol = mapping[i:]
+		mapping = mapping[:i]
+	}
+	parts := strings.Split(mapping, ":")
+	binding := dockerclient.PortBinding{}
+	switch len(parts) {
+	case 1:
+	case 2:
+		binding.HostPort = parts[0]
+	case 3:
+		binding.HostIP = parts[0]
+		binding.HostPort = parts[1]
+	default:
+		return fmt.Errorf("can't understand port %s", mapping)
+	}
+	containerPortNumber := parts[len(parts)-1]
+	for _, number := range []string{binding.HostPort, containerPortNumber} {
+		if number == "" {
+			continue
+		}
+		if _, err := strconv.Atoi(number); err != nil {
+			return fmt.Errorf("port %s isn't a number, ranges aren't supported", number)
+		}
+	}
+	port := containerPort(containerPortNumber + protocol)
+	if config.ExposedPorts == nil {
+		config.ExposedPorts = make(map[dockerclient.Port]struct{})
+	}
+	config.ExposedPorts[port] = struct{}{}
+	if len(parts) == 1 {
+		return nil
+	}
+	if hostConfig.PortBindings == nil {
+		hostConfig.PortBindings = make(map[dockerclient.Port][]dockerclient.PortBinding)
+	}
+	hostConfig.PortBindings[port] = append(hostConfig.PortBindings[port], binding)
+	return nil
+}
+
+func restartPolicy(restart string) (dockerclient.RestartPolicy, error) {
+	parts := strings.SplitN(restart, ":", 2)
+	switch parts[0] {
+	case "":
+		return dockerclient.RestartPolicy{}, nil
+	case "no":
+		return dockerclient.NeverRestart(), nil
+	case "always":
+		return dockerclient.AlwaysRestart(), nil
+	case "unless-stopped":
+		return dockerclient.RestartUnlessStopped(), nil
+	case "on-failure":
+		retries := 0
+		if len(parts) == 2 {
+			var err error
+			retries, err = strconv.Atoi(parts[1])
+			if err != nil {
+				return dockerclient.RestartPolicy{}, fmt.Errorf("restart %s has a bad retry count", restart)
+			}
+		}
+		return dockerclient.RestartOnFailure(retries), nil
+	}
+	return dockerclient.RestartPolicy{}, fmt.Errorf("restart %s isn't one of no, always, on-failure or unless-stopped", restart)
+}
+
+// composeNetworks handles both `networks: [a, b]` and the long form with
+// aliases.
+func composeNetworks(v interface{}) (map[string]*dockerclient.EndpointConfig, error) {
+	names, err := listOrMap(v, "")
+	if err != nil {
+		return nil, fmt.Errorf("networks %s", err.Error())
+	}
+	endpoints := make(map[string]*dockerclient.EndpointConfig)
+	for _, name := range names {
+		endpoints[name] = new(dockerclient.EndpointConfig)
+	}
+	long, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return endpoints, nil
+	}
+	for key, value := range long {
+		options, ok := value.(map[interface{}]interface{})
+		if !ok {
+			continue
+		}
+		aliases, err := listOrMap(options["aliases"], "")
+		if err != nil {
+			return nil, fmt.Errorf("networks %v aliases %s", key, err.Error())
+		}
+		endpoints[fmt.Sprint(key)].Aliases = aliases
+	}
+	return endpoints, nil
+}
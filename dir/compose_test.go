@@ -0,0 +1,223 @@
+package dir
+
+import (
+	"github.com/brimstone/watchdock/channel"
+	"github.com/brimstone/watchdock/docker"
+	"github.com/brimstone/watchdock/docker/dockertest"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const composeExample = `
+version: "3.7"
+services:
+  web:
+    image: nginx:1.17
+    command: nginx -g "daemon off;"
+    environment:
+      BACKEND: http://app:8080
+      DEBUG:
+    ports:
+      - "8080:80"
+      - "127.0.0.1:8443:443/tcp"
+      - 9000
+    volumes:
+      - /srv/www:/usr/share/nginx/html:ro
+      - /var/cache/nginx
+      - ./html:/srv/html
+      - ../shared:/shared:ro
+      - logs:/var/log/nginx
+    restart: on-failure:3
+    labels:
+      - team=web
+    depends_on:
+      - app
+    networks:
+      frontend:
+        aliases: [www]
+  app:
+    image: example/app
+    container_name: backend
+    environment:
+      - MODE=production
+      - WATCHDOCK=app
+    labels:
+      tier:
+    restart: unless-stopped
+`
+
+func TestDecodeCompose(t *testing.T) {
+	specs, err := decodeYAML([]byte(composeExample), "/srv/stack", "WATCHDOCK")
+	if err != nil {
+		t.Fatal("Couldn't decode compose file:", err)
+	}
+	if len(specs) != 2 {
+		t.Fatalf("Expected 2 specs, got %d", len(specs))
+	}
+
+	app := specs[0]
+	if app.Name != "backend" {
+		t.Errorf("Expected container_name backend, got %s", app.Name)
+	}
+	if app.HostConfig.RestartPolicy != dockerclient.RestartUnlessStopped() {
+		t.Errorf("Unexpected restart policy %v", app.HostConfig.RestartPolicy)
+	}
+	// a service that sets the selector itself keeps its own
+	if !reflect.DeepEqual(app.Config.Env, []string{"MODE=production", "WATCHDOCK=app"}) {
+		t.Errorf("Unexpected environment %q", app.Config.Env)
+	}
+	if !reflect.DeepEqual(app.Config.Labels, map[string]string{"tier": ""}) {
+		t.Errorf("Unexpected labels %v", app.Config.Labels)
+	}
+
+	web := specs[1]
+	var tests = []struct {
+		field     string
+		got, want interface{}
+	}{
+		{"Image", web.Config.Image, "nginx:1.17"},
+		{"Cmd", web.Config.Cmd, []string{"nginx", "-g", "daemon off;"}},
+		{"Env", web.Config.Env, []string{"BACKEND=http://app:8080", "DEBUG", "WATCHDOCK=1"}},
+		{"PortBindings", web.HostConfig.PortBindings, map[dockerclient.Port][]dockerclient.PortBinding{
+			"80/tcp":  {{HostPort: "8080"}},
+			"443/tcp": {{HostIP: "127.0.0.1", HostPort: "8443"}},
+		}},
+		{"ExposedPorts", len(web.Config.ExposedPorts), 3},
+		{"Binds", web.HostConfig.Binds, []string{"/srv/www:/usr/share/nginx/html:ro", "/srv/stack/html:/srv/html", "/srv/shared:/shared:ro", "logs:/var/log/nginx"}},
+		{"Volumes", web.Config.Volumes, map[string]struct{}{"/var/cache/nginx": {}}},
+		{"RestartPolicy", web.HostConfig.RestartPolicy, dockerclient.RestartOnFailure(3)},
+		{"Labels", web.Config.Labels, map[string]string{"team": "web"}},
+		{"DependsOn", web.DependsOn, []channel.Dependency{{Name: "backend"}}},
+		{"Aliases", web.NetworkingConfig.EndpointsConfig["frontend"].Aliases, []string{"www"}},
+	}
+	for _, c := range tests {
+		if !reflect.DeepEqual(c.got, c.want) {
+			t.Errorf("web %s == %#v, want %#v", c.field, c.got, c.want)
+		}
+	}
+}
+
+func TestComposeDependsOn(t *testing.T) {
+	specs, err := decodeYAML([]byte("services:\n  web:\n    image: nginx\n    depends_on:\n      db: {condition: service_healthy}\n      cache:\n  db:\n    image: postgres\n  cache:\n    image: redis\n"), "/srv/stack", "WATCHDOCK")
+	if err != nil {
+		t.Fatal("Couldn't decode compose file:", err)
+	}
+	want := []channel.Dependency{{Name: "cache"}, {Name: "db", Condition: channel.DependsHealthy}}
+	if !reflect.DeepEqual(specs[2].DependsOn, want) {
+		t.Errorf("web DependsOn == %#v, want %#v", specs[2].DependsOn, want)
+	}
+}
+
+func TestComposeReplicas(t *testing.T) {
+	specs, err := decodeYAML([]byte("services:\n  web:\n    image: nginx\n    deploy:\n      replicas: 3\n  db:\n    image: postgres\n"), "/srv/stack", "WATCHDOCK")
+	if err != nil {
+		t.Fatal("Couldn't decode compose file:", err)
+	}
+	if specs[0].Replicas != nil {
+		t.Errorf("db shouldn't have replicas, got %+v", specs[0].Replicas)
+	}
+	if specs[1].Replicas == nil || specs[1].Replicas.Count != 3 {
+		t.Errorf("web should have 3 replicas, got %+v", specs[1].Replicas)
+	}
+}
+
+// TestComposeRelativeBinds reads binds relative to where the compose file
+// is, not to wherever watchdock was started.
+func TestComposeRelativeBinds(t *testing.T) {
+	directory := t.TempDir()
+	filename := filepath.Join(directory, "stack.yml")
+	ioutil.WriteFile(filename, []byte("services:\n  web:\n    image: nginx\n    volumes:\n      - ./html:/usr/share/nginx/html:ro\n      - .:/stack\n"), 0644)
+
+	specs, err := ReadFile(filename, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{directory + "/html:/usr/share/nginx/html:ro", directory + ":/stack"}
+	if !reflect.DeepEqual(specs[0].HostConfig.Binds, want) {
+		t.Errorf("Binds == %v, want %v", specs[0].HostConfig.Binds, want)
+	}
+}
+
+// TestComposeManaged plans with specs from a compose file against a fake
+// docker, which only knows what to remove if it manages what compose made.
+func TestComposeManaged(t *testing.T) {
+	directory := t.TempDir()
+	stack := filepath.Join(directory, "stack.yml")
+	ioutil.WriteFile(stack, []byte("services:\n  web:\n    image: nginx\n  db:\n    image: postgres\n    environment:\n      DEBUG:\n"), 0644)
+	dir, err := New(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir.SetSelector("MANAGED=yes")
+	specs, err := dir.Specs()
+	if err != nil || len(specs) != 2 {
+		t.Fatalf("Expected db and web, got %v %v", specs, err)
+	}
+	if env := specs[0].Config.Env; !reflect.DeepEqual(env, []string{"DEBUG", "MANAGED=yes"}) {
+		t.Errorf("db Env == %q", env)
+	}
+
+	fake := dockertest.New()
+	server := httptest.NewServer(fake)
+	for _, spec := range specs {
+		fake.Add(spec.Name, true, *spec.Config)
+	}
+	fake.Add("unmanaged", true, dockerclient.Config{Image: "redis"})
+	processing, err := docker.New(docker.Endpoint{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	processing.SetOptions(docker.Options{Selector: "MANAGED=yes", ReconcileInterval: time.Minute})
+
+	// db taken out of the compose file comes through as a delete, which
+	// only means removing db if it's ours
+	ioutil.WriteFile(stack, []byte("services:\n  web:\n    image: nginx\n"), 0644)
+	specs, err = dir.Specs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions, err := processing.Plan(specs, []string{"db", "unmanaged"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var removed []string
+	for _, action := range actions {
+		if action.Action == docker.ActionRemoveContainer {
+			removed = append(removed, action.Container)
+		}
+	}
+	if !reflect.DeepEqual(removed, []string{"db"}) {
+		t.Errorf("Expected just db removed, got %+v", actions)
+	}
+}
+
+func TestDecodeYAMLErrors(t *testing.T) {
+	var tests = []struct {
+		yaml, err string
+	}{
+		{"Name: web\nConfig:\n  Image: nginx\n", ""},
+		{"Name: web\n", "spec web has no Config"},
+		{"version: '2'\nservices:\n  web:\n    image: nginx\n", "compose version 2 isn't supported, only 3.x"},
+		{"services:\n  web:\n    ports: ['80-81:80-81']\n    image: nginx\n", "service web: port 80-81 isn't a number, ranges aren't supported"},
+		{"services:\n  web:\n    restart: sometimes\n    image: nginx\n", "service web: restart sometimes isn't one of no, always, on-failure or unless-stopped"},
+		{"services:\n  web:\n    command: 5\n", "service web: command must be a string or a list, not int"},
+		{"services:\n  web:\n    command: echo 'hi\n", "service web: command has an unterminated quote or escape in echo 'hi"},
+		{"services:\n  web:\n    image: nginx\n    depends_on: [db]\n", "service web: depends_on db isn't a service"},
+		{"services:\n  web:\n    image: nginx\n    ports: ['80:80']\n    deploy: {replicas: 2}\n", "service web: spec web: replicas would all publish the same host ports, they need a Replicas.PortOffset"},
+		{"services:\n  web:\n    image: nginx\n    depends_on:\n      db: {condition: service_completed_successfully}\n  db:\n    image: postgres\n", "service web: depends_on condition service_completed_successfully of db isn't supported"},
+	}
+	for _, c := range tests {
+		_, err := decodeYAML([]byte(c.yaml), "/srv/stack", "WATCHDOCK")
+		if c.err == "" && err != nil {
+			t.Errorf("decodeYAML(%q) error == %v", c.yaml, err)
+		}
+		if c.err != "" && (err == nil || err.Error() != c.err) {
+			t.Errorf("decodeYAML(%q) error == %v, want %q", c.yaml, err, c.err)
+		}
+	}
+}
@@ -1,14 +1,18 @@
 package dir
 
 import (
-	"encoding/json"
 	//"github.com/davecgh/go-spew/spew"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/brimstone/watchdock/channel"
 	"gopkg.in/fsnotify.v1"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
-	"strings"
+	"path/filepath"
+	"sync"
 	"time"
 )
 
@@ -20,6 +24,14 @@ type Dir struct {
 	directory string
 	watcher   *fsnotify.Watcher
 	modtime   map[string]time.Time
+	// which containers came from which file, a compose file can hold several
+	files map[string][]string
+	// scandir runs alongside Sync
+	lock sync.Mutex
+	// how long after we read or write a file changes to it are ignored
+	debounce time.Duration
+	// what compose services get in their environment to be managed
+	selector string
 }
 
 func (dir *Dir) Init(directory string) error {
@@ -38,29 +50,109 @@ func (dir *Dir) Init(directory string) error {
 	}
 
 	dir.modtime = make(map[string]time.Time)
+	dir.files = make(map[string][]string)
+	dir.debounce = time.Second
+	dir.selector = defaultSelector
 	return nil
 }
 
-func (dir *Dir) validate(filename string) (map[string]interface{}, error) {
-	//temp json object
-	var obj map[string]interface{}
+// SetSelector changes what compose services get in their environment, which
+// has to match the docker module's selector for them to be managed.
+func (dir *Dir) SetSelector(selector string) {
+	dir.selector = selector
+}
+
+// SetDebounce changes how long changes to a file are ignored for after it's
+// read or written. It has to be called before Sync.
+func (dir *Dir) SetDebounce(debounce time.Duration) {
+	dir.debounce = debounce
+}
+
+func (dir *Dir) validate(filename string) ([]*channel.Spec, error) {
+	specs, err := ReadFile(filename, dir.selector)
+	if err != nil {
+		log.Printf("Error reading %s: %s\n", filename, err.Error())
+	}
+	return specs, err
+}
 
+// ReadFile reads the container specs in filename, a .json spec or a .yaml
+// or .yml file of them. Compose services get selector in their environment
+// unless it's empty.
+func ReadFile(filename string, selector string) ([]*channel.Spec, error) {
 	// read in the whole file contents
 	fileContents, err := ioutil.ReadFile(filename)
 	if err != nil {
-		log.Printf("Error reading: %s, %s\n", filename, err.Error())
 		return nil, err
 	}
-	// attempt to convert the file contents into a json object
-	err = json.Unmarshal(fileContents, &obj)
-	if err != nil {
-		log.Printf("Error unmarshalling %s: %s\n", filename, err.Error())
-		return nil, err
+	// attempt to convert the file contents into container specs
+	switch path.Ext(filename) {
+	case ".json":
+		spec, err := channel.Decode(fileContents)
+		if err != nil {
+			return nil, err
+		}
+		return []*channel.Spec{spec}, nil
+	case ".yaml", ".yml":
+		dir, err := filepath.Abs(filepath.Dir(filename))
+		if err != nil {
+			return nil, err
+		}
+		return decodeYAML(fileContents, dir, selector)
+	default:
+		return nil, errors.New("not a .json, .yaml or .yml file")
+	}
+}
+
+// owner finds the file a container was read from.
+func (dir *Dir) owner(name string) string {
+	for filename, names := range dir.files {
+		for _, n := range names {
+			if n == name {
+				return filename
+			}
+		}
+	}
+	return ""
+}
+
+// load sends every container in filename on, and deletes for any container
+// the file used to have but doesn't anymore.
+func (dir *Dir) load(filename string, specs []*channel.Spec, events chan<- channel.Event) {
+	var names []string
+	for _, spec := range specs {
+		if owner := dir.owner(spec.Name); owner != "" && owner != filename {
+			logit("Ignoring", spec.Name, "in", filename, "it's already in", owner)
+			continue
+		}
+		names = append(names, spec.Name)
+	}
+	dir.forget(filename, names, events)
+	dir.files[filename] = names
+	for _, spec := range specs {
+		if dir.owner(spec.Name) == filename {
+			events <- channel.NewUpsert(spec)
+		}
+	}
+}
+
+// forget sends deletes for every container filename had other than keep.
+func (dir *Dir) forget(filename string, keep []string, events chan<- channel.Event) {
+	for _, name := range dir.files[filename] {
+		found := false
+		for _, k := range keep {
+			if k == name {
+				found = true
+			}
+		}
+		if !found {
+			events <- channel.NewDelete(name)
+		}
 	}
-	return obj, nil
+	delete(dir.files, filename)
 }
 
-func (dir *Dir) scandir(channel chan<- map[string]interface{}) error {
+func (dir *Dir) scandir(events chan<- channel.Event) error {
 	directory, err := os.Open(dir.directory)
 	if err != nil {
 		log.Printf("Error opening %s\n", dir.directory)
@@ -71,97 +163,214 @@ func (dir *Dir) scandir(channel chan<- map[string]interface{}) error {
 		log.Printf("Error reading %s: %s\n", dir.directory, err.Error())
 		return err
 	}
+	dir.lock.Lock()
+	defer dir.lock.Unlock()
 	for _, file := range files {
 		filename := dir.directory + "/" + file.Name()
-		obj, err := dir.validate(filename)
+		specs, err := dir.validate(filename)
 		if err != nil {
-			log.Printf("Found invalid json file: %s\n", file.Name())
+			log.Printf("Found invalid spec file: %s\n", file.Name())
 			continue
 		}
-		log.Printf("Found valid json file: %s\n", file.Name())
+		log.Printf("Found valid spec file: %s\n", file.Name())
 		//stat, _ := os.Stat(filename)
 		dir.modtime[filename] = time.Now()
-		channel <- obj
+		dir.load(filename, specs, events)
 	}
 	return nil
 }
 
-func (dir *Dir) Sync(readChannel <-chan map[string]interface{}, writeChannel chan<- map[string]interface{}) {
+// Specs reads every spec in the directory once, without watching it.
+func (dir *Dir) Specs() ([]*channel.Spec, error) {
+	files, err := ioutil.ReadDir(dir.directory)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]string)
+	var all []*channel.Spec
+	for _, file := range files {
+		specs, err := dir.validate(dir.directory + "/" + file.Name())
+		if err != nil {
+			continue
+		}
+		for _, spec := range specs {
+			if owner, ok := seen[spec.Name]; ok {
+				logit("Ignoring", spec.Name, "in", file.Name(), "it's already in", owner)
+				continue
+			}
+			seen[spec.Name] = file.Name()
+			all = append(all, spec)
+		}
+	}
+	return all, nil
+}
+
+func (dir *Dir) Sync(ctx context.Context, readChannel <-chan channel.Event, writeChannel chan<- channel.Event) {
 	defer dir.watcher.Close()
 
 	go dir.scandir(writeChannel)
 
-	// basically run forever
+	// run until we're told to stop, every write is finished by then
 	for {
 		select {
-		// when we get a modified file
+		case <-ctx.Done():
+			logit("Stopping")
+			return
 
+		// when we get a modified file
 		case event := <-dir.watcher.Events:
-
-			if event.Op&fsnotify.Write == fsnotify.Write {
-				obj, err := dir.validate(event.Name)
-				// todo - add a check of modification times to debounce
-				if err == nil {
-					filename := event.Name
-					if time.Now().Before(dir.modtime[filename].Add(time.Second)) {
-						continue
-					}
-					log.Printf("Detected change in %s\n", obj["Name"])
-					dir.modtime[filename] = time.Now()
-					writeChannel <- obj
-				}
-
-			} else if event.Op&fsnotify.Remove == fsnotify.Remove {
-				//spew.Dump(dir.modtime)
-				if _, ok := dir.modtime[event.Name]; !ok {
-					logit("Not tracking", event.Name)
-					continue
-				}
-				// todo - channel <- channel.File{Filename: event.Name}
-				// This one is easy. Simply figure out the name of the file, sans .json ending
-				// Send a special message with the delete attribute
-				logit("Dir should let someone know that this file was removed")
-				obj := make(map[string]interface{})
-				base := path.Base(event.Name)
-				ext := path.Ext(base)
-				obj["Name"] = base[0 : len(base)-len(ext)]
-				obj["deleteme"] = true
-				writeChannel <- obj
-			}
+			dir.lock.Lock()
+			dir.fileChanged(event, writeChannel)
+			dir.lock.Unlock()
 
 		// Error
 		case err := <-dir.watcher.Errors:
 			logit("Dir error:", err)
+
 		// when we get a new container, write it to disk
-		case fileMap := <-readChannel:
-			if _, ok := fileMap["deleteme"]; ok {
-				filename := dir.directory + fileMap["Name"].(string) + ".json"
-				logit("Should delete", filename)
-				delete(dir.modtime, filename)
-				os.Remove(filename)
-				continue
+		case event, ok := <-readChannel:
+			if !ok {
+				logit("Nothing more to write, stopping")
+				return
 			}
-			rawJson, err := json.Marshal(fileMap)
-			if err != nil {
-				logit("Got an error Marshalling:", err.Error())
+			if event.Kind == channel.Resync {
+				go dir.scandir(writeChannel)
 				continue
 			}
-			// todo - log our own write so we don't trigger later
-			names := strings.Split(fileMap["Name"].(string), "/")
-			logit("Writing to", names[1])
-			filename := dir.directory + "/" + names[1] + ".json"
-			dir.modtime[filename] = time.Now()
-			fo, err := os.Create(filename)
+			dir.lock.Lock()
+			err := dir.write(event)
+			dir.lock.Unlock()
 			if err != nil {
-				logit("Got an writing:", err.Error())
-				continue
+				logit("Couldn't write", event.Name+":", err.Error())
 			}
-			fo.Write(rawJson)
-			fo.Close()
 		}
 	}
 }
 
+func (dir *Dir) fileChanged(event fsnotify.Event, writeChannel chan<- channel.Event) {
+	if event.Op&fsnotify.Write == fsnotify.Write {
+		specs, err := dir.validate(event.Name)
+		if err != nil {
+			return
+		}
+		filename := event.Name
+		if time.Now().Before(dir.modtime[filename].Add(dir.debounce)) {
+			return
+		}
+		log.Printf("Detected change in %s\n", filename)
+		dir.modtime[filename] = time.Now()
+		dir.load(filename, specs, writeChannel)
+
+	} else if event.Op&fsnotify.Remove == fsnotify.Remove {
+		//spew.Dump(dir.modtime)
+		if _, ok := dir.modtime[event.Name]; !ok {
+			logit("Not tracking", event.Name)
+			return
+		}
+		// Send a delete for every container this file held
+		logit("Dir should let someone know that this file was removed")
+		delete(dir.modtime, event.Name)
+		dir.forget(event.Name, nil, writeChannel)
+	}
+}
+
+// refuse says why event can't be written, which is when a file someone
+// wrote holds the spec.
+func (dir *Dir) refuse(event channel.Event) error {
+	filename := dir.directory + "/" + event.Name + ".json"
+	// yaml files are written by people, leave them alone
+	if owner := dir.owner(event.Name); owner != "" && owner != filename {
+		return fmt.Errorf("not touching %s, it's managed in %s", event.Name, owner)
+	}
+	return nil
+}
+
+func (dir *Dir) write(event channel.Event) error {
+	if event.Kind != channel.Upsert && event.Kind != channel.Delete {
+		return nil
+	}
+	if err := dir.refuse(event); err != nil {
+		return err
+	}
+	filename := dir.directory + "/" + event.Name + ".json"
+	if event.Kind == channel.Delete {
+		logit("Should delete", filename)
+		delete(dir.modtime, filename)
+		delete(dir.files, filename)
+		err := os.Remove(filename)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	rawJson, err := event.Spec.Encode()
+	if err != nil {
+		return err
+	}
+	// log our own write so we don't trigger later
+	logit("Writing to", event.Name)
+	dir.modtime[filename] = time.Now()
+	dir.files[filename] = []string{event.Name}
+	return ioutil.WriteFile(filename, rawJson, 0644)
+}
+
+// index reads which file holds which spec, for when Sync hasn't.
+func (dir *Dir) index() error {
+	files, err := ioutil.ReadDir(dir.directory)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		filename := dir.directory + "/" + file.Name()
+		specs, err := ReadFile(filename, dir.selector)
+		if err != nil {
+			continue
+		}
+		dir.files[filename] = nil
+		for _, spec := range specs {
+			if dir.owner(spec.Name) == "" {
+				dir.files[filename] = append(dir.files[filename], spec.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// Check says whether Write would leave event alone because a file someone
+// wrote holds the spec.
+func (dir *Dir) Check(event channel.Event) error {
+	dir.lock.Lock()
+	defer dir.lock.Unlock()
+	if err := dir.index(); err != nil {
+		return err
+	}
+	return dir.refuse(event)
+}
+
+// Write saves one change while the module isn't running. The files already
+// there are read first, so specs people wrote are left alone.
+func (dir *Dir) Write(event channel.Event) error {
+	dir.lock.Lock()
+	defer dir.lock.Unlock()
+	if err := dir.index(); err != nil {
+		return err
+	}
+	return dir.write(event)
+}
+
+// NewReader is a Dir that only reads what's in directory, for looking
+// without running: nothing is watched and nothing is created.
+func NewReader(directory string) (*Dir, error) {
+	info, err := os.Stat(directory)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s isn't a directory", directory)
+	}
+	return &Dir{directory: directory, selector: defaultSelector}, nil
+}
+
 func New(directory string) (*Dir, error) {
 	dir := new(Dir)
 	err := dir.Init(directory)
@@ -1,71 +1,123 @@
 package dir
 
 import (
-	"github.com/brimstone/go-chan-test/channel"
+	"context"
+	"github.com/brimstone/watchdock/channel"
+	"io/ioutil"
 	"os"
 	"testing"
 	"time"
 )
 
 func Test(t *testing.T) {
-	t.Log("Creating new watcher on /tmp")
-	dir, err := New("/tmp")
+	directory, err := ioutil.TempDir("", "watchdock")
 	if err != nil {
-		t.Error("Couldn't create a new watcher on /tmp")
+		t.Fatal("Couldn't create a temp directory")
 	}
+	defer os.RemoveAll(directory)
 
-	// make a new channel to catch signals
-	fileChannel := make(chan channel.File)
-	t.Log("Running Sync()")
-	go dir.Sync(fileChannel)
-
-	t.Log("Creating output file")
-	// open output file
-	fo, err := os.Create("/tmp/output.txt")
+	t.Log("Creating new watcher on", directory)
+	dir, err := New(directory)
 	if err != nil {
-		panic(err)
+		t.Fatal("Couldn't create a new watcher on", directory)
 	}
 
+	// make a new channel to catch signals
+	readChannel := make(chan channel.Event)
+	writeChannel := make(chan channel.Event)
+	t.Log("Running Sync()")
+	go dir.Sync(context.Background(), readChannel, writeChannel)
+
 	t.Log("Delaying write operation")
+	filename := directory + "/output.json"
 	go func() {
 		// Wait a second
 		time.Sleep(time.Second)
 		// Write the file
-		fo.Write([]byte("string"))
-		// Close up, we're done here
-		fo.Close()
+		ioutil.WriteFile(filename, []byte(`{"Name": "/output", "Config": {"Image": "busybox"}}`), 0644)
 	}()
 
 	t.Log("Waiting for file to change")
-OuterLoop:
-	for {
-		select {
-		case event := <-fileChannel:
-			t.Log("Got event about:", event.Filename)
-			if event.Filename == "/tmp/output.txt" {
-				t.Log("Passing notification back in")
-				fileChannel <- event
-				break OuterLoop
-			}
-		case <-time.After(2 * time.Second):
-			t.Error("Timeout waiting for modify event")
+	select {
+	case event := <-writeChannel:
+		t.Log("Got event about:", event.Name)
+		if event.Kind != channel.Upsert || event.Name != "output" {
+			t.Errorf("Expected an upsert for output, got %s %s", event.Kind, event.Name)
+		}
+		if event.Spec.Config.Image != "busybox" {
+			t.Errorf("Expected image busybox, got %s", event.Spec.Config.Image)
 		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timeout waiting for modify event")
+	}
+
+	t.Log("Writing an invalid file")
+	ioutil.WriteFile(directory+"/broken.json", []byte(`{"Name": "broken"}`), 0644)
+	select {
+	case event := <-writeChannel:
+		t.Errorf("Didn't expect an event, got %s %s", event.Kind, event.Name)
+	case <-time.After(time.Second):
 	}
 
 	t.Log("Removing file")
-	os.Remove("/tmp/output.txt")
-OuterLoopB:
-	for {
-		select {
-		case event := <-fileChannel:
-			if event.Filename == "/tmp/output.txt" {
-				break OuterLoopB
-			} else {
-				t.Log("File changed is not output.txt it's %v", event.Filename)
-			}
-		case <-time.After(2 * time.Second):
-			t.Error("Timeout waiting for remove event")
+	os.Remove(filename)
+	select {
+	case event := <-writeChannel:
+		if event.Kind != channel.Delete || event.Name != "output" {
+			t.Errorf("Expected a delete for output, got %s %s", event.Kind, event.Name)
 		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timeout waiting for remove event")
+	}
+}
+
+func TestSpecs(t *testing.T) {
+	directory := t.TempDir()
+	ioutil.WriteFile(directory+"/web.json", []byte(`{"Name": "/web", "Config": {"Image": "nginx"}}`), 0644)
+	ioutil.WriteFile(directory+"/web2.json", []byte(`{"Name": "/web", "Config": {"Image": "httpd"}}`), 0644)
+	ioutil.WriteFile(directory+"/broken.json", []byte(`{"Name": "broken"}`), 0644)
+
+	dir, err := New(directory)
+	if err != nil {
+		t.Fatal("Couldn't create a new watcher on", directory)
 	}
+	specs, err := dir.Specs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(specs) != 1 || specs[0].Name != "web" || specs[0].Config.Image != "nginx" {
+		t.Errorf("Expected just web from web.json, got %v", specs)
+	}
+}
 
+func TestWrite(t *testing.T) {
+	directory := t.TempDir()
+	ioutil.WriteFile(directory+"/app.yaml", []byte("Name: web\nConfig:\n  Image: nginx\n"), 0644)
+
+	dir, err := New(directory)
+	if err != nil {
+		t.Fatal("Couldn't create a new watcher on", directory)
+	}
+	spec, _ := channel.Decode([]byte(`{"Name": "/db", "Config": {"Image": "postgres"}}`))
+	if err = dir.Write(channel.NewUpsert(spec)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(directory + "/db.json"); err != nil {
+		t.Error("Expected db.json written:", err)
+	}
+	if err = dir.Check(channel.NewDelete("web")); err == nil || err.Error() != "not touching web, it's managed in "+directory+"/app.yaml" {
+		t.Errorf("Expected Check to refuse web in app.yaml, got %v", err)
+	}
+	if err = dir.Check(channel.NewDelete("db")); err != nil {
+		t.Error("Expected db to be fine to delete, got", err)
+	}
+	if err = dir.Write(channel.NewDelete("web")); err == nil {
+		t.Error("Expected web to be left alone in app.yaml")
+	}
+	if err = dir.Write(channel.NewDelete("db")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(directory + "/db.json"); !os.IsNotExist(err) {
+		t.Error("Expected db.json removed")
+	}
 }
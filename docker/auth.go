@@ -0,0 +1,234 @@
+package docker
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/brimstone/watchdock/reference"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// dockerHub is how docker's own config.json names Docker Hub.
+const dockerHub = "https://index.docker.io/v1/"
+
+// Login is one set of registry credentials from watchdock's logins file.
+type Login struct {
+	// Registry is the host[:port] these credentials are for. Logins
+	// without one are only used when a spec asks for them by name.
+	Registry      string
+	Username      string
+	Password      string
+	IdentityToken string `yaml:"identitytoken"`
+}
+
+// registryAuth finds the credentials to pull an image with.
+type registryAuth struct {
+	// the docker CLI's config.json
+	dockerConfig string
+	// watchdock's own logins, by name, replaced whole when they're reloaded
+	lock   sync.Mutex
+	logins map[string]Login
+}
+
+func newRegistryAuth() *registryAuth {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".docker")
+	}
+	return &registryAuth{
+		dockerConfig: filepath.Join(dir, "config.json"),
+		logins:       make(map[string]Login),
+	}
+}
+
+// LoadLogins reads named registry logins from a YAML or JSON file, in place
+// of any it read before, like
+//
+//	logins:
+//	  deploy:
+//	    registry: registry.example.com:5000
+//	    username: deploy
+//	    password: secret
+func (self *Processing) LoadLogins(filename string) error {
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var file struct {
+		Logins map[string]Login
+	}
+	err = yaml.Unmarshal(raw, &file)
+	if err != nil {
+		return fmt.Errorf("%s: %s", filename, err.Error())
+	}
+	logins := make(map[string]Login)
+	for name, login := range file.Logins {
+		login.Registry = normalizeRegistry(login.Registry)
+		logins[name] = login
+	}
+	self.auth.lock.Lock()
+	defer self.auth.lock.Unlock()
+	self.auth.logins = logins
+	return nil
+}
+
+// normalizeRegistry turns the many ways of writing a registry down, like
+// "https://index.docker.io/v1/", into just its host[:port].
+func normalizeRegistry(registry string) string {
+	registry = strings.TrimPrefix(registry, "https://")
+	registry = strings.TrimPrefix(registry, "http://")
+	if slash := strings.Index(registry, "/"); slash >= 0 {
+		registry = registry[:slash]
+	}
+	switch registry {
+	case "index.docker.io", "registry-1.docker.io":
+		return reference.DefaultRegistry
+	}
+	return registry
+}
+
+// serverAddress is what a credential helper expects to be asked about.
+func serverAddress(registry string) string {
+	if registry == reference.DefaultRegistry {
+		return dockerHub
+	}
+	return registry
+}
+
+// resolve picks credentials for image. A named login from the spec wins,
+// then a login for the image's registry, then whatever docker itself would
+// use from config.json. No credentials at all is fine for public images.
+func (auth *registryAuth) resolve(image *reference.Reference, name string) (dockerclient.AuthConfiguration, error) {
+	registry := image.Registry
+	auth.lock.Lock()
+	logins := auth.logins
+	auth.lock.Unlock()
+	if name != "" {
+		login, ok := logins[name]
+		if !ok {
+			return dockerclient.AuthConfiguration{}, fmt.Errorf("no registry login named %s", name)
+		}
+		// never hand a login's credentials to some other registry
+		if login.Registry != "" && login.Registry != registry {
+			return dockerclient.AuthConfiguration{}, fmt.Errorf("registry login %s is for %s, not %s", name, login.Registry, registry)
+		}
+		return login.config(registry), nil
+	}
+	for _, login := range logins {
+		if login.Registry == registry {
+			return login.config(registry), nil
+		}
+	}
+	return auth.fromDockerConfig(registry)
+}
+
+func (login Login) config(registry string) dockerclient.AuthConfiguration {
+	return dockerclient.AuthConfiguration{
+		Username:      login.Username,
+		Password:      login.Password,
+		IdentityToken: login.IdentityToken,
+		ServerAddress: serverAddress(registry),
+	}
+}
+
+// fromDockerConfig reads config.json the way the docker CLI does: a
+// credHelpers entry for the registry first, then auths, then credsStore.
+func (auth *registryAuth) fromDockerConfig(registry string) (dockerclient.AuthConfiguration, error) {
+	raw, err := ioutil.ReadFile(auth.dockerConfig)
+	if os.IsNotExist(err) {
+		return dockerclient.AuthConfiguration{}, nil
+	}
+	if err != nil {
+		return dockerclient.AuthConfiguration{}, err
+	}
+	var config struct {
+		Auths map[string]struct {
+			Auth          string
+			IdentityToken string
+		}
+		CredsStore  string
+		CredHelpers map[string]string
+	}
+	err = json.Unmarshal(raw, &config)
+	if err != nil {
+		return dockerclient.AuthConfiguration{}, fmt.Errorf("%s: %s", auth.dockerConfig, err.Error())
+	}
+	for key, helper := range config.CredHelpers {
+		if normalizeRegistry(key) == registry {
+			return credentialHelper(helper, registry)
+		}
+	}
+	for key, entry := range config.Auths {
+		if normalizeRegistry(key) != registry {
+			continue
+		}
+		result := dockerclient.AuthConfiguration{
+			IdentityToken: entry.IdentityToken,
+			ServerAddress: serverAddress(registry),
+		}
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return result, fmt.Errorf("bad auth for %s in %s", key, auth.dockerConfig)
+			}
+			pair := strings.SplitN(string(decoded), ":", 2)
+			if len(pair) != 2 {
+				return result, fmt.Errorf("bad auth for %s in %s", key, auth.dockerConfig)
+			}
+			result.Username = pair[0]
+			result.Password = pair[1]
+		}
+		// with a credsStore, auths only lists which registries it has
+		if result.Username != "" || result.IdentityToken != "" || config.CredsStore == "" {
+			return result, nil
+		}
+	}
+	if config.CredsStore != "" {
+		return credentialHelper(config.CredsStore, registry)
+	}
+	return dockerclient.AuthConfiguration{}, nil
+}
+
+// credentialHelper asks docker-credential-<helper> for the registry's
+// credentials, just like the docker CLI.
+func credentialHelper(helper string, registry string) (dockerclient.AuthConfiguration, error) {
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(serverAddress(registry))
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		message := strings.TrimSpace(stdout.String() + stderr.String())
+		// helpers say so on stdout when they don't know the registry
+		if strings.Contains(message, "credentials not found") {
+			return dockerclient.AuthConfiguration{}, nil
+		}
+		return dockerclient.AuthConfiguration{}, fmt.Errorf("docker-credential-%s: %s %s", helper, err.Error(), message)
+	}
+	var credentials struct {
+		Username string
+		Secret   string
+	}
+	err = json.Unmarshal(stdout.Bytes(), &credentials)
+	if err != nil {
+		return dockerclient.AuthConfiguration{}, fmt.Errorf("docker-credential-%s: %s", helper, err.Error())
+	}
+	result := dockerclient.AuthConfiguration{ServerAddress: serverAddress(registry)}
+	// helpers hand back identity tokens with this made up user name
+	if credentials.Username == "<token>" {
+		result.IdentityToken = credentials.Secret
+	} else {
+		result.Username = credentials.Username
+		result.Password = credentials.Secret
+	}
+	return result, nil
+}
@@ -0,0 +1,99 @@
+package docker
+
+import (
+	"github.com/brimstone/watchdock/reference"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const dockerConfigExample = `{
+	"auths": {
+		"https://index.docker.io/v1/": {"auth": "aHViOmh1YnBhc3M="},
+		"registry.example.com": {"auth": "cGxhaW46cGxhaW5wYXNz"},
+		"stored.example.com": {}
+	},
+	"credsStore": "store",
+	"credHelpers": {
+		"helped.example.com:5000": "helper"
+	}
+}`
+
+// helperScript answers like a docker credential helper that only knows
+// about one registry.
+func helperScript(registry string, username string) string {
+	return "#!/bin/sh\n" +
+		"read server\n" +
+		"if [ \"$server\" = \"" + registry + "\" ]; then\n" +
+		"  echo '{\"ServerURL\": \"" + registry + "\", \"Username\": \"" + username + "\", \"Secret\": \"s3cret\"}'\n" +
+		"  exit 0\n" +
+		"fi\n" +
+		"echo 'credentials not found in native keychain'\n" +
+		"exit 1\n"
+}
+
+func TestResolve(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(dockerConfigExample), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "docker-credential-helper"), []byte(helperScript("helped.example.com:5000", "helped")), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "docker-credential-store"), []byte(helperScript("stored.example.com", "stored")), 0755)
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("DOCKER_CONFIG", dir)
+	ioutil.WriteFile(filepath.Join(dir, "logins.yaml"), []byte(`
+logins:
+  deploy:
+    username: deploy
+    password: hunter2
+  ci:
+    registry: https://ci.example.com/v2/
+    username: ci
+    password: build
+`), 0600)
+
+	processing := &Processing{auth: newRegistryAuth()}
+	err := processing.LoadLogins(filepath.Join(dir, "logins.yaml"))
+	if err != nil {
+		t.Fatal("Couldn't load logins:", err)
+	}
+
+	var tests = []struct {
+		image, login         string
+		username, password   string
+		serverAddress, error string
+	}{
+		{"nginx", "", "hub", "hubpass", dockerHub, ""},
+		{"library/nginx:1.17", "", "hub", "hubpass", dockerHub, ""},
+		{"registry.example.com/team/app", "", "plain", "plainpass", "registry.example.com", ""},
+		{"helped.example.com:5000/app:1.0", "", "helped", "s3cret", "helped.example.com:5000", ""},
+		{"stored.example.com/app", "", "stored", "s3cret", "stored.example.com", ""},
+		{"ci.example.com/app", "", "ci", "build", "ci.example.com", ""},
+		{"ci.example.com/app", "deploy", "deploy", "hunter2", "ci.example.com", ""},
+		// the credsStore doesn't know this one, which means anonymous
+		{"unknown.example.com/app", "", "", "", "", ""},
+		{"nginx", "missing", "", "", "", "no registry login named missing"},
+		{"ci.example.com/app", "ci", "ci", "build", "ci.example.com", ""},
+		{"evil.example.com/app", "ci", "", "", "", "registry login ci is for ci.example.com, not evil.example.com"},
+	}
+	for _, c := range tests {
+		image, err := reference.Parse(c.image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		auth, err := processing.auth.resolve(image, c.login)
+		if c.error != "" {
+			if err == nil || err.Error() != c.error {
+				t.Errorf("resolve(%q, %q) error == %v, want %q", c.image, c.login, err, c.error)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("resolve(%q, %q) error == %v", c.image, c.login, err)
+			continue
+		}
+		if auth.Username != c.username || auth.Password != c.password || auth.ServerAddress != c.serverAddress {
+			t.Errorf("resolve(%q, %q) == %s:%s@%s, want %s:%s@%s", c.image, c.login,
+				auth.Username, auth.Password, auth.ServerAddress, c.username, c.password, c.serverAddress)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package docker
+
+import (
+	"fmt"
+	"github.com/brimstone/watchdock/channel"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"strings"
+)
+
+// dependencyOrder sorts containers so each one comes after everything it
+// depends on, and otherwise keeps them in the order they came in.
+// Dependencies on containers we don't manage don't change the order.
+func dependencyOrder(containers []Container) ([]Container, error) {
+	byName := make(map[string]Container)
+	for _, c := range containers {
+		byName[channel.CleanName(c.Name)] = c
+	}
+	const (
+		visiting = 1
+		done     = 2
+	)
+	marks := make(map[string]int)
+	var ordered []Container
+	var path []string
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch marks[name] {
+		case done:
+			return nil
+		case visiting:
+			// the cycle is whatever's on the path from name back to name
+			for i := range path {
+				if path[i] == name {
+					return fmt.Errorf("dependency cycle: %s -> %s", strings.Join(path[i:], " -> "), name)
+				}
+			}
+		}
+		marks[name] = visiting
+		path = append(path, name)
+		for _, dependency := range byName[name].DependsOn {
+			if _, ok := byName[dependency.Name]; !ok {
+				continue
+			}
+			err := visit(dependency.Name)
+			if err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		marks[name] = done
+		ordered = append(ordered, byName[name])
+		return nil
+	}
+	for _, c := range containers {
+		err := visit(channel.CleanName(c.Name))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// checkDependencies makes sure container wouldn't close a dependency cycle
+// with what we already have.
+func (self *Processing) checkDependencies(container Container) error {
+	containers := []Container{container}
+	for _, c := range self.state.list() {
+		if c.Name != container.Name {
+			containers = append(containers, c)
+		}
+	}
+	_, err := dependencyOrder(containers)
+	return err
+}
+
+// ordered is every container we manage, dependencies first.
+func (self *Processing) ordered() []Container {
+	containers := self.state.list()
+	ordered, err := dependencyOrder(containers)
+	if err != nil {
+		// checkDependencies keeps these out, so this is only a safety net
+		logit("Error ordering containers:", err.Error())
+		return containers
+	}
+	return ordered
+}
+
+// waitingOn says which dependency container is still waiting for, if any.
+func (self *Processing) waitingOn(container Container) string {
+	for _, dependency := range container.DependsOn {
+		name := "/" + dependency.Name
+		if replicas := self.state.replicasOf(dependency.Name); len(replicas) > 0 {
+			// the first replica stands for all of them
+			name = replicas[0].Name
+		}
+		running, err := self.findContainerByName(name, true)
+		if err != nil {
+			return dependency.Name + " to run"
+		}
+		if dependency.Condition == channel.DependsHealthy && !self.isHealthy(running) {
+			return dependency.Name + " to be healthy"
+		}
+	}
+	return ""
+}
+
+// healthy is whether docker says the container passes its healthcheck.
+// Containers without one count as healthy as soon as they run.
+func healthy(container *dockerclient.Container) bool {
+	status := container.State.Health.Status
+	return status == "healthy" || status == ""
+}
+
+// dependents is everything that depends on name, directly or not, in the
+// order they have to be stopped in: the furthest from name first.
+func (self *Processing) dependents(name string) []Container {
+	name = channel.CleanName(name)
+	ordered := self.ordered()
+	affected := map[string]bool{name: true}
+	var result []Container
+	for _, c := range ordered {
+		for _, dependency := range c.DependsOn {
+			if affected[dependency.Name] {
+				affected[channel.CleanName(c.Name)] = true
+				result = append(result, c)
+				break
+			}
+		}
+	}
+	// reversed, so nothing is stopped before what depends on it
+	for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+		result[i], result[j] = result[j], result[i]
+	}
+	return result
+}
+
+// stopDependents stops everything depending on name before name itself
+// goes down, in reverse dependency order. CheckOnContainers starts them
+// again, in order, once name is back.
+func (self *Processing) stopDependents(name string) {
+	for _, c := range self.dependents(name) {
+		running, err := self.findContainerByName(c.Name, true)
+		if err != nil {
+			continue
+		}
+		logit("Stopping", c.Name, "since it depends on", name)
+		self.state.stoppedOnPurpose(c.Name)
+		err = self.docker.StopContainer(running.ID, 10)
+		if err != nil {
+			logit("Error stopping", c.Name, err.Error())
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package docker
+
+import (
+	"fmt"
+	"github.com/brimstone/watchdock/reference"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"reflect"
+	"strings"
+)
+
+// change is a single way a running container differs from its spec.
+type change struct {
+	Field string
+	Want  interface{}
+	Have  interface{}
+}
+
+func (c change) String() string {
+	return fmt.Sprintf("%s: want %v, have %v", c.Field, c.Want, c.Have)
+}
+
+// normalizeImage makes "nginx" and "docker.io/library/nginx:latest"
+// compare equal.
+func normalizeImage(image string) string {
+	ref, err := reference.Parse(image)
+	if err != nil {
+		return image
+	}
+	return ref.String()
+}
+
+// envMap only keeps the variables the spec cares about, docker adds
+// everything from the image on top of them.
+func envMap(env []string, keep []string) map[string]string {
+	wanted := make(map[string]bool)
+	for _, e := range keep {
+		wanted[strings.SplitN(e, "=", 2)[0]] = true
+	}
+	result := make(map[string]string)
+	for _, e := range env {
+		pair := strings.SplitN(e, "=", 2)
+		if !wanted[pair[0]] {
+			continue
+		}
+		if len(pair) == 1 {
+			pair = append(pair, "")
+		}
+		result[pair[0]] = pair[1]
+	}
+	return result
+}
+
+func contains(list []string, item string) bool {
+	for _, l := range list {
+		if l == item {
+			return true
+		}
+	}
+	return false
+}
+
+// diffContainer lists everything in the spec that doesn't match what docker
+// is actually running. Only fields the spec sets are compared, since docker
+// fills in the rest from the image and its own defaults.
+func diffContainer(want *Container, have *dockerclient.Container) []change {
+	var changes []change
+	add := func(field string, w interface{}, h interface{}) {
+		if !reflect.DeepEqual(w, h) {
+			changes = append(changes, change{Field: field, Want: w, Have: h})
+		}
+	}
+	wc := want.Config
+	hc := have.Config
+	if hc == nil {
+		hc = new(dockerclient.Config)
+	}
+	if wc != nil {
+		add("Image", normalizeImage(wc.Image), normalizeImage(hc.Image))
+		if len(wc.Cmd) > 0 {
+			add("Cmd", wc.Cmd, hc.Cmd)
+		}
+		if len(wc.Entrypoint) > 0 {
+			add("Entrypoint", wc.Entrypoint, hc.Entrypoint)
+		}
+		if len(wc.Env) > 0 {
+			add("Env", envMap(wc.Env, wc.Env), envMap(hc.Env, wc.Env))
+		}
+		for port := range wc.ExposedPorts {
+			if _, ok := hc.ExposedPorts[port]; !ok {
+				add("ExposedPorts", port, nil)
+			}
+		}
+		for volume := range wc.Volumes {
+			if _, ok := hc.Volumes[volume]; !ok {
+				add("Volumes", volume, nil)
+			}
+		}
+		for key, value := range wc.Labels {
+			add("Labels."+key, value, hc.Labels[key])
+		}
+		if wc.User != "" {
+			add("User", wc.User, hc.User)
+		}
+		if wc.WorkingDir != "" {
+			add("WorkingDir", wc.WorkingDir, hc.WorkingDir)
+		}
+		if wc.Healthcheck != nil {
+			add("Healthcheck", wc.Healthcheck, hc.Healthcheck)
+		}
+	}
+	wh := want.HostConfig
+	hh := have.HostConfig
+	if hh == nil {
+		hh = new(dockerclient.HostConfig)
+	}
+	if wh != nil {
+		if len(wh.Binds) > 0 || len(hh.Binds) > 0 {
+			add("Binds", wh.Binds, hh.Binds)
+		}
+		if len(wh.PortBindings) > 0 || len(hh.PortBindings) > 0 {
+			add("PortBindings", wh.PortBindings, hh.PortBindings)
+		}
+		if wh.RestartPolicy.Name != "" {
+			add("RestartPolicy", wh.RestartPolicy, hh.RestartPolicy)
+		}
+		if wh.NetworkMode != "" {
+			add("NetworkMode", wh.NetworkMode, hh.NetworkMode)
+		}
+		add("Privileged", wh.Privileged, hh.Privileged)
+		if len(wh.Mounts) > 0 {
+			add("Mounts", wh.Mounts, hh.Mounts)
+		}
+		if len(wh.Ulimits) > 0 {
+			add("Ulimits", wh.Ulimits, hh.Ulimits)
+		}
+		if len(wh.CapAdd) > 0 {
+			add("CapAdd", wh.CapAdd, hh.CapAdd)
+		}
+		if len(wh.CapDrop) > 0 {
+			add("CapDrop", wh.CapDrop, hh.CapDrop)
+		}
+		if wh.LogConfig.Type != "" {
+			add("LogConfig", wh.LogConfig, hh.LogConfig)
+		}
+		if wh.Memory != 0 {
+			add("Memory", wh.Memory, hh.Memory)
+		}
+		if wh.NanoCPUs != 0 {
+			add("NanoCPUs", wh.NanoCPUs, hh.NanoCPUs)
+		}
+		if wh.CPUShares != 0 {
+			add("CPUShares", wh.CPUShares, hh.CPUShares)
+		}
+	}
+	if want.NetworkingConfig != nil {
+		var networks map[string]dockerclient.ContainerNetwork
+		if have.NetworkSettings != nil {
+			networks = have.NetworkSettings.Networks
+		}
+		for name, endpoint := range want.NetworkingConfig.EndpointsConfig {
+			network, ok := networks[name]
+			if !ok {
+				add("Networks."+name, "connected", "not connected")
+				continue
+			}
+			for _, alias := range endpoint.Aliases {
+				if !contains(network.Aliases, alias) {
+					add("Networks."+name+".Aliases", endpoint.Aliases, network.Aliases)
+					break
+				}
+			}
+		}
+	}
+	return changes
+}
@@ -1,12 +1,17 @@
 package docker
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
-	"github.com/davecgh/go-spew/spew"
+	"fmt"
+	"github.com/brimstone/watchdock/channel"
+	"github.com/brimstone/watchdock/metrics"
+	"github.com/brimstone/watchdock/reference"
 	dockerclient "github.com/fsouza/go-dockerclient"
 	"log"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,293 +20,463 @@ func logit(v ...interface{}) {
 }
 
 type Processing struct {
-	docker     *dockerclient.Client
-	containers []Container
-	Images     map[string]string
+	docker   *dockerclient.Client
+	endpoint Endpoint
+	state    *store
+	backoff  backoff
+	// how long containers that keep failing wait between restarts
+	restartBackoff backoff
+	auth           *registryAuth
+	// 1 while the docker event stream is up
+	connected int32
+	// anyone can ask for a reconcile, Sync does it
+	reconcile chan struct{}
+	// where Sync sends its events, for anything that isn't a docker event
+	events chan<- channel.Event
+	// cancelled once Sync has been asked to stop, which then waits for
+	// everything in work to finish
+	ctx  context.Context
+	work sync.WaitGroup
+	// what the config file says, which can change while we run
+	options     Options
+	optionsLock sync.Mutex
 }
 
-type Container struct {
-	ID         string
-	Name       string
-	Image      string
-	Protect    bool
-	Config     *dockerclient.Config
-	HostConfig *dockerclient.HostConfig
-}
-
-func (self *Processing) findInternalContainerByName(name string) (*Container, error) {
-	for i, _ := range self.containers {
-		c := &self.containers[i]
-		if c.Name == name {
-			return c, nil
-		}
-	}
-	return nil, errors.New("container not found")
+// Options are the settings from watchdock's config file.
+type Options struct {
+	// how often everything is checked on
+	ReconcileInterval time.Duration
+	// the environment variable, or NAME=value, that marks our containers
+	Selector string
+	// whether images left without a tag are removed
+	CleanUntaggedImages bool
 }
 
-func (self *Processing) findInternalContainerByID(ID string) (*Container, error) {
-	logit("Searching for", ID)
-	for i, _ := range self.containers {
-		c := &self.containers[i]
-		if c.ID == ID {
-			logit("Found it")
-			return c, nil
-		}
-	}
-	spew.Dump(self.containers)
-	logit("not found")
-	return nil, errors.New("container not found")
-}
+var defaultOptions = Options{ReconcileInterval: 10 * time.Second, Selector: "WATCHDOCK", CleanUntaggedImages: true}
 
-func (self *Processing) appendContainer(container Container) {
-	var c *Container
-	var err error
-	c, err = self.findInternalContainerByName(container.Name)
-	if err != nil {
-		logit("Error", err.Error())
-	}
-	if c != nil {
-		if container.ID != "" {
-			c.ID = container.ID
-		}
-		c.Config = container.Config
-		c.HostConfig = container.HostConfig
-		logit("Found container already!", c.Name)
-	} else {
-		logit("Couldn't find existing container to update, adding a new one")
-		for _, c := range self.containers {
-			logit("Container", c.ID, c.Name, c.Image)
-		}
-		logit("New container", container.Name, container.Image)
-		self.containers = append(self.containers, container)
-	}
+type Container struct {
+	ID               string
+	Name             string
+	Image            string
+	Protect          bool
+	Config           *dockerclient.Config
+	HostConfig       *dockerclient.HostConfig
+	NetworkingConfig *dockerclient.NetworkingConfig
+	// the registry login to pull Image with, if any
+	RegistryAuth string
+	// when to move to a newer image, nil for the default
+	Update *channel.UpdatePolicy
+	// how to move to it, nil for the default
+	Rollout *channel.Rollout
+	// what has to be up before this starts
+	DependsOn []channel.Dependency
+	// the probe we run ourselves, if any
+	Health *channel.Probe
+	// the spec this is one of the replicas of, if any
+	ReplicaOf string
 }
 
-func (self *Processing) Init(socket string) error {
+func (self *Processing) Init(endpoint Endpoint) error {
 	var err error
-	// Connect to our docker instance
-	self.docker, err = dockerclient.NewClient(socket)
+	// nothing is asked of docker until Connect
+	self.endpoint = endpoint
+	self.docker, err = newClient(endpoint, "")
 	if err != nil {
 		return err
 	}
-	//self.containers = new([]Container)
-	self.Images = make(map[string]string)
+	self.state = newStore()
+	self.backoff = defaultBackoff
+	self.restartBackoff = defaultRestartBackoff
+	self.auth = newRegistryAuth()
+	self.connected = 1
+	self.reconcile = make(chan struct{}, 1)
+	self.ctx = context.Background()
+	self.options = defaultOptions
 	return nil
 }
 
-func (self *Processing) sendContainer(channel chan<- map[string]interface{}, container *dockerclient.Container) {
-	rawContainer, err := json.Marshal(container)
-	if err != nil {
-		log.Fatal(err)
+// SetOptions takes new settings, even while Sync is running.
+func (self *Processing) SetOptions(options Options) {
+	self.optionsLock.Lock()
+	defer self.optionsLock.Unlock()
+	self.options = options
+}
+
+func (self *Processing) currentOptions() Options {
+	self.optionsLock.Lock()
+	defer self.optionsLock.Unlock()
+	return self.options
+}
+
+// background runs f in its own goroutine, which Sync waits for before it
+// returns.
+func (self *Processing) background(f func()) {
+	self.work.Add(1)
+	go func() {
+		defer self.work.Done()
+		f()
+	}()
+}
+
+// stopping reports whether Sync has been asked to stop.
+func (self *Processing) stopping() bool {
+	return self.ctx.Err() != nil
+}
+
+func (self *Processing) sendContainer(events chan<- channel.Event, container *dockerclient.Container) {
+	if replicaOf(container) != "" {
+		// storage only knows the spec it's a replica of
+		return
+	}
+	spec := self.exportSpec(container)
+	// docker doesn't know which login we pulled with
+	if known, err := self.state.byName(container.Name); err == nil {
+		spec.RegistryAuth = known.RegistryAuth
+		spec.Update = known.Update
+		spec.Rollout = known.Rollout
+		spec.DependsOn = known.DependsOn
+		spec.Health = known.Health
 	}
-	containerObj := new(map[string]interface{})
-	err = json.Unmarshal(rawContainer, &containerObj)
+	err := spec.Validate()
 	if err != nil {
-		log.Fatal(err)
+		logit("Not sending", container.Name, err.Error())
+		return
 	}
-	channel <- *containerObj
+	events <- channel.NewUpsert(spec)
+}
+
+func (self *Processing) sendStatus(events chan<- channel.Event, name string, ID string, running bool, message string) {
+	events <- channel.NewStatus(name, &channel.State{
+		ID:      ID,
+		Running: running,
+		Message: message,
+	})
 }
 
-func (self *Processing) scanContainers(channel chan<- map[string]interface{}) error {
+func (self *Processing) scanContainers(events chan<- channel.Event) error {
 	// Get a list of what's currently running
-	runningContainers, err := self.docker.ListContainers(dockerclient.ListContainersOptions{All: true})
+	var runningContainers []dockerclient.APIContainers
+	err := self.retry("listing containers", func() error {
+		var err error
+		runningContainers, err = self.docker.ListContainers(dockerclient.ListContainersOptions{All: true})
+		return err
+	})
 	if err != nil {
-		log.Fatal(err)
+		logit("Couldn't scan containers:", err.Error())
+		return err
 	}
 	// Send all of the valid containers back to the storage module
 	for _, c := range runningContainers {
 		logit("Found already running container", c.Names[0])
-		fullContainer, err := self.docker.InspectContainer(c.ID)
-		if !self.shouldRun(fullContainer) {
+		fullContainer, err := self.inspect(c.ID)
+		if err != nil {
+			logit("Couldn't inspect", c.Names[0], err.Error())
 			continue
 		}
-		if err != nil {
-			log.Fatal(err)
+		if !self.shouldRun(fullContainer) || self.state.isRemoving(c.Names[0]) {
+			continue
 		}
 		container := Container{
-			Name:       c.Names[0],
-			ID:         c.ID,
-			Image:      c.Image,
-			Config:     fullContainer.Config,
-			HostConfig: fullContainer.HostConfig,
+			Name:             c.Names[0],
+			ID:               c.ID,
+			Image:            c.Image,
+			Config:           fullContainer.Config,
+			HostConfig:       fullContainer.HostConfig,
+			NetworkingConfig: networkingConfig(fullContainer),
+			ReplicaOf:        replicaOf(fullContainer),
+		}
+		if known, err := self.state.byName(container.Name); err == nil {
+			container.RegistryAuth = known.RegistryAuth
+			container.Update = known.Update
+			container.Rollout = known.Rollout
+			container.DependsOn = known.DependsOn
+			container.Health = known.Health
 		}
-		self.appendContainer(container)
-		self.sendContainer(channel, fullContainer)
+		self.state.upsert(container)
+		self.sendContainer(events, fullContainer)
 	}
 	return nil
 }
 
-func (self *Processing) listenToDocker(channel chan<- map[string]interface{}) {
-	blah := make(chan *dockerclient.APIEvents, 10)
-	self.docker.AddEventListener(blah)
-	for {
-		event := <-blah
-		switch event.Status {
-		case "start":
-			container, err := self.docker.InspectContainer(event.ID)
-			if err != nil {
-				log.Fatal(err)
-			}
-			if !self.shouldRun(container) {
-				logit("Not monitoring", container.Name)
-				continue
-			}
-			if _, ok := self.findInternalContainerByName(container.Name); ok != nil {
-				c := Container{
-					Name:    container.Name,
-					ID:      event.ID,
-					Image:   container.Image,
-					Protect: false,
-				}
-				self.containers = append(self.containers, c)
-				self.sendContainer(channel, container)
-			}
-		case "destroy":
-			// When a container is destroyed, all I'm going to know is the ID.
-			// I need to lookup the name from the ID, and send an event with some special attribute.
-			// This attribute will inform the storage module that it should forget what it knows about the container by this name.
-			container, err := self.findInternalContainerByID(event.ID)
-			if err != nil {
-				logit("Err", err)
-				continue
+// inspect is InspectContainer that rides out docker hiccups.
+func (self *Processing) inspect(ID string) (*dockerclient.Container, error) {
+	var container *dockerclient.Container
+	err := self.retry("inspecting "+ID, func() error {
+		var err error
+		container, err = self.docker.InspectContainer(ID)
+		return err
+	})
+	return container, err
+}
+
+// listenToDocker follows the docker event stream. The stream only ends when
+// docker goes away, so then we wait for it to come back, subscribe again
+// and look at everything afresh.
+func (self *Processing) listenToDocker(events chan<- channel.Event) {
+	for reconnected := false; ; reconnected = true {
+		blah := make(chan *dockerclient.APIEvents, 10)
+		err := self.docker.AddEventListener(blah)
+		if err != nil {
+			logit("Couldn't listen for docker events:", err.Error())
+		} else {
+			if reconnected {
+				// anything could have happened while we weren't listening
+				self.background(func() { self.scanContainers(events) })
+				self.Reconcile()
 			}
-			if container.Protect {
-				logit("This container is protected")
-				continue
+			if !self.follow(events, blah) {
+				logit("Done listening for docker events")
+				self.docker.RemoveEventListener(blah)
+				return
 			}
-			logit("Sending notification about this not existing")
-			obj := make(map[string]interface{})
-			obj["Name"] = container.Name
-			obj["deleteme"] = true
-			for i, c := range self.containers {
-				if c.ID == event.ID {
-					if i == 0 {
-						self.containers = self.containers[1:]
-					} else if i == len(self.containers) {
-						self.containers = self.containers[0 : len(self.containers)-1]
-					} else {
-						self.containers = append(self.containers[:i], self.containers[i+1:]...)
-					}
-				}
+		}
+		atomic.StoreInt32(&self.connected, 0)
+		logit("Lost the docker event stream")
+		if !self.reconnect() {
+			return
+		}
+		atomic.StoreInt32(&self.connected, 1)
+	}
+}
+
+// follow handles docker events until the stream ends, or reports false if
+// we're stopping.
+func (self *Processing) follow(events chan<- channel.Event, blah <-chan *dockerclient.APIEvents) bool {
+	for {
+		select {
+		case event, ok := <-blah:
+			if !ok {
+				return true
 			}
-			channel <- obj
+			self.handleEvent(events, event)
+		case <-self.ctx.Done():
+			return false
+		}
+	}
+}
 
-		default:
-			logit("Docker says", event.ID, event.Status)
+func (self *Processing) handleEvent(events chan<- channel.Event, event *dockerclient.APIEvents) {
+	metrics.DockerEvents.WithLabelValues(event.Status).Inc()
+	switch event.Status {
+	case "start":
+		container, err := self.inspect(event.ID)
+		if err != nil {
+			logit("Couldn't inspect", event.ID, err.Error())
+			return
+		}
+		if !self.shouldRun(container) || self.state.isRemoving(container.Name) {
+			logit("Not monitoring", container.Name)
+			return
+		}
+		c := Container{
+			Name:      container.Name,
+			ID:        event.ID,
+			Image:     container.Image,
+			ReplicaOf: replicaOf(container),
+		}
+		if self.state.add(c) {
+			self.sendContainer(events, container)
+		}
+		self.sendStatus(events, container.Name, event.ID, true, "started")
+		if self.state.hasDependents(container.Name) {
+			// whatever was waiting on this may go now
+			self.Reconcile()
 		}
+	case "health_status: healthy":
+		container, err := self.state.byID(event.ID)
+		if err == nil && self.state.hasDependents(container.Name) {
+			self.Reconcile()
+		}
+	case "die":
+		container, err := self.state.byID(event.ID)
+		if err != nil {
+			return
+		}
+		self.sendStatus(events, container.Name, event.ID, false, "exited")
+	case "destroy":
+		if c, err := self.state.byID(event.ID); err == nil && c.ReplicaOf != "" && !c.Protect {
+			// the spec still wants it, only deleting the spec removes it
+			logit("Replica", c.Name, "was removed, starting it again")
+			self.Reconcile()
+			return
+		}
+		// When a container is destroyed, all I'm going to know is the ID.
+		// I need to lookup the name from the ID, and send an event with some special attribute.
+		// This attribute will inform the storage module that it should forget what it knows about the container by this name.
+		container, err := self.state.forget(event.ID)
+		if err != nil {
+			logit("Not forgetting", event.ID, err.Error())
+			return
+		}
+		logit("Sending notification about this not existing")
+		events <- channel.NewDelete(container.Name)
+
+	default:
+		logit("Docker says", event.ID, event.Status)
 	}
 }
 
-func (self *Processing) Sync(readChannel <-chan map[string]interface{}, writeChannel chan<- map[string]interface{}) {
+func (self *Processing) Sync(ctx context.Context, readChannel <-chan channel.Event, writeChannel chan<- channel.Event) {
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	self.ctx = ctx
+	self.events = writeChannel
 
-	go self.scanContainers(writeChannel)
+	self.background(func() { self.scanContainers(writeChannel) })
 
-	go self.listenToDocker(writeChannel)
+	self.background(func() { self.listenToDocker(writeChannel) })
+
+	self.background(self.checkHealth)
 
 	logit("Listening for events from storage module")
 	for {
 		select {
-		case event := <-readChannel:
-			logit("Got notification about", event["Name"])
-			if _, ok := event["deleteme"]; ok {
-				logit("Killing", event["Name"])
-				container, err := self.findContainerByName("/"+event["Name"].(string), false)
+		case <-ctx.Done():
+			self.shutdown()
+			return
+		case event, ok := <-readChannel:
+			if !ok {
+				stop()
+				self.shutdown()
+				return
+			}
+			logit("Got", event.Kind, "about", event.Name)
+			switch event.Kind {
+			case channel.Delete:
+				self.remove(event.Name)
+			case channel.Upsert:
+				spec := event.Spec
+				err := spec.Validate()
 				if err != nil {
-					logit("Couldn't find container named", event["Name"])
+					logit("Error, bad spec passed to us:", err.Error())
 					continue
 				}
-				self.docker.KillContainer(dockerclient.KillContainerOptions{ID: container.ID})
-				continue
-			}
-			rawConfig, err := json.Marshal(event["Config"])
-			config := new(dockerclient.Config)
-			err = json.Unmarshal(rawConfig, &config)
-			if err != nil {
-				logit("Error, bad json passed to us")
-				continue
-			}
-			rawHostConfig, err := json.Marshal(event["HostConfig"])
-			hostConfig := new(dockerclient.HostConfig)
-			err = json.Unmarshal(rawHostConfig, &hostConfig)
-			//spew.Dump(hostConfig)
-			if err != nil {
-				logit("Error, bad json passed to us")
-				continue
-			}
-
-			c := Container{
-				Name:       event["Name"].(string),
-				Config:     config,
-				HostConfig: hostConfig,
-				Image:      config.Image,
+				containers, err := containersFor(spec)
+				if err != nil {
+					logit("Error, rejecting", spec.Name+":", err.Error())
+					self.sendStatus(writeChannel, spec.Name, "", false, "rejected: "+err.Error())
+					continue
+				}
+				for _, c := range containers {
+					err = self.checkDependencies(c)
+					if err != nil {
+						break
+					}
+				}
+				if err != nil {
+					logit("Error, rejecting", spec.Name+":", err.Error())
+					self.sendStatus(writeChannel, spec.Name, "", false, "rejected: "+err.Error())
+					continue
+				}
+				self.scale(spec.Name, containers)
+				for _, c := range containers {
+					c := c
+					self.state.upsert(c)
+					self.background(func() { self.CheckOn(c) })
+				}
+			case channel.Resync:
+				self.background(func() { self.scanContainers(writeChannel) })
 			}
-			self.appendContainer(c)
-			go self.CheckOn(c)
-		case <-time.After(10 * time.Second):
-			self.pullAllImages()
-			self.CheckOnContainers()
-			self.removeUntaggedImages()
-			self.removeUntaggedContainers()
-			//spew.Dump(self.containers)
+		case <-self.reconcile:
+			logit("Reconciling on request")
+			self.reconcileAll()
+		case <-time.After(self.currentOptions().ReconcileInterval):
+			self.reconcileAll()
 		}
 	}
 }
 
+// shutdown waits for everything we started to finish. Pulls, probes and
+// rollouts are seen through, nothing new is started.
+func (self *Processing) shutdown() {
+	logit("Shutting down, waiting for work in progress")
+	self.work.Wait()
+	logit("Stopped")
+}
+
+func (self *Processing) reconcileAll() {
+	if atomic.LoadInt32(&self.connected) == 0 {
+		logit("Docker is unreachable, skipping this round")
+		return
+	}
+	started := time.Now()
+	defer func() {
+		metrics.ReconcileRuns.Inc()
+		metrics.ReconcileDuration.Observe(time.Since(started).Seconds())
+	}()
+	self.updateAll()
+	self.CheckOnContainers()
+	if self.currentOptions().CleanUntaggedImages {
+		self.removeUntaggedImages()
+	}
+}
+
+// Reconcile asks Sync to check on everything now instead of waiting for the
+// next tick.
+func (self *Processing) Reconcile() {
+	select {
+	case self.reconcile <- struct{}{}:
+	default:
+		// one is already queued up
+	}
+}
+
+// ImageStatus is a copy of what each image is doing.
+func (self *Processing) ImageStatus() map[string]string {
+	return self.state.imageStatus()
+}
+
+// Inspect asks docker about the container called name.
+func (self *Processing) Inspect(name string) (*dockerclient.Container, error) {
+	return self.docker.InspectContainer(channel.CleanName(name))
+}
+
 func (self *Processing) CheckOnContainers() {
-	// todo - this needs to check on any containers,
-	// start them if they're stopped
-	// unset protection flag
-	for i, c := range self.containers {
-		self.CheckOn(c)
-		self.containers[i].Protect = false
+	// start anything that's stopped, recreate anything that drifted
+	states := map[string]float64{"running": 0, "stopped": 0, "missing": 0, "drifted": 0, "waiting": 0, "backing-off": 0, "crash-looping": 0}
+	// dependencies first, so what depends on them can start in the same go
+	for _, c := range self.ordered() {
+		state, err := self.checkOn(c)
+		if err != nil {
+			logit("Couldn't check on", c.Name, err.Error())
+		}
+		if _, ok := states[state]; ok {
+			states[state]++
+		}
+	}
+	for state, count := range states {
+		metrics.Containers.WithLabelValues(state).Set(count)
 	}
 }
 
 func (self *Processing) removeUntaggedImages() {
-	for i, pulling := range self.Images {
+	for i, pulling := range self.ImageStatus() {
 		if pulling == "pulling" {
 			logit("Currently pulling", i, "so not removing images")
 			return
 		}
 	}
-	images, _ := self.docker.ListImages(false)
+	pinned := self.pinnedImages()
+	images, _ := self.docker.ListImages(dockerclient.ListImagesOptions{})
 	for _, image := range images {
-		if image.RepoTags[0] == "<none>:<none>" {
+		if dangling(image, pinned) {
 			logit("Removing untagged image", image.ID)
-			self.docker.RemoveImage(image.ID)
-		}
-	}
-}
-
-func (self *Processing) removeUntaggedContainers() {
-	runningContainers, err := self.docker.ListContainers(dockerclient.ListContainersOptions{All: true})
-	if err != nil {
-		logit(err)
-		return
-	}
-	images, err := self.docker.ListImages(false)
-	for _, c := range runningContainers {
-		instance, _ := self.docker.InspectContainer(c.ID)
-		for _, image := range images {
-			if image.ID != instance.Image {
-				continue
-			}
-			if image.RepoTags[0] == "<none>:<none>" {
-				c, _ := self.findInternalContainerByID(c.ID)
-				// This prevents us from sending the delete command to the storage module in the callback handler
-				c.Protect = true
-				logit("Cleaning up old container", instance.ID)
-				self.docker.StopContainer(instance.ID, 0)
-				self.docker.RemoveContainer(dockerclient.RemoveContainerOptions{ID: instance.ID})
+			if self.docker.RemoveImage(image.ID) == nil {
+				metrics.UntaggedRemoved.WithLabelValues("image").Inc()
 			}
 		}
 	}
 }
 
 func (self *Processing) findContainerByName(name string, running bool) (*dockerclient.Container, error) {
-	runningContainers, err := self.docker.ListContainers(dockerclient.ListContainersOptions{All: !running})
+	var runningContainers []dockerclient.APIContainers
+	err := self.retry("listing containers", func() error {
+		var err error
+		runningContainers, err = self.docker.ListContainers(dockerclient.ListContainersOptions{All: !running})
+		return err
+	})
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	for _, c := range runningContainers {
 		if len(c.Names) == 0 {
@@ -309,90 +484,164 @@ func (self *Processing) findContainerByName(name string, running bool) (*dockerc
 		}
 		// If we find one
 		if c.Names[0] == name {
-			return self.docker.InspectContainer(c.ID)
+			return self.inspect(c.ID)
 		}
 	}
-	return nil, errors.New("Not found")
+	return nil, &dockerclient.NoSuchContainer{ID: name}
 }
 
 func (self *Processing) CheckOn(container Container) error {
+	_, err := self.checkOn(container)
+	return err
+}
+
+// checkOn also reports what state the container was found in.
+func (self *Processing) checkOn(container Container) (string, error) {
 	name := container.Name
+	// the tick and a new spec can both want the same container at once
+	if !self.state.claim(name) {
+		logit("Container", name, "is already being checked on")
+		return "busy", nil
+	}
+	defer self.state.release(name)
+	// only whoever holds the claim is done with what it protected
+	defer self.state.protect(name, false)
+	if _, err := self.state.byName(name); err != nil {
+		// scaled away since it was asked for
+		return "gone", nil
+	}
 	c, err := self.findContainerByName(name, false)
+	var missing *dockerclient.NoSuchContainer
+	if err != nil && !errors.As(err, &missing) {
+		// docker having a bad moment isn't the container being gone
+		logit("Couldn't look for container", name, err.Error())
+		return "unknown", err
+	}
+	if err == nil && c.State.Running && len(diffContainer(&container, c)) == 0 {
+		logit("Container", name, "is already running")
+		if self.state.settled(name, self.restartBackoff.max) {
+			logit("Container", name, "has settled down, forgetting its restarts")
+		}
+		return "running", nil
+	}
+	// anything else means starting it, which has to wait for its dependencies
+	if waiting := self.waitingOn(container); waiting != "" {
+		logit("Container", name, "is waiting for", waiting)
+		return "waiting", nil
+	}
 	if err != nil {
 		logit("Couldn't find container", name)
-		return self.startContainer(container)
+		return "missing", self.startContainer(container)
 	}
-	if c.State.Running {
-		// todo - actually check the config
-		logit("Container", name, "is already running")
-		return nil
+	changes := diffContainer(&container, c)
+	if len(changes) > 0 {
+		logit("Container", name, "doesn't match its spec, need to recreate it")
+		for _, change := range changes {
+			logit("Container", name, "drifted:", change)
+		}
+		self.stopDependents(name)
+		return "drifted", self.recreateContainer(container, c)
 	}
 	logit("Container", name, "is not running, need to start it")
-	//spew.Dump(container)
-	return nil
+	if !self.state.startingOnPurpose(name) {
+		// it went down by itself, so it only gets started so often
+		return self.restart(name, c, fmt.Sprintf("exited with code %d", c.State.ExitCode))
+	}
+	err = self.docker.StartContainer(c.ID, nil)
+	if err != nil {
+		return "stopped", err
+	}
+	metrics.ContainerActions.WithLabelValues("started").Inc()
+	return "stopped", nil
 }
 
-func (self *Processing) pullImage(imageName string) error {
-	if imageName == "" {
-		log.Fatal("I can't pull nothing. You've got something wrong")
+// recreateContainer throws away what docker is running and starts a fresh
+// container from the spec.
+func (self *Processing) recreateContainer(container Container, running *dockerclient.Container) error {
+	// This prevents us from sending the delete command to the storage module in the callback handler
+	self.state.protect(container.Name, true)
+	logit("Removing old container", running.ID)
+	if running.State.Running {
+		err := self.docker.StopContainer(running.ID, 10)
+		if err != nil {
+			logit("Error stopping", container.Name, err.Error())
+		}
 	}
-	image := strings.Split(imageName, ":")
-	// when we just have "repo"
-	if len(image) == 1 {
-		image = append(image, "latest")
+	err := self.docker.RemoveContainer(dockerclient.RemoveContainerOptions{ID: running.ID})
+	if err != nil {
+		return err
+	}
+	metrics.ContainerActions.WithLabelValues("recreated").Inc()
+	return self.startContainer(container)
+}
+
+// pullImage pulls imageName with the registry login called login, or
+// whatever credentials we can find for its registry if that's empty.
+func (self *Processing) pullImage(imageName string, login string) error {
+	if imageName == "" {
+		return errors.New("I can't pull nothing. You've got something wrong")
 	}
-	// when we have something like "registry:5000/user/repo:latest"
-	if len(image) == 3 {
-		image[0] = image[0] + ":" + image[1]
-		image = append(image[0:1], image[2])
+	image, err := reference.Parse(imageName)
+	if err != nil {
+		return err
 	}
-	if self.Images[image[0]] == "pulling" {
+	if !self.state.startPull(image.String()) {
 		return errors.New("Already pulling " + imageName)
 	}
-	logit("Pulling", imageName)
-	self.Images[image[0]] = "pulling"
-	err := self.docker.PullImage(dockerclient.PullImageOptions{Repository: image[0], Tag: image[1]}, dockerclient.AuthConfiguration{})
-	self.Images[image[0]] = "idle"
+	defer self.state.finishPull(image.String())
+	logit("Pulling", image)
+	auth, err := self.auth.resolve(image, login)
 	if err != nil {
 		return err
 	}
-	return nil
+	started := time.Now()
+	// docker takes a digest in place of the tag
+	err = self.docker.PullImage(dockerclient.PullImageOptions{Repository: image.Name(), Tag: image.Version()}, auth)
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	metrics.ImagePulls.WithLabelValues(result).Inc()
+	metrics.ImagePullDuration.WithLabelValues(result).Observe(time.Since(started).Seconds())
+	return err
 }
 
-func (self *Processing) pullAllImages() {
-	logit("Pulling all Images")
-	// Make a temp channel
-	channel := make(chan struct{})
-	channels := 0
-	self.Images = nil
-	self.Images = make(map[string]string)
-	images, _ := self.docker.ListImages(false)
-	for _, c := range self.containers {
-		for _, image := range images {
-			if image.ID != c.Image {
-				continue
-			}
-			// We need to lookup the "name" of the image from this ID
-			logit("Adding", image.RepoTags[0])
-			if _, ok := self.Images[image.RepoTags[0]]; !ok {
-				self.Images[image.RepoTags[0]] = "fresh"
-			}
+// specImage is the image a container's spec asks for, rather than the ID
+// docker resolved it to.
+func specImage(container Container) string {
+	if container.Config != nil && container.Config.Image != "" {
+		return container.Config.Image
+	}
+	return container.Image
+}
+
+// pinnedImages is every digest our specs pin, the way RepoDigests lists them.
+func (self *Processing) pinnedImages() map[string]bool {
+	pinned := make(map[string]bool)
+	for _, c := range self.state.list() {
+		image, err := reference.Parse(specImage(c))
+		if err == nil && image.Pinned() {
+			pinned[image.Digested()] = true
 		}
 	}
-	for image, _ := range self.Images {
-		// run all of our pulls concurrently
-		go func() {
-			self.pullImage(image)
-			// notify our parent when we're done
-			channel <- struct{}{}
-		}()
-		channels++
+	return pinned
+}
+
+// dangling reports whether image has no name left to it: no tag, and no
+// digest one of our specs is pinned to.
+func dangling(image dockerclient.APIImages, pinned map[string]bool) bool {
+	for _, tag := range image.RepoTags {
+		if tag != "<none>:<none>" {
+			return false
+		}
 	}
-	// wait for all of the images to complete their pull
-	for ; channels > 0; channels-- {
-		<-channel
+	for _, digest := range image.RepoDigests {
+		ref, err := reference.Parse(digest)
+		if err == nil && ref.Pinned() && pinned[ref.Digested()] {
+			return false
+		}
 	}
-	logit("Finished checking for new images")
+	return true
 }
 
 func (self *Processing) startContainer(container Container) error {
@@ -402,42 +651,70 @@ func (self *Processing) startContainer(container Container) error {
 				spew.Dump(container)
 			}
 	*/
-	err := self.pullImage(container.Image)
+	ID, err := self.runContainer(container, container.Name)
+	if ID != "" {
+		// remember this ID for later
+		self.state.setID(container.Name, ID)
+	}
+	return err
+}
+
+// runContainer creates and starts a container from container's spec
+// called name, and hands back its ID once it's been created.
+func (self *Processing) runContainer(container Container, name string) (string, error) {
+	err := self.ensureImage(container)
 	if err != nil {
 		logit("Error pulling", container.Name, err.Error())
 	}
+	// docker only takes one network at create time, the rest get
+	// connected before the container starts
+	networkingConfig, otherNetworks := splitNetworks(container)
 	options := dockerclient.CreateContainerOptions{
-		Name:   container.Name,
-		Config: container.Config,
+		Name:             name,
+		Config:           container.Config,
+		HostConfig:       container.HostConfig,
+		NetworkingConfig: networkingConfig,
 	}
-	// remember this name for later
 	containerObj, err := self.docker.CreateContainer(options)
 	if err != nil {
 		logit("Error starting container", err.Error())
-		return err
+		return "", err
+	}
+	for network, endpoint := range otherNetworks {
+		err = self.docker.ConnectNetwork(network, dockerclient.NetworkConnectionOptions{
+			Container:      containerObj.ID,
+			EndpointConfig: endpoint,
+		})
+		if err != nil {
+			logit("Error connecting", name, "to", network, err.Error())
+			return containerObj.ID, err
+		}
 	}
-	c, _ := self.findInternalContainerByName(container.Name)
-	c.ID = containerObj.ID
-	err = self.docker.StartContainer(c.ID, container.HostConfig)
+	err = self.docker.StartContainer(containerObj.ID, nil)
 	if err != nil {
-		return err
+		return containerObj.ID, err
 	}
-	return nil
+	metrics.ContainerActions.WithLabelValues("started").Inc()
+	return containerObj.ID, nil
 }
 
 func (self *Processing) shouldRun(container *dockerclient.Container) bool {
+	if inRollout(container.Name) {
+		return false
+	}
+	// NAME matches any value, NAME=value only that one
+	selector := self.currentOptions().Selector
 	for _, env := range container.Config.Env {
-		envArray := strings.Split(env, "=")
-		if envArray[0] == "WATCHDOCK" {
+		if env == selector || strings.SplitN(env, "=", 2)[0] == selector {
 			return true
 		}
 	}
 	return false
 }
 
-func New(socket string) (*Processing, error) {
+func New(endpoint Endpoint) (*Processing, error) {
 	self := new(Processing)
-	err := self.Init(socket)
+	err := self.Init(endpoint)
 	if err != nil {
 		return nil, err
 	}
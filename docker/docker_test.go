@@ -1,21 +1,1209 @@
 package docker
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/brimstone/watchdock/channel"
+	"github.com/brimstone/watchdock/docker/dockertest"
+	"github.com/brimstone/watchdock/metrics"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
-# http://www.youtube.com/watch?v=XCsL89YtqCs
+// fakeRegistry only lets username in with password.
+func fakeRegistry(username string, password string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != username || pass != password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="fake"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+// tagRegistry serves tags for repository, two to a page, to anyone who
+// fetches a token first.
+func tagRegistry(repository string, tags ...string) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			w.Write([]byte(`{"token": "letmein"}`))
+			return
+		}
+		if r.URL.Path != "/v2/"+repository+"/tags/list" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer letmein" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="fake"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		page := tags
+		if r.URL.Query().Get("last") == "" && len(tags) > 2 {
+			page = tags[:2]
+			w.Header().Set("Link", `</v2/`+repository+`/tags/list?last=`+tags[1]+`>; rel="next"`)
+		} else if r.URL.Query().Get("last") != "" {
+			page = tags[2:]
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": repository, "tags": page})
+	}))
+	return server
+}
+
+// waitForUpdate skips over everything until name reports being updated.
+func waitForUpdate(t *testing.T, events <-chan channel.Event, name string) channel.Event {
+	for {
+		event := waitFor(t, events, channel.Status, name)
+		if event.Status.Message == "updated" {
+			return event
+		}
+	}
+}
+
+// startSync runs Sync against a fresh fake docker. Sync never returns, so
+// the fake stays up for as long as the test binary does.
+func startSync(t *testing.T) (*dockertest.Docker, *Processing, chan<- channel.Event, <-chan channel.Event) {
+	fake := dockertest.New()
+	server := httptest.NewServer(fake)
+	processing, err := New(Endpoint{Host: server.URL})
+	if err != nil {
+		t.Fatal("Couldn't connect to the fake docker:", err)
+	}
+	processing.backoff = backoff{min: 10 * time.Millisecond, max: 100 * time.Millisecond, attempts: 3}
+	processing.restartBackoff = backoff{min: 100 * time.Millisecond, max: 5 * time.Second, attempts: 2}
+	err = processing.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := make(chan channel.Event)
+	write := make(chan channel.Event, 100)
+	go processing.Sync(context.Background(), read, write)
+	return fake, processing, read, write
+}
+
+func spec(name string, env ...string) *channel.Spec {
+	return &channel.Spec{
+		Version: channel.SpecVersion,
+		Name:    name,
+		Config:  &dockerclient.Config{Image: "nginx", Env: append([]string{"WATCHDOCK=1"}, env...)},
+	}
+}
+
+// waitFor skips over everything else until it sees kind about name.
+func waitFor(t *testing.T, events <-chan channel.Event, kind channel.Kind, name string) channel.Event {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			if event.Kind == kind && event.Name == name {
+				return event
+			}
+		case <-timeout:
+			t.Fatal("Timeout waiting for", kind, name)
+		}
+	}
+}
+
+func never(t *testing.T, events <-chan channel.Event, kind channel.Kind, name string) {
+	timeout := time.After(300 * time.Millisecond)
+	for {
+		select {
+		case event := <-events:
+			if event.Kind == kind && event.Name == name {
+				t.Errorf("Didn't expect %s %s", kind, name)
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
+
+func eventually(t *testing.T, what string, check func() bool) {
+	for i := 0; i < 100; i++ {
+		if check() {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("Timeout waiting until", what)
+}
+
+func TestSync(t *testing.T) {
+	fake, processing, read, write := startSync(t)
+
+	read <- channel.NewUpsert(spec("web"))
+	event := waitFor(t, write, channel.Status, "web")
+	if !event.Status.Running {
+		t.Errorf("Expected web to be running, got %+v", event.Status)
+	}
+	if status := processing.ImageStatus()["docker.io/library/nginx:latest"]; status != "idle" {
+		t.Errorf("Expected nginx to be idle after pulling, got %q", status)
+	}
+
+	// stopped behind our back, started again on the next reconcile
+	fake.Stop("web")
+	event = waitFor(t, write, channel.Status, "web")
+	if event.Status.Running {
+		t.Errorf("Expected web to have exited, got %+v", event.Status)
+	}
+	processing.Reconcile()
+	event = waitFor(t, write, channel.Status, "web")
+	if !event.Status.Running {
+		t.Errorf("Expected web to be running again, got %+v", event.Status)
+	}
+
+	// a new spec means a new container, which isn't a delete
+	old, _ := fake.ByName("web")
+	read <- channel.NewUpsert(spec("web", "VERSION=2"))
+	never(t, write, channel.Delete, "web")
+	eventually(t, "web is recreated", func() bool {
+		c, ok := fake.ByName("web")
+		return ok && c.ID != old.ID && c.State.Running && contains(c.Config.Env, "VERSION=2")
+	})
+
+	read <- channel.NewDelete("web")
+	eventually(t, "web is removed", func() bool {
+		_, ok := fake.ByName("web")
+		return !ok
+	})
+	never(t, write, channel.Delete, "web")
+	// and stays gone
+	processing.Reconcile()
+	never(t, write, channel.Status, "web")
+	if _, ok := fake.ByName("web"); ok {
+		t.Error("web came back after a reconcile")
+	}
+	if _, err := processing.state.byName("/web"); err == nil {
+		t.Error("web should have been forgotten")
+	}
+
+	// removed behind our back, storage needs to hear about it
+	read <- channel.NewUpsert(spec("db"))
+	waitFor(t, write, channel.Status, "db")
+	fake.Remove("db")
+	waitFor(t, write, channel.Delete, "db")
+	if _, err := processing.state.byName("/db"); err == nil {
+		t.Error("db should have been forgotten")
+	}
+}
+
+// scrape is the value of metric as served at address, 0 if it's not there.
+func scrape(t *testing.T, address string, metric string) float64 {
+	response, err := http.Get("http://" + address + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	raw, _ := ioutil.ReadAll(response.Body)
+	for _, line := range strings.Split(string(raw), "\n") {
+		if strings.HasPrefix(line, metric+" ") {
+			value, err := strconv.ParseFloat(strings.TrimPrefix(line, metric+" "), 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return value
+		}
+	}
+	return 0
+}
+
+func TestMetrics(t *testing.T) {
+	server, err := metrics.Serve("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	pulls := `watchdock_image_pulls_total{result="success"}`
+	recreated := `watchdock_container_actions_total{action="recreated"}`
+	pulledBefore := scrape(t, server.Addr, pulls)
+	recreatedBefore := scrape(t, server.Addr, recreated)
+
+	fake, _, read, write := startSync(t)
+	read <- channel.NewUpsert(spec("counted"))
+	waitFor(t, write, channel.Status, "counted")
+	old, _ := fake.ByName("counted")
+	read <- channel.NewUpsert(spec("counted", "VERSION=2"))
+	eventually(t, "counted is recreated", func() bool {
+		c, ok := fake.ByName("counted")
+		return ok && c.ID != old.ID && c.State.Running
+	})
+
+	if pulled := scrape(t, server.Addr, pulls); pulled <= pulledBefore {
+		t.Errorf("Expected the pull to be counted, went from %v to %v", pulledBefore, pulled)
+	}
+	if after := scrape(t, server.Addr, recreated); after != recreatedBefore+1 {
+		t.Errorf("Expected one more recreate, went from %v to %v", recreatedBefore, after)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	fake, processing, read, write := startSync(t)
+
+	read <- channel.NewUpsert(spec("web"))
+	waitFor(t, write, channel.Status, "web")
+
+	fake.Restart()
+	eventually(t, "the event stream is lost", func() bool {
+		return atomic.LoadInt32(&processing.connected) == 0
+	})
+	// nothing to do while docker is away
+	processing.Reconcile()
+
+	fake.Up()
+	// everything is scanned again, and web is started back up
+	waitFor(t, write, channel.Upsert, "web")
+	eventually(t, "web is running again", func() bool {
+		c, ok := fake.ByName("web")
+		return ok && c.State.Running
+	})
+	if atomic.LoadInt32(&processing.connected) != 1 {
+		t.Error("Expected to be connected again")
+	}
+}
+
+// TestCheckOnBusy checks on everything while a recreate owns web, which
+// mustn't let the recreate's destroy through as a delete.
+func TestCheckOnBusy(t *testing.T) {
+	fake, processing, read, write := startSync(t)
+	read <- channel.NewUpsert(spec("web"))
+	waitFor(t, write, channel.Status, "web")
+
+	if !processing.state.claim("/web") {
+		t.Fatal("Couldn't claim web")
+	}
+	processing.state.protect("/web", true)
+	checked := make(chan struct{})
+	go func() {
+		defer close(checked)
+		processing.CheckOnContainers()
+	}()
+	<-checked
+	if c, _ := processing.state.byName("/web"); !c.Protect {
+		t.Error("Expected web still protected while the recreate has it")
+	}
+	fake.Remove("web")
+	never(t, write, channel.Delete, "web")
+	processing.state.release("/web")
+}
+
+// TestDestroyStopping gives up on a container something else holds once
+// we're stopping, instead of waiting on it forever.
+func TestDestroyStopping(t *testing.T) {
+	fake, processing, read, write := startSync(t)
+	read <- channel.NewUpsert(spec("web"))
+	waitFor(t, write, channel.Status, "web")
+
+	if !processing.state.claim("/web") {
+		t.Fatal("Couldn't claim web")
+	}
+	defer processing.state.release("/web")
+	ctx, stop := context.WithCancel(context.Background())
+	destroyed := make(chan struct{})
+	go func() {
+		defer close(destroyed)
+		processing.destroy(ctx, "/web")
+	}()
+	time.Sleep(250 * time.Millisecond)
+	stop()
+	select {
+	case <-destroyed:
+	case <-time.After(time.Second):
+		t.Fatal("destroy is still waiting for web")
+	}
+	if _, ok := fake.ByName("web"); !ok {
+		t.Error("web shouldn't have been removed")
+	}
+}
+
+func TestCheckOnLookupError(t *testing.T) {
+	fake, processing, read, write := startSync(t)
+	read <- channel.NewUpsert(spec("web"))
+	waitFor(t, write, channel.Status, "web")
+	before, _ := fake.ByName("web")
+
+	// docker failing to list isn't web being gone
+	fake.Lock()
+	fake.ListStatus = 500
+	fake.Unlock()
+	container, err := processing.state.byName("/web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := processing.checkOn(container)
+	if state != "unknown" || err == nil {
+		t.Errorf("checkOn() == %q, %v, want unknown and an error", state, err)
+	}
+	fake.Lock()
+	fake.ListStatus = 0
+	removed := len(fake.Removed)
+	fake.Unlock()
+	if after, _ := fake.ByName("web"); after.ID != before.ID || removed != 0 {
+		t.Error("web shouldn't have been recreated")
+	}
+
+	// while a container that really is gone is created again
+	fake.Remove("web")
+	if state, err = processing.checkOn(container); state != "missing" || err != nil {
+		t.Errorf("checkOn() == %q, %v, want missing", state, err)
+	}
+	if _, ok := fake.ByName("web"); !ok {
+		t.Error("Expected web created again")
+	}
+}
+
+func TestPrivateRegistry(t *testing.T) {
+	registry := fakeRegistry("deploy", "hunter2")
+	defer registry.Close()
+	host := strings.TrimPrefix(registry.URL, "http://")
+
+	dir := t.TempDir()
+	logins := filepath.Join(dir, "logins.yaml")
+	ioutil.WriteFile(logins, []byte("logins:\n  deploy:\n    username: deploy\n    password: hunter2\n"), 0600)
+	// nothing to be found in docker's own config
+	t.Setenv("DOCKER_CONFIG", dir)
+
+	fake := dockertest.New()
+	fake.Registry = host
+	server := httptest.NewServer(fake)
+	processing, err := New(Endpoint{Host: server.URL})
+	if err != nil {
+		t.Fatal("Couldn't connect to the fake docker:", err)
+	}
+	err = processing.LoadLogins(logins)
+	if err != nil {
+		t.Fatal("Couldn't load logins:", err)
+	}
+	read := make(chan channel.Event)
+	write := make(chan channel.Event, 100)
+	go processing.Sync(context.Background(), read, write)
+
+	private := spec("private")
+	private.Config.Image = host + "/team/app:1.0"
+	private.RegistryAuth = "deploy"
+	read <- channel.NewUpsert(private)
+	waitFor(t, write, channel.Status, "private")
+
+	// without the login the pull is refused, so there's nothing to run
+	anonymous := spec("anonymous")
+	anonymous.Config.Image = host + "/team/other:1.0"
+	read <- channel.NewUpsert(anonymous)
+	never(t, write, channel.Status, "anonymous")
+	if _, ok := fake.ByName("anonymous"); ok {
+		t.Error("anonymous shouldn't have been created")
+	}
+}
+
+func TestPinned(t *testing.T) {
+	fake, processing, read, write := startSync(t)
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	pinned := spec("pinned")
+	pinned.Config.Image = "registry:5000/app@" + digest
+	read <- channel.NewUpsert(pinned)
+	waitFor(t, write, channel.Status, "pinned")
+
+	key := "registry:5000/app@" + digest
+	processing.Reconcile()
+	processing.Reconcile()
+	never(t, write, channel.Delete, "pinned")
+	fake.Lock()
+	defer fake.Unlock()
+	if fake.Pulls[key] != 1 {
+		t.Errorf("%s was pulled %d times, want once", key, fake.Pulls[key])
+	}
+	for _, ID := range fake.Removed {
+		if ID == fake.Images[key] {
+			t.Errorf("%s was removed as dangling", key)
+		}
+	}
+}
+
+func TestUpdatePolicies(t *testing.T) {
+	registry := tagRegistry("team/app", "1.4.2", "latest", "1.4.5", "1.5.0")
+	defer registry.Close()
+	host := strings.TrimPrefix(registry.URL, "http://")
+	fake, processing, read, write := startSync(t)
+
+	read <- channel.NewUpsert(spec("web"))
+	waitFor(t, write, channel.Status, "web")
+	frozen := spec("frozen")
+	frozen.Update = &channel.UpdatePolicy{Policy: channel.UpdateNever}
+	read <- channel.NewUpsert(frozen)
+	waitFor(t, write, channel.Status, "frozen")
+	app := spec("app")
+	app.Config.Image = host + "/team/app:1.4.2"
+	app.Update = &channel.UpdatePolicy{Policy: channel.UpdateSemver, Constraint: "~1.4"}
+	read <- channel.NewUpsert(app)
+	waitFor(t, write, channel.Status, "app")
+	before, _ := fake.ByName("frozen")
+
+	fake.Rebuild("nginx")
+	processing.Reconcile()
+	event := waitForUpdate(t, write, "web")
+	if event.Status.Digest == "" || event.Status.Digest == event.Status.PreviousDigest {
+		t.Errorf("web should record both digests, got %+v", event.Status)
+	}
+	upsert := waitFor(t, write, channel.Upsert, "app")
+	if upsert.Spec.Config.Image != host+"/team/app:1.4.5" {
+		t.Errorf("app should have moved to 1.4.5, got %s", upsert.Spec.Config.Image)
+	}
+	if upsert.Spec.Update == nil || upsert.Spec.Update.Constraint != "~1.4" {
+		t.Errorf("app should keep its update policy, got %+v", upsert.Spec.Update)
+	}
+	waitForUpdate(t, write, "app")
+	if after, _ := fake.ByName("frozen"); after.ID != before.ID || after.Image != before.Image {
+		t.Error("frozen shouldn't have been updated")
+	}
+
+	// nothing new, so nothing happens
+	processing.Reconcile()
+	never(t, write, channel.Status, "web")
+}
+
+func TestRollout(t *testing.T) {
+	fake, processing, read, write := startSync(t)
+	web := spec("web")
+	web.Rollout = &channel.Rollout{Window: "200ms"}
+	read <- channel.NewUpsert(web)
+	waitFor(t, write, channel.Status, "web")
+	before, _ := fake.ByName("web")
+
+	// the new one starts next to the old one, which is only removed once
+	// the window is over
+	next := fake.Rebuild("nginx")
+	processing.Reconcile()
+	event := waitForUpdate(t, write, "web")
+	if event.Status.Digest != next || event.Status.PreviousDigest != before.Image {
+		t.Errorf("web should have moved from %s to %s, got %+v", before.Image, next, event.Status)
+	}
+	if after, _ := fake.ByName("web"); after.Image != next || !after.State.Running {
+		t.Errorf("web should be running %s, got %s", next, after.Image)
+	}
+	eventually(t, "the old web to be removed", func() bool {
+		return strings.Join(fake.Names(), " ") == "/web"
+	})
+
+	// this one dies within the window, so the old one comes back
+	broken := fake.Rebuild("nginx")
+	fake.BreakImage(broken)
+	processing.Reconcile()
+	waitForUpdate(t, write, "web")
+	for {
+		event = waitFor(t, write, channel.Status, "web")
+		if strings.HasPrefix(event.Status.Message, "rolled back") {
+			break
+		}
+	}
+	if event.Status.Digest != next || event.Status.PreviousDigest != broken {
+		t.Errorf("web should have gone back from %s to %s, got %+v", broken, next, event.Status)
+	}
+	eventually(t, "web to run the old image again", func() bool {
+		after, _ := fake.ByName("web")
+		return after.Image == next && after.State.Running && strings.Join(fake.Names(), " ") == "/web"
+	})
+	// and the broken image isn't tried again
+	processing.Reconcile()
+	never(t, write, channel.Status, "web")
+}
+
+func TestRolloutStopFirst(t *testing.T) {
+	// nothing ever answers the probe
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	fake, processing, read, write := startSync(t)
+	db := spec("db")
+	db.HostConfig = &dockerclient.HostConfig{PortBindings: map[dockerclient.Port][]dockerclient.PortBinding{
+		"5432/tcp": {{HostPort: "5432"}},
+	}}
+	db.Rollout = &channel.Rollout{Timeout: "100ms", Probe: &channel.Probe{Port: port}}
+	read <- channel.NewUpsert(db)
+	waitFor(t, write, channel.Status, "db")
+	before, _ := fake.ByName("db")
+
+	fake.Rebuild("nginx")
+	processing.Reconcile()
+	// fixed ports mean the old one has to stop first
+	event := waitFor(t, write, channel.Status, "db")
+	if event.Status.Running {
+		t.Errorf("db should have been stopped first, got %+v", event.Status)
+	}
+	for !strings.HasPrefix(event.Status.Message, "rolled back") {
+		event = waitFor(t, write, channel.Status, "db")
+	}
+	if after, _ := fake.ByName("db"); after.ID != before.ID || !after.State.Running {
+		t.Errorf("db should be the old container again, got %s", after.ID)
+	}
+}
+
+func TestDependencyOrder(t *testing.T) {
+	depends := func(name string, on ...string) Container {
+		c := Container{Name: "/" + name}
+		for _, dependency := range on {
+			c.DependsOn = append(c.DependsOn, channel.Dependency{Name: dependency})
+		}
+		return c
+	}
+	ordered, err := dependencyOrder([]Container{depends("web", "app"), depends("app", "db", "elsewhere"), depends("db"), depends("cron")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, c := range ordered {
+		names = append(names, c.Name)
+	}
+	if strings.Join(names, " ") != "/db /app /web /cron" {
+		t.Errorf("dependencyOrder == %v", names)
+	}
+	_, err = dependencyOrder([]Container{depends("web", "app"), depends("app", "db"), depends("db", "app")})
+	if err == nil || err.Error() != "dependency cycle: app -> db -> app" {
+		t.Errorf("dependencyOrder error == %v", err)
+	}
+}
+
+func TestDependsOn(t *testing.T) {
+	fake, _, read, write := startSync(t)
+	app := spec("app")
+	app.DependsOn = []channel.Dependency{{Name: "db", Condition: channel.DependsHealthy}}
+	read <- channel.NewUpsert(app)
+	never(t, write, channel.Status, "app")
+
+	// db coming up healthy lets app go
+	db := spec("db")
+	db.Config.Healthcheck = &dockerclient.HealthConfig{Test: []string{"CMD", "true"}}
+	read <- channel.NewUpsert(db)
+	waitFor(t, write, channel.Status, "db")
+	waitFor(t, write, channel.Status, "app")
+
+	// a cycle is turned away
+	cycle := spec("db")
+	cycle.Config.Healthcheck = db.Config.Healthcheck
+	cycle.DependsOn = []channel.Dependency{{Name: "app"}}
+	read <- channel.NewUpsert(cycle)
+	event := waitFor(t, write, channel.Status, "db")
+	if event.Status.Message != "rejected: dependency cycle: db -> app -> db" {
+		t.Errorf("Expected db to be rejected, got %+v", event.Status)
+	}
+
+	// recreating db stops app first, and starts it again after
+	changed := spec("db", "CHANGED=1")
+	changed.Config.Healthcheck = db.Config.Healthcheck
+	read <- channel.NewUpsert(changed)
+	var order []string
+	for len(order) < 4 {
+		select {
+		case event := <-write:
+			if event.Kind == channel.Status {
+				order = append(order, event.Name+" "+event.Status.Message)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout waiting for db to be recreated, got", order)
+		}
+	}
+	if strings.Join(order, ", ") != "app exited, db exited, db started, app started" {
+		t.Errorf("Unexpected order %v", order)
+	}
+	if c, _ := fake.ByName("app"); !c.State.Running {
+		t.Error("app should be running again")
+	}
+}
+
+func TestReplicas(t *testing.T) {
+	fake, processing, read, write := startSync(t)
+	replicated := func(count int) *channel.Spec {
+		web := spec("web", "ID={{.Replica}}")
+		web.HostConfig = &dockerclient.HostConfig{PortBindings: map[dockerclient.Port][]dockerclient.PortBinding{
+			"80/tcp": {{HostPort: "8080"}},
+		}}
+		web.Replicas = &channel.Replicas{Count: count, PortOffset: 1}
+		return web
+	}
+	running := func(names ...string) func() bool {
+		return func() bool {
+			for _, name := range names {
+				if c, ok := fake.ByName(name); !ok || !c.State.Running {
+					return false
+				}
+			}
+			return true
+		}
+	}
+
+	// what ran as one container runs as replicas now
+	read <- channel.NewUpsert(spec("web"))
+	waitFor(t, write, channel.Status, "web")
+	read <- channel.NewUpsert(replicated(2))
+	eventually(t, "web runs as two replicas", func() bool {
+		return running("web-1", "web-2")() && strings.Join(fake.Names(), " ") == "/web-1 /web-2"
+	})
+	never(t, write, channel.Delete, "web")
+	for i, name := range []string{"web-1", "web-2"} {
+		c, _ := fake.ByName(name)
+		if !contains(c.Config.Env, fmt.Sprintf("ID=%d", i+1)) || c.HostConfig.PortBindings["80/tcp"][0].HostPort != fmt.Sprint(8080+i) {
+			t.Errorf("%s has %v and %v", name, c.Config.Env, c.HostConfig.PortBindings)
+		}
+	}
+
+	// scaling up starts the new one, scaling down removes them from the top
+	read <- channel.NewUpsert(replicated(3))
+	eventually(t, "web-3 runs", running("web-3"))
+	read <- channel.NewUpsert(replicated(1))
+	eventually(t, "web scales down to one", func() bool {
+		return strings.Join(fake.Names(), " ") == "/web-1"
+	})
+
+	// a replica removed by hand comes back, without storage hearing of it
+	fake.Remove("web-1")
+	eventually(t, "web-1 runs again", running("web-1"))
+
+	// none of it is a spec of its own
+	read <- channel.NewResync()
+	timeout := time.After(500 * time.Millisecond)
+	for done := false; !done; {
+		select {
+		case event := <-write:
+			if event.Kind == channel.Upsert || event.Kind == channel.Delete {
+				t.Errorf("Didn't expect %s %s", event.Kind, event.Name)
+			}
+		case <-timeout:
+			done = true
+		}
+	}
+
+	read <- channel.NewDelete("web")
+	eventually(t, "web's replicas are removed", func() bool {
+		_, one := fake.ByName("web-1")
+		_, two := fake.ByName("web-2")
+		return !one && !two
+	})
+	processing.Reconcile()
+	never(t, write, channel.Status, "web-1")
+	if _, ok := fake.ByName("web-1"); ok {
+		t.Error("web-1 came back after a reconcile")
+	}
+}
+
+func TestPlan(t *testing.T) {
+	fake := dockertest.New()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	fake.Images[dockertest.ImageKey("nginx")] = dockertest.ImageID(dockertest.ImageKey("nginx"), 0)
+	fake.Images["<none>:<none>"] = "sha256:old"
+	env := []string{"WATCHDOCK=1"}
+	fake.Add("web", true, dockerclient.Config{Image: "nginx", Env: env})
+	fake.Add("db", false, dockerclient.Config{Image: "nginx", Env: env})
+	fake.Add("cache", true, dockerclient.Config{Image: "nginx", Env: append(env, "SIZE=1")})
+	for i := 1; i <= 2; i++ {
+		labels := map[string]string{channel.ReplicaOfLabel: "app", channel.ReplicaLabel: fmt.Sprint(i)}
+		fake.Add(fmt.Sprintf("app-%d", i), true, dockerclient.Config{Image: "nginx", Env: env, Labels: labels})
+	}
+	fake.Add("gone", true, dockerclient.Config{Image: "nginx", Env: env})
+	fake.Add("stopped", false, dockerclient.Config{Image: "nginx", Env: env})
+	fake.Add("unmanaged", false, dockerclient.Config{Image: "nginx"})
+	before := fake.Names()
+
+	processing, err := New(Endpoint{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = processing.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	app := spec("app")
+	app.Replicas = &channel.Replicas{Count: 1}
+	fresh := spec("fresh")
+	fresh.Config.Image = "redis"
+	actions, err := processing.Plan([]*channel.Spec{spec("web"), spec("db"), spec("cache", "SIZE=2"), app, fresh}, []string{"gone", "stopped"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, action := range actions {
+		got = append(got, action.String())
+	}
+	want := []string{
+		"pull nginx (to look for a newer image)",
+		"start db (exited with code 0)",
+		"recreate cache (Env: want map[SIZE:2 WATCHDOCK:1], have map[SIZE:1 WATCHDOCK:1])",
+		"pull redis (it's missing)",
+		"create fresh (it doesn't exist)",
+		"start fresh",
+		"remove-container app-2 (there are only 1 replicas now)",
+		"remove-container gone (its spec was deleted)",
+		"remove-container stopped (its spec was deleted)",
+		"remove-image sha256:old (it has no tag)",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Plan() ==\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// and nothing happened
+	if after := fake.Names(); strings.Join(after, " ") != strings.Join(before, " ") || len(fake.Pulls) != 0 || len(fake.Removed) != 0 {
+		t.Errorf("Plan changed things: %v, %v pulls, %v removed", after, fake.Pulls, fake.Removed)
+	}
+	if c, _ := fake.ByName("db"); c.State.Running {
+		t.Error("Plan started db")
+	}
+}
+
+func TestHealth(t *testing.T) {
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	port := listener.Addr().(*net.TCPAddr).Port
+	fake, _, read, write := startSync(t)
+
+	web := spec("web")
+	web.Health = &channel.Probe{Port: port, Interval: "20ms", Timeout: "100ms", FailureThreshold: 2}
+	read <- channel.NewUpsert(web)
+	// waits for the status with a message starting with prefix
+	waitForMessage := func(name string, prefix string) *channel.State {
+		for {
+			event := waitFor(t, write, channel.Status, name)
+			if strings.HasPrefix(event.Status.Message, prefix) {
+				return event.Status
+			}
+		}
+	}
+	if status := waitForMessage("web", "healthy"); status.Health != "healthy" {
+		t.Errorf("web should be healthy, got %+v", status)
+	}
+
+	// nothing answers any more, so web is restarted, then less and less
+	// often until it's crash-looping
+	listener.Close()
+	status := waitForMessage("web", "restarted: unhealthy")
+	if status.Restarts != 1 || status.CrashLoop {
+		t.Errorf("web should have been restarted once, got %+v", status)
+	}
+	status = waitForMessage("web", "crash-looping")
+	if status.Restarts != 2 || !status.CrashLoop {
+		t.Errorf("web should be crash-looping, got %+v", status)
+	}
+	if c, _ := fake.ByName("web"); c.RestartCount != 2 {
+		t.Errorf("web should have been restarted twice, got %d", c.RestartCount)
+	}
+
+	// answering again makes it healthy, and the restarts stay on record
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Skip("Couldn't listen on the probe port again:", err)
+	}
+	defer listener.Close()
+	status = waitForMessage("web", "healthy")
+	if status.Health != "healthy" || status.Restarts != 2 {
+		t.Errorf("web should be healthy again, got %+v", status)
+	}
+
+	// exec probes run inside the container, and one that fails gets its
+	// container restarted just the same
+	worker := spec("worker")
+	worker.Health = &channel.Probe{Exec: []string{"true"}, Interval: "20ms"}
+	read <- channel.NewUpsert(worker)
+	waitForMessage("worker", "healthy")
+	sick := spec("sick")
+	sick.Health = &channel.Probe{Exec: []string{"false"}, Interval: "20ms", FailureThreshold: 1}
+	read <- channel.NewUpsert(sick)
+	status = waitForMessage("sick", "restarted: unhealthy: false exited with 1")
+	if status.Restarts != 1 {
+		t.Errorf("sick should have been restarted once, got %+v", status)
+	}
+}
+
+func TestCrashLoop(t *testing.T) {
+	fake, processing, read, write := startSync(t)
+	read <- channel.NewUpsert(spec("web"))
+	waitFor(t, write, channel.Status, "web")
+
+	// exiting by itself gets web started straight away the first time, then
+	// only after the backoff
+	fake.Stop("web")
+	processing.Reconcile()
+	eventually(t, "web is started again", func() bool {
+		c, _ := fake.ByName("web")
+		return c.State.Running
+	})
+	fake.Stop("web")
+	processing.Reconcile()
+	time.Sleep(20 * time.Millisecond)
+	if c, _ := fake.ByName("web"); c.State.Running {
+		t.Error("web shouldn't be started again before its backoff is up")
+	}
+	eventually(t, "web is started after its backoff", func() bool {
+		processing.Reconcile()
+		c, _ := fake.ByName("web")
+		return c.State.Running
+	})
+	for {
+		event := waitFor(t, write, channel.Status, "web")
+		if strings.HasPrefix(event.Status.Message, "crash-looping: restarted 2 times, last because exited with code 0") {
+			break
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	fake := dockertest.New()
+	server := httptest.NewServer(fake)
+	processing, err := New(Endpoint{Host: server.URL})
+	if err != nil {
+		t.Fatal("Couldn't connect to the fake docker:", err)
+	}
+	processing.backoff = backoff{min: 10 * time.Millisecond, max: 100 * time.Millisecond, attempts: 3}
+	ctx, stop := context.WithCancel(context.Background())
+	read := make(chan channel.Event)
+	write := make(chan channel.Event, 100)
+	stopped := make(chan struct{})
+	go func() {
+		processing.Sync(ctx, read, write)
+		close(stopped)
+	}()
+
+	web := spec("web")
+	web.Rollout = &channel.Rollout{Window: "1h"}
+	read <- channel.NewUpsert(web)
+	waitFor(t, write, channel.Status, "web")
+	next := fake.Rebuild("nginx")
+	processing.Reconcile()
+	waitForUpdate(t, write, "web")
+
+	// the rollout's window is cut short, it isn't left half done
+	stop()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for Sync to return")
+	}
+	if strings.Join(fake.Names(), " ") != "/web" {
+		t.Errorf("Only web should be left, got %v", fake.Names())
+	}
+	if c, _ := fake.ByName("web"); c.Image != next {
+		t.Errorf("web should be on %s, got %s", next, c.Image)
+	}
+}
+
+func TestDangling(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	pinned := map[string]bool{"docker.io/library/nginx@" + digest: true}
+	var tests = []struct {
+		image    dockerclient.APIImages
+		dangling bool
+	}{
+		{dockerclient.APIImages{RepoTags: []string{"nginx:latest"}}, false},
+		{dockerclient.APIImages{RepoTags: []string{"<none>:<none>"}}, true},
+		{dockerclient.APIImages{}, true},
+		{dockerclient.APIImages{RepoDigests: []string{"nginx@" + digest}}, false},
+		{dockerclient.APIImages{RepoDigests: []string{"redis@" + digest}}, true},
+	}
+	for _, c := range tests {
+		if dangling(c.image, pinned) != c.dangling {
+			t.Errorf("dangling(%+v) != %v", c.image, c.dangling)
+		}
+	}
+}
 
-func TestHello(t *testing.T) {
+func TestSelector(t *testing.T) {
 	var tests = []struct {
-		s, want string
+		selector string
+		env      []string
+		run      bool
 	}{
-		{"", "hi there!"},
+		{"WATCHDOCK", []string{"WATCHDOCK=1"}, true},
+		{"WATCHDOCK", []string{"WATCHDOCK"}, true},
+		{"WATCHDOCK", []string{"WATCHDOCKER=1"}, false},
+		{"TEAM=web", []string{"TEAM=web"}, true},
+		{"TEAM=web", []string{"TEAM=db"}, false},
+		{"TEAM=web", []string{"TEAM"}, false},
 	}
 	for _, c := range tests {
-		got := Hello()
-		if got != c.want {
-			t.Errorf("Hello() == %q, want %q", got, c.want)
+		self := &Processing{options: Options{Selector: c.selector}}
+		container := &dockerclient.Container{Name: "/web", Config: &dockerclient.Config{Env: c.env}}
+		if self.shouldRun(container) != c.run {
+			t.Errorf("shouldRun(%v) with %s != %v", c.env, c.selector, c.run)
 		}
 	}
 }
+
+func TestConcurrentSync(t *testing.T) {
+	fake, processing, read, write := startSync(t)
+	go func() {
+		for range write {
+		}
+	}()
+
+	names := []string{"a", "b", "c", "d", "e"}
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(2)
+		go func(name string) {
+			defer wg.Done()
+			for i := 0; i < 3; i++ {
+				read <- channel.NewUpsert(spec(name, fmt.Sprintf("ROUND=%d", i)))
+			}
+		}(name)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 3; i++ {
+				processing.Reconcile()
+				processing.ImageStatus()
+			}
+		}()
+	}
+	wg.Wait()
+
+	eventually(t, "everything runs its last spec", func() bool {
+		processing.Reconcile()
+		for _, name := range names {
+			c, ok := fake.ByName(name)
+			if !ok || !c.State.Running || !contains(c.Config.Env, "ROUND=2") {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestStore(t *testing.T) {
+	s := newStore()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("/c%d", i%3)
+			s.upsert(Container{Name: name, Image: "nginx"})
+			s.setID(name, fmt.Sprintf("id%d", i%3))
+			s.protect(name, i%2 == 0)
+			s.byName(name)
+			s.list()
+			if s.startPull("nginx") {
+				s.finishPull("nginx")
+			}
+			s.track([]string{"nginx"})
+			s.imageStatus()
+		}(i)
+	}
+	wg.Wait()
+	if len(s.list()) != 3 {
+		t.Fatalf("Expected 3 containers, got %d", len(s.list()))
+	}
+
+	s.protect("/c0", true)
+	if _, err := s.forget("id0"); err == nil {
+		t.Error("Shouldn't forget a protected container")
+	}
+	s.protect("/c1", false)
+	if c, err := s.forget("id1"); err != nil || c.Name != "/c1" {
+		t.Errorf("forget(id1) == %v, %v", c.Name, err)
+	}
+	if s.add(Container{Name: "/c0"}) {
+		t.Error("add shouldn't replace /c0")
+	}
+
+	s.startPull("nginx")
+	s.track([]string{"redis"})
+	status := s.imageStatus()
+	if status["nginx"] != "pulling" || status["redis"] != "fresh" {
+		t.Errorf("track should keep running pulls, got %v", status)
+	}
+	if s.startPull("nginx") {
+		t.Error("nginx is already being pulled")
+	}
+
+	if !s.due("/c0", time.Hour) || s.due("/c0", time.Hour) || !s.due("/c0", 0) {
+		t.Error("/c0 should be due once an hour")
+	}
+
+	b := backoff{min: time.Hour, max: 2 * time.Hour, attempts: 2}
+	if ok, _ := s.mayRestart("/c0"); !ok {
+		t.Error("/c0 should be restarted straight away the first time")
+	}
+	if h := s.restarted("/c0", "exited", b); h.restarts != 1 || h.crashLoop || h.delay != time.Hour {
+		t.Errorf("restarted(/c0) == %+v", h)
+	}
+	if ok, _ := s.mayRestart("/c0"); ok {
+		t.Error("/c0 should wait before being restarted again")
+	}
+	if h := s.restarted("/c0", "exited", b); h.restarts != 2 || !h.crashLoop || h.delay != 2*time.Hour {
+		t.Errorf("restarted(/c0) == %+v", h)
+	}
+	if s.settled("/c0", time.Hour) || !s.settled("/c0", 0) || s.healthOf("/c0").crashLoop {
+		t.Error("/c0 should only settle down after an hour")
+	}
+	if h := s.probed("/c0", errors.New("no"), 2); h.status != "" || h.failures != 1 {
+		t.Errorf("probed(/c0) == %+v", h)
+	}
+	if h := s.probed("/c0", errors.New("no"), 2); h.status != "unhealthy" {
+		t.Errorf("probed(/c0) == %+v", h)
+	}
+	if h := s.probed("/c0", nil, 2); h.status != "healthy" || h.failures != 0 {
+		t.Errorf("probed(/c0) == %+v", h)
+	}
+
+	if !s.claim("/c0") || s.claim("/c0") {
+		t.Error("Only one claim on /c0 at a time")
+	}
+	s.release("/c0")
+	if !s.claim("/c0") {
+		t.Error("/c0 should be free again")
+	}
+}
+
+func TestExport(t *testing.T) {
+	fake := dockertest.New()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	fake.Images[dockertest.ImageKey("nginx")] = dockertest.ImageID(dockertest.ImageKey("nginx"), 0)
+	labels := map[string]string{channel.ReplicaOfLabel: "app", channel.ReplicaLabel: "1"}
+	fake.Add("app-1", true, dockerclient.Config{Image: "nginx", Env: []string{"WATCHDOCK=1"}, Labels: labels})
+	fake.Add("unmanaged", true, dockerclient.Config{Image: "nginx", Env: []string{"SIZE=1"}})
+
+	processing, err := New(Endpoint{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = processing.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	spec, err := processing.Export("app-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.Name != "app-1" || spec.Config.Labels != nil || fmt.Sprint(spec.Config.Env) != "[WATCHDOCK=1]" {
+		t.Errorf("Expected app-1 without the replica labels, got %s %v %v", spec.Name, spec.Config.Labels, spec.Config.Env)
+	}
+	spec, err = processing.Export("unmanaged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(spec.Config.Env) != "[SIZE=1 WATCHDOCK=1]" {
+		t.Errorf("Expected the selector added, got %v", spec.Config.Env)
+	}
+	if _, err = processing.Export("missing"); err == nil {
+		t.Error("Expected an error for a container that doesn't exist")
+	}
+}
+
+func TestCleanSpec(t *testing.T) {
+	image := &dockerclient.Config{
+		Image:        "nginx",
+		Env:          []string{"PATH=/usr/bin"},
+		Cmd:          []string{"nginx", "-g", "daemon off;"},
+		Entrypoint:   []string{"/docker-entrypoint.sh"},
+		ExposedPorts: map[dockerclient.Port]struct{}{"80/tcp": {}},
+		Labels:       map[string]string{"maintainer": "nginx"},
+	}
+	container := &dockerclient.Container{
+		ID:   "0123456789abcdef",
+		Name: "/web",
+		Config: &dockerclient.Config{
+			Hostname:     "0123456789ab",
+			Image:        "nginx",
+			Env:          []string{"PATH=/usr/bin", "SIZE=1"},
+			Cmd:          []string{"nginx", "-g", "daemon off;"},
+			Entrypoint:   []string{},
+			ExposedPorts: map[dockerclient.Port]struct{}{"80/tcp": {}},
+			Labels:       map[string]string{"maintainer": "nginx", "tier": "web"},
+		},
+		HostConfig: &dockerclient.HostConfig{NetworkMode: "default", RestartPolicy: dockerclient.RestartPolicy{Name: "no"}, ConsoleSize: [2]int{24, 80}},
+	}
+	raw, err := cleanSpec(container, image).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the image's defaults go, the cleared entrypoint stays cleared
+	want := `{
+  "Config": {
+    "Entrypoint": [],
+    "Env": [
+      "SIZE=1"
+    ],
+    "Image": "nginx",
+    "Labels": {
+      "tier": "web"
+    }
+  },
+  "Name": "web",
+  "Version": ` + fmt.Sprint(channel.SpecVersion) + `
+}
+`
+	if string(raw) != want {
+		t.Errorf("Encode() == %s, want %s", raw, want)
+	}
+
+	// and applying it again gives back an empty entrypoint, not the image's
+	spec, err := channel.Decode(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.Config.Entrypoint == nil || len(spec.Config.Entrypoint) != 0 {
+		t.Errorf("Expected an empty Entrypoint, got %#v", spec.Config.Entrypoint)
+	}
+}
+
+func TestNetworks(t *testing.T) {
+	fake, processing, read, write := startSync(t)
+	web := spec("web")
+	web.HostConfig = &dockerclient.HostConfig{NetworkMode: "frontend", Binds: []string{"/srv/web:/usr/share/nginx/html:ro"}}
+	web.NetworkingConfig = &dockerclient.NetworkingConfig{EndpointsConfig: map[string]*dockerclient.EndpointConfig{
+		"backend":  {Aliases: []string{"api"}},
+		"frontend": {Aliases: []string{"www", "site"}},
+	}}
+	read <- channel.NewUpsert(web)
+	waitFor(t, write, channel.Status, "web")
+	c, _ := fake.ByName("web")
+
+	// created with its host config on the network of its NetworkMode, the
+	// other one connected before it started
+	if c.HostConfig == nil || c.HostConfig.NetworkMode != "frontend" || fmt.Sprint(c.HostConfig.Binds) != "[/srv/web:/usr/share/nginx/html:ro]" {
+		t.Errorf("Expected the HostConfig passed on, got %+v", c.HostConfig)
+	}
+	fake.Lock()
+	connects := fmt.Sprintf("%+v", fake.Connects)
+	fake.Unlock()
+	if want := fmt.Sprintf("[{Network:backend Container:%s Aliases:[api]}]", c.ID); connects != want {
+		t.Errorf("Expected only backend connected, got %s want %s", connects, want)
+	}
+	if aliases := c.NetworkSettings.Networks["frontend"].Aliases; fmt.Sprint(aliases) != fmt.Sprint([]string{"www", "site", c.ID[:12]}) {
+		t.Errorf("Expected frontend's aliases at create time, got %v", aliases)
+	}
+
+	// what docker reports turns back into what the spec asked for, without
+	// the aliases docker added
+	found := networkingConfig(&c)
+	if found == nil || len(found.EndpointsConfig) != 2 ||
+		fmt.Sprint(found.EndpointsConfig["backend"].Aliases) != "[api]" ||
+		fmt.Sprint(found.EndpointsConfig["frontend"].Aliases) != "[www site]" {
+		t.Errorf("networkingConfig() == %+v", found)
+	}
+
+	// so it isn't recreated for drifting
+	processing.Reconcile()
+	time.Sleep(300 * time.Millisecond)
+	if after, _ := fake.ByName("web"); after.ID != c.ID {
+		t.Error("web shouldn't have been recreated")
+	}
+
+	// one network alone goes in at create time, whatever NetworkMode says
+	create, rest := splitNetworks(Container{NetworkingConfig: web.NetworkingConfig})
+	if _, ok := create.EndpointsConfig["backend"]; !ok || len(create.EndpointsConfig) != 1 || len(rest) != 1 || rest["frontend"] == nil {
+		t.Errorf("splitNetworks() == %+v, %+v", create, rest)
+	}
+	if create, rest = splitNetworks(Container{}); create != nil || rest != nil {
+		t.Errorf("Expected nothing to split without networks, got %+v, %+v", create, rest)
+	}
+}
@@ -0,0 +1,478 @@
+// Package dockertest is a fake docker daemon for tests of anything that
+// drives the docker module.
+package dockertest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/brimstone/watchdock/reference"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Docker is just enough of the docker remote API to exercise the docker
+// module, including the event stream. Serve it with httptest.
+type Docker struct {
+	sync.Mutex
+	Containers map[string]*dockerclient.Container
+	Images     map[string]string
+	// how many times each image was pulled, and which images were removed
+	Pulls   map[string]int
+	Removed []string
+	// bumped to make the next pull of an image come back different
+	builds map[string]int
+	// containers on these images die right after starting
+	broken map[string]bool
+	// the command of every exec, which passes if it's true
+	execs     map[string][]string
+	listeners []chan *dockerclient.APIEvents
+	created   int
+	// while down every connection is dropped, closing stopped ends the
+	// event streams
+	down    bool
+	stopped chan struct{}
+	// images from here are pulled with whatever credentials we're given
+	Registry string
+	// the API version we claim, and the one the last request asked for
+	APIVersion string
+	Requested  string
+	// every network connected after create, in order
+	Connects []Connect
+	// when set, listing containers answers with this status instead
+	ListStatus int
+}
+
+// Connect is a container connected to a network after it was created.
+type Connect struct {
+	Network   string
+	Container string
+	Aliases   []string
+}
+
+// attach puts c on network the way docker does, which adds the short ID to
+// the aliases it was given. The caller holds the lock.
+func attach(c *dockerclient.Container, network string, endpoint *dockerclient.EndpointConfig) {
+	attached := dockerclient.ContainerNetwork{NetworkID: network}
+	if endpoint != nil {
+		attached.Aliases = append(attached.Aliases, endpoint.Aliases...)
+	}
+	attached.Aliases = append(attached.Aliases, c.ID[:12])
+	c.NetworkSettings.Networks[network] = attached
+}
+
+func New() *Docker {
+	return &Docker{
+		Containers: make(map[string]*dockerclient.Container),
+		Images:     make(map[string]string),
+		Pulls:      make(map[string]int),
+		builds:     make(map[string]int),
+		broken:     make(map[string]bool),
+		execs:      make(map[string][]string),
+		stopped:    make(chan struct{}),
+		APIVersion: "1.43",
+	}
+}
+
+// emit sends an event to everyone listening. The caller holds the lock.
+func (f *Docker) emit(status string, ID string) {
+	event := &dockerclient.APIEvents{Status: status, ID: ID, Time: time.Now().Unix()}
+	for _, listener := range f.listeners {
+		listener <- event
+	}
+}
+
+func (f *Docker) find(idOrName string) *dockerclient.Container {
+	if c, ok := f.Containers[idOrName]; ok {
+		return c
+	}
+	for _, c := range f.Containers {
+		if c.Name == "/"+strings.TrimPrefix(idOrName, "/") {
+			return c
+		}
+	}
+	return nil
+}
+
+// ByName returns a copy of what docker is running as name.
+func (f *Docker) ByName(name string) (dockerclient.Container, bool) {
+	f.Lock()
+	defer f.Unlock()
+	c := f.find(name)
+	if c == nil {
+		return dockerclient.Container{}, false
+	}
+	return *c, true
+}
+
+// Stop and Remove are the same things happening behind watchdock's back.
+func (f *Docker) Stop(name string) {
+	f.Lock()
+	defer f.Unlock()
+	c := f.find(name)
+	c.State.Running = false
+	f.emit("die", c.ID)
+}
+
+func (f *Docker) Remove(name string) {
+	f.Lock()
+	defer f.Unlock()
+	c := f.find(name)
+	delete(f.Containers, c.ID)
+	f.emit("destroy", c.ID)
+}
+
+// Restart takes the daemon away, which stops every container, until Up is
+// called.
+func (f *Docker) Restart() {
+	f.Lock()
+	defer f.Unlock()
+	f.down = true
+	f.listeners = nil
+	close(f.stopped)
+	for _, c := range f.Containers {
+		c.State.Running = false
+	}
+}
+
+// ImageID is the ID of the build'th push of tag.
+func ImageID(tag string, build int) string {
+	return fmt.Sprintf("sha256:%x", fmt.Sprintf("%s#%d", tag, build))
+}
+
+// Rebuild pushes a new image under the same name, and reports its ID.
+func (f *Docker) Rebuild(image string) string {
+	f.Lock()
+	defer f.Unlock()
+	f.builds[ImageKey(image)]++
+	return ImageID(ImageKey(image), f.builds[ImageKey(image)])
+}
+
+// BreakImage makes containers on the image with ID die shortly after they
+// start, and fail their healthcheck if they have one.
+func (f *Docker) BreakImage(ID string) {
+	f.Lock()
+	defer f.Unlock()
+	f.broken[ID] = true
+}
+
+func (f *Docker) Up() {
+	f.Lock()
+	defer f.Unlock()
+	f.down = false
+	f.stopped = make(chan struct{})
+}
+
+// ImageKey is how the fake files images, so "nginx" finds what was pulled
+// as docker.io/library/nginx:latest.
+func ImageKey(image string) string {
+	ref, err := reference.Parse(image)
+	if err != nil {
+		return image
+	}
+	return ref.String()
+}
+
+func (f *Docker) events(w http.ResponseWriter, r *http.Request) {
+	listener := make(chan *dockerclient.APIEvents, 100)
+	f.Lock()
+	f.listeners = append(f.listeners, listener)
+	stopped := f.stopped
+	f.Unlock()
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case event := <-listener:
+			encoder.Encode(event)
+			w.(http.Flusher).Flush()
+		case <-r.Context().Done():
+			return
+		case <-stopped:
+			return
+		}
+	}
+}
+
+var versionPrefix = regexp.MustCompile(`^/v[0-9.]+`)
+
+func (f *Docker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := versionPrefix.ReplaceAllString(r.URL.Path, "")
+	f.Lock()
+	down := f.down
+	f.Requested = strings.TrimPrefix(versionPrefix.FindString(r.URL.Path), "/v")
+	f.Unlock()
+	if down {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+		return
+	}
+	if path == "/events" {
+		f.events(w, r)
+		return
+	}
+	f.Lock()
+	defer f.Unlock()
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	last := parts[len(parts)-1]
+	switch {
+	case path == "/_ping":
+		w.Write([]byte("OK"))
+	case path == "/version":
+		json.NewEncoder(w).Encode(map[string]string{"Version": "24.0.0", "ApiVersion": f.APIVersion, "MinAPIVersion": "1.24"})
+	case r.Method == "GET" && path == "/containers/json" && f.ListStatus != 0:
+		http.Error(w, "listing containers failed", f.ListStatus)
+	case r.Method == "GET" && path == "/containers/json":
+		list := []dockerclient.APIContainers{}
+		all := r.URL.Query().Get("all") == "1" || r.URL.Query().Get("all") == "true"
+		for _, c := range f.Containers {
+			if !all && !c.State.Running {
+				continue
+			}
+			list = append(list, dockerclient.APIContainers{ID: c.ID, Names: []string{c.Name}, Image: c.Config.Image})
+		}
+		json.NewEncoder(w).Encode(list)
+	case r.Method == "POST" && path == "/containers/create":
+		var body struct {
+			dockerclient.Config
+			HostConfig       *dockerclient.HostConfig
+			NetworkingConfig *dockerclient.NetworkingConfig
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		name := "/" + strings.TrimPrefix(r.URL.Query().Get("name"), "/")
+		if f.find(name) != nil {
+			http.Error(w, "name in use", http.StatusConflict)
+			return
+		}
+		imageID, ok := f.Images[ImageKey(body.Image)]
+		if !ok {
+			http.Error(w, "no such image", http.StatusNotFound)
+			return
+		}
+		// docker takes just the one network at create time
+		if body.NetworkingConfig != nil && len(body.NetworkingConfig.EndpointsConfig) > 1 {
+			http.Error(w, "Container cannot be connected to network endpoints", http.StatusBadRequest)
+			return
+		}
+		f.created++
+		config := body.Config
+		c := &dockerclient.Container{
+			ID:         fmt.Sprintf("%064x", f.created),
+			Name:       name,
+			Image:      imageID,
+			Config:     &config,
+			HostConfig: body.HostConfig,
+			// probes get to reach whatever the test is serving
+			NetworkSettings: &dockerclient.NetworkSettings{
+				IPAddress: "127.0.0.1",
+				Networks:  make(map[string]dockerclient.ContainerNetwork),
+			},
+		}
+		if body.NetworkingConfig != nil {
+			for network, endpoint := range body.NetworkingConfig.EndpointsConfig {
+				attach(c, network, endpoint)
+			}
+		}
+		f.Containers[c.ID] = c
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"Id": c.ID})
+	case parts[0] == "containers" && len(parts) >= 2:
+		c := f.find(strings.Join(parts[1:len(parts)-1], "/"))
+		if r.Method == "DELETE" {
+			c = f.find(strings.Join(parts[1:], "/"))
+		}
+		if c == nil {
+			http.Error(w, "no such container", http.StatusNotFound)
+			return
+		}
+		switch {
+		case r.Method == "GET" && last == "json":
+			json.NewEncoder(w).Encode(c)
+		case r.Method == "POST" && last == "start":
+			c.State.Running = true
+			c.State.StartedAt = time.Now()
+			if c.Config.Healthcheck != nil {
+				c.State.Health.Status = "healthy"
+			}
+			if f.broken[c.Image] {
+				if c.Config.Healthcheck != nil {
+					c.State.Health.Status = "unhealthy"
+				}
+				go func(c *dockerclient.Container) {
+					time.Sleep(50 * time.Millisecond)
+					f.Lock()
+					defer f.Unlock()
+					c.State.Running = false
+					f.emit("die", c.ID)
+				}(c)
+			}
+			f.emit("start", c.ID)
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == "POST" && last == "restart":
+			c.State.Running = true
+			c.RestartCount++
+			f.emit("die", c.ID)
+			f.emit("start", c.ID)
+			f.emit("restart", c.ID)
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == "POST" && last == "exec":
+			var body dockerclient.CreateExecOptions
+			json.NewDecoder(r.Body).Decode(&body)
+			ID := fmt.Sprintf("exec%d", len(f.execs))
+			f.execs[ID] = body.Cmd
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]string{"Id": ID})
+		case r.Method == "POST" && last == "rename":
+			name := "/" + r.URL.Query().Get("name")
+			if other := f.find(name); other != nil && other != c {
+				http.Error(w, "name in use", http.StatusConflict)
+				return
+			}
+			c.Name = name
+			f.emit("rename", c.ID)
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == "POST" && (last == "stop" || last == "kill"):
+			c.State.Running = false
+			f.emit("die", c.ID)
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == "DELETE":
+			delete(f.Containers, c.ID)
+			f.emit("destroy", c.ID)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	case r.Method == "GET" && path == "/images/json":
+		list := []dockerclient.APIImages{}
+		for name, ID := range f.Images {
+			image := dockerclient.APIImages{ID: ID, RepoTags: []string{name}}
+			// pulled by digest, so it has no tag at all
+			if strings.Contains(name, "@") {
+				image = dockerclient.APIImages{ID: ID, RepoDigests: []string{name}}
+			}
+			list = append(list, image)
+		}
+		json.NewEncoder(w).Encode(list)
+	case r.Method == "POST" && path == "/images/create":
+		tag := r.URL.Query().Get("fromImage") + ":" + r.URL.Query().Get("tag")
+		if strings.HasPrefix(r.URL.Query().Get("tag"), "sha256:") {
+			tag = r.URL.Query().Get("fromImage") + "@" + r.URL.Query().Get("tag")
+		}
+		tag = ImageKey(tag)
+		f.Pulls[tag]++
+		if f.Registry != "" && strings.HasPrefix(tag, f.Registry+"/") {
+			err := pullFrom(f.Registry, r.Header.Get("X-Registry-Auth"))
+			if err != nil {
+				http.Error(w, `{"message": "`+err.Error()+`"}`, http.StatusInternalServerError)
+				return
+			}
+		}
+		f.Images[tag] = ImageID(tag, f.builds[tag])
+		w.Write([]byte(`{"status":"Downloaded newer image"}` + "\n"))
+	case r.Method == "GET" && parts[0] == "images" && last == "json":
+		name := strings.Join(parts[1:len(parts)-1], "/")
+		for tag, ID := range f.Images {
+			if ID == name || tag == ImageKey(name) {
+				json.NewEncoder(w).Encode(dockerclient.Image{ID: ID, Config: &dockerclient.Config{}})
+				return
+			}
+		}
+		http.Error(w, "no such image", http.StatusNotFound)
+	case r.Method == "DELETE" && parts[0] == "images":
+		f.Removed = append(f.Removed, strings.Join(parts[1:], "/"))
+		w.Write([]byte("[]"))
+	case parts[0] == "exec" && len(parts) == 3:
+		command, ok := f.execs[parts[1]]
+		if !ok {
+			http.Error(w, "no such exec", http.StatusNotFound)
+			return
+		}
+		if last == "start" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		exitCode := 1
+		if command[0] == "true" {
+			exitCode = 0
+		}
+		json.NewEncoder(w).Encode(dockerclient.ExecInspect{ID: parts[1], ExitCode: exitCode})
+	case r.Method == "POST" && parts[0] == "networks" && last == "connect":
+		var body dockerclient.NetworkConnectionOptions
+		json.NewDecoder(r.Body).Decode(&body)
+		network := strings.Join(parts[1:len(parts)-1], "/")
+		c := f.find(body.Container)
+		if c == nil {
+			http.Error(w, "no such container", http.StatusNotFound)
+			return
+		}
+		connect := Connect{Network: network, Container: c.ID}
+		if body.EndpointConfig != nil {
+			connect.Aliases = body.EndpointConfig.Aliases
+		}
+		f.Connects = append(f.Connects, connect)
+		attach(c, network, body.EndpointConfig)
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// pullFrom logs in to registry with auth the way the docker daemon would.
+func pullFrom(registry string, auth string) error {
+	var config dockerclient.AuthConfiguration
+	if auth != "" {
+		raw, err := base64.URLEncoding.DecodeString(auth)
+		if err != nil {
+			return err
+		}
+		json.Unmarshal(raw, &config)
+	}
+	request, _ := http.NewRequest("GET", "http://"+registry+"/v2/", nil)
+	request.SetBasicAuth(config.Username, config.Password)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("pull access denied for %s", registry)
+	}
+	return nil
+}
+
+// Names lists the names of every container the fake has.
+func (f *Docker) Names() []string {
+	f.Lock()
+	defer f.Unlock()
+	var names []string
+	for _, c := range f.Containers {
+		names = append(names, c.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Add puts a container there as if someone had run it before we came
+// along. The caller doesn't hold the lock.
+func (f *Docker) Add(name string, running bool, config dockerclient.Config) {
+	f.Lock()
+	defer f.Unlock()
+	f.created++
+	c := &dockerclient.Container{
+		ID:         fmt.Sprintf("%064x", f.created),
+		Name:       "/" + name,
+		Image:      f.Images[ImageKey(config.Image)],
+		Config:     &config,
+		HostConfig: &dockerclient.HostConfig{},
+	}
+	c.State.Running = running
+	f.Containers[c.ID] = c
+}
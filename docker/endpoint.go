@@ -0,0 +1,170 @@
+package docker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Endpoint is how to reach docker.
+type Endpoint struct {
+	// Host is a unix://, tcp://, http:// or https:// address
+	Host string
+	// CertPath holds ca.pem, cert.pem and key.pem for TLS
+	CertPath string
+	// TLSVerify checks docker's certificate against ca.pem
+	TLSVerify bool
+}
+
+// the docker API versions we know how to talk, healthchecks and exec need
+// 1.24
+const (
+	minAPIVersion = "1.24"
+	maxAPIVersion = "1.41"
+)
+
+// newClient makes a client for endpoint that talks API version, or
+// whatever docker speaks when version is empty.
+func newClient(endpoint Endpoint, version string) (*dockerclient.Client, error) {
+	var client *dockerclient.Client
+	var err error
+	if endpoint.CertPath == "" {
+		client, err = dockerclient.NewVersionedClient(endpoint.Host, version)
+	} else {
+		// without verification there's no ca.pem to check against
+		files := []string{"cert.pem", "key.pem"}
+		ca := ""
+		if endpoint.TLSVerify {
+			files = append(files, "ca.pem")
+			ca = filepath.Join(endpoint.CertPath, "ca.pem")
+		}
+		// the client quietly goes without any file that's missing, which
+		// for ca.pem means not verifying anything
+		for _, file := range files {
+			if _, err = os.Stat(filepath.Join(endpoint.CertPath, file)); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			client, err = dockerclient.NewVersionedTLSClient(endpoint.Host,
+				filepath.Join(endpoint.CertPath, "cert.pem"),
+				filepath.Join(endpoint.CertPath, "key.pem"),
+				ca, version)
+		}
+		if err != nil {
+			err = fmt.Errorf("loading certificates from %s: %s", endpoint.CertPath, err.Error())
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	// until there's a version Connect does the asking
+	client.SkipServerVersionCheck = version == ""
+	return client, nil
+}
+
+// Connect makes sure docker is there and agrees on an API version with it.
+// When it isn't, the error says why as best it can.
+func (self *Processing) Connect() error {
+	var version *dockerclient.Env
+	err := self.retry("connecting to docker at "+self.endpoint.Host, func() error {
+		var err error
+		version, err = self.docker.Version()
+		return err
+	})
+	if err != nil {
+		return diagnose(self.endpoint, err)
+	}
+	negotiated, err := negotiate(version.Get("ApiVersion"), version.Get("MinAPIVersion"))
+	if err != nil {
+		return fmt.Errorf("docker at %s: %s", self.endpoint.Host, err.Error())
+	}
+	client, err := newClient(self.endpoint, negotiated)
+	if err != nil {
+		return err
+	}
+	// the client looks up docker's version itself the first time it's
+	// used, which isn't safe to do from more than one goroutine
+	err = client.Ping()
+	if err != nil {
+		return diagnose(self.endpoint, err)
+	}
+	self.docker = client
+	logit("Connected to docker", version.Get("Version"), "at", self.endpoint.Host, "with API", negotiated)
+	return nil
+}
+
+// negotiate picks the newest API version both docker and we speak.
+func negotiate(server string, serverMin string) (string, error) {
+	serverVersion, err := dockerclient.NewAPIVersion(server)
+	if err != nil {
+		return "", fmt.Errorf("it answered with API version %q", server)
+	}
+	ours, _ := dockerclient.NewAPIVersion(maxAPIVersion)
+	oldest, _ := dockerclient.NewAPIVersion(minAPIVersion)
+	if serverVersion.LessThan(oldest) {
+		return "", fmt.Errorf("its API %s is older than the %s watchdock needs", server, minAPIVersion)
+	}
+	if serverVersion.LessThanOrEqualTo(ours) {
+		return server, nil
+	}
+	// newer dockers stop speaking old versions eventually, their oldest
+	// is the best we can do then
+	if newest, err := dockerclient.NewAPIVersion(serverMin); err == nil && newest.GreaterThan(ours) {
+		logit("Docker only speaks API", serverMin, "and newer, watchdock was written against", maxAPIVersion)
+		return serverMin, nil
+	}
+	return maxAPIVersion, nil
+}
+
+// diagnose turns an error reaching docker into what's most likely wrong.
+func diagnose(endpoint Endpoint, err error) error {
+	host := endpoint.Host
+	var apiError *dockerclient.Error
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	var notTLS tls.RecordHeaderError
+	switch {
+	case errors.As(err, &apiError) && strings.Contains(apiError.Message, "HTTPS"):
+		return fmt.Errorf("docker at %s only talks TLS, docker.tls.cert_path or DOCKER_CERT_PATH needs to be set", host)
+	case errors.As(err, &unknownAuthority):
+		return fmt.Errorf("docker at %s has a certificate %s doesn't trust: %s", host, filepath.Join(endpoint.CertPath, "ca.pem"), err.Error())
+	case errors.As(err, &hostname):
+		return fmt.Errorf("docker's certificate isn't for %s: %s", host, err.Error())
+	case errors.As(err, &invalid):
+		return fmt.Errorf("docker at %s has a bad certificate: %s", host, err.Error())
+	case errors.As(err, &notTLS), strings.Contains(err.Error(), "HTTP response to HTTPS client"):
+		return fmt.Errorf("docker at %s doesn't talk TLS, docker.tls.cert_path or DOCKER_CERT_PATH shouldn't be set", host)
+	case strings.Contains(err.Error(), "remote error: tls"):
+		return fmt.Errorf("docker at %s didn't accept the client certificate in %s: %s", host, endpoint.CertPath, err.Error())
+	case errors.Is(err, syscall.ENOENT):
+		return fmt.Errorf("there's no docker socket at %s, is docker running, or is docker.host or DOCKER_HOST wrong?", host)
+	case errors.Is(err, syscall.EACCES):
+		return fmt.Errorf("not allowed to use %s, watchdock has to run as root or in the docker group", host)
+	case errors.Is(err, dockerclient.ErrConnectionRefused), errors.Is(err, syscall.ECONNREFUSED):
+		return fmt.Errorf("nothing is listening at %s, is docker running there, or is docker.host or DOCKER_HOST wrong?", host)
+	}
+	return fmt.Errorf("can't reach docker at %s: %s", host, err.Error())
+}
+
+// certificateProblem is whether err is TLS failing, which trying again
+// won't fix.
+func certificateProblem(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	var notTLS tls.RecordHeaderError
+	return errors.As(err, &unknownAuthority) ||
+		errors.As(err, &hostname) ||
+		errors.As(err, &invalid) ||
+		errors.As(err, &notTLS) ||
+		strings.Contains(err.Error(), "HTTP response to HTTPS client") ||
+		strings.Contains(err.Error(), "remote error: tls")
+}
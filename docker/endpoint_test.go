@@ -0,0 +1,176 @@
+package docker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/brimstone/watchdock/docker/dockertest"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNegotiate(t *testing.T) {
+	var tests = []struct {
+		server    string
+		serverMin string
+		want      string
+		err       string
+	}{
+		{"1.30", "1.12", "1.30", ""},
+		{"1.41", "1.12", "1.41", ""},
+		{"1.43", "1.24", "1.41", ""},
+		{"1.47", "1.44", "1.44", ""},
+		{"1.21", "1.12", "", "its API 1.21 is older than the 1.24 watchdock needs"},
+		{"", "", "", `it answered with API version ""`},
+	}
+	for _, c := range tests {
+		got, err := negotiate(c.server, c.serverMin)
+		if got != c.want || (err == nil) != (c.err == "") || (err != nil && err.Error() != c.err) {
+			t.Errorf("negotiate(%s, %s) == %s, %v", c.server, c.serverMin, got, err)
+		}
+	}
+}
+
+func TestConnect(t *testing.T) {
+	fake := dockertest.New()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	processing, err := New(Endpoint{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = processing.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	processing.docker.ListContainers(dockerclient.ListContainersOptions{})
+	fake.Lock()
+	requested := fake.Requested
+	fake.APIVersion = "1.20"
+	fake.Unlock()
+	if requested != maxAPIVersion {
+		t.Errorf("Expected API %s to be asked for, got %q", maxAPIVersion, requested)
+	}
+
+	processing, _ = New(Endpoint{Host: server.URL})
+	err = processing.Connect()
+	if err == nil || !strings.Contains(err.Error(), "older than the 1.24 watchdock needs") {
+		t.Errorf("Expected an old docker to be refused, got %v", err)
+	}
+}
+
+// writeCerts makes a self signed certificate for 127.0.0.1, and writes it
+// to dir as ca.pem and cert.pem, the way the docker CLI wants it.
+func writeCerts(t *testing.T, dir string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "docker"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawKey, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: rawKey})
+	ioutil.WriteFile(filepath.Join(dir, "ca.pem"), certPEM, 0600)
+	ioutil.WriteFile(filepath.Join(dir, "cert.pem"), certPEM, 0600)
+	ioutil.WriteFile(filepath.Join(dir, "key.pem"), keyPEM, 0600)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert.Leaf, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestTLS(t *testing.T) {
+	trusted := t.TempDir()
+	untrusted := t.TempDir()
+	cert := writeCerts(t, trusted)
+	writeCerts(t, untrusted)
+
+	fake := dockertest.New()
+	secure := httptest.NewUnstartedServer(fake)
+	secure.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	secure.StartTLS()
+	defer secure.Close()
+	plain := httptest.NewServer(fake)
+	defer plain.Close()
+	// only lets in clients with the trusted certificate
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+	strict := httptest.NewUnstartedServer(fake)
+	strict.TLS = &tls.Config{Certificates: []tls.Certificate{cert}, ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert}
+	strict.StartTLS()
+	defer strict.Close()
+	secureHost := "tcp://" + secure.Listener.Addr().String()
+	strictHost := "tcp://" + strict.Listener.Addr().String()
+	plainHost := "tcp://" + plain.Listener.Addr().String()
+
+	var tests = []struct {
+		endpoint Endpoint
+		err      string
+	}{
+		{Endpoint{Host: secureHost, CertPath: trusted, TLSVerify: true}, ""},
+		{Endpoint{Host: secureHost, CertPath: untrusted}, ""},
+		{Endpoint{Host: secureHost, CertPath: untrusted, TLSVerify: true}, "has a certificate " + untrusted + "/ca.pem doesn't trust"},
+		{Endpoint{Host: secureHost}, "only talks TLS"},
+		{Endpoint{Host: strictHost, CertPath: trusted, TLSVerify: true}, ""},
+		{Endpoint{Host: strictHost, CertPath: untrusted}, "didn't accept the client certificate in " + untrusted},
+		{Endpoint{Host: plainHost, CertPath: trusted, TLSVerify: true}, "doesn't talk TLS"},
+		{Endpoint{Host: "unix://" + filepath.Join(trusted, "docker.sock")}, "there's no docker socket at"},
+		{Endpoint{Host: "tcp://127.0.0.1:1"}, "nothing is listening at tcp://127.0.0.1:1"},
+	}
+	for _, c := range tests {
+		processing, err := New(c.endpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		processing.backoff = backoff{min: time.Millisecond, max: time.Millisecond, attempts: 2}
+		err = processing.Connect()
+		if c.err == "" {
+			if err != nil {
+				t.Errorf("Connect() to %+v == %v", c.endpoint, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("Connect() to %+v == %v, want %q", c.endpoint, err, c.err)
+		}
+	}
+
+	_, err := New(Endpoint{Host: secureHost, CertPath: filepath.Join(trusted, "missing")})
+	if err == nil || !strings.HasPrefix(err.Error(), "loading certificates from") {
+		t.Errorf("Expected missing certificates to fail, got %v", err)
+	}
+}
@@ -0,0 +1,165 @@
+package docker
+
+import (
+	"github.com/brimstone/watchdock/channel"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"reflect"
+	"strings"
+)
+
+// Export is the spec for the container called name, whether watchdock runs
+// it or not, with what only watchdock itself puts on its containers left out.
+// It gets the selector if it doesn't have it, so watchdock runs it from then
+// on.
+func (self *Processing) Export(name string) (*channel.Spec, error) {
+	container, err := self.Inspect(name)
+	if err != nil {
+		return nil, err
+	}
+	spec := self.exportSpec(container)
+	if !self.shouldRun(container) {
+		selector := self.currentOptions().Selector
+		if !strings.Contains(selector, "=") {
+			selector += "=1"
+		}
+		spec.Config.Env = append(spec.Config.Env, selector)
+	}
+	for _, label := range []string{channel.ReplicaOfLabel, channel.ReplicaLabel} {
+		delete(spec.Config.Labels, label)
+	}
+	if len(spec.Config.Labels) == 0 {
+		spec.Config.Labels = nil
+	}
+	return spec, spec.Validate()
+}
+
+// exportSpec turns a running container into the spec a person would have
+// written for it. Runtime state is dropped, and so is anything the image or
+// the engine would fill in by itself.
+func (self *Processing) exportSpec(container *dockerclient.Container) *channel.Spec {
+	imageConfig := new(dockerclient.Config)
+	image, err := self.docker.InspectImage(container.Image)
+	if err != nil {
+		logit("Couldn't inspect image for", container.Name, err.Error())
+	} else if image.Config != nil {
+		imageConfig = image.Config
+	}
+	return cleanSpec(container, imageConfig)
+}
+
+func cleanSpec(container *dockerclient.Container, imageConfig *dockerclient.Config) *channel.Spec {
+	config := new(dockerclient.Config)
+	if container.Config != nil {
+		*config = *container.Config
+	}
+	hostConfig := new(dockerclient.HostConfig)
+	if container.HostConfig != nil {
+		*hostConfig = *container.HostConfig
+	}
+
+	// docker makes the hostname up from the ID unless told otherwise
+	if len(container.ID) >= 12 && config.Hostname == container.ID[:12] {
+		config.Hostname = ""
+	}
+	config.Env = without(config.Env, imageConfig.Env)
+	if reflect.DeepEqual(config.Cmd, imageConfig.Cmd) {
+		config.Cmd = nil
+	}
+	if reflect.DeepEqual(config.Entrypoint, imageConfig.Entrypoint) {
+		config.Entrypoint = nil
+	}
+	if config.WorkingDir == imageConfig.WorkingDir {
+		config.WorkingDir = ""
+	}
+	if config.User == imageConfig.User {
+		config.User = ""
+	}
+	if config.StopSignal == imageConfig.StopSignal {
+		config.StopSignal = ""
+	}
+	if reflect.DeepEqual(config.Healthcheck, imageConfig.Healthcheck) {
+		config.Healthcheck = nil
+	}
+	config.OnBuild = nil
+	config.ArgsEscaped = false
+	config.AttachStdin = false
+	config.AttachStdout = false
+	config.AttachStderr = false
+	config.StdinOnce = false
+	for port := range imageConfig.ExposedPorts {
+		if _, ok := hostConfig.PortBindings[port]; !ok {
+			delete(config.ExposedPorts, port)
+		}
+	}
+	for volume := range imageConfig.Volumes {
+		delete(config.Volumes, volume)
+	}
+	if len(config.Labels) > 0 {
+		labels := make(map[string]string)
+		for key, value := range config.Labels {
+			if imageValue, ok := imageConfig.Labels[key]; !ok || imageValue != value {
+				labels[key] = value
+			}
+		}
+		config.Labels = labels
+	}
+
+	// engine defaults
+	switch hostConfig.NetworkMode {
+	case "default", "bridge":
+		hostConfig.NetworkMode = ""
+	}
+	if hostConfig.RestartPolicy.Name == "no" {
+		hostConfig.RestartPolicy = dockerclient.RestartPolicy{}
+	}
+	if hostConfig.LogConfig.Type == "json-file" && len(hostConfig.LogConfig.Config) == 0 {
+		hostConfig.LogConfig = dockerclient.LogConfig{}
+	}
+	switch hostConfig.IpcMode {
+	case "private", "shareable":
+		hostConfig.IpcMode = ""
+	}
+	switch hostConfig.CgroupnsMode {
+	case "private", "host":
+		hostConfig.CgroupnsMode = ""
+	}
+	if hostConfig.Runtime == "runc" {
+		hostConfig.Runtime = ""
+	}
+	// 64MB
+	if hostConfig.ShmSize == 67108864 {
+		hostConfig.ShmSize = 0
+	}
+	hostConfig.ConsoleSize = [2]int{}
+	hostConfig.MaskedPaths = nil
+	hostConfig.ReadonlyPaths = nil
+	hostConfig.ContainerIDFile = ""
+	if hostConfig.MemorySwappiness != nil && *hostConfig.MemorySwappiness == -1 {
+		hostConfig.MemorySwappiness = nil
+	}
+	if hostConfig.OOMKillDisable != nil && !*hostConfig.OOMKillDisable {
+		hostConfig.OOMKillDisable = nil
+	}
+	if hostConfig.PidsLimit != nil && *hostConfig.PidsLimit <= 0 {
+		hostConfig.PidsLimit = nil
+	}
+
+	return &channel.Spec{
+		Version:          channel.SpecVersion,
+		Name:             channel.CleanName(container.Name),
+		Config:           config,
+		HostConfig:       hostConfig,
+		NetworkingConfig: networkingConfig(container),
+	}
+}
+
+// without returns list minus everything that's also in defaults.
+func without(list []string, defaults []string) []string {
+	var result []string
+	for _, item := range list {
+		if !contains(defaults, item) {
+			result = append(result, item)
+		}
+	}
+	return result
+}
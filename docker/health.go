@@ -0,0 +1,230 @@
+package docker
+
+import (
+	"errors"
+	"fmt"
+	"github.com/brimstone/watchdock/channel"
+	"github.com/brimstone/watchdock/metrics"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// defaultRestartBackoff is how long a container that keeps failing waits
+// between restarts. After attempts restarts in a row it's crash-looping,
+// and once it's stayed up for max it's forgiven.
+var defaultRestartBackoff = backoff{min: 10 * time.Second, max: 5 * time.Minute, attempts: 5}
+
+// probeSettings is a Probe with the defaults filled in.
+type probeSettings struct {
+	interval  time.Duration
+	timeout   time.Duration
+	threshold int
+}
+
+func settingsFor(p *channel.Probe) probeSettings {
+	settings := probeSettings{interval: 10 * time.Second, timeout: 5 * time.Second, threshold: 3}
+	if interval, err := time.ParseDuration(p.Interval); err == nil {
+		settings.interval = interval
+	}
+	if timeout, err := time.ParseDuration(p.Timeout); err == nil {
+		settings.timeout = timeout
+	}
+	if p.FailureThreshold > 0 {
+		settings.threshold = p.FailureThreshold
+	}
+	return settings
+}
+
+// checkHealth probes every container with a Health probe whenever its
+// interval is up, until we're stopping.
+func (self *Processing) checkHealth() {
+	for {
+		select {
+		case <-time.After(self.backoff.min):
+		case <-self.ctx.Done():
+			return
+		}
+		if atomic.LoadInt32(&self.connected) == 0 {
+			continue
+		}
+		for _, c := range self.state.list() {
+			if c.Health == nil || c.ID == "" {
+				continue
+			}
+			if self.state.probeDue(c.Name, settingsFor(c.Health).interval) {
+				c := c
+				self.background(func() { self.checkHealthOf(c) })
+			}
+		}
+	}
+}
+
+// checkHealthOf probes container once, and restarts it if that made it
+// unhealthy.
+func (self *Processing) checkHealthOf(container Container) {
+	name := container.Name
+	settings := settingsFor(container.Health)
+	defer self.state.doneProbing(name)
+	running, err := self.inspect(container.ID)
+	if err != nil || !running.State.Running {
+		// not running is for CheckOnContainers to deal with
+		return
+	}
+	before := self.state.healthOf(name).status
+	err = self.probe(running, container.Health)
+	h := self.state.probed(name, err, settings.threshold)
+	if err != nil {
+		metrics.HealthChecks.WithLabelValues("failure").Inc()
+		logit("Container", name, "failed its probe", fmt.Sprintf("(%d/%d):", h.failures, settings.threshold), err.Error())
+	} else {
+		metrics.HealthChecks.WithLabelValues("success").Inc()
+	}
+	switch {
+	case h.status == "healthy" && before != "healthy":
+		logit("Container", name, "is healthy")
+		self.sendHealth(name, running.ID, true, "healthy", h)
+		if self.state.hasDependents(name) {
+			self.Reconcile()
+		}
+	case h.status == "unhealthy":
+		// tried on every probe, restart decides whether it's time yet
+		if !self.state.claim(name) {
+			// someone else is replacing it already
+			return
+		}
+		defer self.state.release(name)
+		state, err := self.restart(name, running, "unhealthy: "+h.reason)
+		if err != nil {
+			logit("Error restarting", name, err.Error())
+		} else if before != "unhealthy" && state != "stopped" {
+			self.sendHealth(name, running.ID, true, state+": unhealthy: "+h.reason, self.state.healthOf(name))
+		}
+	}
+}
+
+// restart starts the container again, or restarts it if it's still
+// running, unless it's been restarted so often lately it has to wait. It
+// reports the state the container is left in.
+func (self *Processing) restart(name string, running *dockerclient.Container, reason string) (string, error) {
+	if ok, wait := self.state.mayRestart(name); !ok {
+		h := self.state.healthOf(name)
+		state := "backing-off"
+		if h.crashLoop {
+			state = "crash-looping"
+		}
+		logit("Container", name, "is", state+", not restarting it for another", wait.Round(time.Second), "after", h.restarts, "restarts")
+		return state, nil
+	}
+	var err error
+	if running.State.Running {
+		err = self.docker.RestartContainer(running.ID, 10)
+	} else {
+		err = self.docker.StartContainer(running.ID, nil)
+	}
+	if err != nil {
+		return "stopped", err
+	}
+	metrics.ContainerActions.WithLabelValues("restarted").Inc()
+	h := self.state.restarted(name, reason, self.restartBackoff)
+	message := "restarted: " + reason
+	if h.crashLoop {
+		message = fmt.Sprintf("crash-looping: restarted %d times, last because %s", h.restarts, reason)
+	}
+	logit("Container", name, message+", next restart no sooner than", h.delay)
+	self.sendHealth(name, running.ID, true, message, h)
+	return "stopped", nil
+}
+
+// sendHealth tells the storage modules how a container is doing and why.
+func (self *Processing) sendHealth(name string, ID string, running bool, message string, h health) {
+	self.events <- channel.NewStatus(name, &channel.State{
+		ID:        ID,
+		Running:   running,
+		Message:   message,
+		Health:    h.status,
+		Restarts:  h.restarts,
+		CrashLoop: h.crashLoop,
+	})
+}
+
+// isHealthy is whether the container passes its Health probe, or its
+// docker healthcheck when it has no probe of ours.
+func (self *Processing) isHealthy(container *dockerclient.Container) bool {
+	if known, err := self.state.byName(container.Name); err == nil && known.Health != nil {
+		return self.state.healthOf(container.Name).status == "healthy"
+	}
+	return healthy(container)
+}
+
+// probe checks the container the way p says, inside it or on its own
+// address.
+func (self *Processing) probe(container *dockerclient.Container, p *channel.Probe) error {
+	timeout := settingsFor(p).timeout
+	if len(p.Exec) > 0 {
+		return self.probeExec(container.ID, p.Exec, timeout)
+	}
+	ip := ""
+	if container.NetworkSettings != nil {
+		ip = container.NetworkSettings.IPAddress
+		for _, network := range container.NetworkSettings.Networks {
+			if ip == "" {
+				ip = network.IPAddress
+			}
+		}
+	}
+	if ip == "" {
+		return errors.New("it has no address to probe")
+	}
+	address := net.JoinHostPort(ip, strconv.Itoa(p.Port))
+	if p.Path == "" {
+		conn, err := net.DialTimeout("tcp", address, timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	client := http.Client{Timeout: timeout}
+	response, err := client.Get("http://" + address + "/" + strings.TrimPrefix(p.Path, "/"))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode >= 400 {
+		return fmt.Errorf("probe answered %s", response.Status)
+	}
+	return nil
+}
+
+// probeExec runs command in the container and waits for it to exit 0.
+func (self *Processing) probeExec(ID string, command []string, timeout time.Duration) error {
+	exec, err := self.docker.CreateExec(dockerclient.CreateExecOptions{Container: ID, Cmd: command})
+	if err != nil {
+		return err
+	}
+	err = self.docker.StartExec(exec.ID, dockerclient.StartExecOptions{Detach: true})
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		inspected, err := self.docker.InspectExec(exec.ID)
+		if err != nil {
+			return err
+		}
+		if !inspected.Running {
+			if inspected.ExitCode != 0 {
+				return fmt.Errorf("%s exited with %d", command[0], inspected.ExitCode)
+			}
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s took longer than %s", command[0], timeout)
+		}
+		time.Sleep(self.backoff.min)
+	}
+}
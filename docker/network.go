@@ -0,0 +1,67 @@
+package docker
+
+import (
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"sort"
+)
+
+// networkingConfig turns the networks docker reports for a container back
+// into what we'd have to ask for at create time. The default bridge and
+// the aliases docker makes up on its own are left out.
+func networkingConfig(container *dockerclient.Container) *dockerclient.NetworkingConfig {
+	if container.NetworkSettings == nil || len(container.NetworkSettings.Networks) == 0 {
+		return nil
+	}
+	endpoints := make(map[string]*dockerclient.EndpointConfig)
+	for name, network := range container.NetworkSettings.Networks {
+		switch name {
+		case "bridge", "host", "none":
+			continue
+		}
+		endpoint := new(dockerclient.EndpointConfig)
+		for _, alias := range network.Aliases {
+			if len(container.ID) >= 12 && alias == container.ID[:12] {
+				continue
+			}
+			if alias == container.Config.Hostname || "/"+alias == container.Name {
+				continue
+			}
+			endpoint.Aliases = append(endpoint.Aliases, alias)
+		}
+		endpoints[name] = endpoint
+	}
+	if len(endpoints) == 0 {
+		return nil
+	}
+	return &dockerclient.NetworkingConfig{EndpointsConfig: endpoints}
+}
+
+// splitNetworks picks the one network docker lets us attach at create time
+// and returns the rest to be connected before the container starts.
+func splitNetworks(container Container) (*dockerclient.NetworkingConfig, map[string]*dockerclient.EndpointConfig) {
+	if container.NetworkingConfig == nil || len(container.NetworkingConfig.EndpointsConfig) == 0 {
+		return nil, nil
+	}
+	endpoints := container.NetworkingConfig.EndpointsConfig
+	var names []string
+	for name := range endpoints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	first := names[0]
+	if container.HostConfig != nil {
+		if _, ok := endpoints[container.HostConfig.NetworkMode]; ok {
+			first = container.HostConfig.NetworkMode
+		}
+	}
+	rest := make(map[string]*dockerclient.EndpointConfig)
+	for _, name := range names {
+		if name != first {
+			rest[name] = endpoints[name]
+		}
+	}
+	create := &dockerclient.NetworkingConfig{
+		EndpointsConfig: map[string]*dockerclient.EndpointConfig{first: endpoints[first]},
+	}
+	return create, rest
+}
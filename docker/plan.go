@@ -0,0 +1,221 @@
+package docker
+
+import (
+	"fmt"
+	"github.com/brimstone/watchdock/channel"
+	"github.com/brimstone/watchdock/reference"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"sort"
+	"strings"
+)
+
+// The things a reconcile can do.
+const (
+	ActionPull            = "pull"
+	ActionCreate          = "create"
+	ActionRecreate        = "recreate"
+	ActionStart           = "start"
+	ActionRemoveContainer = "remove-container"
+	ActionRemoveImage     = "remove-image"
+)
+
+// Action is one thing a reconcile would do, on a Container or an Image.
+type Action struct {
+	Action    string
+	Container string `json:",omitempty"`
+	Image     string `json:",omitempty"`
+	// Host is the docker host it happens on, when there's more than one
+	Host string `json:",omitempty"`
+	// Reason is why, like what drifted
+	Reason string `json:",omitempty"`
+}
+
+// Planner is anything that can say what it would do: docker on a host,
+// on every host, or this node's share of a cluster.
+type Planner interface {
+	Plan(specs []*channel.Spec, deleted []string) ([]Action, error)
+}
+
+func (action Action) String() string {
+	what := action.Container
+	if what == "" {
+		what = action.Image
+	}
+	s := action.Action + " " + what
+	if action.Host != "" {
+		s = action.Host + ": " + s
+	}
+	if action.Reason != "" {
+		s += " (" + action.Reason + ")"
+	}
+	return s
+}
+
+// Plan works out everything a reconcile would do to make docker run specs,
+// and to remove what the specs called deleted ran as, without doing any of
+// it. Containers with the selector but no spec aren't touched, they're
+// saved to storage instead. Newer images can't be foreseen without pulling
+// them, so the pulls that look for them are listed but not what follows.
+func (self *Processing) Plan(specs []*channel.Spec, deleted []string) ([]Action, error) {
+	existing, err := self.existing()
+	if err != nil {
+		return nil, err
+	}
+	var desired []Container
+	for _, spec := range specs {
+		containers, err := containersFor(spec)
+		if err != nil {
+			logit("Not planning for", spec.Name+":", err.Error())
+			continue
+		}
+		desired = append(desired, containers...)
+	}
+	if ordered, err := dependencyOrder(desired); err == nil {
+		desired = ordered
+	}
+
+	var actions []Action
+	pulled := make(map[string]bool)
+	wanted := make(map[string]bool)
+	for _, c := range desired {
+		wanted[c.Name] = true
+		name := channel.CleanName(c.Name)
+		image := specImage(c)
+		if reason := self.pullReason(c); reason != "" && !pulled[image] {
+			pulled[image] = true
+			actions = append(actions, Action{Action: ActionPull, Image: image, Reason: reason})
+		}
+		have, ok := existing[c.Name]
+		if !ok {
+			actions = append(actions,
+				Action{Action: ActionCreate, Container: name, Reason: "it doesn't exist"},
+				Action{Action: ActionStart, Container: name})
+			continue
+		}
+		if changes := diffContainer(&c, have); len(changes) > 0 {
+			var reasons []string
+			for _, change := range changes {
+				reasons = append(reasons, change.String())
+			}
+			actions = append(actions, Action{Action: ActionRecreate, Container: name, Reason: strings.Join(reasons, ", ")})
+			continue
+		}
+		if !have.State.Running {
+			actions = append(actions, Action{Action: ActionStart, Container: name, Reason: fmt.Sprintf("exited with code %d", have.State.ExitCode)})
+		}
+	}
+
+	// what scaling leaves behind, and what's been deleted
+	gone := make(map[string]bool)
+	for _, name := range deleted {
+		gone[name] = true
+	}
+	var names []string
+	for name := range existing {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		have := existing[name]
+		if wanted[name] || !self.shouldRun(have) {
+			continue
+		}
+		switch spec := specOf(specs, have); {
+		case gone[channel.CleanName(name)] || gone[replicaOf(have)]:
+			actions = append(actions, Action{Action: ActionRemoveContainer, Container: channel.CleanName(name), Reason: "its spec was deleted"})
+		case spec == nil:
+			// found, not managed yet
+		case spec.Replicas != nil && replicaOf(have) == "":
+			actions = append(actions, Action{Action: ActionRemoveContainer, Container: channel.CleanName(name), Reason: "it runs as replicas now"})
+		case spec.Replicas != nil:
+			actions = append(actions, Action{Action: ActionRemoveContainer, Container: channel.CleanName(name), Reason: fmt.Sprintf("there are only %d replicas now", spec.Replicas.Count)})
+		default:
+			actions = append(actions, Action{Action: ActionRemoveContainer, Container: channel.CleanName(name), Reason: "it doesn't have replicas any more"})
+		}
+	}
+
+	if self.currentOptions().CleanUntaggedImages {
+		removals, err := self.planImageRemovals(desired)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, removals...)
+	}
+	return actions, nil
+}
+
+// existing is every container docker has, by name.
+func (self *Processing) existing() (map[string]*dockerclient.Container, error) {
+	var list []dockerclient.APIContainers
+	err := self.retry("listing containers", func() error {
+		var err error
+		list, err = self.docker.ListContainers(dockerclient.ListContainersOptions{All: true})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]*dockerclient.Container)
+	for _, c := range list {
+		if len(c.Names) == 0 || inRollout(c.Names[0]) {
+			continue
+		}
+		container, err := self.inspect(c.ID)
+		if err != nil {
+			return nil, err
+		}
+		existing[c.Names[0]] = container
+	}
+	return existing, nil
+}
+
+// specOf is the spec the container have was run from, if it's one of specs.
+func specOf(specs []*channel.Spec, have *dockerclient.Container) *channel.Spec {
+	name := replicaOf(have)
+	if name == "" {
+		name = channel.CleanName(have.Name)
+	}
+	for _, spec := range specs {
+		if spec.Name == name {
+			return spec
+		}
+	}
+	return nil
+}
+
+// pullReason is why the next reconcile would pull container's image, if it
+// would: because it's missing, or to look for a newer one.
+func (self *Processing) pullReason(container Container) string {
+	image := specImage(container)
+	_, err := self.docker.InspectImage(image)
+	if err == dockerclient.ErrNoSuchImage {
+		return "it's missing"
+	}
+	policy := channel.PolicyFor(image, container.Update)
+	if policy.Policy == channel.UpdateAlways || policy.Policy == channel.UpdateSemver {
+		return "to look for a newer image"
+	}
+	return ""
+}
+
+// planImageRemovals is every image removeUntaggedImages would remove.
+func (self *Processing) planImageRemovals(desired []Container) ([]Action, error) {
+	pinned := make(map[string]bool)
+	for _, c := range desired {
+		image, err := reference.Parse(specImage(c))
+		if err == nil && image.Pinned() {
+			pinned[image.Digested()] = true
+		}
+	}
+	images, err := self.docker.ListImages(dockerclient.ListImagesOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var actions []Action
+	for _, image := range images {
+		if dangling(image, pinned) {
+			actions = append(actions, Action{Action: ActionRemoveImage, Image: image.ID, Reason: "it has no tag"})
+		}
+	}
+	return actions, nil
+}
@@ -0,0 +1,169 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/brimstone/watchdock/reference"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// docker only asks registries for tags when it's told to pull by tag, so
+// finding the newest one is up to us
+var registryClient = &http.Client{Timeout: 30 * time.Second}
+
+// registryURL is where a registry's v2 API lives. Docker Hub is served from
+// its own host, and like docker we only talk plain http to localhost.
+func registryURL(registry string) string {
+	if registry == reference.DefaultRegistry {
+		return "https://registry-1.docker.io"
+	}
+	host := registry
+	if h, _, err := net.SplitHostPort(registry); err == nil {
+		host = h
+	}
+	if host == "localhost" || net.ParseIP(host).IsLoopback() {
+		return "http://" + registry
+	}
+	return "https://" + registry
+}
+
+// listTags asks image's registry for every tag of its repository.
+func (self *Processing) listTags(image *reference.Reference, login string) ([]string, error) {
+	auth, err := self.auth.resolve(image, login)
+	if err != nil {
+		return nil, err
+	}
+	var tags []string
+	next := registryURL(image.Registry) + "/v2/" + image.Repository + "/tags/list"
+	for next != "" {
+		response, err := registryGet(next, auth)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Tags []string
+		}
+		err = json.NewDecoder(response.Body).Decode(&page)
+		response.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("tags for %s: %s", image.Name(), err.Error())
+		}
+		tags = append(tags, page.Tags...)
+		next, err = nextPage(next, response.Header.Get("Link"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tags, nil
+}
+
+// nextPage follows a Link: <...>; rel="next" header, if there is one.
+func nextPage(current string, link string) (string, error) {
+	if !strings.Contains(link, `rel="next"`) {
+		return "", nil
+	}
+	start, end := strings.Index(link, "<"), strings.Index(link, ">")
+	if start < 0 || end < start {
+		return "", fmt.Errorf("bad Link header %q", link)
+	}
+	base, err := url.Parse(current)
+	if err != nil {
+		return "", err
+	}
+	next, err := base.Parse(link[start+1 : end])
+	if err != nil {
+		return "", err
+	}
+	return next.String(), nil
+}
+
+// registryGet fetches address, answering the registry's challenge if it
+// wants us to log in first.
+func registryGet(address string, auth dockerclient.AuthConfiguration) (*http.Response, error) {
+	response, err := registryClient.Get(address)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode == http.StatusUnauthorized {
+		challenge := response.Header.Get("WWW-Authenticate")
+		response.Body.Close()
+		request, _ := http.NewRequest("GET", address, nil)
+		if strings.HasPrefix(challenge, "Bearer ") {
+			token, err := bearerToken(challenge, auth)
+			if err != nil {
+				return nil, err
+			}
+			request.Header.Set("Authorization", "Bearer "+token)
+		} else {
+			request.SetBasicAuth(auth.Username, auth.Password)
+		}
+		response, err = registryClient.Do(request)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, fmt.Errorf("registry answered %s for %s", response.Status, address)
+	}
+	return response, nil
+}
+
+var challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// bearerToken gets a token from the auth server a Bearer challenge points
+// at, the way the docker daemon does.
+func bearerToken(challenge string, auth dockerclient.AuthConfiguration) (string, error) {
+	params := make(map[string]string)
+	for _, match := range challengeParam.FindAllStringSubmatch(challenge, -1) {
+		params[match[1]] = match[2]
+	}
+	if params["realm"] == "" {
+		return "", fmt.Errorf("bad challenge %q", challenge)
+	}
+	query := url.Values{}
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			query.Set(key, params[key])
+		}
+	}
+	var request *http.Request
+	if auth.IdentityToken != "" {
+		query.Set("grant_type", "refresh_token")
+		query.Set("refresh_token", auth.IdentityToken)
+		query.Set("client_id", "watchdock")
+		request, _ = http.NewRequest("POST", params["realm"], strings.NewReader(query.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		request, _ = http.NewRequest("GET", params["realm"]+"?"+query.Encode(), nil)
+		if auth.Username != "" {
+			request.SetBasicAuth(auth.Username, auth.Password)
+		}
+	}
+	response, err := registryClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("auth server answered %s", response.Status)
+	}
+	var token struct {
+		Token       string
+		AccessToken string `json:"access_token"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&token)
+	if err != nil {
+		return "", err
+	}
+	if token.Token != "" {
+		return token.Token, nil
+	}
+	return token.AccessToken, nil
+}
@@ -0,0 +1,131 @@
+package docker
+
+import (
+	"context"
+	"github.com/brimstone/watchdock/channel"
+	"github.com/brimstone/watchdock/metrics"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"time"
+)
+
+// replicaOf is the spec container is a replica of, if it is one.
+func replicaOf(container *dockerclient.Container) string {
+	if container.Config == nil {
+		return ""
+	}
+	return container.Config.Labels[channel.ReplicaOfLabel]
+}
+
+func containerFor(spec *channel.Spec) Container {
+	return Container{
+		Name:             "/" + spec.Name,
+		Config:           spec.Config,
+		HostConfig:       spec.HostConfig,
+		NetworkingConfig: spec.NetworkingConfig,
+		Image:            spec.Config.Image,
+		RegistryAuth:     spec.RegistryAuth,
+		Update:           spec.Update,
+		Rollout:          spec.Rollout,
+		DependsOn:        spec.DependsOn,
+		Health:           spec.Health,
+	}
+}
+
+// containersFor is every container spec runs as: just the one, or each of
+// its replicas.
+func containersFor(spec *channel.Spec) ([]Container, error) {
+	if spec.Replicas == nil {
+		return []Container{containerFor(spec)}, nil
+	}
+	var containers []Container
+	for i := 1; i <= spec.Replicas.Count; i++ {
+		replica, err := spec.Replica(i)
+		if err != nil {
+			return nil, err
+		}
+		c := containerFor(replica)
+		c.ReplicaOf = spec.Name
+		containers = append(containers, c)
+	}
+	return containers, nil
+}
+
+// containerNames is what the spec called name runs as in docker.
+func (self *Processing) containerNames(name string) []string {
+	replicas := self.state.replicasOf(name)
+	if len(replicas) == 0 {
+		return []string{"/" + name}
+	}
+	var names []string
+	for _, c := range replicas {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+// scale removes whatever the spec called name ran as that isn't one of
+// containers any more: replicas past the new count, the single container
+// it was before it had replicas, or its replicas once it has none.
+func (self *Processing) scale(name string, containers []Container) {
+	keep := make(map[string]bool)
+	for _, c := range containers {
+		keep[c.Name] = true
+	}
+	for _, c := range self.state.list() {
+		if keep[c.Name] || (c.ReplicaOf != name && c.Name != "/"+name) {
+			continue
+		}
+		self.removeContainer(c.Name)
+	}
+}
+
+// remove takes away everything the spec called name runs as.
+func (self *Processing) remove(name string) {
+	for _, c := range self.containerNames(name) {
+		self.removeContainer(c)
+	}
+}
+
+// removeContainer forgets the container called name straight away, so
+// nothing starts it again, then stops and removes it for good in the
+// background once whoever's checking on it is done.
+func (self *Processing) removeContainer(name string) {
+	self.state.remove(name)
+	ctx := self.ctx
+	self.background(func() {
+		defer self.state.removed(name)
+		self.destroy(ctx, name)
+	})
+}
+
+// destroy waits for name to be free, unless ctx is done first, since a
+// rollout or restart that's stuck on it mustn't hold up stopping.
+func (self *Processing) destroy(ctx context.Context, name string) {
+	for !self.state.claim(name) {
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+			logit("Not removing", name, "it's still busy and we're stopping")
+			return
+		}
+	}
+	defer self.state.release(name)
+	running, err := self.findContainerByName(name, false)
+	if err != nil {
+		return
+	}
+	logit("Removing", name)
+	self.stopDependents(name)
+	if running.State.Running {
+		err = self.docker.StopContainer(running.ID, 10)
+		if err != nil {
+			logit("Error stopping", name, err.Error())
+		}
+	}
+	err = self.docker.RemoveContainer(dockerclient.RemoveContainerOptions{ID: running.ID})
+	if err != nil {
+		logit("Error removing", name, err.Error())
+		return
+	}
+	metrics.ContainerActions.WithLabelValues("removed").Inc()
+}
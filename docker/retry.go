@@ -0,0 +1,90 @@
+package docker
+
+import (
+	"errors"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"io"
+	"net"
+	"syscall"
+	"time"
+)
+
+// backoff is how hard we try docker again before giving up on a call.
+type backoff struct {
+	min      time.Duration
+	max      time.Duration
+	attempts int
+}
+
+var defaultBackoff = backoff{min: time.Second, max: 30 * time.Second, attempts: 5}
+
+// next doubles delay, up to max.
+func (b backoff) next(delay time.Duration) time.Duration {
+	delay *= 2
+	if delay > b.max {
+		return b.max
+	}
+	return delay
+}
+
+// transient reports whether err looks like docker being unreachable or
+// having a bad moment, as opposed to docker saying no.
+func transient(err error) bool {
+	if err == nil || certificateProblem(err) {
+		return false
+	}
+	var apiError *dockerclient.Error
+	if errors.As(err, &apiError) {
+		return apiError.Status >= 500
+	}
+	switch {
+	case errors.Is(err, dockerclient.ErrConnectionRefused),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ENOENT):
+		return true
+	}
+	var netError net.Error
+	return errors.As(err, &netError)
+}
+
+// retry calls f until it works, fails for good, or we run out of attempts.
+// Stopping cuts the wait short and gives back the last error.
+func (self *Processing) retry(what string, f func() error) error {
+	delay := self.backoff.min
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if !transient(err) || attempt >= self.backoff.attempts {
+			return err
+		}
+		logit("Error", what, "retrying in", delay, err.Error())
+		select {
+		case <-time.After(delay):
+		case <-self.ctx.Done():
+			return err
+		}
+		delay = self.backoff.next(delay)
+	}
+}
+
+// reconnect waits for docker to answer again, however long that takes. It
+// reports false if we're stopping instead.
+func (self *Processing) reconnect() bool {
+	delay := self.backoff.min
+	for {
+		err := self.docker.Ping()
+		if err == nil {
+			logit("Docker is back")
+			return true
+		}
+		logit("Docker is unreachable, trying again in", delay, err.Error())
+		select {
+		case <-time.After(delay):
+		case <-self.ctx.Done():
+			return false
+		}
+		delay = self.backoff.next(delay)
+	}
+}
@@ -0,0 +1,101 @@
+package docker
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"io"
+	"net"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTransient(t *testing.T) {
+	var tests = []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("something else"), false},
+		{&dockerclient.Error{Status: 500}, true},
+		{&dockerclient.Error{Status: 503}, true},
+		{&dockerclient.Error{Status: 404}, false},
+		{&dockerclient.Error{Status: 409}, false},
+		{&dockerclient.NoSuchContainer{ID: "web"}, false},
+		{dockerclient.ErrNoSuchImage, false},
+		{dockerclient.ErrConnectionRefused, true},
+		{io.EOF, true},
+		{fmt.Errorf("reading: %w", io.ErrUnexpectedEOF), true},
+		{&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, true},
+		{&url.Error{Op: "Get", Err: x509.UnknownAuthorityError{}}, false},
+	}
+	for _, c := range tests {
+		if got := transient(c.err); got != c.want {
+			t.Errorf("transient(%v) == %v, want %v", c.err, got, c.want)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	processing := &Processing{ctx: context.Background(), backoff: backoff{min: time.Millisecond, max: 2 * time.Millisecond, attempts: 3}}
+
+	calls := 0
+	err := processing.retry("testing", func() error {
+		calls++
+		if calls < 2 {
+			return io.EOF
+		}
+		return nil
+	})
+	if err != nil || calls != 2 {
+		t.Errorf("Expected success on the second call, got %v after %d", err, calls)
+	}
+
+	calls = 0
+	err = processing.retry("testing", func() error {
+		calls++
+		return io.EOF
+	})
+	if err != io.EOF || calls != 3 {
+		t.Errorf("Expected to give up after 3 calls, got %v after %d", err, calls)
+	}
+
+	calls = 0
+	err = processing.retry("testing", func() error {
+		calls++
+		return &dockerclient.Error{Status: 404}
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("Expected no retries for a 404, got %v after %d", err, calls)
+	}
+
+	if delay := processing.backoff.next(time.Millisecond); delay != 2*time.Millisecond {
+		t.Errorf("next(1ms) == %v", delay)
+	}
+	if delay := processing.backoff.next(2 * time.Millisecond); delay != 2*time.Millisecond {
+		t.Errorf("next(2ms) == %v, should stop at max", delay)
+	}
+}
+
+func TestRetryStopping(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	processing := &Processing{ctx: ctx, backoff: backoff{min: time.Minute, max: time.Minute, attempts: 5}}
+	time.AfterFunc(50*time.Millisecond, stop)
+
+	started := time.Now()
+	calls := 0
+	err := processing.retry("testing", func() error {
+		calls++
+		return io.EOF
+	})
+	if err != io.EOF || calls != 1 {
+		t.Errorf("Expected the last error after 1 call, got %v after %d", err, calls)
+	}
+	if waited := time.Since(started); waited > 5*time.Second {
+		t.Errorf("Expected stopping to cut the backoff short, waited %v", waited)
+	}
+}
@@ -0,0 +1,278 @@
+package docker
+
+import (
+	"errors"
+	"fmt"
+	"github.com/brimstone/watchdock/channel"
+	"github.com/brimstone/watchdock/metrics"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"strings"
+	"time"
+)
+
+// the names the new and the old container go by while one replaces the
+// other
+const (
+	nextSuffix     = ".watchdock-next"
+	previousSuffix = ".watchdock-prev"
+)
+
+// inRollout reports whether name is one of our stand-ins rather than a
+// container anyone asked for.
+func inRollout(name string) bool {
+	return strings.HasSuffix(name, nextSuffix) || strings.HasSuffix(name, previousSuffix)
+}
+
+// rollout is a spec's Rollout with the defaults filled in.
+type rollout struct {
+	strategy string
+	probe    *channel.Probe
+	timeout  time.Duration
+	window   time.Duration
+}
+
+func rolloutFor(container Container) rollout {
+	settings := rollout{strategy: channel.StartFirst, probe: container.Health, timeout: time.Minute, window: 30 * time.Second}
+	if container.Rollout == nil {
+		return settings
+	}
+	if container.Rollout.Strategy != "" {
+		settings.strategy = container.Rollout.Strategy
+	}
+	if container.Rollout.Probe != nil {
+		settings.probe = container.Rollout.Probe
+	}
+	if timeout, err := time.ParseDuration(container.Rollout.Timeout); err == nil {
+		settings.timeout = timeout
+	}
+	if window, err := time.ParseDuration(container.Rollout.Window); err == nil {
+		settings.window = window
+	}
+	return settings
+}
+
+// fixedPorts reports whether hostConfig asks for host ports a second copy
+// of the container couldn't have at the same time.
+func fixedPorts(hostConfig *dockerclient.HostConfig) bool {
+	if hostConfig == nil {
+		return false
+	}
+	if hostConfig.NetworkMode == "host" {
+		return true
+	}
+	for _, bindings := range hostConfig.PortBindings {
+		for _, binding := range bindings {
+			if binding.HostPort != "" && binding.HostPort != "0" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rollOut replaces running with a new container for container. The old
+// one is only stopped and renamed out of the way, and comes back if the new
+// one doesn't get healthy or fails within the window. The claim on the
+// container is released once it's all over, which may be well after this
+// returns.
+func (self *Processing) rollOut(container Container, running *dockerclient.Container, u update, policy string) error {
+	name := container.Name
+	settings := rolloutFor(container)
+	watching := false
+	defer func() {
+		if !watching {
+			self.state.release(name)
+		}
+	}()
+	self.removeLeftovers(name)
+
+	var ID string
+	var err error
+	if settings.strategy == channel.StartFirst && !fixedPorts(container.HostConfig) {
+		logit("Starting", name+nextSuffix, "next to", name)
+		ID, err = self.runContainer(container, name+nextSuffix)
+		if err == nil {
+			err = self.waitHealthy(ID, settings)
+		}
+		if err != nil {
+			// the old one was never touched
+			self.discard(ID)
+			self.state.reject(name, u.image)
+			return fmt.Errorf("kept the old container, the new one failed: %s", err.Error())
+		}
+		// from here on docker events about the old one aren't about name
+		self.state.setID(name, ID)
+		err = self.setAside(running, name)
+		if err == nil {
+			err = self.docker.RenameContainer(dockerclient.RenameContainerOptions{ID: ID, Name: channel.CleanName(name)})
+		}
+	} else {
+		logit("Stopping", name, "to make room for the new one")
+		err = self.setAside(running, name)
+		if err != nil {
+			return err
+		}
+		ID, err = self.runContainer(container, name)
+		if ID != "" {
+			self.state.setID(name, ID)
+		}
+		if err == nil {
+			err = self.waitHealthy(ID, settings)
+		}
+	}
+	if err != nil {
+		return self.rollBack(name, ID, running.ID, u, err)
+	}
+	metrics.ContainerActions.WithLabelValues("recreated").Inc()
+	metrics.ImageUpdates.WithLabelValues(policy).Inc()
+	if current, err := self.inspect(ID); err == nil {
+		self.sendContainer(self.events, current)
+	}
+	self.report(name, ID, "updated", u.to, u.from)
+
+	watching = true
+	self.background(func() {
+		defer self.state.release(name)
+		err := self.watch(ID, settings)
+		if err != nil {
+			self.rollBack(name, ID, running.ID, u, err)
+			return
+		}
+		logit("Container", name, "made it through its window, removing the old one")
+		self.discard(running.ID)
+	})
+	return nil
+}
+
+// setAside stops the old container and moves it out of the way of the new
+// one, keeping it around in case we need it back.
+func (self *Processing) setAside(running *dockerclient.Container, name string) error {
+	if running.State.Running {
+		err := self.docker.StopContainer(running.ID, 10)
+		if err != nil {
+			logit("Error stopping", name, err.Error())
+		}
+	}
+	return self.docker.RenameContainer(dockerclient.RenameContainerOptions{
+		ID:   running.ID,
+		Name: channel.CleanName(name) + previousSuffix,
+	})
+}
+
+// rollBack throws the new container away and brings the old one back under
+// its own name. The new image won't be tried again until it changes.
+func (self *Processing) rollBack(name string, newID string, oldID string, u update, reason error) error {
+	logit("Rolling", name, "back to", u.from+":", reason.Error())
+	self.state.setID(name, oldID)
+	self.state.reject(name, u.image)
+	self.state.upsert(u.container)
+	self.discard(newID)
+	err := self.docker.RenameContainer(dockerclient.RenameContainerOptions{ID: oldID, Name: channel.CleanName(name)})
+	if err != nil {
+		logit("Error renaming", oldID, "back to", name, err.Error())
+	}
+	err = self.docker.StartContainer(oldID, nil)
+	if err != nil {
+		logit("Error starting", name, "again", err.Error())
+		return err
+	}
+	metrics.ContainerActions.WithLabelValues("rolled-back").Inc()
+	if current, err := self.inspect(oldID); err == nil {
+		self.sendContainer(self.events, current)
+	}
+	self.report(name, oldID, "rolled back: "+reason.Error(), u.from, u.to)
+	return reason
+}
+
+// removeLeftovers cleans up after a rollout that never finished, like one
+// we were killed in the middle of.
+func (self *Processing) removeLeftovers(name string) {
+	for _, suffix := range []string{nextSuffix, previousSuffix} {
+		leftover, err := self.findContainerByName(name+suffix, false)
+		if err == nil {
+			logit("Removing leftover", leftover.Name)
+			self.discard(leftover.ID)
+		}
+	}
+}
+
+func (self *Processing) discard(ID string) {
+	if ID == "" {
+		return
+	}
+	err := self.docker.RemoveContainer(dockerclient.RemoveContainerOptions{ID: ID, Force: true})
+	if err != nil {
+		logit("Error removing", ID, err.Error())
+	}
+}
+
+// report tells the storage modules how an update went.
+func (self *Processing) report(name string, ID string, message string, digest string, previous string) {
+	self.events <- channel.NewStatus(name, &channel.State{
+		ID:             ID,
+		Running:        true,
+		Message:        message,
+		Digest:         digest,
+		PreviousDigest: previous,
+	})
+}
+
+// waitHealthy waits for the container to pass its probe, or its docker
+// healthcheck when it has no probe. Without either, running is healthy.
+func (self *Processing) waitHealthy(ID string, settings rollout) error {
+	deadline := time.Now().Add(settings.timeout)
+	for {
+		container, err := self.inspect(ID)
+		if err != nil {
+			return err
+		}
+		if !container.State.Running {
+			return errors.New("it exited")
+		}
+		switch {
+		case settings.probe != nil:
+			err = self.probe(container, settings.probe)
+			if err == nil {
+				return nil
+			}
+		case container.State.Health.Status == "unhealthy":
+			return errors.New("docker says it's unhealthy")
+		case container.State.Health.Status == "healthy", container.State.Health.Status == "":
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if err == nil {
+				err = errors.New("docker still says " + container.State.Health.Status)
+			}
+			return fmt.Errorf("not healthy after %s: %s", settings.timeout, err.Error())
+		}
+		if self.stopping() {
+			return errors.New("watchdock is shutting down")
+		}
+		time.Sleep(self.backoff.min)
+	}
+}
+
+// watch makes sure the container stays up, and healthy, for the window.
+// Shutting down cuts the window short in the new container's favour.
+func (self *Processing) watch(ID string, settings rollout) error {
+	deadline := time.Now().Add(settings.window)
+	restarts := -1
+	for time.Now().Before(deadline) && !self.stopping() {
+		container, err := self.inspect(ID)
+		if err != nil {
+			return err
+		}
+		switch {
+		case !container.State.Running:
+			return errors.New("it exited")
+		case container.State.Health.Status == "unhealthy":
+			return errors.New("docker says it's unhealthy")
+		case restarts >= 0 && container.RestartCount > restarts:
+			return errors.New("it restarted")
+		}
+		restarts = container.RestartCount
+		time.Sleep(self.backoff.min)
+	}
+	return nil
+}
@@ -0,0 +1,455 @@
+package docker
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// store is everything the docker module remembers between calls. Sync,
+// listenToDocker, scanContainers and the image pulls all run at once, so
+// it all sits behind one lock and only copies ever leave it.
+type store struct {
+	lock       sync.Mutex
+	containers []Container
+	images     map[string]string
+	// containers someone is in the middle of checking on
+	busy map[string]bool
+	// when each container last looked for a newer image
+	polled map[string]time.Time
+	// the image ID each container was last rolled back from
+	rejected map[string]string
+	// how each container has been doing lately
+	health map[string]*health
+	// containers on their way out, which nothing may pick up again
+	removing map[string]bool
+}
+
+// health is what we know about how well a container has been doing.
+type health struct {
+	// healthy or unhealthy, empty until the first probe
+	status string
+	// probes failed in a row, and why the last one did
+	failures int
+	reason   string
+	probing  bool
+	probed   time.Time
+	// restarts in a row without the container settling down, when the
+	// last one was and how long to wait before the next
+	restarts  int
+	restarted time.Time
+	delay     time.Duration
+	crashLoop bool
+	// we stopped it ourselves, so starting it again isn't a restart
+	stopped bool
+}
+
+// update is a container moving from one image to another.
+type update struct {
+	// digests to report
+	from string
+	to   string
+	// the ID of the new image
+	image string
+	// the container as it was before, to go back to
+	container Container
+}
+
+func newStore() *store {
+	return &store{
+		images:   make(map[string]string),
+		busy:     make(map[string]bool),
+		polled:   make(map[string]time.Time),
+		rejected: make(map[string]string),
+		health:   make(map[string]*health),
+		removing: make(map[string]bool),
+	}
+}
+
+func (s *store) find(name string) int {
+	for i := range s.containers {
+		if s.containers[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// upsert adds container, or replaces the spec of the one with the same name.
+func (s *store) upsert(container Container) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	i := s.find(container.Name)
+	if i < 0 {
+		logit("New container", container.Name, container.Image)
+		s.containers = append(s.containers, container)
+		return
+	}
+	c := &s.containers[i]
+	if container.ID != "" {
+		c.ID = container.ID
+	}
+	if container.Image != "" {
+		c.Image = container.Image
+	}
+	c.Config = container.Config
+	c.HostConfig = container.HostConfig
+	c.NetworkingConfig = container.NetworkingConfig
+	c.RegistryAuth = container.RegistryAuth
+	c.Update = container.Update
+	c.Rollout = container.Rollout
+	c.DependsOn = container.DependsOn
+	c.Health = container.Health
+	c.ReplicaOf = container.ReplicaOf
+	logit("Found container already!", c.Name)
+}
+
+// add only adds container if nothing by that name is known yet, and reports
+// whether it did.
+func (s *store) add(container Container) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.find(container.Name) >= 0 {
+		return false
+	}
+	s.containers = append(s.containers, container)
+	return true
+}
+
+func (s *store) byName(name string) (Container, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	i := s.find(name)
+	if i < 0 {
+		return Container{}, errors.New("container not found")
+	}
+	return s.containers[i], nil
+}
+
+func (s *store) byID(ID string) (Container, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, c := range s.containers {
+		if c.ID == ID {
+			return c, nil
+		}
+	}
+	return Container{}, errors.New("container not found")
+}
+
+func (s *store) list() []Container {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]Container(nil), s.containers...)
+}
+
+// replicasOf is every replica of the spec called name, in the order they
+// were added.
+func (s *store) replicasOf(name string) []Container {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var replicas []Container
+	for _, c := range s.containers {
+		if c.ReplicaOf == name {
+			replicas = append(replicas, c)
+		}
+	}
+	return replicas
+}
+
+// remove forgets the container called name and protects it until it's
+// gone, so it isn't started again or found and saved as a new spec.
+func (s *store) remove(name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if i := s.find(name); i >= 0 {
+		s.containers = append(s.containers[:i], s.containers[i+1:]...)
+	}
+	delete(s.polled, name)
+	delete(s.health, name)
+	s.removing[name] = true
+}
+
+func (s *store) removed(name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.removing, name)
+}
+
+// isRemoving reports whether name is on its way out.
+func (s *store) isRemoving(name string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.removing[name]
+}
+
+func (s *store) setID(name string, ID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if i := s.find(name); i >= 0 {
+		s.containers[i].ID = ID
+	}
+}
+
+// protect stops a destroy event for the named container from being passed
+// on as a delete, since we're the ones destroying it.
+func (s *store) protect(name string, protect bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if i := s.find(name); i >= 0 {
+		s.containers[i].Protect = protect
+	}
+}
+
+func (s *store) protectID(ID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i := range s.containers {
+		if s.containers[i].ID == ID {
+			s.containers[i].Protect = true
+		}
+	}
+}
+
+// forget drops the container with ID, unless it's protected.
+func (s *store) forget(ID string) (Container, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, c := range s.containers {
+		if c.ID != ID {
+			continue
+		}
+		if c.Protect {
+			return c, errors.New("container is protected")
+		}
+		s.containers = append(s.containers[:i], s.containers[i+1:]...)
+		delete(s.polled, c.Name)
+		delete(s.health, c.Name)
+		return c, nil
+	}
+	return Container{}, errors.New("container not found")
+}
+
+// hasDependents reports whether any container depends on name.
+func (s *store) hasDependents(name string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	name = strings.TrimPrefix(name, "/")
+	for _, c := range s.containers {
+		for _, dependency := range c.DependsOn {
+			if dependency.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claim marks name as being checked on, and reports false if someone else
+// already is.
+func (s *store) claim(name string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.busy[name] {
+		return false
+	}
+	s.busy[name] = true
+	return true
+}
+
+func (s *store) release(name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.busy, name)
+}
+
+// due reports whether name should look for a newer image now, and if so
+// starts its interval over.
+func (s *store) due(name string, interval time.Duration) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if time.Since(s.polled[name]) < interval {
+		return false
+	}
+	s.polled[name] = time.Now()
+	return true
+}
+
+// reject remembers not to update name to image again.
+func (s *store) reject(name string, image string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.rejected[name] = image
+}
+
+func (s *store) isRejected(name string, image string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.rejected[name] == image
+}
+
+// track replaces the set of images we keep up to date. Pulls already
+// running are left alone.
+func (s *store) track(images []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	tracked := make(map[string]string)
+	for _, image := range images {
+		tracked[image] = "fresh"
+	}
+	for image, state := range s.images {
+		if state == "pulling" {
+			tracked[image] = state
+		}
+	}
+	s.images = tracked
+}
+
+// startPull reports false if image is already being pulled.
+func (s *store) startPull(image string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.images[image] == "pulling" {
+		return false
+	}
+	s.images[image] = "pulling"
+	return true
+}
+
+func (s *store) finishPull(image string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.images[image] = "idle"
+}
+
+func (s *store) imageStatus() map[string]string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	status := make(map[string]string)
+	for image, state := range s.images {
+		status[image] = state
+	}
+	return status
+}
+
+func (s *store) healthFor(name string) *health {
+	h, ok := s.health[name]
+	if !ok {
+		h = new(health)
+		s.health[name] = h
+	}
+	return h
+}
+
+// healthOf is a copy of how name has been doing.
+func (s *store) healthOf(name string) health {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return *s.healthFor(name)
+}
+
+// probeDue reports whether name should be probed now, and if so marks it
+// as being probed until doneProbing is called.
+func (s *store) probeDue(name string, interval time.Duration) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	h := s.healthFor(name)
+	if h.probing || time.Since(h.probed) < interval {
+		return false
+	}
+	h.probing = true
+	h.probed = time.Now()
+	return true
+}
+
+func (s *store) doneProbing(name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.healthFor(name).probing = false
+}
+
+// probed records how a probe went. Once threshold probes in a row fail name
+// is unhealthy, one that passes makes it healthy again.
+func (s *store) probed(name string, err error, threshold int) health {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	h := s.healthFor(name)
+	if err == nil {
+		h.status = "healthy"
+		h.failures = 0
+		h.reason = ""
+		return *h
+	}
+	h.failures++
+	h.reason = err.Error()
+	if h.failures >= threshold {
+		h.status = "unhealthy"
+	}
+	return *h
+}
+
+// mayRestart reports whether name has waited long enough since it was
+// last restarted, and if not how much longer it has to.
+func (s *store) mayRestart(name string) (bool, time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	h := s.healthFor(name)
+	wait := time.Until(h.restarted.Add(h.delay))
+	return wait <= 0, wait
+}
+
+// restarted records that name was restarted because of reason, and works
+// out how long the next restart has to wait: nothing the first time, then
+// b.min, doubling up to b.max. After b.attempts restarts in a row it's
+// crash-looping.
+func (s *store) restarted(name string, reason string, b backoff) health {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	h := s.healthFor(name)
+	h.restarts++
+	h.restarted = time.Now()
+	if h.delay == 0 {
+		h.delay = b.min
+	} else {
+		h.delay = b.next(h.delay)
+	}
+	h.crashLoop = h.restarts >= b.attempts
+	h.reason = reason
+	h.status = ""
+	h.failures = 0
+	return *h
+}
+
+// settled forgets name's restarts once it's been up, and not unhealthy,
+// for longer than after.
+func (s *store) settled(name string, after time.Duration) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	h := s.healthFor(name)
+	if h.restarts == 0 || h.status == "unhealthy" || time.Since(h.restarted) < after {
+		return false
+	}
+	h.restarts = 0
+	h.delay = 0
+	h.crashLoop = false
+	return true
+}
+
+// stoppedOnPurpose remembers that we stopped name, rather than it exiting.
+func (s *store) stoppedOnPurpose(name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.healthFor(name).stopped = true
+}
+
+// startingOnPurpose reports whether we were the ones who stopped name, and
+// forgets it since it's being started again.
+func (s *store) startingOnPurpose(name string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	h := s.healthFor(name)
+	stopped := h.stopped
+	h.stopped = false
+	return stopped
+}
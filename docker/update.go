@@ -0,0 +1,182 @@
+package docker
+
+import (
+	"github.com/brimstone/watchdock/channel"
+	"github.com/brimstone/watchdock/reference"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"time"
+)
+
+// candidate is a container due to look for a newer image, and the image it
+// should be running if there is one.
+type candidate struct {
+	container Container
+	policy    channel.UpdatePolicy
+	image     *reference.Reference
+}
+
+// updateAll looks for newer images for every container whose update
+// interval is up. Images are pulled all at once, but containers are
+// recreated one at a time.
+func (self *Processing) updateAll() {
+	logit("Checking for new images")
+	var tracked []string
+	var candidates []candidate
+	for _, c := range self.state.list() {
+		name := specImage(c)
+		image, err := reference.Parse(name)
+		if err != nil {
+			logit("Not updating", c.Name, err.Error())
+			continue
+		}
+		tracked = append(tracked, image.String())
+		policy := channel.PolicyFor(name, c.Update)
+		if policy.Policy != channel.UpdateAlways && policy.Policy != channel.UpdateSemver {
+			// startContainer pulls these when they're missing, that's all
+			continue
+		}
+		interval, _ := time.ParseDuration(policy.Interval)
+		if !self.state.due(c.Name, interval) {
+			continue
+		}
+		if policy.Policy == channel.UpdateSemver {
+			image, err = self.newestTag(image, policy.Constraint, c.RegistryAuth)
+			if err != nil {
+				logit("Couldn't look for a newer", name, err.Error())
+				continue
+			}
+		}
+		candidates = append(candidates, candidate{container: c, policy: policy, image: image})
+	}
+	self.state.track(tracked)
+	self.pullAll(candidates)
+	for _, c := range candidates {
+		err := self.updateContainer(c)
+		if err != nil {
+			logit("Error updating", c.container.Name, err.Error())
+		}
+	}
+	logit("Finished checking for new images")
+}
+
+// newestTag is image moved to the newest tag within constraint, or image
+// itself when that's already the newest.
+func (self *Processing) newestTag(image *reference.Reference, constraint string, login string) (*reference.Reference, error) {
+	allowed, err := reference.ParseConstraint(constraint)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := self.listTags(image, login)
+	if err != nil {
+		return nil, err
+	}
+	newest := allowed.Newest(tags)
+	if newest == "" {
+		return image, nil
+	}
+	// never go backwards, even when the current tag is out of range
+	if current, err := reference.ParseVersion(image.Tag); err == nil {
+		if version, _ := reference.ParseVersion(newest); version.Compare(current) <= 0 {
+			return image, nil
+		}
+	}
+	moved := *image
+	moved.Tag = newest
+	return &moved, nil
+}
+
+// pullAll pulls every image candidates want, each only once.
+func (self *Processing) pullAll(candidates []candidate) {
+	logins := make(map[string]string)
+	for _, c := range candidates {
+		logins[c.image.String()] = c.container.RegistryAuth
+	}
+	finished := make(chan struct{})
+	for image, login := range logins {
+		// run all of our pulls concurrently
+		go func(image string, login string) {
+			err := self.pullImage(image, login)
+			if err != nil {
+				logit("Error pulling", image, err.Error())
+			}
+			// notify our parent when we're done
+			finished <- struct{}{}
+		}(image, login)
+	}
+	// wait for all of the images to complete their pull
+	for range logins {
+		<-finished
+	}
+}
+
+// updateContainer rolls the container out on c.image if that isn't the
+// image it's running already, or one it was rolled back from.
+func (self *Processing) updateContainer(c candidate) error {
+	name := c.container.Name
+	if !self.state.claim(name) {
+		logit("Container", name, "is already being checked on")
+		return nil
+	}
+	running, err := self.findContainerByName(name, false)
+	if err != nil {
+		// nothing to update, CheckOnContainers will start it
+		self.state.release(name)
+		return nil
+	}
+	pulled, err := self.docker.InspectImage(c.image.String())
+	if err != nil {
+		self.state.release(name)
+		return err
+	}
+	if pulled.ID == running.Image || self.state.isRejected(name, pulled.ID) {
+		self.state.release(name)
+		return nil
+	}
+	u := update{
+		from:      self.digestOf(running.Image, c.image),
+		to:        self.digestOf(pulled.ID, c.image),
+		image:     pulled.ID,
+		container: c.container,
+	}
+	logit("Updating", name, "from", u.from, "to", u.to, "with policy", c.policy.Policy)
+	container := c.container
+	if specImage(container) != c.image.String() {
+		// semver moved to another tag, the spec has to follow
+		config := *container.Config
+		config.Image = c.image.String()
+		container.Config = &config
+		container.Image = config.Image
+		self.state.upsert(container)
+	}
+	return self.rollOut(container, running, u, c.policy.Policy)
+}
+
+// digestOf is the registry digest of the image with ID when docker knows
+// it, otherwise the ID, which is a digest too.
+func (self *Processing) digestOf(ID string, image *reference.Reference) string {
+	inspected, err := self.docker.InspectImage(ID)
+	if err != nil {
+		return ID
+	}
+	for _, digest := range inspected.RepoDigests {
+		ref, err := reference.Parse(digest)
+		if err == nil && ref.Pinned() && ref.Name() == image.Name() {
+			return ref.Digest
+		}
+	}
+	return ID
+}
+
+// ensureImage pulls the image container runs on. Images that are only ever
+// updated by hand are only pulled when they're missing.
+func (self *Processing) ensureImage(container Container) error {
+	policy := channel.PolicyFor(container.Image, container.Update)
+	if policy.Policy == channel.UpdateNever || policy.Policy == channel.UpdateDigestPinned {
+		if _, err := self.docker.InspectImage(container.Image); err == nil {
+			return nil
+		} else if err != dockerclient.ErrNoSuchImage {
+			return err
+		}
+	}
+	return self.pullImage(container.Image, container.RegistryAuth)
+}
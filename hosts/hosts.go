@@ -0,0 +1,462 @@
+package hosts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/brimstone/watchdock/channel"
+	"github.com/brimstone/watchdock/docker"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"log"
+	"sync"
+	"time"
+)
+
+func logit(v ...interface{}) {
+	log.Println("Hosts:", v)
+}
+
+// Docker is what we need from the processing module of each host.
+type Docker interface {
+	channel.Module
+	Connect() error
+	Reconcile()
+	ImageStatus() map[string]string
+	Inspect(name string) (*dockerclient.Container, error)
+	SetOptions(options docker.Options)
+	LoadLogins(filename string) error
+	Plan(specs []*channel.Spec, deleted []string) ([]docker.Action, error)
+	Export(name string) (*channel.Spec, error)
+}
+
+type host struct {
+	name   string
+	labels map[string]string
+	docker Docker
+	input  chan channel.Event
+	// whether Connect has worked yet
+	connected bool
+}
+
+type message struct {
+	source int
+	event  channel.Event
+}
+
+// Hosts sits between the storage modules and a docker processing module
+// for every host, each with its own state and reconcile loop. It looks like
+// a single processing module to the storage modules, and hands every spec
+// to the hosts it's placed on.
+type Hosts struct {
+	hosts []*host
+	// the specs we've been sent, and which hosts each is placed on, first
+	// host first
+	specs     map[string]*channel.Spec
+	placement map[string][]int
+	lock      sync.Mutex
+	// how long a host that couldn't be reached waits to be tried again
+	retry time.Duration
+}
+
+func (hosts *Hosts) Init() error {
+	hosts.specs = make(map[string]*channel.Spec)
+	hosts.placement = make(map[string][]int)
+	hosts.retry = 30 * time.Second
+	return nil
+}
+
+// AddHost manages the docker host called name with module. Specs pick it by
+// name or by labels.
+func (hosts *Hosts) AddHost(name string, labels map[string]string, module Docker) {
+	hosts.hosts = append(hosts.hosts, &host{
+		name:   name,
+		labels: labels,
+		docker: module,
+		input:  make(chan channel.Event),
+	})
+}
+
+func (hosts *Hosts) Len() int {
+	return len(hosts.hosts)
+}
+
+// Connect connects to every host. A single host has to be there, but with
+// several the ones that aren't are tried again in the background, as long
+// as at least one can be reached.
+func (hosts *Hosts) Connect() error {
+	for _, h := range hosts.hosts {
+		err := h.docker.Connect()
+		if err != nil {
+			if len(hosts.hosts) == 1 {
+				return err
+			}
+			logit("Can't use host", h.name, "for now:", err.Error())
+			continue
+		}
+		h.connected = true
+	}
+	for _, h := range hosts.hosts {
+		if h.connected {
+			return nil
+		}
+	}
+	return errors.New("none of the docker hosts can be reached")
+}
+
+// waitFor keeps trying a host that couldn't be reached until it can, or
+// reports false if we're stopping first.
+func (hosts *Hosts) waitFor(ctx context.Context, h *host) bool {
+	for !h.connected {
+		select {
+		case <-time.After(hosts.retry):
+		case <-ctx.Done():
+			return false
+		}
+		err := h.docker.Connect()
+		if err != nil {
+			logit("Still can't use host", h.name+":", err.Error())
+			continue
+		}
+		h.connected = true
+	}
+	return true
+}
+
+// SetOptions takes new settings for every host.
+func (hosts *Hosts) SetOptions(options docker.Options) {
+	for _, h := range hosts.hosts {
+		h.docker.SetOptions(options)
+	}
+}
+
+// LoadLogins reads the registry logins in filename for every host.
+func (hosts *Hosts) LoadLogins(filename string) error {
+	for _, h := range hosts.hosts {
+		err := h.docker.LoadLogins(filename)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reconcile has every host check on everything now.
+func (hosts *Hosts) Reconcile() {
+	for _, h := range hosts.hosts {
+		h.docker.Reconcile()
+	}
+}
+
+// ImageStatus is what each image is doing, with the host in front when
+// there's more than one.
+func (hosts *Hosts) ImageStatus() map[string]string {
+	if len(hosts.hosts) == 1 {
+		return hosts.hosts[0].docker.ImageStatus()
+	}
+	status := make(map[string]string)
+	for _, h := range hosts.hosts {
+		for image, s := range h.docker.ImageStatus() {
+			status[h.name+": "+image] = s
+		}
+	}
+	return status
+}
+
+// Inspect asks the hosts the container called name is placed on about it,
+// or every host if it isn't placed anywhere.
+func (hosts *Hosts) Inspect(name string) (*dockerclient.Container, error) {
+	hosts.lock.Lock()
+	placed := hosts.placement[channel.CleanName(name)]
+	hosts.lock.Unlock()
+	if len(placed) == 0 {
+		placed = hosts.all()
+	}
+	var err error
+	for _, i := range placed {
+		var container *dockerclient.Container
+		container, err = hosts.hosts[i].docker.Inspect(name)
+		if err == nil {
+			return container, nil
+		}
+	}
+	return nil, err
+}
+
+// Export is the spec for the container called name on the first host that
+// has one.
+func (hosts *Hosts) Export(name string) (*channel.Spec, error) {
+	hosts.lock.Lock()
+	placed := hosts.placement[channel.CleanName(name)]
+	hosts.lock.Unlock()
+	if len(placed) == 0 {
+		placed = hosts.all()
+	}
+	var err error
+	for _, i := range placed {
+		var spec *channel.Spec
+		spec, err = hosts.hosts[i].docker.Export(name)
+		if err == nil {
+			return spec, nil
+		}
+	}
+	return nil, err
+}
+
+// Plan is everything every host would do to run specs where they're placed,
+// and to remove what deleted ran as, host by host.
+func (hosts *Hosts) Plan(specs []*channel.Spec, deleted []string) ([]docker.Action, error) {
+	placed := make([][]*channel.Spec, len(hosts.hosts))
+	for _, spec := range specs {
+		for _, i := range hosts.placeOn(spec) {
+			placed[i] = append(placed[i], spec)
+		}
+	}
+	var actions []docker.Action
+	for i, h := range hosts.hosts {
+		if !h.connected {
+			return nil, fmt.Errorf("host %s can't be reached", h.name)
+		}
+		planned, err := h.docker.Plan(placed[i], deleted)
+		if err != nil {
+			return nil, fmt.Errorf("host %s: %s", h.name, err.Error())
+		}
+		for _, action := range planned {
+			if len(hosts.hosts) > 1 {
+				action.Host = h.name
+			}
+			actions = append(actions, action)
+		}
+	}
+	return actions, nil
+}
+
+func (hosts *Hosts) all() []int {
+	all := make([]int, len(hosts.hosts))
+	for i := range hosts.hosts {
+		all[i] = i
+	}
+	return all
+}
+
+// placeOn picks the hosts spec runs on: the one it names, every one with
+// all of its labels, or the first.
+func (hosts *Hosts) placeOn(spec *channel.Spec) []int {
+	var placed []int
+	for i, h := range hosts.hosts {
+		switch {
+		case spec.Host != "":
+			if h.name == spec.Host {
+				placed = append(placed, i)
+			}
+		case len(spec.HostLabels) > 0:
+			if matches(h.labels, spec.HostLabels) {
+				placed = append(placed, i)
+			}
+		case i == 0:
+			placed = append(placed, i)
+		}
+	}
+	return placed
+}
+
+// matches is whether labels has everything in selector.
+func matches(labels map[string]string, selector map[string]string) bool {
+	for key, value := range selector {
+		if have, ok := labels[key]; !ok || have != value {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(placed []int, i int) bool {
+	for _, p := range placed {
+		if p == i {
+			return true
+		}
+	}
+	return false
+}
+
+// Sync runs docker on every host until ctx is cancelled or readChannel is
+// closed, and waits for them all to finish up. A host that's down only
+// holds up what's placed on it.
+func (hosts *Hosts) Sync(ctx context.Context, readChannel <-chan channel.Event, writeChannel chan<- channel.Event) {
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	fromHosts := make(chan message)
+	var running sync.WaitGroup
+	for i, h := range hosts.hosts {
+		output := make(chan channel.Event)
+		buffered := make(chan channel.Event)
+		go channel.Queue(output, buffered)
+		running.Add(1)
+		go func(source int, events <-chan channel.Event) {
+			defer running.Done()
+			for event := range events {
+				fromHosts <- message{source: source, event: event}
+			}
+		}(i, buffered)
+
+		// whatever's sent to a host that's down waits for it
+		input := make(chan channel.Event)
+		go channel.Queue(h.input, input)
+		go func(h *host) {
+			defer close(output)
+			if !hosts.waitFor(ctx, h) {
+				return
+			}
+			logit("Starting docker on", h.name)
+			h.docker.Sync(ctx, input, output)
+			logit("Docker on", h.name, "stopped")
+		}(h)
+	}
+	// once every host has stopped and everything they said is passed on
+	stopped := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(stopped)
+	}()
+
+	for {
+		select {
+		case <-stopped:
+			for _, h := range hosts.hosts {
+				close(h.input)
+			}
+			return
+		case event, ok := <-readChannel:
+			if !ok {
+				readChannel = nil
+				stop()
+				continue
+			}
+			hosts.fromStorage(event, writeChannel)
+		case msg := <-fromHosts:
+			hosts.fromHost(msg.source, msg.event, writeChannel)
+		}
+	}
+}
+
+// fromStorage hands event to the hosts it's about.
+func (hosts *Hosts) fromStorage(event channel.Event, writeChannel chan<- channel.Event) {
+	name := event.Name
+	switch event.Kind {
+	case channel.Upsert:
+		placed := hosts.placeOn(event.Spec)
+		hosts.lock.Lock()
+		before := hosts.placement[name]
+		hosts.specs[name] = event.Spec
+		hosts.placement[name] = placed
+		hosts.lock.Unlock()
+		if len(placed) == 0 {
+			logit("No host for", name)
+			writeChannel <- channel.NewStatus(name, &channel.State{Message: noHost(event.Spec)})
+		}
+		for _, i := range placed {
+			hosts.hosts[i].input <- event
+		}
+		for _, i := range before {
+			if !contains(placed, i) {
+				logit("Moving", name, "off", hosts.hosts[i].name)
+				hosts.hosts[i].input <- channel.NewDelete(name)
+			}
+		}
+	case channel.Delete:
+		hosts.lock.Lock()
+		placed, ok := hosts.placement[name]
+		delete(hosts.specs, name)
+		delete(hosts.placement, name)
+		hosts.lock.Unlock()
+		if !ok {
+			placed = hosts.all()
+		}
+		for _, i := range placed {
+			hosts.hosts[i].input <- event
+		}
+	default:
+		for _, h := range hosts.hosts {
+			h.input <- event
+		}
+	}
+}
+
+func noHost(spec *channel.Spec) string {
+	if spec.Host != "" {
+		return fmt.Sprintf("no docker host is called %s", spec.Host)
+	}
+	return fmt.Sprintf("no docker host has the labels %v", spec.HostLabels)
+}
+
+// fromHost passes on what host source says about its containers. Only the
+// first host a container is placed on speaks for its spec, and a host it
+// isn't placed on doesn't speak for it at all.
+func (hosts *Hosts) fromHost(source int, event channel.Event, writeChannel chan<- channel.Event) {
+	h := hosts.hosts[source]
+	name := event.Name
+	hosts.lock.Lock()
+	placed, known := hosts.placement[name]
+	spec := hosts.specs[name]
+	hosts.lock.Unlock()
+	switch event.Kind {
+	case channel.Upsert:
+		found := *event.Spec
+		if !known {
+			// already running there, so that's where it stays
+			if len(hosts.hosts) > 1 {
+				found.Host = h.name
+			}
+			hosts.lock.Lock()
+			hosts.specs[name] = &found
+			hosts.placement[name] = []int{source}
+			hosts.lock.Unlock()
+			writeChannel <- channel.NewUpsert(&found)
+			return
+		}
+		if len(placed) == 0 || placed[0] != source {
+			return
+		}
+		found.Host = spec.Host
+		found.HostLabels = spec.HostLabels
+		hosts.lock.Lock()
+		hosts.specs[name] = &found
+		hosts.lock.Unlock()
+		writeChannel <- channel.NewUpsert(&found)
+	case channel.Delete:
+		if !contains(placed, source) {
+			// we moved it off, or never knew it
+			return
+		}
+		if len(placed) > 1 {
+			logit("Container", name, "was removed from", h.name, "but still belongs there, putting it back")
+			h.input <- channel.NewUpsert(spec)
+			return
+		}
+		hosts.lock.Lock()
+		delete(hosts.specs, name)
+		delete(hosts.placement, name)
+		hosts.lock.Unlock()
+		writeChannel <- event
+	case channel.Status:
+		if known && !contains(placed, source) {
+			return
+		}
+		if len(hosts.hosts) > 1 {
+			state := *event.Status
+			state.Host = h.name
+			event = channel.NewStatus(name, &state)
+		}
+		writeChannel <- event
+	default:
+		writeChannel <- event
+	}
+}
+
+func New() (*Hosts, error) {
+	hosts := new(Hosts)
+	err := hosts.Init()
+	if err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
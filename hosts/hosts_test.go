@@ -0,0 +1,321 @@
+package hosts
+
+import (
+	"context"
+	"errors"
+	"github.com/brimstone/watchdock/channel"
+	"github.com/brimstone/watchdock/docker"
+	"github.com/brimstone/watchdock/docker/dockertest"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDocker hands everything it is told to the test, and sends whatever
+// the test gives it back.
+type fakeDocker struct {
+	received chan channel.Event
+	send     chan channel.Event
+	// Connect fails this many times before it works
+	down int
+	lock sync.Mutex
+}
+
+func newFakeDocker() *fakeDocker {
+	return &fakeDocker{
+		received: make(chan channel.Event, 10),
+		send:     make(chan channel.Event),
+	}
+}
+
+func (f *fakeDocker) Sync(ctx context.Context, readChannel <-chan channel.Event, writeChannel chan<- channel.Event) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-readChannel:
+			f.received <- event
+		case event := <-f.send:
+			writeChannel <- event
+		}
+	}
+}
+
+func (f *fakeDocker) Connect() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.down > 0 {
+		f.down--
+		return errors.New("nothing is listening")
+	}
+	return nil
+}
+
+func (f *fakeDocker) Reconcile()                     {}
+func (f *fakeDocker) ImageStatus() map[string]string { return map[string]string{"nginx": "up to date"} }
+func (f *fakeDocker) Inspect(name string) (*dockerclient.Container, error) {
+	return nil, errors.New("no such container")
+}
+func (f *fakeDocker) SetOptions(options docker.Options) {}
+func (f *fakeDocker) LoadLogins(filename string) error  { return nil }
+func (f *fakeDocker) Export(name string) (*channel.Spec, error) {
+	return nil, errors.New("no such container")
+}
+func (f *fakeDocker) Plan(specs []*channel.Spec, deleted []string) ([]docker.Action, error) {
+	var actions []docker.Action
+	for _, spec := range specs {
+		actions = append(actions, docker.Action{Action: docker.ActionCreate, Container: spec.Name})
+	}
+	return actions, nil
+}
+
+func expect(t *testing.T, events <-chan channel.Event, kind channel.Kind, name string) channel.Event {
+	select {
+	case event := <-events:
+		if event.Kind != kind || event.Name != name {
+			t.Errorf("Expected %s %s, got %s %s", kind, name, event.Kind, event.Name)
+		}
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for", kind, name)
+	}
+	return channel.Event{}
+}
+
+func expectNothing(t *testing.T, events <-chan channel.Event) {
+	select {
+	case event := <-events:
+		t.Errorf("Didn't expect anything, got %s %s", event.Kind, event.Name)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func spec(name string, host string, labels map[string]string) *channel.Spec {
+	return &channel.Spec{
+		Version:    channel.SpecVersion,
+		Name:       name,
+		Config:     &dockerclient.Config{Image: "nginx"},
+		Host:       host,
+		HostLabels: labels,
+	}
+}
+
+// startSync runs hosts a and b in eu and c in us.
+func startSync(t *testing.T) (*Hosts, []*fakeDocker, chan<- channel.Event, <-chan channel.Event) {
+	hosts, _ := New()
+	fakes := []*fakeDocker{newFakeDocker(), newFakeDocker(), newFakeDocker()}
+	hosts.AddHost("a", map[string]string{"region": "eu"}, fakes[0])
+	hosts.AddHost("b", map[string]string{"region": "eu"}, fakes[1])
+	hosts.AddHost("c", map[string]string{"region": "us"}, fakes[2])
+	if err := hosts.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	read := make(chan channel.Event)
+	write := make(chan channel.Event, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go hosts.Sync(ctx, read, write)
+	return hosts, fakes, read, write
+}
+
+func TestPlacement(t *testing.T) {
+	_, fakes, read, write := startSync(t)
+	a, b, c := fakes[0], fakes[1], fakes[2]
+
+	read <- channel.NewUpsert(spec("plain", "", nil))
+	expect(t, a.received, channel.Upsert, "plain")
+
+	read <- channel.NewUpsert(spec("pinned", "c", nil))
+	expect(t, c.received, channel.Upsert, "pinned")
+
+	read <- channel.NewUpsert(spec("web", "", map[string]string{"region": "eu"}))
+	expect(t, a.received, channel.Upsert, "web")
+	expect(t, b.received, channel.Upsert, "web")
+	expectNothing(t, c.received)
+
+	// moving it takes it off wherever it was
+	read <- channel.NewUpsert(spec("web", "c", nil))
+	expect(t, c.received, channel.Upsert, "web")
+	expect(t, a.received, channel.Delete, "web")
+	expect(t, b.received, channel.Delete, "web")
+
+	read <- channel.NewUpsert(spec("nowhere", "", map[string]string{"region": "mars"}))
+	status := expect(t, write, channel.Status, "nowhere")
+	if status.Status.Message != "no docker host has the labels map[region:mars]" {
+		t.Errorf("Message == %q", status.Status.Message)
+	}
+
+	read <- channel.NewDelete("pinned")
+	expect(t, c.received, channel.Delete, "pinned")
+	expectNothing(t, a.received)
+
+	read <- channel.NewResync()
+	for _, f := range fakes {
+		expect(t, f.received, channel.Resync, "")
+	}
+}
+
+func TestFromHost(t *testing.T) {
+	_, fakes, read, write := startSync(t)
+	a, b, c := fakes[0], fakes[1], fakes[2]
+	web := spec("web", "", map[string]string{"region": "eu"})
+	read <- channel.NewUpsert(web)
+	expect(t, a.received, channel.Upsert, "web")
+	expect(t, b.received, channel.Upsert, "web")
+
+	// only the first host speaks for the spec
+	found := spec("web", "", nil)
+	b.send <- channel.NewUpsert(found)
+	expectNothing(t, write)
+	a.send <- channel.NewUpsert(found)
+	event := expect(t, write, channel.Upsert, "web")
+	if event.Spec.HostLabels["region"] != "eu" {
+		t.Errorf("HostLabels should be kept, got %+v", event.Spec)
+	}
+
+	b.send <- channel.NewStatus("web", &channel.State{Running: true})
+	event = expect(t, write, channel.Status, "web")
+	if event.Status.Host != "b" {
+		t.Errorf("Host == %q", event.Status.Host)
+	}
+	c.send <- channel.NewStatus("web", &channel.State{Running: true})
+	expectNothing(t, write)
+
+	// gone from one of its hosts, so it's put back there
+	b.send <- channel.NewDelete("web")
+	expect(t, b.received, channel.Upsert, "web")
+	expectNothing(t, write)
+
+	// found somewhere nobody asked for, so it stays there
+	c.send <- channel.NewUpsert(spec("db", "", nil))
+	event = expect(t, write, channel.Upsert, "db")
+	if event.Spec.Host != "c" {
+		t.Errorf("db should be placed on c, got %q", event.Spec.Host)
+	}
+	c.send <- channel.NewDelete("db")
+	expect(t, write, channel.Delete, "db")
+}
+
+func TestHostDown(t *testing.T) {
+	hosts, _ := New()
+	hosts.retry = 10 * time.Millisecond
+	up := newFakeDocker()
+	down := newFakeDocker()
+	down.down = 2
+	hosts.AddHost("up", nil, up)
+	hosts.AddHost("down", map[string]string{"disk": "ssd"}, down)
+	if err := hosts.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	read := make(chan channel.Event)
+	write := make(chan channel.Event, 10)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		hosts.Sync(context.Background(), read, write)
+	}()
+
+	// what's meant for the host that's down waits for it, everything else
+	// carries on
+	read <- channel.NewUpsert(spec("db", "", map[string]string{"disk": "ssd"}))
+	read <- channel.NewUpsert(spec("web", "", nil))
+	expect(t, up.received, channel.Upsert, "web")
+	expect(t, down.received, channel.Upsert, "db")
+
+	close(read)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for Sync to return")
+	}
+
+	single, _ := New()
+	single.AddHost("local", nil, &fakeDocker{down: 1})
+	if err := single.Connect(); err == nil || err.Error() != "nothing is listening" {
+		t.Errorf("A single host that's down should fail, got %v", err)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	hosts, _, _, _ := startSync(t)
+	specs := []*channel.Spec{
+		spec("plain", "", nil),
+		spec("pinned", "c", nil),
+		spec("web", "", map[string]string{"region": "eu"}),
+	}
+	actions, err := hosts.Plan(specs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, action := range actions {
+		got = append(got, action.String())
+	}
+	want := "a: create plain, a: create web, b: create web, c: create pinned"
+	if strings.Join(got, ", ") != want {
+		t.Errorf("Plan() == %s, want %s", strings.Join(got, ", "), want)
+	}
+}
+
+// TestMove moves a spec from one host to another against real docker
+// processing, and checks it stays gone from the first.
+func TestMove(t *testing.T) {
+	hosts, _ := New()
+	fakes := make(map[string]*dockertest.Docker)
+	processing := make(map[string]*docker.Processing)
+	for _, name := range []string{"a", "b"} {
+		fakes[name] = dockertest.New()
+		// docker's event stream keeps the server busy, so it's left up
+		server := httptest.NewServer(fakes[name])
+		p, err := docker.New(docker.Endpoint{Host: server.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		processing[name] = p
+		hosts.AddHost(name, nil, p)
+	}
+	if err := hosts.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	read := make(chan channel.Event)
+	write := make(chan channel.Event)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hosts.Sync(ctx, read, write)
+	go func() {
+		for range write {
+		}
+	}()
+	eventually := func(what string, check func() bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !check() {
+			if time.Now().After(deadline) {
+				t.Fatal("Timeout waiting until", what)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	running := func(host string) bool {
+		c, ok := fakes[host].ByName("web")
+		return ok && c.State.Running
+	}
+
+	read <- channel.NewUpsert(spec("web", "a", nil))
+	eventually("web runs on a", func() bool { return running("a") })
+	read <- channel.NewUpsert(spec("web", "b", nil))
+	eventually("web runs on b", func() bool { return running("b") })
+	eventually("web is gone from a", func() bool {
+		_, ok := fakes["a"].ByName("web")
+		return !ok
+	})
+
+	// a checking on everything doesn't bring it back
+	processing["a"].Reconcile()
+	time.Sleep(300 * time.Millisecond)
+	if _, ok := fakes["a"].ByName("web"); ok {
+		t.Error("web came back on a after a reconcile, it runs on both hosts")
+	}
+}
@@ -0,0 +1,112 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log"
+	"net"
+	"net/http"
+)
+
+func logit(v ...interface{}) {
+	log.Println("Metrics:", v)
+}
+
+// Everything watchdock counts, registered with the default prometheus
+// registry so Handler can serve it.
+var (
+	ReconcileRuns = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "watchdock_reconcile_runs_total",
+		Help: "Number of times every container was checked on.",
+	})
+	ReconcileDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "watchdock_reconcile_duration_seconds",
+		Help:    "How long checking on every container took.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 12),
+	})
+	// action is started, restarted, recreated, rolled-back or removed
+	ContainerActions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "watchdock_container_actions_total",
+		Help: "Containers started, restarted, recreated, rolled back or removed.",
+	}, []string{"action"})
+	// result is success or error
+	ImagePulls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "watchdock_image_pulls_total",
+		Help: "Image pulls by result.",
+	}, []string{"result"})
+	ImagePullDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "watchdock_image_pull_duration_seconds",
+		Help:    "How long image pulls took, by result.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 12),
+	}, []string{"result"})
+	// kind is image
+	UntaggedRemoved = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "watchdock_untagged_removed_total",
+		Help: "Untagged images cleaned up.",
+	}, []string{"kind"})
+	// policy is always or semver
+	ImageUpdates = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "watchdock_image_updates_total",
+		Help: "Containers recreated on a newer image, by update policy.",
+	}, []string{"policy"})
+	// result is success or failure
+	HealthChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "watchdock_health_checks_total",
+		Help: "Health probes watchdock ran, by result.",
+	}, []string{"result"})
+	DockerEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "watchdock_docker_events_total",
+		Help: "Events received from docker, by status.",
+	}, []string{"status"})
+	StorageEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "watchdock_storage_events_total",
+		Help: "Events received from storage modules, by module and kind.",
+	}, []string{"module", "kind"})
+	// state is running, stopped, missing, drifted, waiting, backing-off or
+	// crash-looping as of the last reconcile
+	Containers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "watchdock_containers",
+		Help: "Managed containers by the state they were found in.",
+	}, []string{"state"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		ReconcileRuns,
+		ReconcileDuration,
+		ContainerActions,
+		ImagePulls,
+		ImagePullDuration,
+		UntaggedRemoved,
+		ImageUpdates,
+		HealthChecks,
+		DockerEvents,
+		StorageEvents,
+		Containers,
+	)
+}
+
+// Handler serves everything above in the prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Serve serves Handler on /metrics at listen, host:port, until the server
+// it returns is closed. Its Addr is where it ended up, for port 0.
+func Serve(listen string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	server := &http.Server{Addr: listener.Addr().String(), Handler: mux}
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			logit("Stopped serving:", err.Error())
+		}
+	}()
+	logit("Listening on", server.Addr)
+	return server, nil
+}
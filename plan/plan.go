@@ -0,0 +1,187 @@
+package plan
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/brimstone/watchdock/channel"
+	"github.com/brimstone/watchdock/docker"
+	"io"
+	"log"
+	"reflect"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+func logit(v ...interface{}) {
+	log.Println("Plan:", v)
+}
+
+// Print writes actions to out, as a table or as JSON.
+func Print(out io.Writer, actions []docker.Action, asJSON bool) error {
+	if asJSON {
+		if actions == nil {
+			actions = []docker.Action{}
+		}
+		raw, err := json.MarshalIndent(actions, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(out, string(raw))
+		return err
+	}
+	if len(actions) == 0 {
+		_, err := fmt.Fprintln(out, "Nothing to do")
+		return err
+	}
+	hosts := false
+	for _, action := range actions {
+		hosts = hosts || action.Host != ""
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	if hosts {
+		fmt.Fprint(w, "HOST\t")
+	}
+	fmt.Fprintln(w, "ACTION\tTARGET\tREASON")
+	for _, action := range actions {
+		target := action.Container
+		if target == "" {
+			target = action.Image
+		}
+		if hosts {
+			fmt.Fprint(w, action.Host+"\t")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", action.Action, target, action.Reason)
+	}
+	return w.Flush()
+}
+
+// DryRun stands in for the processing module. It keeps track of what
+// storage says and prints what planner would do about it, but never does
+// any of it and never tells storage anything.
+type DryRun struct {
+	planner  docker.Planner
+	out      io.Writer
+	json     bool
+	interval time.Duration
+	// how long storage has to be quiet before we plan
+	settle time.Duration
+	// only used by Sync
+	specs   map[string]*channel.Spec
+	deleted map[string]bool
+	last    []docker.Action
+	planned bool
+}
+
+func (dryRun *DryRun) Init(planner docker.Planner, out io.Writer, asJSON bool) error {
+	dryRun.planner = planner
+	dryRun.out = out
+	dryRun.json = asJSON
+	dryRun.interval = time.Minute
+	dryRun.settle = time.Second
+	dryRun.specs = make(map[string]*channel.Spec)
+	dryRun.deleted = make(map[string]bool)
+	return nil
+}
+
+// SetInterval is how often we plan again when storage hasn't changed, like
+// the reconcile interval. Zero only plans when it has.
+func (dryRun *DryRun) SetInterval(interval time.Duration) {
+	dryRun.interval = interval
+}
+
+// SetSettle is how long storage has to be quiet before we plan.
+func (dryRun *DryRun) SetSettle(settle time.Duration) {
+	dryRun.settle = settle
+}
+
+func (dryRun *DryRun) Sync(ctx context.Context, readChannel <-chan channel.Event, writeChannel chan<- channel.Event) {
+	logit("Dry run, nothing will be changed")
+	var tick <-chan time.Time
+	if dryRun.interval > 0 {
+		ticker := time.NewTicker(dryRun.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	var settled <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-readChannel:
+			if !ok {
+				return
+			}
+			if dryRun.apply(event) {
+				settled = time.After(dryRun.settle)
+			}
+		case <-settled:
+			settled = nil
+			dryRun.plan()
+		case <-tick:
+			if settled == nil {
+				dryRun.plan()
+			}
+		}
+	}
+}
+
+// apply keeps track of event, and reports whether it changed anything.
+func (dryRun *DryRun) apply(event channel.Event) bool {
+	switch event.Kind {
+	case channel.Upsert:
+		dryRun.specs[event.Name] = event.Spec
+		delete(dryRun.deleted, event.Name)
+	case channel.Delete:
+		delete(dryRun.specs, event.Name)
+		dryRun.deleted[event.Name] = true
+	case channel.Resync:
+	default:
+		return false
+	}
+	return true
+}
+
+// plan works out what a reconcile would do now, and prints it if that's
+// not what it would have done last time.
+func (dryRun *DryRun) plan() {
+	var names []string
+	for name := range dryRun.specs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var specs []*channel.Spec
+	for _, name := range names {
+		specs = append(specs, dryRun.specs[name])
+	}
+	var deleted []string
+	for name := range dryRun.deleted {
+		deleted = append(deleted, name)
+	}
+	sort.Strings(deleted)
+
+	actions, err := dryRun.planner.Plan(specs, deleted)
+	if err != nil {
+		logit("Error planning:", err.Error())
+		return
+	}
+	if dryRun.planned && reflect.DeepEqual(actions, dryRun.last) {
+		return
+	}
+	dryRun.planned = true
+	dryRun.last = actions
+	err = Print(dryRun.out, actions, dryRun.json)
+	if err != nil {
+		logit("Error printing the plan:", err.Error())
+	}
+}
+
+func New(planner docker.Planner, out io.Writer, asJSON bool) (*DryRun, error) {
+	dryRun := new(DryRun)
+	err := dryRun.Init(planner, out, asJSON)
+	if err != nil {
+		return nil, err
+	}
+	return dryRun, nil
+}
@@ -0,0 +1,150 @@
+package plan
+
+import (
+	"bytes"
+	"context"
+	"github.com/brimstone/watchdock/channel"
+	"github.com/brimstone/watchdock/docker"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePlanner creates whatever it's given and removes whatever was deleted.
+type fakePlanner struct {
+	lock  sync.Mutex
+	calls int
+}
+
+func (f *fakePlanner) Plan(specs []*channel.Spec, deleted []string) ([]docker.Action, error) {
+	f.lock.Lock()
+	f.calls++
+	f.lock.Unlock()
+	var actions []docker.Action
+	for _, spec := range specs {
+		actions = append(actions, docker.Action{Action: docker.ActionCreate, Container: spec.Name, Reason: "it doesn't exist"})
+	}
+	for _, name := range deleted {
+		actions = append(actions, docker.Action{Action: docker.ActionRemoveContainer, Container: name})
+	}
+	return actions, nil
+}
+
+// syncBuffer is a bytes.Buffer that Sync and the test can share.
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+func spec(name string) *channel.Spec {
+	return &channel.Spec{Version: 1, Name: name, Config: &dockerclient.Config{Image: "busybox"}}
+}
+
+func TestPrint(t *testing.T) {
+	actions := []docker.Action{
+		{Action: docker.ActionPull, Image: "nginx:latest", Reason: "it's missing"},
+		{Action: docker.ActionCreate, Container: "web", Reason: "it doesn't exist"},
+		{Action: docker.ActionStart, Container: "web"},
+	}
+	var out bytes.Buffer
+	err := Print(&out, actions, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "ACTION  TARGET        REASON\n" +
+		"pull    nginx:latest  it's missing\n" +
+		"create  web           it doesn't exist\n" +
+		"start   web           \n"
+	if out.String() != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, out.String())
+	}
+
+	out.Reset()
+	actions[0].Host = "a"
+	Print(&out, actions[:1], false)
+	if !strings.HasPrefix(out.String(), "HOST  ACTION") || !strings.Contains(out.String(), "a     pull") {
+		t.Errorf("Expected a host column, got\n%s", out.String())
+	}
+
+	out.Reset()
+	Print(&out, actions[1:2], true)
+	expected = "[\n  {\n    \"Action\": \"create\",\n    \"Container\": \"web\",\n    \"Reason\": \"it doesn't exist\"\n  }\n]\n"
+	if out.String() != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, out.String())
+	}
+
+	out.Reset()
+	Print(&out, nil, false)
+	if out.String() != "Nothing to do\n" {
+		t.Errorf("Expected nothing to do, got %q", out.String())
+	}
+	out.Reset()
+	Print(&out, nil, true)
+	if out.String() != "[]\n" {
+		t.Errorf("Expected an empty list, got %q", out.String())
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	planner := new(fakePlanner)
+	out := new(syncBuffer)
+	dryRun, err := New(planner, out, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dryRun.SetSettle(50 * time.Millisecond)
+	dryRun.SetInterval(100 * time.Millisecond)
+
+	ctx, stop := context.WithCancel(context.Background())
+	read := make(chan channel.Event)
+	write := make(chan channel.Event)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		dryRun.Sync(ctx, read, write)
+	}()
+
+	read <- channel.NewUpsert(spec("web"))
+	read <- channel.NewUpsert(spec("db"))
+	time.Sleep(300 * time.Millisecond)
+	printed := out.String()
+	if strings.Count(printed, "ACTION") != 1 {
+		t.Errorf("Expected the plan printed once, got\n%s", printed)
+	}
+	if !strings.Contains(printed, "create  db") || !strings.Contains(printed, "create  web") {
+		t.Errorf("Expected both created, got\n%s", printed)
+	}
+	planner.lock.Lock()
+	if planner.calls < 2 {
+		t.Errorf("Expected to plan again every interval, planned %d times", planner.calls)
+	}
+	planner.lock.Unlock()
+
+	read <- channel.NewDelete("db")
+	time.Sleep(200 * time.Millisecond)
+	if !strings.Contains(out.String()[len(printed):], "remove-container  db") {
+		t.Errorf("Expected db removed, got\n%s", out.String())
+	}
+
+	select {
+	case event := <-write:
+		t.Errorf("Didn't expect to tell storage anything, got %s %s", event.Kind, event.Name)
+	default:
+	}
+	stop()
+	<-stopped
+}
@@ -0,0 +1,116 @@
+package reference
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DefaultRegistry is where images without a registry in front come from.
+const DefaultRegistry = "docker.io"
+
+var (
+	// one path component of a repository, like "library" or "my-app"
+	component  = `[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*`
+	repository = regexp.MustCompile(`^` + component + `(?:/` + component + `)*$`)
+	registry   = regexp.MustCompile(`^(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)*(?::[0-9]+)?$`)
+	tag        = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+	digest     = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-fA-F0-9]{32,}$`)
+)
+
+// Reference is an image name taken apart, like
+// registry.example.com:5000/team/app:1.0 or nginx@sha256:...
+type Reference struct {
+	// Registry is host[:port], DefaultRegistry when none was given
+	Registry string
+	// Repository is the path on the registry, library/nginx for nginx
+	Repository string
+	// Tag is latest when neither a tag nor a digest was given
+	Tag    string
+	Digest string
+}
+
+// Parse reads an image name the way docker does. Docker Hub images are
+// normalized, so "nginx", "library/nginx" and "docker.io/library/nginx:latest"
+// all come back the same.
+func Parse(image string) (*Reference, error) {
+	ref := new(Reference)
+	name := image
+	if i := strings.Index(name, "@"); i >= 0 {
+		ref.Digest = name[i+1:]
+		name = name[:i]
+		if !digest.MatchString(ref.Digest) {
+			return nil, fmt.Errorf("image %s has a bad digest %s", image, ref.Digest)
+		}
+	}
+	// a colon after the last slash starts the tag, before it it's a port
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		ref.Tag = name[i+1:]
+		name = name[:i]
+		if !tag.MatchString(ref.Tag) {
+			return nil, fmt.Errorf("image %s has a bad tag %s", image, ref.Tag)
+		}
+	}
+	ref.Registry = DefaultRegistry
+	if i := strings.Index(name, "/"); i >= 0 {
+		host := name[:i]
+		if strings.ContainsAny(host, ".:") || host == "localhost" {
+			ref.Registry = host
+			name = name[i+1:]
+		}
+	}
+	switch ref.Registry {
+	case "index.docker.io", "registry-1.docker.io":
+		ref.Registry = DefaultRegistry
+	}
+	if !registry.MatchString(ref.Registry) {
+		return nil, fmt.Errorf("image %s has a bad registry %s", image, ref.Registry)
+	}
+	if ref.Registry == DefaultRegistry && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	if !repository.MatchString(name) {
+		return nil, fmt.Errorf("image %s has a bad repository name %s", image, name)
+	}
+	ref.Repository = name
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = "latest"
+	}
+	return ref, nil
+}
+
+// Name is the image without its tag or digest.
+func (ref *Reference) Name() string {
+	return ref.Registry + "/" + ref.Repository
+}
+
+// String is the fully spelled out image name.
+func (ref *Reference) String() string {
+	name := ref.Name()
+	if ref.Tag != "" {
+		name += ":" + ref.Tag
+	}
+	if ref.Digest != "" {
+		name += "@" + ref.Digest
+	}
+	return name
+}
+
+// Pinned reports whether this always means exactly the same image.
+func (ref *Reference) Pinned() bool {
+	return ref.Digest != ""
+}
+
+// Digested is the image by digest alone, the way docker lists RepoDigests.
+func (ref *Reference) Digested() string {
+	return ref.Name() + "@" + ref.Digest
+}
+
+// Version is what to ask docker to pull: the digest when there is one,
+// otherwise the tag.
+func (ref *Reference) Version() string {
+	if ref.Digest != "" {
+		return ref.Digest
+	}
+	return ref.Tag
+}
@@ -0,0 +1,65 @@
+package reference
+
+import (
+	"testing"
+)
+
+const sha = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestParse(t *testing.T) {
+	var tests = []struct {
+		image, registry, repository, tag, digest, err string
+	}{
+		{"nginx", "docker.io", "library/nginx", "latest", "", ""},
+		{"nginx:1.17", "docker.io", "library/nginx", "1.17", "", ""},
+		{"library/nginx", "docker.io", "library/nginx", "latest", "", ""},
+		{"docker.io/library/nginx:latest", "docker.io", "library/nginx", "latest", "", ""},
+		{"index.docker.io/brimstone/watchdock", "docker.io", "brimstone/watchdock", "latest", "", ""},
+		{"registry:5000/repo", "registry:5000", "repo", "latest", "", ""},
+		{"registry:5000/team/sub/app:1.0", "registry:5000", "team/sub/app", "1.0", "", ""},
+		{"localhost/app", "localhost", "app", "latest", "", ""},
+		{"quay.io/team/app", "quay.io", "team/app", "latest", "", ""},
+		{"nginx@" + sha, "docker.io", "library/nginx", "", sha, ""},
+		{"registry:5000/app:1.0@" + sha, "registry:5000", "app", "1.0", sha, ""},
+		{"Nginx", "", "", "", "", "image Nginx has a bad repository name library/Nginx"},
+		{"nginx:", "", "", "", "", "image nginx: has a bad tag "},
+		{"nginx@sha256:abc", "", "", "", "", "image nginx@sha256:abc has a bad digest sha256:abc"},
+		{"", "", "", "", "", "image  has a bad repository name library/"},
+	}
+	for _, c := range tests {
+		ref, err := Parse(c.image)
+		if c.err != "" {
+			if err == nil || err.Error() != c.err {
+				t.Errorf("Parse(%q) error == %v, want %q", c.image, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parse(%q) error == %v", c.image, err)
+			continue
+		}
+		if ref.Registry != c.registry || ref.Repository != c.repository || ref.Tag != c.tag || ref.Digest != c.digest {
+			t.Errorf("Parse(%q) == %+v", c.image, ref)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	var tests = []struct {
+		image, str, version string
+	}{
+		{"nginx", "docker.io/library/nginx:latest", "latest"},
+		{"registry:5000/app", "registry:5000/app:latest", "latest"},
+		{"nginx@" + sha, "docker.io/library/nginx@" + sha, sha},
+		{"nginx:1.17@" + sha, "docker.io/library/nginx:1.17@" + sha, sha},
+	}
+	for _, c := range tests {
+		ref, err := Parse(c.image)
+		if err != nil {
+			t.Fatalf("Parse(%q) error == %v", c.image, err)
+		}
+		if ref.String() != c.str || ref.Version() != c.version {
+			t.Errorf("Parse(%q) == %s %s, want %s %s", c.image, ref, ref.Version(), c.str, c.version)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package reference
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is a tag read as a semantic version, like 1.4.2 or v2.0.
+type Version struct {
+	Major, Minor, Patch int
+	// Prerelease is whatever came after a "-", like rc1 or alpine
+	Prerelease string
+}
+
+// ParseVersion reads a tag as a version. Missing minor and patch numbers
+// count as 0 and a leading "v" is ignored.
+func ParseVersion(tag string) (Version, error) {
+	var version Version
+	core := strings.TrimPrefix(tag, "v")
+	if i := strings.Index(core, "-"); i >= 0 {
+		version.Prerelease = core[i+1:]
+		core = core[:i]
+	}
+	parts := strings.Split(core, ".")
+	if len(parts) > 3 {
+		return version, fmt.Errorf("tag %s isn't a version", tag)
+	}
+	numbers := []*int{&version.Major, &version.Minor, &version.Patch}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return version, fmt.Errorf("tag %s isn't a version", tag)
+		}
+		*numbers[i] = n
+	}
+	return version, nil
+}
+
+// Compare is -1, 0 or 1 as version is older than, the same as or newer than
+// other. A prerelease is older than the release it leads up to.
+func (version Version) Compare(other Version) int {
+	for _, pair := range [][2]int{
+		{version.Major, other.Major},
+		{version.Minor, other.Minor},
+		{version.Patch, other.Patch},
+	} {
+		if pair[0] < pair[1] {
+			return -1
+		}
+		if pair[0] > pair[1] {
+			return 1
+		}
+	}
+	switch {
+	case version.Prerelease == other.Prerelease:
+		return 0
+	case version.Prerelease == "":
+		return 1
+	case other.Prerelease == "":
+		return -1
+	case version.Prerelease < other.Prerelease:
+		return -1
+	}
+	return 1
+}
+
+func (version Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", version.Major, version.Minor, version.Patch)
+	if version.Prerelease != "" {
+		s += "-" + version.Prerelease
+	}
+	return s
+}
+
+// bound is one half of a version range, like ">=1.4.0".
+type bound struct {
+	op      string
+	version Version
+}
+
+func (b bound) allows(version Version) bool {
+	c := version.Compare(b.version)
+	switch b.op {
+	case ">=":
+		return c >= 0
+	case ">":
+		return c > 0
+	case "<=":
+		return c <= 0
+	case "<":
+		return c < 0
+	}
+	return c == 0
+}
+
+// Constraint is a range of versions like "~1.4", "^2", ">=1.2 <1.6" or
+// "1.4.x". Prereleases never match.
+type Constraint struct {
+	text   string
+	bounds []bound
+}
+
+// ParseConstraint reads space or comma separated ranges, all of which have
+// to hold.
+func ParseConstraint(text string) (*Constraint, error) {
+	constraint := &Constraint{text: text}
+	fields := strings.Fields(strings.Replace(text, ",", " ", -1))
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("constraint %q is empty", text)
+	}
+	for _, field := range fields {
+		bounds, err := parseRange(field)
+		if err != nil {
+			return nil, fmt.Errorf("constraint %q: %s", text, err.Error())
+		}
+		constraint.bounds = append(constraint.bounds, bounds...)
+	}
+	return constraint, nil
+}
+
+func parseRange(field string) ([]bound, error) {
+	if field == "*" || field == "x" {
+		return nil, nil
+	}
+	for _, op := range []string{">=", "<=", ">", "<", "="} {
+		if strings.HasPrefix(field, op) {
+			version, err := ParseVersion(field[len(op):])
+			if err != nil {
+				return nil, err
+			}
+			return []bound{{op, version}}, nil
+		}
+	}
+	prefix := field[0]
+	if prefix == '~' || prefix == '^' {
+		field = field[1:]
+	}
+	// how many of major.minor.patch were actually given
+	given := strings.Split(strings.SplitN(strings.TrimPrefix(field, "v"), "-", 2)[0], ".")
+	for i, part := range given {
+		if part == "x" || part == "X" || part == "*" {
+			given = given[:i]
+			break
+		}
+	}
+	if len(given) == 0 {
+		return nil, nil
+	}
+	low, err := ParseVersion(strings.Join(given, "."))
+	if err != nil {
+		return nil, fmt.Errorf("%s isn't a version", field)
+	}
+	high := low
+	high.Prerelease = ""
+	switch {
+	case prefix == '^' && low.Major > 0, len(given) == 1:
+		high = Version{Major: low.Major + 1}
+	case prefix == '^' && low.Minor > 0, prefix == '~', len(given) == 2:
+		high = Version{Major: low.Major, Minor: low.Minor + 1}
+	case prefix == '^':
+		high = Version{Major: low.Major, Minor: low.Minor, Patch: low.Patch + 1}
+	default:
+		// a full version on its own means exactly that version
+		return []bound{{"=", low}}, nil
+	}
+	return []bound{{">=", low}, {"<", high}}, nil
+}
+
+// Allows reports whether version is in range.
+func (constraint *Constraint) Allows(version Version) bool {
+	if version.Prerelease != "" {
+		return false
+	}
+	for _, b := range constraint.bounds {
+		if !b.allows(version) {
+			return false
+		}
+	}
+	return true
+}
+
+func (constraint *Constraint) String() string {
+	return constraint.text
+}
+
+// Newest picks the tag with the highest version constraint allows, or ""
+// when none do. Tags that aren't versions are skipped.
+func (constraint *Constraint) Newest(tags []string) string {
+	newest := ""
+	var best Version
+	for _, tag := range tags {
+		version, err := ParseVersion(tag)
+		if err != nil || !constraint.Allows(version) {
+			continue
+		}
+		// 1.4 and 1.4.0 are the same, the more specific tag wins
+		c := version.Compare(best)
+		if newest == "" || c > 0 || (c == 0 && len(tag) > len(newest)) {
+			newest = tag
+			best = version
+		}
+	}
+	return newest
+}
@@ -0,0 +1,56 @@
+package reference
+
+import (
+	"testing"
+)
+
+func TestConstraint(t *testing.T) {
+	var tests = []struct {
+		constraint string
+		allows     []string
+		denies     []string
+	}{
+		{"~1.4", []string{"1.4.0", "1.4.9"}, []string{"1.3.9", "1.5.0", "1.4.1-rc1"}},
+		{"~1.4.2", []string{"1.4.2", "1.4.7"}, []string{"1.4.1", "1.5.0"}},
+		{"^1.4", []string{"1.4.0", "1.9.9"}, []string{"1.3.0", "2.0.0"}},
+		{"^0.2.3", []string{"0.2.3", "0.2.9"}, []string{"0.3.0"}},
+		{"1.x", []string{"1.0.0", "1.9.0"}, []string{"2.0.0"}},
+		{"1.4.2", []string{"1.4.2", "v1.4.2"}, []string{"1.4.3"}},
+		{">=1.2, <1.6", []string{"1.2.0", "1.5.9"}, []string{"1.1.0", "1.6.0"}},
+		{"*", []string{"0.0.1", "9.0.0"}, nil},
+	}
+	for _, c := range tests {
+		constraint, err := ParseConstraint(c.constraint)
+		if err != nil {
+			t.Fatalf("ParseConstraint(%q) error == %v", c.constraint, err)
+		}
+		for _, tag := range c.allows {
+			version, _ := ParseVersion(tag)
+			if !constraint.Allows(version) {
+				t.Errorf("%s should allow %s", c.constraint, tag)
+			}
+		}
+		for _, tag := range c.denies {
+			version, _ := ParseVersion(tag)
+			if constraint.Allows(version) {
+				t.Errorf("%s shouldn't allow %s", c.constraint, tag)
+			}
+		}
+	}
+	for _, bad := range []string{"", "~", "~a.b", ">=1.2.3.4"} {
+		if _, err := ParseConstraint(bad); err == nil {
+			t.Errorf("ParseConstraint(%q) should fail", bad)
+		}
+	}
+}
+
+func TestNewest(t *testing.T) {
+	constraint, _ := ParseConstraint("~1.4")
+	tags := []string{"latest", "1.3.9", "1.4", "1.4.0", "1.4.10", "1.4.9", "1.5.0", "1.4.11-rc1"}
+	if newest := constraint.Newest(tags); newest != "1.4.10" {
+		t.Errorf("Newest == %q, want 1.4.10", newest)
+	}
+	if newest := constraint.Newest([]string{"latest", "2.0"}); newest != "" {
+		t.Errorf("Newest == %q, want nothing", newest)
+	}
+}
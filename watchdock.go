@@ -1,19 +1,37 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"log"
-	//"github.com/brimstone/watchdock/channel"
+	"fmt"
+	"github.com/brimstone/watchdock/api"
+	"github.com/brimstone/watchdock/broker"
+	"github.com/brimstone/watchdock/channel"
+	"github.com/brimstone/watchdock/cluster"
+	"github.com/brimstone/watchdock/config"
 	"github.com/brimstone/watchdock/consul"
 	"github.com/brimstone/watchdock/dir"
 	"github.com/brimstone/watchdock/docker"
+	"github.com/brimstone/watchdock/hosts"
+	"github.com/brimstone/watchdock/metrics"
+	"github.com/brimstone/watchdock/plan"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
 )
 
 /* So here's the idea:
 
-There's a number of storage modules, right now only DIR and CONSUL.
+There's a number of storage modules, right now only DIR and CONSUL. Any
+number of them can run at once behind the broker, which looks like a single
+storage module to docker.
 
-There's only one job running module, docker
+There's only one job running module, docker, with one of it for every docker
+host behind hosts, which looks like a single docker to the storage modules.
 
 Intialize our local container slice as empty
 
@@ -25,61 +43,363 @@ Tell the storage module it's now ok to run concurrently and handle events
 
 Tell the docker module it's now ok to run concurrently and handle events
 
-Sleep, forever
+Everything comes from the config file, then the environment, then the flags.
+
+Sleep until we're told to stop: SIGHUP reloads the config file, applies what
+can change without a restart and has everything sent again, SIGTERM and
+SIGINT stop docker first so nothing new is started, then the storage modules
+once they've written everything down.
 
 */
-type Module interface {
-	Sync(<-chan map[string]interface{}, chan<- map[string]interface{})
+
+// shutdownTimeout is how long each side gets to finish up before we stop
+// waiting for it.
+const shutdownTimeout = 30 * time.Second
+
+// run starts module and returns a channel that's closed once it's stopped.
+func run(ctx context.Context, module channel.Module, read <-chan channel.Event, write chan<- channel.Event) <-chan struct{} {
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		module.Sync(ctx, read, write)
+	}()
+	return stopped
 }
 
-func main() {
-	// parse our command line args
-	var dockerSock = flag.String("docker", "unix:///var/run/docker.sock", "Path to docker socket")
-	consulSeed := flag.String("consul", "", "Connection information for consul")
-	dirSeed := flag.String("dir", "", "Directory to store")
-	flag.Parse()
+// wait waits for stopped, but not forever.
+func wait(name string, stopped <-chan struct{}) {
+	select {
+	case <-stopped:
+		log.Println("Stopped", name)
+	case <-time.After(shutdownTimeout):
+		log.Println("Gave up waiting for", name, "to stop")
+	}
+}
 
-	done := make(chan bool)
+// flags are the command line settings, which win over the config file and
+// the environment.
+type flags struct {
+	config         *string
+	docker         *string
+	consul         *string
+	dir            *string
+	listen         *string
+	metricsListen  *string
+	registryLogins *string
+}
 
-	storageChannel := make(chan map[string]interface{})
-	processingChannel := make(chan map[string]interface{})
+// load reads the config file and applies the environment and whichever
+// flags were given on top of it.
+func (f flags) load() (*config.Config, error) {
+	cfg, err := config.Load(*f.config)
+	if err != nil {
+		return nil, err
+	}
+	flag.Visit(func(given *flag.Flag) {
+		switch given.Name {
+		case "docker":
+			// just the one host then
+			cfg.Docker.Host = *f.docker
+			cfg.Docker.Hosts = nil
+		case "consul":
+			cfg.SetConsul(*f.consul)
+		case "dir":
+			cfg.SetDir(*f.dir)
+		case "listen":
+			cfg.API.Listen = *f.listen
+		case "metrics-listen":
+			cfg.Metrics.Listen = *f.metricsListen
+		case "registry-logins":
+			cfg.RegistryLogins = *f.registryLogins
+		}
+	})
+	// commands that don't need storage can do with cfg anyway
+	err = cfg.Validate()
+	if err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
 
-	var storageModule Module
-	if *dirSeed != "" {
+// logTo sends the log where cfg says, closing the file it went to before.
+func logTo(cfg *config.Config, previous *os.File) (*os.File, error) {
+	flags := 0
+	if cfg.LogTimestamps() {
+		flags = log.LstdFlags
+	}
+	var file *os.File
+	if cfg.Log.File != "" {
 		var err error
-		storageModule, err = dir.New(*dirSeed)
+		file, err = os.OpenFile(cfg.Log.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return previous, fmt.Errorf("log.file: %s", err.Error())
+		}
+		log.SetOutput(file)
+	} else {
+		log.SetOutput(os.Stderr)
+	}
+	log.SetFlags(flags)
+	if previous != nil {
+		previous.Close()
+	}
+	return file, nil
+}
+
+func dockerOptions(cfg *config.Config) docker.Options {
+	return docker.Options{
+		ReconcileInterval:   cfg.ReconcileInterval(),
+		Selector:            cfg.Docker.Selector,
+		CleanUntaggedImages: cfg.CleanUntaggedImages(),
+	}
+}
+
+// newCluster puts processing behind cluster mode as cfg says.
+func newCluster(cfg *config.Config, processing channel.Module) (*cluster.Cluster, error) {
+	name, err := cfg.ClusterNode()
+	if err != nil {
+		return nil, err
+	}
+	var backend cluster.Backend
+	if cfg.Cluster.Dir != "" {
+		backend, err = cluster.NewDir(cfg.Cluster.Dir, cfg.ClusterGrace())
+	} else {
+		backend, err = cluster.NewConsul(cfg.Cluster.Consul, cfg.ClusterGrace())
+	}
+	if err != nil {
+		return nil, err
+	}
+	clusterModule, err := cluster.New(cluster.Node{Name: name, Labels: cfg.Cluster.Labels}, backend, processing)
+	if err != nil {
+		return nil, err
+	}
+	clusterModule.SetTimings(cfg.ClusterHeartbeat(), cfg.ClusterGrace())
+	return clusterModule, nil
+}
+
+// newStorage loads the storage modules cfg asks for behind a broker.
+func newStorage(cfg *config.Config) (*broker.Broker, error) {
+	return loadStorage(cfg, dir.New)
+}
+
+// readStorage is newStorage for commands that only read what storage has,
+// which shouldn't watch or create anything.
+func readStorage(cfg *config.Config) (*broker.Broker, error) {
+	return loadStorage(cfg, dir.NewReader)
+}
+
+func loadStorage(cfg *config.Config, newDir func(string) (*dir.Dir, error)) (*broker.Broker, error) {
+	storageModule, err := broker.New()
+	if err != nil {
+		return nil, fmt.Errorf("Error loading broker")
+	}
+	if cfg.Storage.Dir != nil {
+		dirModule, err := newDir(cfg.Storage.Dir.Path)
 		if err != nil {
 			log.Println("Error loading module dir")
 		} else {
+			dirModule.SetDebounce(cfg.DirDebounce())
+			dirModule.SetSelector(cfg.Docker.Selector)
+			storageModule.AddStorage("dir", dirModule)
 			log.Println("Loaded storage module: dir")
 		}
 	}
-	// todo - add consul check here
-	if *consulSeed != "" {
-		var err error
-		storageModule, err = consul.New(*consulSeed)
+	if cfg.Storage.Consul != nil {
+		consulModule, err := consul.New(cfg.Storage.Consul.Address)
 		if err != nil {
 			log.Println("Error loading module consul")
 		} else {
+			storageModule.AddStorage("consul", consulModule)
 			log.Println("Loaded storage module: consul")
 		}
 	}
+	if storageModule.Len() == 0 {
+		return nil, fmt.Errorf("No storage module loaded successfully")
+	}
+	return storageModule, nil
+}
+
+// newProcessing connects to every docker host cfg lists.
+func newProcessing(cfg *config.Config) (*hosts.Hosts, error) {
+	processingModule, err := hosts.New()
+	if err != nil {
+		return nil, fmt.Errorf("Error loading hosts")
+	}
+	for _, host := range cfg.DockerHosts() {
+		dockerModule, err := docker.New(docker.Endpoint{
+			Host:      host.Host,
+			CertPath:  host.TLS.CertPath,
+			TLSVerify: host.TLS.Verify,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Error loading module docker for %s: %s", host.Name, err.Error())
+		}
+		processingModule.AddHost(host.Name, host.Labels, dockerModule)
+	}
+	err = processingModule.Connect()
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to docker: %s", err.Error())
+	}
+	processingModule.SetOptions(dockerOptions(cfg))
+	if cfg.RegistryLogins != "" {
+		err = processingModule.LoadLogins(cfg.RegistryLogins)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading registry logins: %s", err.Error())
+		}
+	}
+	return processingModule, nil
+}
+
+func main() {
+	// parse our command line args
+	f := flags{
+		config:         flag.String("config", "", "YAML or JSON file to configure watchdock with"),
+		docker:         flag.String("docker", "", "Docker endpoint, $DOCKER_HOST or unix:///var/run/docker.sock by default"),
+		consul:         flag.String("consul", "", "Connection information for consul, as host:port[/prefix]"),
+		dir:            flag.String("dir", "", "Directory to store"),
+		listen:         flag.String("listen", "", "Address to serve the management API on, as host:port"),
+		metricsListen:  flag.String("metrics-listen", "", "Address to serve just the metrics on, as host:port"),
+		registryLogins: flag.String("registry-logins", "", "YAML or JSON file of named registry logins"),
+	}
+	dryRun := flag.Bool("dry-run", false, "Print what would be done instead of doing it")
+	asJSON := flag.Bool("json", false, "Print plans, listings and statuses as JSON")
+	flag.Usage = usage
+	flag.Parse()
+
+	cfg, err := f.load()
 
-	if storageModule == nil {
-		log.Fatal("No storage module loaded successfully")
+	// commands only say what they have to, their errors included
+	if flag.NArg() > 0 {
+		c, ok := commands[flag.Arg(0)]
+		if !ok {
+			fmt.Fprintln(os.Stderr, "Unknown command", flag.Arg(0))
+			usage()
+			os.Exit(2)
+		}
+		if err = c.check(cfg, err); err != nil {
+			fmt.Fprintln(os.Stderr, "Bad configuration:", err.Error())
+			os.Exit(1)
+		}
+		log.SetOutput(ioutil.Discard)
+		err = c.run(cfg, flag.Args()[1:], *asJSON)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	if err != nil {
+		log.Fatal("Bad configuration: ", err)
+	}
+
+	logFile, err := logTo(cfg, nil)
+	if err != nil {
+		log.Fatal("Bad configuration: ", err)
+	}
+
+	// metrics have their own port, so they're there whatever else is, even
+	// while docker is still being waited for
+	if cfg.Metrics.Listen != "" {
+		metricsServer, err := metrics.Serve(cfg.Metrics.Listen)
+		if err != nil {
+			log.Fatal("Error serving metrics: ", err)
+		}
+		defer metricsServer.Close()
 	}
 
-	processingModule, err := docker.New(*dockerSock)
+	// set up before anything starts, so an early signal isn't fatal
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	storageChannel := make(chan channel.Event)
+	processingChannel := make(chan channel.Event)
+
+	storageModule, err := newStorage(cfg)
 	if err != nil {
-		log.Fatal("Error loading module docker")
+		log.Fatal(err)
+	}
+	processingModule, err := newProcessing(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the API only keeps things in memory, the other storage modules
+	// persist whatever it changes
+	if cfg.API.Listen != "" && !*dryRun {
+		apiModule, err := api.New(cfg.API.Listen, processingModule)
+		if err != nil {
+			log.Println("Error loading module api:", err.Error())
+		} else {
+			storageModule.AddStorage("api", apiModule)
+			log.Println("Loaded storage module: api")
+		}
+	}
+
+	// in a cluster only what's placed on this node gets through to docker
+	var processing channel.Module = processingModule
+	if cfg.Cluster != nil {
+		clusterModule, err := newCluster(cfg, processingModule)
+		if err != nil {
+			log.Fatal("Error loading cluster: ", err)
+		}
+		processing = clusterModule
+	}
+	// a dry run only prints what processing would do
+	if *dryRun {
+		planner, _ := processing.(docker.Planner)
+		dryRunModule, err := plan.New(planner, os.Stdout, *asJSON)
+		if err != nil {
+			log.Fatal("Error loading dry run: ", err)
+		}
+		dryRunModule.SetInterval(cfg.ReconcileInterval())
+		processing = dryRunModule
 	}
 
 	// Start all of our modules
 
-	go storageModule.Sync(storageChannel, processingChannel)
-	go processingModule.Sync(processingChannel, storageChannel)
+	storageCtx, stopStorage := context.WithCancel(context.Background())
+	processingCtx, stopProcessing := context.WithCancel(context.Background())
+	storageStopped := run(storageCtx, storageModule, storageChannel, processingChannel)
+	processingStopped := run(processingCtx, processing, processingChannel, storageChannel)
 
 	log.Println("Startup Finished")
-	<-done
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			log.Println("Got", sig, "shutting down")
+			break
+		}
+		log.Println("Got", sig, "reloading")
+		reloaded, err := f.load()
+		if err != nil {
+			log.Println("Bad configuration, keeping the old one:", err.Error())
+			continue
+		}
+		logFile, err = logTo(reloaded, logFile)
+		if err != nil {
+			log.Println("Error reopening the log:", err.Error())
+		}
+		processingModule.SetOptions(dockerOptions(reloaded))
+		if reloaded.RegistryLogins != "" {
+			err = processingModule.LoadLogins(reloaded.RegistryLogins)
+			if err != nil {
+				log.Println("Error reloading registry logins, keeping the old ones:", err.Error())
+			}
+		}
+		if !reflect.DeepEqual(reloaded.DockerHosts(), cfg.DockerHosts()) || reloaded.API != cfg.API || reloaded.Metrics != cfg.Metrics ||
+			!reflect.DeepEqual(reloaded.Storage, cfg.Storage) || !reflect.DeepEqual(reloaded.Cluster, cfg.Cluster) {
+			log.Println("Storage, docker, API, metrics and cluster settings only change with a restart")
+		}
+		// the next reload is compared with this one
+		cfg = reloaded
+		// every storage module sends everything it has again, and docker
+		// checks on all of it
+		storageChannel <- channel.NewResync()
+		processingModule.Reconcile()
+	}
 
+	// docker goes first, whatever it reports on the way out still has to
+	// reach storage
+	stopProcessing()
+	wait("docker", processingStopped)
+	stopStorage()
+	wait("storage", storageStopped)
 }